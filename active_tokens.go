@@ -0,0 +1,103 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const activeTokensPath = "active-tokens/"
+
+// activeTokens counts the active leases of a role, so its max_active_tokens
+// can be enforced without listing all of the mount's leases.
+//
+// Updates are serialized by the backend's activeTokensLock, which is enough
+// since only the active node writes to storage. The count is taken before the
+// Kubernetes objects are created, so concurrent requests can't exceed the cap
+// while their objects are being created, and is released when the lease's
+// creds index entry is removed, so a lease is only released once even if both
+// the revoke and a background cleanup of its objects succeed.
+type activeTokens struct {
+	Count int `json:"count"`
+}
+
+func getActiveTokens(ctx context.Context, s logical.Storage, roleName string) (*activeTokens, error) {
+	entry, err := s.Get(ctx, activeTokensPath+roleName)
+	if err != nil {
+		return nil, err
+	}
+	active := &activeTokens{}
+	if entry == nil {
+		return active, nil
+	}
+	if err := entry.DecodeJSON(active); err != nil {
+		return nil, fmt.Errorf("error reading active tokens of role %q: %w", roleName, err)
+	}
+	return active, nil
+}
+
+func setActiveTokens(ctx context.Context, s logical.Storage, roleName string, active *activeTokens) error {
+	if active.Count <= 0 {
+		return s.Delete(ctx, activeTokensPath+roleName)
+	}
+	entry, err := logical.StorageEntryJSON(activeTokensPath+roleName, active)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// acquireActiveToken counts a new lease of the role. It returns false if the
+// role already has maxActiveTokens active leases, or there is no limit if
+// maxActiveTokens is 0.
+func (b *backend) acquireActiveToken(ctx context.Context, s logical.Storage, roleName string, maxActiveTokens int) (bool, error) {
+	b.activeTokensLock.Lock()
+	defer b.activeTokensLock.Unlock()
+
+	active, err := getActiveTokens(ctx, s, roleName)
+	if err != nil {
+		return false, err
+	}
+	if maxActiveTokens > 0 && active.Count >= maxActiveTokens {
+		return false, nil
+	}
+	active.Count++
+	return true, setActiveTokens(ctx, s, roleName, active)
+}
+
+// releaseActiveToken drops a lease from the role's count of active leases
+func (b *backend) releaseActiveToken(ctx context.Context, s logical.Storage, roleName string) error {
+	b.activeTokensLock.Lock()
+	defer b.activeTokensLock.Unlock()
+
+	active, err := getActiveTokens(ctx, s, roleName)
+	if err != nil {
+		return err
+	}
+	active.Count--
+	return setActiveTokens(ctx, s, roleName, active)
+}
+
+// removeCredsIndexEntry deletes the creds index entry of a revoked lease, and
+// releases the lease from its role's count of active leases. Nothing is
+// released if the entry was already removed.
+func (b *backend) removeCredsIndexEntry(ctx context.Context, s logical.Storage, id string) error {
+	if id == "" {
+		return nil
+	}
+	entry, err := getCredsIndexEntry(ctx, s, id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+	if err := deleteCredsIndexEntry(ctx, s, id); err != nil {
+		return err
+	}
+	return b.releaseActiveToken(ctx, s, entry.Role)
+}
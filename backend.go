@@ -10,9 +10,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/go-secure-stdlib/fileutil"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 var (
@@ -28,17 +30,38 @@ var (
 	// CA cert can be used, before reading it again from disk.
 	caReloadPeriod = 1 * time.Hour
 
+	// caCertFileReloadPeriod is the time period how often the in-memory copy
+	// of the configured kubernetes_ca_cert_file can be used, before reading it
+	// again from disk.
+	caCertFileReloadPeriod = 1 * time.Minute
+
+	// roleRulesReloadPeriod is the time period how often the in-memory copy
+	// of a role's generated_role_rules_file can be used, before reading it
+	// again from disk.
+	roleRulesReloadPeriod = 1 * time.Minute
+
 	// operationPrefixKubernetes is used as a prefix for OpenAPI operation id's.
 	operationPrefixKubernetes = "kubernetes"
 
 	WALRollbackMinAge = "10m"
+
+	// maxCredentialCheckFailures is the number of consecutive periodic checks
+	// the Kubernetes API must reject the plugin's credentials before they are
+	// reported as unhealthy.
+	maxCredentialCheckFailures = 3
 )
 
 // backend wraps the backend framework and adds a map for storing key value pairs
 type backend struct {
 	*framework.Backend
-	lock   sync.Mutex
-	client *client
+	lock sync.Mutex
+	// clients are the Kubernetes API clients of the clusters, keyed by
+	// cluster name, with the default cluster's under the empty name
+	clients map[string]*client
+
+	// mountID uniquely identifies the mount, and labels the objects it
+	// creates
+	mountID string
 
 	// localSATokenReader caches the service account token in memory.
 	// It periodically reloads the token to support token rotation/renewal.
@@ -52,6 +75,62 @@ type backend struct {
 	// - kubernetes_ca_cert is not set
 	// - disable_local_ca_jwt is false
 	localCACertReader *fileutil.CachingFileReader
+
+	// localNamespaceReader contains the namespace of the pod that Vault runs
+	// in, which is protected from credentials by default
+	localNamespaceReader *fileutil.CachingFileReader
+
+	// caCertFileReaders caches the contents of the configured
+	// kubernetes_ca_cert_file of each cluster, keyed by path
+	caCertFileLock    sync.Mutex
+	caCertFileReaders map[string]*fileutil.CachingFileReader
+
+	// roleRulesReaders caches the contents of the files referenced by roles'
+	// generated_role_rules_file, keyed by path
+	roleRulesLock    sync.Mutex
+	roleRulesReaders map[string]*fileutil.CachingFileReader
+
+	// configLock serializes writes of the config, so that a rotation of the
+	// service_account_jwt, which rewrites the config, can't overwrite a
+	// concurrent config write or revive a deleted config
+	configLock sync.Mutex
+
+	// namespaceCache caches the namespaces of creds requests, keyed by
+	// cluster/namespace
+	namespaceCacheLock sync.Mutex
+	namespaceCache     map[string]namespaceCacheEntry
+
+	// activeTokensLock serializes updates to the counts of roles' active
+	// leases
+	activeTokensLock sync.Mutex
+
+	// sharedClusterRolesLock serializes updates to the reference counts of
+	// shared ClusterRoles
+	sharedClusterRolesLock sync.Mutex
+
+	// pendingCleanupsAfter is the key of the last pending cleanup looked at
+	// by drainPendingCleanups, where its next run picks up
+	pendingCleanupsLock  sync.Mutex
+	pendingCleanupsAfter string
+
+	// credsSemaphore limits the creds requests creating objects at once to
+	// the config's max_concurrent_creds
+	credsSemaphoreLock sync.Mutex
+	credsSemaphore     *credsSemaphore
+
+	// healthLock protects the results of the periodic credential check
+	healthLock sync.RWMutex
+	// credentialCheckFailures is the number of consecutive periodic checks
+	// where the Kubernetes API rejected the plugin's credentials
+	credentialCheckFailures int
+	// credentialCheckErr is the last error returned by the periodic check
+	credentialCheckErr error
+	// apiChecks caches the results of the health endpoint's requests to the
+	// Kubernetes API, keyed by cluster name
+	apiChecks map[string]apiCheckResult
+	// credsIssued is when credentials were last issued, keyed by cluster
+	// name
+	credsIssued map[string]time.Time
 }
 
 var _ logical.Factory = Factory
@@ -70,14 +149,24 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
 	}
+	b.mountID = conf.BackendUUID
 
 	return b, nil
 }
 
 func newBackend() (*backend, error) {
 	b := &backend{
-		localSATokenReader: fileutil.NewCachingFileReader(localJWTPath, jwtReloadPeriod),
-		localCACertReader:  fileutil.NewCachingFileReader(localCACertPath, caReloadPeriod),
+		localSATokenReader:   fileutil.NewCachingFileReader(localJWTPath, jwtReloadPeriod),
+		localCACertReader:    fileutil.NewCachingFileReader(localCACertPath, caReloadPeriod),
+		localNamespaceReader: fileutil.NewCachingFileReader(localNamespacePath, caReloadPeriod),
+		roleRulesReaders:     make(map[string]*fileutil.CachingFileReader),
+		caCertFileReaders:    make(map[string]*fileutil.CachingFileReader),
+		clients:              make(map[string]*client),
+
+		namespaceCache: make(map[string]namespaceCacheEntry),
+
+		apiChecks:   make(map[string]apiCheckResult),
+		credsIssued: make(map[string]time.Time),
 	}
 
 	walRollbackMinAge, err := time.ParseDuration(WALRollbackMinAge)
@@ -91,10 +180,19 @@ func newBackend() (*backend, error) {
 		Invalidate:  b.invalidate,
 		Paths: framework.PathAppend(
 			[]*framework.Path{
-				b.pathConfig(),
 				b.pathCredentials(),
+				b.pathCredentialsMulti(),
+				b.pathCredsList(),
+				b.pathCredsRoleList(),
 				b.pathCheck(),
+				b.pathCheckRBAC(),
+				b.pathRotateRoot(),
+				b.pathTidy(),
+				b.pathRotateBinding(),
+				b.pathTokenValidate(),
+				b.pathHealth(),
 			},
+			b.pathConfig(),
 			b.pathRoles(),
 		),
 		PathsSpecial: &logical.Paths{
@@ -103,30 +201,114 @@ func newBackend() (*backend, error) {
 			},
 			SealWrapStorage: []string{
 				"config",
+				// The config of each additional cluster
+				"config/",
 			},
 		},
 		Secrets: []*framework.Secret{
 			b.kubeServiceAccount(),
+			b.kubeServiceAccountMulti(),
 		},
 		WALRollback:       b.walRollback,
 		WALRollbackMinAge: walRollbackMinAge,
+		PeriodicFunc:      b.periodicFunc,
 	}
 
 	return b, nil
 }
 
 // This resets anything that needs to be rebuilt after a change. In our case,
-// the k8s client if the config is changed.
+// the k8s clients, the namespaces they looked up and the cached health
+// checks if the config of any cluster is changed.
 func (b *backend) invalidate(_ context.Context, key string) {
-	if key == "config" {
+	if key == configPath || strings.HasPrefix(key, configPath+"/") {
 		b.reset()
+		b.clearAPIChecks()
 	}
 }
 
 func (b *backend) reset() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.client = nil
+	b.clients = make(map[string]*client)
+	b.clearNamespaceCaches()
+}
+
+// periodicFunc is called by Vault's rollback manager about once a minute
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	var errs *multierror.Error
+	if err := b.checkCredentials(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := b.drainPendingCleanups(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := b.pruneExpiredCreds(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	b.rotateRootIfDue(ctx, req.Storage)
+	return errs.ErrorOrNil()
+}
+
+// checkCredentials verifies that the Kubernetes API still accepts the
+// plugin's credentials, so that an expired or revoked JWT is noticed before
+// it breaks credential issuance.
+func (b *backend) checkCredentials(ctx context.Context, s logical.Storage) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return nil
+	}
+
+	client, err := b.getClient(ctx, s, "")
+	if err != nil {
+		return err
+	}
+
+	err = client.checkAuth(ctx)
+	if err != nil && !k8s_errors.IsUnauthorized(err) && !k8s_errors.IsForbidden(err) {
+		// Only track auth failures, connectivity problems are reported by
+		// the operations that hit them
+		b.Logger().Debug("periodic credential check failed", "error", err)
+		return nil
+	}
+
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+	if err == nil {
+		b.credentialCheckFailures = 0
+		b.credentialCheckErr = nil
+		return nil
+	}
+
+	b.credentialCheckFailures++
+	b.credentialCheckErr = err
+	if b.credentialCheckFailures >= maxCredentialCheckFailures {
+		b.Logger().Warn("the Kubernetes API is rejecting the plugin's credentials, generating credentials will fail until they are updated",
+			"consecutive_failures", b.credentialCheckFailures, "error", err)
+	}
+
+	// The local service account token is rotated by the kubelet, so rebuild
+	// the client to pick up the current token on the next invocation
+	if config.ServiceAccountJwt == "" && config.ClientCert == "" && !config.DisableLocalCAJwt {
+		b.reset()
+	}
+
+	return nil
+}
+
+// credentialsRejected returns the last error from the periodic credential
+// check if the Kubernetes API has consistently rejected the plugin's
+// credentials, or nil otherwise
+func (b *backend) credentialsRejected() error {
+	b.healthLock.RLock()
+	defer b.healthLock.RUnlock()
+	if b.credentialCheckFailures >= maxCredentialCheckFailures {
+		return b.credentialCheckErr
+	}
+	return nil
 }
 
 const backendHelp = `
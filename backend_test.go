@@ -5,12 +5,25 @@ package kubesecrets
 
 import (
 	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/fileutil"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 var (
@@ -35,3 +48,119 @@ func getTestBackend(t *testing.T) (*backend, logical.Storage) {
 	}
 	return b.(*backend), config.StorageView
 }
+
+func TestBackend_checkCredentials(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, nil)
+	fakeClient := setupFakeClient(t, b, s)
+
+	unauthorized := k8s_errors.NewUnauthorized("token expired")
+	rejectCredentials := true
+	fakeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if rejectCredentials {
+			return true, nil, unauthorized
+		}
+		return true, &authorizationv1.SelfSubjectAccessReview{}, nil
+	})
+
+	for i := 0; i < maxCredentialCheckFailures; i++ {
+		assert.NoError(t, b.credentialsRejected())
+		require.NoError(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	}
+	assert.Equal(t, unauthorized, b.credentialsRejected())
+
+	resp, err := b.pathCheckRead(context.Background(), &logical.Request{Storage: s}, nil)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "The Kubernetes API is rejecting the plugin's credentials: token expired")
+
+	rejectCredentials = false
+	require.NoError(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	assert.NoError(t, b.credentialsRejected())
+}
+
+func TestBackend_getClientRebuildsOnConfigChange(t *testing.T) {
+	origPeriod := caCertFileReloadPeriod
+	caCertFileReloadPeriod = 0
+	defer func() { caCertFileReloadPeriod = origPeriod }()
+
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	caCert, _ := testClientCertificate(t)
+	rotatedCACert, _ := testClientCertificate(t)
+	caCertFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caCertFile, []byte(caCert), 0o600))
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"kubernetes_ca_cert_file": caCertFile,
+	})
+
+	client, err := b.getClient(ctx, s, "")
+	require.NoError(t, err)
+	sameClient, err := b.getClient(ctx, s, "")
+	require.NoError(t, err)
+	assert.Same(t, client, sameClient)
+
+	// Rotating the CA file builds a new client
+	require.NoError(t, os.WriteFile(caCertFile, []byte(rotatedCACert), 0o600))
+	rotatedClient, err := b.getClient(ctx, s, "")
+	require.NoError(t, err)
+	assert.NotSame(t, client, rotatedClient)
+
+	// So does a config change that reaches storage without invalidating the
+	// backend, e.g. replicated from the active node
+	config, err := getConfig(ctx, s)
+	require.NoError(t, err)
+	config.CACertFile = ""
+	config.CACert = caCert
+	entry, err := logical.StorageEntryJSON(configPath, config)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(ctx, entry))
+	inlineClient, err := b.getClient(ctx, s, "")
+	require.NoError(t, err)
+	assert.NotSame(t, rotatedClient, inlineClient)
+}
+
+func TestBackend_getClientRotatedLocalToken(t *testing.T) {
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind": "Namespace", "apiVersion": "v1", "metadata": {"name": "app1"}}`))
+	}))
+	defer server.Close()
+
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	caCertFile := filepath.Join(dir, "ca.crt")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caCertFile, caCert, 0o600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("local-token"), 0o600))
+	b.localCACertReader = fileutil.NewCachingFileReader(caCertFile, caReloadPeriod)
+	// Read the token on every request, like after jwtReloadPeriod
+	b.localSATokenReader = fileutil.NewCachingFileReader(tokenFile, 0)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"kubernetes_host":      server.URL,
+		"disable_local_ca_jwt": false,
+	})
+
+	getNamespace := func(t *testing.T) *client {
+		t.Helper()
+		client, err := b.getClient(ctx, s, "")
+		require.NoError(t, err)
+		_, err = client.k8s.CoreV1().Namespaces().Get(ctx, "app1", metav1.GetOptions{})
+		require.NoError(t, err)
+		return client
+	}
+	client := getNamespace(t)
+	assert.Equal(t, "Bearer local-token", authorization)
+
+	// The kubelet rotates the projected token by replacing the file
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rotated-token"), 0o600))
+	rotatedClient := getNamespace(t)
+	assert.NotSame(t, client, rotatedClient)
+	assert.Equal(t, "Bearer rotated-token", authorization)
+
+	// The client is kept until the token changes again
+	assert.Same(t, rotatedClient, getNamespace(t))
+}
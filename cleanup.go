@@ -0,0 +1,420 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/sync/errgroup"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	pendingCleanupPath = "pending-cleanup/"
+
+	// maxPendingCleanupsPerRun bounds the number of pending cleanups that are
+	// retried on each periodic run
+	maxPendingCleanupsPerRun = 100
+
+	// maxPendingCleanupAttempts is the number of failed attempts after which
+	// a pending cleanup is given up, leaving its objects to tidy
+	maxPendingCleanupAttempts = 50
+
+	// maxConcurrentDeletes bounds the number of requests to delete the
+	// objects of a lease that are made to the Kubernetes API at once
+	maxConcurrentDeletes = 4
+)
+
+// A pending cleanup is retried with an exponential backoff between
+// pendingCleanupBaseBackoff and pendingCleanupMaxBackoff
+var (
+	pendingCleanupBaseBackoff = time.Minute
+	pendingCleanupMaxBackoff  = time.Hour
+)
+
+// pendingCleanup records the Kubernetes objects created for a lease that
+// could not be deleted on revocation, so they can be retried in the
+// background until they are gone
+type pendingCleanup struct {
+	Namespace          string    `json:"namespace"`
+	ServiceAccount     string    `json:"service_account"`
+	RoleBinding        string    `json:"role_binding"`
+	BaseRoleBinding    string    `json:"base_role_binding"`
+	ClusterRoleBinding bool      `json:"cluster_role_binding"`
+	Role               string    `json:"role"`
+	RoleType           string    `json:"role_type"`
+	SharedClusterRole  string    `json:"shared_cluster_role"`
+	TokenSecret        string    `json:"token_secret"`
+	Cluster            string    `json:"kubernetes_cluster,omitempty"`
+	RemoveFinalizers   []string  `json:"remove_finalizers,omitempty"`
+	IndexID            string    `json:"index_id"`
+	Attempts           int       `json:"attempts"`
+	LastError          string    `json:"last_error"`
+	Created            time.Time `json:"created"`
+	NextAttempt        time.Time `json:"next_attempt,omitempty"`
+}
+
+// key returns the storage key of the pending cleanup. The key is derived from
+// the objects so that repeated revoke failures for the same lease update a
+// single entry.
+func (p *pendingCleanup) key() string {
+	id := fmt.Sprintf("%s\x00%s\x00%s\x00%t\x00%s\x00%s",
+		p.Namespace, p.ServiceAccount, p.RoleBinding, p.ClusterRoleBinding, p.Role, p.RoleType)
+	// Only appended when set, so the keys of existing entries don't change
+	if p.TokenSecret != "" {
+		id += "\x00" + p.TokenSecret
+	}
+	if p.Cluster != "" {
+		id += "\x00cluster\x00" + p.Cluster
+	}
+	sum := sha256.Sum256([]byte(id))
+	return pendingCleanupPath + hex.EncodeToString(sum[:])
+}
+
+func (p *pendingCleanup) isEmpty() bool {
+	return p.ServiceAccount == "" && p.RoleBinding == "" && p.BaseRoleBinding == "" && p.Role == "" && p.SharedClusterRole == "" && p.TokenSecret == ""
+}
+
+// deleteObjects deletes the objects in the pending cleanup, and reports
+// whether each one was deleted or was already gone. The objects are deleted
+// concurrently, up to maxConcurrentDeletes at a time. The reference to a
+// shared ClusterRole is released once the lease's own objects are gone.
+//
+// If relyOnOwnerGC is set, only the object that owns the others is deleted:
+// the generated Role, or else the RoleBinding. The objects with an owner
+// reference to it are left to Kubernetes garbage collection, and the owner is
+// deleted last, once the finalizers of the objects it owns are removed.
+func (b *backend) deleteObjects(ctx context.Context, s logical.Storage, client *client, p *pendingCleanup, relyOnOwnerGC bool) (map[string]interface{}, error) {
+	// Record whether each object was explicitly deleted here, or was already
+	// gone, e.g. garbage collected by Kubernetes via its owner reference
+	var lock sync.Mutex
+	var errs *multierror.Error
+	cleanup := map[string]interface{}{}
+	setCleanup := func(kind, result string) {
+		lock.Lock()
+		defer lock.Unlock()
+		cleanup[kind] = result
+	}
+	recordCleanup := func(kind, name string, deleted bool) {
+		result := cleanupAlreadyDeleted
+		if deleted {
+			result = cleanupDeleted
+		}
+		setCleanup(kind, result)
+		b.Logger().Debug("revoked Kubernetes object", "kind", kind, "namespace", p.Namespace, "name", name, "result", result)
+	}
+	recordError := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = multierror.Append(errs, err)
+	}
+
+	// Deleting an object with finalizers only marks it for deletion, so the
+	// finalizers set by the lease's role are removed if it asked for that
+	removeFinalizers := func(kind, name string) error {
+		if len(p.RemoveFinalizers) == 0 {
+			return nil
+		}
+		return client.removeFinalizers(ctx, kind, p.Namespace, name, p.RemoveFinalizers)
+	}
+
+	bindingKind := "RoleBinding"
+	baseBindingKind := "BaseRoleBinding"
+	if p.ClusterRoleBinding {
+		bindingKind = "ClusterRoleBinding"
+		baseBindingKind = "BaseClusterRoleBinding"
+	}
+	deleteRole := func() {
+		deleted, err := client.deleteRole(ctx, p.Namespace, p.Role, p.RoleType)
+		if err == nil && deleted {
+			err = removeFinalizers(p.RoleType, p.Role)
+		}
+		if err != nil {
+			recordError(fmt.Errorf("failed to delete %s '%s/%s': %s", p.RoleType, p.Namespace, p.Role, err))
+		} else {
+			recordCleanup(p.RoleType, p.Role, deleted)
+		}
+	}
+	// kind is the kind the binding is reported as
+	deleteBinding := func(kind, name string) {
+		deleted, err := client.deleteRoleBinding(ctx, p.Namespace, name, p.ClusterRoleBinding)
+		if err == nil && deleted {
+			err = removeFinalizers(bindingKind, name)
+		}
+		if err != nil {
+			recordError(fmt.Errorf("failed to delete %s '%s/%s: %s", kind, p.Namespace, name, err))
+		} else {
+			recordCleanup(kind, name, deleted)
+		}
+	}
+	collectBinding := func(kind, name string) {
+		if err := removeFinalizers(bindingKind, name); err != nil {
+			recordError(fmt.Errorf("failed to remove the finalizers of %s '%s/%s': %s", kind, p.Namespace, name, err))
+		} else {
+			setCleanup(kind, cleanupGarbageCollected)
+		}
+	}
+
+	// The objects owned by the Role, or else by the RoleBinding, which are
+	// created with an owner reference to it
+	ownedByRole := relyOnOwnerGC && p.Role != ""
+	ownedByBinding := relyOnOwnerGC && (p.Role != "" || p.RoleBinding != "")
+
+	// The deletes don't depend on each other, except for the owner's when the
+	// objects it owns are left to garbage collection
+	var deleteOwner func()
+	var group errgroup.Group
+	group.SetLimit(maxConcurrentDeletes)
+	run := func(f func()) {
+		group.Go(func() error {
+			f()
+			return nil
+		})
+	}
+	if p.Role != "" {
+		if ownedByRole {
+			deleteOwner = deleteRole
+		} else {
+			run(deleteRole)
+		}
+	}
+	switch {
+	case p.RoleBinding == "":
+	case ownedByRole:
+		run(func() { collectBinding(bindingKind, p.RoleBinding) })
+	case ownedByBinding:
+		deleteOwner = func() { deleteBinding(bindingKind, p.RoleBinding) }
+	default:
+		run(func() { deleteBinding(bindingKind, p.RoleBinding) })
+	}
+	switch {
+	case p.BaseRoleBinding == "":
+	case ownedByRole:
+		run(func() { collectBinding(baseBindingKind, p.BaseRoleBinding) })
+	default:
+		run(func() { deleteBinding(baseBindingKind, p.BaseRoleBinding) })
+	}
+	if p.TokenSecret != "" {
+		run(func() {
+			deleted, err := client.deleteSecret(ctx, p.Namespace, p.TokenSecret)
+			if err != nil {
+				recordError(fmt.Errorf("failed to delete Secret '%s/%s': %s", p.Namespace, p.TokenSecret, err))
+			} else {
+				recordCleanup("Secret", p.TokenSecret, deleted)
+			}
+		})
+	}
+	if p.ServiceAccount != "" && ownedByBinding {
+		setCleanup("ServiceAccount", cleanupGarbageCollected)
+	} else if p.ServiceAccount != "" {
+		run(func() {
+			deleted, err := client.deleteServiceAccount(ctx, p.Namespace, p.ServiceAccount)
+			if err != nil {
+				recordError(fmt.Errorf("failed to delete ServiceAccount '%s/%s': %s", p.Namespace, p.ServiceAccount, err))
+			} else {
+				recordCleanup("ServiceAccount", p.ServiceAccount, deleted)
+			}
+		})
+	}
+	_ = group.Wait()
+	if deleteOwner != nil {
+		deleteOwner()
+	}
+
+	if p.SharedClusterRole != "" && errs.ErrorOrNil() == nil {
+		deleted, err := b.releaseSharedClusterRole(ctx, s, client, p.SharedClusterRole)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		} else if deleted {
+			recordCleanup("ClusterRole", p.SharedClusterRole, true)
+		} else {
+			cleanup["ClusterRole"] = cleanupReleased
+		}
+	}
+
+	return cleanup, errs.ErrorOrNil()
+}
+
+// deleteCreatedNamespace deletes a namespace that was created for a role with
+// create_namespace, once no active lease has objects in it, and reports
+// whether it was deleted, already gone or kept in use. Namespaces that Vault
+// didn't create, or that another mount created, are never deleted, and an
+// empty result is returned for them.
+func (b *backend) deleteCreatedNamespace(ctx context.Context, s logical.Storage, client *client, namespace string) (string, error) {
+	nsLabels, err := client.getNamespaceLabelSet(ctx, namespace)
+	switch {
+	case k8s_errors.IsNotFound(err):
+		return cleanupAlreadyDeleted, nil
+	case err != nil:
+		return "", fmt.Errorf("failed to get namespace '%s': %w", namespace, err)
+	}
+	if nsLabels[createdNamespaceLabel] != "true" || nsLabels[mountIDLabel] != b.mountID {
+		return "", nil
+	}
+
+	_, leaseNamespaces, err := activeLeaseObjects(ctx, s, client.cluster)
+	if err != nil {
+		return "", err
+	}
+	if strutil.StrListContains(leaseNamespaces, namespace) {
+		return cleanupInUse, nil
+	}
+
+	deleted, err := client.deleteNamespace(ctx, namespace)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete namespace '%s': %w", namespace, err)
+	}
+	b.forgetNamespace(client.cluster, namespace)
+	b.Logger().Debug("deleted namespace created by Vault", "namespace", namespace, "deleted", deleted)
+	if !deleted {
+		return cleanupAlreadyDeleted, nil
+	}
+	return cleanupDeleted, nil
+}
+
+// enqueueCleanup records (or updates) a pending cleanup after a failed
+// attempt to delete its objects
+func (b *backend) enqueueCleanup(ctx context.Context, s logical.Storage, p *pendingCleanup, cause error) error {
+	existing, err := getPendingCleanup(ctx, s, p.key())
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		p = existing
+	} else {
+		p.Created = time.Now()
+	}
+	p.Attempts++
+	p.LastError = cause.Error()
+	p.NextAttempt = time.Now().Add(pendingCleanupBackoff(p.Attempts))
+
+	entry, err := logical.StorageEntryJSON(p.key(), p)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// pendingCleanupBackoff returns how long to wait before retrying a pending
+// cleanup after the given number of failed attempts
+func pendingCleanupBackoff(attempts int) time.Duration {
+	backoff := pendingCleanupBaseBackoff
+	for i := 1; i < attempts && backoff < pendingCleanupMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > pendingCleanupMaxBackoff {
+		backoff = pendingCleanupMaxBackoff
+	}
+	return backoff
+}
+
+func getPendingCleanup(ctx context.Context, s logical.Storage, key string) (*pendingCleanup, error) {
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	p := new(pendingCleanup)
+	if err := entry.DecodeJSON(p); err != nil {
+		return nil, fmt.Errorf("error reading pending cleanup %q: %w", key, err)
+	}
+	return p, nil
+}
+
+// drainPendingCleanups retries deleting the objects of leases that failed to
+// revoke. Entries are removed once all of their objects are gone, or once
+// they've failed maxPendingCleanupAttempts times. Each run picks up after the
+// last entry that the previous run looked at, so entries that keep failing
+// don't stop the others from being retried.
+func (b *backend) drainPendingCleanups(ctx context.Context, s logical.Storage) error {
+	keys, err := s.List(ctx, pendingCleanupPath)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	b.pendingCleanupsLock.Lock()
+	start := sort.SearchStrings(keys, b.pendingCleanupsAfter)
+	if start < len(keys) && keys[start] == b.pendingCleanupsAfter {
+		start++
+	}
+	keys = append(keys[start:], keys[:start]...)
+	if len(keys) > maxPendingCleanupsPerRun {
+		keys = keys[:maxPendingCleanupsPerRun]
+	}
+	b.pendingCleanupsAfter = keys[len(keys)-1]
+	b.pendingCleanupsLock.Unlock()
+
+	var errs *multierror.Error
+	// The clusters whose client couldn't be built in this run, e.g. because
+	// their config was deleted
+	failedClusters := make(map[string]bool)
+	for _, key := range keys {
+		p, err := getPendingCleanup(ctx, s, pendingCleanupPath+key)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if p == nil || time.Now().Before(p.NextAttempt) {
+			continue
+		}
+		if p.Attempts >= maxPendingCleanupAttempts {
+			b.Logger().Warn("giving up cleaning up the objects of revoked lease, tidy may delete them", "namespace", p.Namespace, "service_account", p.ServiceAccount, "attempts", p.Attempts, "last_error", p.LastError)
+			if err := b.removeCredsIndexEntry(ctx, s, p.IndexID); err != nil {
+				errs = multierror.Append(errs, err)
+				continue
+			}
+			if err := s.Delete(ctx, p.key()); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+		if failedClusters[p.Cluster] {
+			continue
+		}
+
+		client, err := b.getClient(ctx, s, p.Cluster)
+		if err != nil {
+			failedClusters[p.Cluster] = true
+			errs = multierror.Append(errs, err)
+			if err := b.enqueueCleanup(ctx, s, p, err); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+
+		if _, err := b.deleteObjects(ctx, s, client, p, client.relyOnOwnerGC); err != nil {
+			b.Logger().Warn("retrying cleanup of revoked lease failed", "namespace", p.Namespace, "attempts", p.Attempts+1, "error", err)
+			if err := b.enqueueCleanup(ctx, s, p, err); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+
+		b.Logger().Info("cleaned up objects of revoked lease", "namespace", p.Namespace, "service_account", p.ServiceAccount)
+		if err := b.removeCredsIndexEntry(ctx, s, p.IndexID); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if err := s.Delete(ctx, p.key()); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
@@ -4,18 +4,31 @@
 package kubesecrets
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/cenkalti/backoff/v3"
 	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	k8s_yaml "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -26,8 +39,105 @@ var standardLabels = map[string]string{
 	"app.kubernetes.io/created-by": "vault-plugin-secrets-kubernetes",
 }
 
+// reservedKeyPrefix is the prefix of labels and annotations that are managed
+// by the plugin
+const reservedKeyPrefix = "vault.hashicorp.com/"
+
+// mountIDLabel is set on generated objects to the unique ID of the mount that
+// created them, so tidy only considers the objects of its own mount
+const mountIDLabel = reservedKeyPrefix + "mount-id"
+
+// createdNamespaceLabel is set on namespaces created for roles with
+// create_namespace, so only those are ever deleted
+const createdNamespaceLabel = reservedKeyPrefix + "created-namespace"
+
+// mountAccessorLabel and roleNameLabel are set on generated objects to the
+// accessor of the mount and the name of the Vault role that created them, for
+// auditing and cost attribution
+const (
+	mountAccessorLabel = reservedKeyPrefix + "mount-accessor"
+	roleNameLabel      = reservedKeyPrefix + "role"
+)
+
+// leaseIndexIDAnnotation and requestIDAnnotation are set on the objects of a
+// lease of roles with annotate_lease_id, to trace them back to the lease
+const (
+	leaseIndexIDAnnotation = reservedKeyPrefix + "lease-index-id"
+	requestIDAnnotation    = reservedKeyPrefix + "request-id"
+)
+
+// mountLabels returns the labels identifying the mount from the labels of a
+// generated object
+func mountLabels(labels map[string]string) map[string]string {
+	mount := map[string]string{}
+	for _, key := range []string{mountIDLabel, mountAccessorLabel} {
+		if value, ok := labels[key]; ok {
+			mount[key] = value
+		}
+	}
+	return mount
+}
+
+// isReservedKey returns true if the label or annotation key is managed by the
+// plugin and can't be set by users
+func isReservedKey(key string) bool {
+	if _, ok := standardLabels[key]; ok {
+		return true
+	}
+	return strings.HasPrefix(key, reservedKeyPrefix)
+}
+
+const (
+	// defaultMaxRetries and defaultRetryBaseDelay are used when the config
+	// doesn't set kubernetes_api_max_retries or
+	// kubernetes_api_retry_base_delay_ms
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 200 * time.Millisecond
+
+	// maxRetryDelay caps the delay between retries
+	maxRetryDelay = 5 * time.Second
+
+	// defaultAPITimeout is used when the config doesn't set
+	// kubernetes_api_timeout
+	defaultAPITimeout = 30 * time.Second
+
+	// operationTimeoutFactor is how many times the timeout of a single
+	// request all the requests of an operation, like issuing creds, may take
+	operationTimeoutFactor = 4
+)
+
 type client struct {
 	k8s kubernetes.Interface
+
+	// deleteOptions are used for all deletes of Kubernetes objects
+	deleteOptions metav1.DeleteOptions
+
+	// maxRetries and retryBaseDelay control the retries of create requests
+	// that fail with a transient error
+	maxRetries     int
+	retryBaseDelay time.Duration
+
+	// timeout limits each request to the Kubernetes API
+	timeout time.Duration
+
+	// configHash is the hash of the effective config the client was built
+	// from
+	configHash string
+
+	// cluster is the name of the cluster the client connects to, which is
+	// empty for the default cluster
+	cluster string
+
+	// cacheTTL is the namespace_cache_ttl of the cluster's config, if set
+	cacheTTL *time.Duration
+
+	// controllerOwnerRefs and blockOwnerDeletion are the flags set on the
+	// owner references of generated objects
+	controllerOwnerRefs bool
+	blockOwnerDeletion  bool
+
+	// relyOnOwnerGC is the rely_on_owner_gc of the cluster's config
+	relyOnOwnerGC bool
 }
 
 func newClient(config *kubeConfig) (*client, error) {
@@ -35,40 +145,782 @@ func newClient(config *kubeConfig) (*client, error) {
 		return nil, errors.New("client configuration was nil")
 	}
 
-	clientConfig := rest.Config{
-		Host:        config.Host,
-		BearerToken: config.ServiceAccountJwt,
+	clientConfig, err := makeRestConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	k8sClient, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		k8s: k8sClient,
+		deleteOptions: metav1.DeleteOptions{
+			GracePeriodSeconds: config.RevokeGracePeriodSeconds,
+		},
+		maxRetries:     config.maxRetries(),
+		retryBaseDelay: config.retryBaseDelay(),
+		timeout:        config.apiTimeout(),
+		cacheTTL:       config.NamespaceCacheTTL,
+
+		controllerOwnerRefs: config.ControllerOwnerReferences,
+		blockOwnerDeletion:  config.BlockOwnerDeletion,
+		relyOnOwnerGC:       config.RelyOnOwnerGC,
+	}, nil
+}
+
+// ownerReference returns a reference to the Role or RoleBinding that owns the
+// other objects of a lease, with the flags set in the cluster's config. The
+// UID is only known once the owner is created.
+func (c *client) ownerReference(kind, name string, uid types.UID) metav1.OwnerReference {
+	ref := metav1.OwnerReference{
+		APIVersion: rbacv1.SchemeGroupVersion.String(),
+		Kind:       kind,
+		Name:       name,
+		UID:        uid,
+	}
+	if c.controllerOwnerRefs {
+		controller := true
+		ref.Controller = &controller
+	}
+	if c.blockOwnerDeletion {
+		blockOwnerDeletion := true
+		ref.BlockOwnerDeletion = &blockOwnerDeletion
+	}
+	return ref
+}
+
+// namespaceCacheTTL returns how long the namespaces looked up in the cluster
+// are cached, which is defaultTTL unless the cluster's config sets
+// namespace_cache_ttl
+func (c *client) namespaceCacheTTL(defaultTTL time.Duration) time.Duration {
+	if c.cacheTTL == nil {
+		return defaultTTL
+	}
+	return *c.cacheTTL
+}
+
+// makeRestConfig builds the configuration of the Kubernetes API client from
+// the plugin's config
+func makeRestConfig(config *kubeConfig) (*rest.Config, error) {
+	clientConfig := &rest.Config{
+		Host:    config.Host,
+		QPS:     config.qps(),
+		Burst:   config.burst(),
+		Timeout: config.apiTimeout(),
+	}
+	if config.ClientCert != "" {
+		clientConfig.TLSClientConfig.CertData = []byte(config.ClientCert)
+		clientConfig.TLSClientConfig.KeyData = []byte(config.ClientKey)
+	} else {
+		clientConfig.BearerToken = config.ServiceAccountJwt
 	}
 	if config.CACert != "" {
 		clientConfig.TLSClientConfig.CAData = []byte(config.CACert)
 	}
-	k8sClient, err := kubernetes.NewForConfig(&clientConfig)
+	clientConfig.TLSClientConfig.ServerName = config.TLSServerName
+	clientConfig.Impersonate = rest.ImpersonationConfig{
+		UserName: config.ImpersonateUser,
+		Groups:   config.ImpersonateGroups,
+	}
+	// If no proxy is configured, client-go uses the HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY environment variables
+	if config.ProxyURL != "" {
+		proxyURL, err := parseProxyURL(config.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.Proxy = http.ProxyURL(proxyURL)
+	}
+	return clientConfig, nil
+}
+
+// parseProxyURL parses and validates the URL of a proxy to the Kubernetes API
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme must be one of http, https or socks5", proxyURL.Redacted())
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+// withTimeout returns a copy of ctx that is cancelled after the client's
+// timeout, if one is set
+func (c *client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	return &client{k8sClient}, nil
+	return context.WithTimeout(ctx, c.timeout)
 }
 
-func (c *client) createToken(ctx context.Context, namespace, name string, ttl time.Duration, audiences []string) (*authenticationv1.TokenRequestStatus, error) {
+// withOperationTimeout returns a copy of ctx that is cancelled after
+// operationTimeoutFactor times the client's timeout, or defaultAPITimeout if
+// none is set, to bound all the requests of an operation
+func (c *client) withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = defaultAPITimeout
+	}
+	return context.WithTimeout(ctx, operationTimeoutFactor*timeout)
+}
+
+// withRetry calls op until it succeeds, fails with an error that isn't
+// retryable, or c.maxRetries retries have been made. The delay between
+// retries grows exponentially from c.retryBaseDelay up to maxRetryDelay.
+// Each call of op is passed a context limited by the client's timeout.
+func (c *client) withRetry(ctx context.Context, op func(context.Context) error) error {
+	attempt := func() error {
+		// Don't send requests once the operation was cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		return op(ctx)
+	}
+	// backoff treats zero max retries as unlimited
+	if c.maxRetries <= 0 {
+		return attempt()
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = c.retryBaseDelay
+	bo.MaxInterval = maxRetryDelay
+	bo.MaxElapsedTime = 0
+	return backoff.Retry(func() error {
+		err := attempt()
+		if err != nil && !isRetryableError(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(backoff.WithMaxRetries(bo, uint64(c.maxRetries)), ctx))
+}
+
+// isRetryableError returns true if err is likely to be transient
+func isRetryableError(err error) bool {
+	switch {
+	case k8s_errors.IsServerTimeout(err),
+		k8s_errors.IsTimeout(err),
+		k8s_errors.IsTooManyRequests(err),
+		k8s_errors.IsConflict(err),
+		k8s_errors.IsInternalError(err),
+		k8s_errors.IsServiceUnavailable(err):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// createToken requests a token for the service account. If boundObjectRef is
+// set, the token is only valid as long as that object exists.
+func (c *client) createToken(ctx context.Context, namespace, name string, ttl time.Duration, audiences []string, boundObjectRef *authenticationv1.BoundObjectReference) (*authenticationv1.TokenRequestStatus, error) {
+	defer measureAPICall("create_token", time.Now())
 	intTTL := int64(ttl.Seconds())
-	resp, err := c.k8s.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, &authenticationv1.TokenRequest{
-		Spec: authenticationv1.TokenRequestSpec{
-			ExpirationSeconds: &intTTL,
-			Audiences:         audiences,
+	var resp *authenticationv1.TokenRequest
+	err := c.withRetry(ctx, func(ctx context.Context) (err error) {
+		resp, err = c.k8s.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, &authenticationv1.TokenRequest{
+			Spec: authenticationv1.TokenRequestSpec{
+				ExpirationSeconds: &intTTL,
+				Audiences:         audiences,
+				BoundObjectRef:    boundObjectRef,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.Status, nil
+}
+
+// reviewToken asks the Kubernetes API whether the token is valid for any of
+// the audiences, or for the API server's audience if none are given
+func (c *client) reviewToken(ctx context.Context, token string, audiences []string) (*authenticationv1.TokenReviewStatus, error) {
+	defer measureAPICall("review_token", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := c.k8s.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: audiences,
 		},
 	}, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
-
-	c.k8s.CoreV1().ServiceAccounts(namespace)
 	return &resp.Status, nil
 }
 
 func (c *client) createServiceAccount(ctx context.Context, namespace, name string, vaultRole *roleEntry, ownerRef metav1.OwnerReference) (*v1.ServiceAccount, error) {
+	defer measureAPICall("create_service_account", time.Now())
+	serviceAccountConfig := makeServiceAccount(namespace, name, vaultRole, ownerRef)
+	var resp *v1.ServiceAccount
+	err := c.withRetry(ctx, func(ctx context.Context) (err error) {
+		resp, err = c.k8s.CoreV1().ServiceAccounts(namespace).Create(ctx, serviceAccountConfig, metav1.CreateOptions{})
+		if k8s_errors.IsAlreadyExists(err) {
+			resp, err = c.k8s.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err == nil {
+				err = checkExisting("ServiceAccount", resp, serviceAccountConfig, true)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// tokenSecretTimeout is how long to wait for Kubernetes to populate the token
+// of a created service account token Secret, polling every
+// tokenSecretPollInterval
+var (
+	tokenSecretTimeout      = 30 * time.Second
+	tokenSecretPollInterval = 250 * time.Millisecond
+)
+
+// createTokenSecret creates a Secret of type kubernetes.io/service-account-token
+// for the service account, and returns the long-lived token that Kubernetes
+// issues into it. The Secret is deleted if the token isn't issued in time.
+func (c *client) createTokenSecret(ctx context.Context, namespace, name, serviceAccountName string, vaultRole *roleEntry) (string, error) {
+	defer measureAPICall("create_token_secret", time.Now())
+	secretConfig := makeTokenSecret(namespace, name, serviceAccountName, vaultRole)
+	err := c.withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.k8s.CoreV1().Secrets(namespace).Create(ctx, secretConfig, metav1.CreateOptions{})
+		if k8s_errors.IsAlreadyExists(err) {
+			var existing *corev1.Secret
+			existing, err = c.k8s.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err == nil {
+				sameSpec := existing.Type == secretConfig.Type &&
+					existing.Annotations[corev1.ServiceAccountNameKey] == serviceAccountName
+				err = checkExisting("Secret", existing, secretConfig, sameSpec)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = wait.PollUntilContextTimeout(ctx, tokenSecretPollInterval, tokenSecretTimeout, true, func(ctx context.Context) (bool, error) {
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		secret, err := c.k8s.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		token = string(secret.Data[corev1.ServiceAccountTokenKey])
+		return token != "", nil
+	})
+	if err != nil {
+		if _, deleteErr := c.deleteSecret(context.Background(), namespace, name); deleteErr != nil {
+			err = fmt.Errorf("%w; failed to delete the Secret: %s", err, deleteErr)
+		}
+		return "", fmt.Errorf("token was not issued into Secret '%s/%s': %w", namespace, name, err)
+	}
+	return token, nil
+}
+
+// deleteSecret deletes a service account token Secret, and reports whether it
+// was deleted or was already gone
+func (c *client) deleteSecret(ctx context.Context, namespace, name string) (bool, error) {
+	defer measureAPICall("delete_secret", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	err := c.k8s.CoreV1().Secrets(namespace).Delete(ctx, name, c.deleteOptions)
+	return deleteResult(err)
+}
+
+// deleteServiceAccount deletes the service account, and returns false if it
+// had already been deleted (e.g. garbage collected via an owner reference)
+func (c *client) deleteServiceAccount(ctx context.Context, namespace, name string) (bool, error) {
+	defer measureAPICall("delete_service_account", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	err := c.k8s.CoreV1().ServiceAccounts(namespace).Delete(ctx, name, c.deleteOptions)
+	return deleteResult(err)
+}
+
+func (c *client) createRole(ctx context.Context, namespace, name string, vaultRole *roleEntry) (metav1.OwnerReference, error) {
+	defer measureAPICall("create_role", time.Now())
+	thisOwnerRef := c.ownerReference("", name, "")
+	obj, err := makeRole(namespace, name, vaultRole)
+	if err != nil {
+		return thisOwnerRef, err
+	}
+
+	switch roleConfig := obj.(type) {
+	case *rbacv1.Role:
+		var resp *rbacv1.Role
+		err := c.withRetry(ctx, func(ctx context.Context) (err error) {
+			resp, err = c.k8s.RbacV1().Roles(namespace).Create(ctx, roleConfig, metav1.CreateOptions{})
+			if k8s_errors.IsAlreadyExists(err) {
+				resp, err = c.k8s.RbacV1().Roles(namespace).Get(ctx, name, metav1.GetOptions{})
+				if err == nil {
+					err = checkExisting("Role", resp, roleConfig, equality.Semantic.DeepEqual(resp.Rules, roleConfig.Rules))
+				}
+			}
+			return err
+		})
+		if err == nil {
+			thisOwnerRef.Kind = "Role"
+			thisOwnerRef.UID = resp.UID
+		}
+		return thisOwnerRef, err
+
+	case *rbacv1.ClusterRole:
+		var resp *rbacv1.ClusterRole
+		err := c.withRetry(ctx, func(ctx context.Context) (err error) {
+			resp, err = c.k8s.RbacV1().ClusterRoles().Create(ctx, roleConfig, metav1.CreateOptions{})
+			if k8s_errors.IsAlreadyExists(err) {
+				resp, err = c.k8s.RbacV1().ClusterRoles().Get(ctx, name, metav1.GetOptions{})
+				if err == nil {
+					err = checkExisting("ClusterRole", resp, roleConfig, sameClusterRoleSpec(resp, roleConfig))
+				}
+			}
+			return err
+		})
+		if err == nil {
+			thisOwnerRef.Kind = "ClusterRole"
+			thisOwnerRef.UID = resp.UID
+		}
+		return thisOwnerRef, err
+
+	default:
+		return thisOwnerRef, fmt.Errorf("unknown role type '%s'", vaultRole.K8sRoleType)
+	}
+}
+
+// createSharedClusterRole creates a ClusterRole that is shared by multiple
+// leases, so it has only the standard labels and no owner. An existing
+// ClusterRole is reused if the mount created it with the same rules, e.g.
+// after its reference count was lost.
+func (c *client) createSharedClusterRole(ctx context.Context, name string, vaultRole *roleEntry) error {
+	defer measureAPICall("create_shared_cluster_role", time.Now())
+	roleConfig, err := makeSharedClusterRole(name, vaultRole)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	_, err = c.k8s.RbacV1().ClusterRoles().Create(ctx, roleConfig, metav1.CreateOptions{})
+	if k8s_errors.IsAlreadyExists(err) {
+		var existing *rbacv1.ClusterRole
+		existing, err = c.k8s.RbacV1().ClusterRoles().Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			err = checkExisting("ClusterRole", existing, roleConfig, sameClusterRoleSpec(existing, roleConfig))
+		}
+	}
+	return err
+}
+
+// deleteRole deletes the Role or ClusterRole, and returns false if it had
+// already been deleted
+func (c *client) deleteRole(ctx context.Context, namespace, name, roleType string) (bool, error) {
+	defer measureAPICall("delete_role", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	switch roleType {
+	case "Role":
+		err = c.k8s.RbacV1().Roles(namespace).Delete(ctx, name, c.deleteOptions)
+	case "ClusterRole":
+		err = c.k8s.RbacV1().ClusterRoles().Delete(ctx, name, c.deleteOptions)
+	default:
+		return false, fmt.Errorf("unsupported role type '%s'", roleType)
+	}
+	return deleteResult(err)
+}
+
+func (c *client) createRoleBinding(ctx context.Context, namespace, name, serviceAccountName, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry, ownerRef *metav1.OwnerReference) (metav1.OwnerReference, error) {
+	defer measureAPICall("create_role_binding", time.Now())
+	thisOwnerRef := c.ownerReference("", name, "")
+	obj, err := makeRoleBinding(namespace, name, serviceAccountName, k8sRoleName, isClusterRoleBinding, vaultRole, ownerRef)
+	if err != nil {
+		return thisOwnerRef, err
+	}
+
+	switch roleConfig := obj.(type) {
+	case *rbacv1.ClusterRoleBinding:
+		var resp *rbacv1.ClusterRoleBinding
+		err := c.withRetry(ctx, func(ctx context.Context) (err error) {
+			resp, err = c.k8s.RbacV1().ClusterRoleBindings().Create(ctx, roleConfig, metav1.CreateOptions{})
+			if k8s_errors.IsAlreadyExists(err) {
+				resp, err = c.k8s.RbacV1().ClusterRoleBindings().Get(ctx, name, metav1.GetOptions{})
+				if err == nil {
+					err = checkExisting("ClusterRoleBinding", resp, roleConfig, resp.RoleRef == roleConfig.RoleRef && equality.Semantic.DeepEqual(resp.Subjects, roleConfig.Subjects))
+				}
+			}
+			return err
+		})
+		if err == nil {
+			thisOwnerRef.Kind = "ClusterRoleBinding"
+			thisOwnerRef.UID = resp.UID
+		}
+		return thisOwnerRef, err
+
+	case *rbacv1.RoleBinding:
+		var resp *rbacv1.RoleBinding
+		err := c.withRetry(ctx, func(ctx context.Context) (err error) {
+			resp, err = c.k8s.RbacV1().RoleBindings(namespace).Create(ctx, roleConfig, metav1.CreateOptions{})
+			if k8s_errors.IsAlreadyExists(err) {
+				resp, err = c.k8s.RbacV1().RoleBindings(namespace).Get(ctx, name, metav1.GetOptions{})
+				if err == nil {
+					err = checkExisting("RoleBinding", resp, roleConfig, resp.RoleRef == roleConfig.RoleRef && equality.Semantic.DeepEqual(resp.Subjects, roleConfig.Subjects))
+				}
+			}
+			return err
+		})
+		if err == nil {
+			thisOwnerRef.Kind = "RoleBinding"
+			thisOwnerRef.UID = resp.UID
+		}
+		return thisOwnerRef, err
+
+	default:
+		return thisOwnerRef, fmt.Errorf("unknown role binding type %T", obj)
+	}
+}
+
+// deleteRoleBinding deletes the RoleBinding or ClusterRoleBinding, and
+// returns false if it had already been deleted (e.g. garbage collected via an
+// owner reference)
+func (c *client) deleteRoleBinding(ctx context.Context, namespace, name string, isClusterRoleBinding bool) (bool, error) {
+	defer measureAPICall("delete_role_binding", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	if isClusterRoleBinding {
+		err = c.k8s.RbacV1().ClusterRoleBindings().Delete(ctx, name, c.deleteOptions)
+	} else {
+		err = c.k8s.RbacV1().RoleBindings(namespace).Delete(ctx, name, c.deleteOptions)
+	}
+	return deleteResult(err)
+}
+
+// removeFinalizers removes the finalizers from the Role, ClusterRole,
+// RoleBinding or ClusterRoleBinding, leaving any others in place, so a deleted
+// object is removed without waiting for the controllers that own them. It's
+// not an error if the object is already gone.
+func (c *client) removeFinalizers(ctx context.Context, kind, namespace, name string, finalizers []string) error {
+	defer measureAPICall("remove_finalizers", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"$deleteFromPrimitiveList/finalizers": finalizers,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "Role":
+		_, err = c.k8s.RbacV1().Roles(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "ClusterRole":
+		_, err = c.k8s.RbacV1().ClusterRoles().Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "RoleBinding":
+		_, err = c.k8s.RbacV1().RoleBindings(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "ClusterRoleBinding":
+		_, err = c.k8s.RbacV1().ClusterRoleBindings().Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	default:
+		return fmt.Errorf("unsupported kind '%s'", kind)
+	}
+	if k8s_errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// getRoleBinding returns the role reference and subjects of the RoleBinding
+// or ClusterRoleBinding
+func (c *client) getRoleBinding(ctx context.Context, namespace, name string, isClusterRoleBinding bool) (rbacv1.RoleRef, []rbacv1.Subject, error) {
+	defer measureAPICall("get_role_binding", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	if isClusterRoleBinding {
+		binding, err := c.k8s.RbacV1().ClusterRoleBindings().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return rbacv1.RoleRef{}, nil, err
+		}
+		return binding.RoleRef, binding.Subjects, nil
+	}
+	binding, err := c.k8s.RbacV1().RoleBindings(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return rbacv1.RoleRef{}, nil, err
+	}
+	return binding.RoleRef, binding.Subjects, nil
+}
+
+// objectConflictError is returned when an object to create already exists,
+// but can't be used in its place
+type objectConflictError struct {
+	kind   string
+	name   string
+	reason string
+}
+
+func (e *objectConflictError) Error() string {
+	return fmt.Sprintf("%s '%s' already exists and %s", e.kind, e.name, e.reason)
+}
+
+// checkExisting returns an objectConflictError unless the existing object
+// with the name of the intended object was created by the plugin for the same
+// mount, with the same owners and spec. Such an object is left behind when a
+// previous creds request generated the same name and failed part way, and is
+// used as if it had just been created.
+func checkExisting(kind string, existing, intended metav1.Object, sameSpec bool) error {
+	name := intended.GetName()
+	if intended.GetNamespace() != "" {
+		name = intended.GetNamespace() + "/" + name
+	}
+	for _, key := range append(sortedKeys(standardLabels), mountIDLabel, mountAccessorLabel) {
+		if existing.GetLabels()[key] != intended.GetLabels()[key] {
+			return &objectConflictError{kind: kind, name: name, reason: "was not created by this mount"}
+		}
+	}
+	if !sameSpec || !equality.Semantic.DeepEqual(existing.GetOwnerReferences(), intended.GetOwnerReferences()) {
+		return &objectConflictError{kind: kind, name: name, reason: "doesn't match the object to create"}
+	}
+	return nil
+}
+
+// sameClusterRoleSpec returns true if the ClusterRoles have the same rules.
+// The rules of an aggregated ClusterRole are managed by Kubernetes, so only
+// the aggregation rules are compared.
+func sameClusterRoleSpec(existing, intended *rbacv1.ClusterRole) bool {
+	if intended.AggregationRule != nil {
+		return equality.Semantic.DeepEqual(existing.AggregationRule, intended.AggregationRule)
+	}
+	return existing.AggregationRule == nil && equality.Semantic.DeepEqual(existing.Rules, intended.Rules)
+}
+
+// deleteResult converts the error from a delete call into whether the object
+// was deleted by the call. An object that was not found is not an error.
+func deleteResult(err error) (bool, error) {
+	switch {
+	case err == nil:
+		return true, nil
+	case k8s_errors.IsNotFound(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// checkAuth makes a lightweight authenticated request to the Kubernetes API
+// to verify that the client's credentials are accepted
+func (c *client) checkAuth(ctx context.Context) error {
+	defer measureAPICall("check_auth", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	_, err := c.k8s.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:     "create",
+				Resource: "serviceaccounts",
+			},
+		},
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// checkAccess asks the Kubernetes API whether the client's credentials allow
+// the verb on the resource, in the namespace unless it's empty, and returns
+// the reason given by the authorizer
+func (c *client) checkAccess(ctx context.Context, namespace, group, resource, subresource, verb string) (bool, string, error) {
+	defer measureAPICall("check_access", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	review, err := c.k8s.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", err
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// createNamespace creates the namespace, and returns false if it already
+// existed
+func (c *client) createNamespace(ctx context.Context, name string, vaultRole *roleEntry) (bool, error) {
+	defer measureAPICall("create_namespace", time.Now())
+	namespaceConfig := makeNamespace(name, vaultRole)
+	err := c.withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.k8s.CoreV1().Namespaces().Create(ctx, namespaceConfig, metav1.CreateOptions{})
+		return err
+	})
+	if k8s_errors.IsAlreadyExists(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteNamespace deletes the namespace, and returns false if it had already
+// been deleted
+func (c *client) deleteNamespace(ctx context.Context, name string) (bool, error) {
+	defer measureAPICall("delete_namespace", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	err := c.k8s.CoreV1().Namespaces().Delete(ctx, name, c.deleteOptions)
+	return deleteResult(err)
+}
+
+func (c *client) getNamespaceLabelSet(ctx context.Context, namespace string) (map[string]string, error) {
+	defer measureAPICall("get_namespace", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	ns, err := c.k8s.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return ns.Labels, nil
+}
+
+// secretExists returns true if the Secret exists
+func (c *client) secretExists(ctx context.Context, namespace, name string) (bool, error) {
+	defer measureAPICall("get_secret", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	_, err := c.k8s.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case k8s_errors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// serviceAccountExists returns true if the ServiceAccount exists
+func (c *client) serviceAccountExists(ctx context.Context, namespace, name string) (bool, error) {
+	defer measureAPICall("get_service_account", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	_, err := c.k8s.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case k8s_errors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// getBoundObjectUID returns the UID of the Pod or Secret that a token is to
+// be bound to
+func (c *client) getBoundObjectUID(ctx context.Context, namespace, kind, name string) (types.UID, error) {
+	defer measureAPICall("get_bound_object", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	switch kind {
+	case "Pod":
+		pod, err := c.k8s.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		return pod.UID, nil
+	case "Secret":
+		secret, err := c.k8s.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		return secret.UID, nil
+	default:
+		return "", fmt.Errorf("unsupported bound object kind '%s'", kind)
+	}
+}
+
+// managedObject is a namespaced object that was created by the plugin
+type managedObject struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Created   time.Time
+}
+
+// listManagedObjects lists the ServiceAccounts, Roles and RoleBindings in
+// the namespace that match the label selector
+func (c *client) listManagedObjects(ctx context.Context, namespace, selector string) ([]managedObject, error) {
+	defer measureAPICall("list_managed_objects", time.Now())
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	opts := metav1.ListOptions{LabelSelector: selector}
+	var objects []managedObject
+	add := func(kind string, meta metav1.ObjectMeta) {
+		objects = append(objects, managedObject{
+			Kind:      kind,
+			Namespace: namespace,
+			Name:      meta.Name,
+			Created:   meta.CreationTimestamp.Time,
+		})
+	}
+
+	serviceAccounts, err := c.k8s.CoreV1().ServiceAccounts(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, sa := range serviceAccounts.Items {
+		add("ServiceAccount", sa.ObjectMeta)
+	}
+	roles, err := c.k8s.RbacV1().Roles(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles.Items {
+		add("Role", role.ObjectMeta)
+	}
+	roleBindings, err := c.k8s.RbacV1().RoleBindings(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleBinding := range roleBindings.Items {
+		add("RoleBinding", roleBinding.ObjectMeta)
+	}
+	return objects, nil
+}
+
+// makeServiceAccount builds the service account to create for a lease
+func makeServiceAccount(namespace, name string, vaultRole *roleEntry, ownerRef metav1.OwnerReference) *corev1.ServiceAccount {
 	// Set standardLabels last so that users can't override them
 	labels := combineMaps(vaultRole.ExtraLabels, standardLabels)
-	serviceAccountConfig := &corev1.ServiceAccount{
+	return &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ServiceAccount",
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            name,
 			Namespace:       namespace,
@@ -77,25 +929,67 @@ func (c *client) createServiceAccount(ctx context.Context, namespace, name strin
 			OwnerReferences: []metav1.OwnerReference{ownerRef},
 		},
 	}
-	return c.k8s.CoreV1().ServiceAccounts(namespace).Create(ctx, serviceAccountConfig, metav1.CreateOptions{})
 }
 
-func (c *client) deleteServiceAccount(ctx context.Context, namespace, name string) error {
-	err := c.k8s.CoreV1().ServiceAccounts(namespace).Delete(ctx, name, metav1.DeleteOptions{})
-	if err != nil && !k8s_errors.IsNotFound(err) {
-		return err
+// makeNamespace builds the namespace to create for a lease of a role with
+// create_namespace
+func makeNamespace(name string, vaultRole *roleEntry) *corev1.Namespace {
+	// Set standardLabels last so that users can't override them
+	labels := combineMaps(vaultRole.ExtraLabels, standardLabels, map[string]string{
+		createdNamespaceLabel: "true",
+	})
+	return &corev1.Namespace{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Namespace",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      labels,
+			Annotations: vaultRole.ExtraAnnotations,
+		},
 	}
-	return nil
 }
 
-func (c *client) createRole(ctx context.Context, namespace, name string, vaultRole *roleEntry) (metav1.OwnerReference, error) {
-	thisOwnerRef := metav1.OwnerReference{
-		APIVersion: "rbac.authorization.k8s.io/v1",
-		Name:       name,
+// makeTokenSecret builds the Secret to create for a lease of a role with
+// token_type secret, which Kubernetes populates with a long-lived token for
+// the service account
+func makeTokenSecret(namespace, name, serviceAccountName string, vaultRole *roleEntry) *corev1.Secret {
+	// Set standardLabels last so that users can't override them
+	labels := combineMaps(vaultRole.ExtraLabels, standardLabels)
+	annotations := combineMaps(vaultRole.ExtraAnnotations, map[string]string{
+		corev1.ServiceAccountNameKey: serviceAccountName,
+	})
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Type: corev1.SecretTypeServiceAccountToken,
+	}
+}
+
+// makeRole builds the Role or ClusterRole to create for a lease, depending on
+// the Vault role's kubernetes_role_type
+func makeRole(namespace, name string, vaultRole *roleEntry) (runtime.Object, error) {
+	// An aggregated ClusterRole has no rules of its own, the rules of the
+	// ClusterRoles matching its selectors are filled in by Kubernetes
+	var roleRules []rbacv1.PolicyRule
+	var aggregationRule *rbacv1.AggregationRule
+	var err error
+	if vaultRole.AggregationRule != "" {
+		aggregationRule, err = makeAggregationRule(vaultRole.AggregationRule)
+	} else {
+		roleRules, err = vaultRole.policyRules()
 	}
-	roleRules, err := makeRules(vaultRole.RoleRules)
 	if err != nil {
-		return thisOwnerRef, err
+		return nil, err
 	}
 	// Set standardLabels last so that users can't override them
 	labels := combineMaps(vaultRole.ExtraLabels, standardLabels)
@@ -103,59 +997,61 @@ func (c *client) createRole(ctx context.Context, namespace, name string, vaultRo
 		Name:        name,
 		Labels:      labels,
 		Annotations: vaultRole.ExtraAnnotations,
+		Finalizers:  vaultRole.RoleFinalizers,
 	}
 
 	switch vaultRole.K8sRoleType {
 	case "Role":
 		objectMeta.Namespace = namespace
-		roleConfig := &rbacv1.Role{
+		return &rbacv1.Role{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "Role",
+			},
 			ObjectMeta: objectMeta,
 			Rules:      roleRules,
-		}
-		resp, err := c.k8s.RbacV1().Roles(namespace).Create(ctx, roleConfig, metav1.CreateOptions{})
-		if resp != nil {
-			thisOwnerRef.Kind = "Role"
-			thisOwnerRef.UID = resp.UID
-		}
-		return thisOwnerRef, err
-
+		}, nil
 	case "ClusterRole":
-		roleConfig := &rbacv1.ClusterRole{
-			ObjectMeta: objectMeta,
-			Rules:      roleRules,
-		}
-		resp, err := c.k8s.RbacV1().ClusterRoles().Create(ctx, roleConfig, metav1.CreateOptions{})
-		if resp != nil {
-			thisOwnerRef.Kind = "ClusterRole"
-			thisOwnerRef.UID = resp.UID
-		}
-		return thisOwnerRef, err
-
+		return &rbacv1.ClusterRole{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "ClusterRole",
+			},
+			ObjectMeta:      objectMeta,
+			Rules:           roleRules,
+			AggregationRule: aggregationRule,
+		}, nil
 	default:
-		return thisOwnerRef, fmt.Errorf("unknown role type '%s'", vaultRole.K8sRoleType)
+		return nil, fmt.Errorf("unknown role type '%s'", vaultRole.K8sRoleType)
 	}
 }
 
-func (c *client) deleteRole(ctx context.Context, namespace, name, roleType string) error {
-	var err error
-	switch roleType {
-	case "Role":
-		err = c.k8s.RbacV1().Roles(namespace).Delete(ctx, name, metav1.DeleteOptions{})
-	case "ClusterRole":
-		err = c.k8s.RbacV1().ClusterRoles().Delete(ctx, name, metav1.DeleteOptions{})
-	default:
-		return fmt.Errorf("unsupported role type '%s'", roleType)
-	}
-	if err != nil && !k8s_errors.IsNotFound(err) {
-		return err
+// makeSharedClusterRole builds a ClusterRole shared by multiple leases and
+// roles, which has only the standard labels and those of the mount
+func makeSharedClusterRole(name string, vaultRole *roleEntry) (*rbacv1.ClusterRole, error) {
+	roleRules, err := makeRules(vaultRole.RoleRules)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: combineMaps(mountLabels(vaultRole.ExtraLabels), standardLabels),
+		},
+		Rules: roleRules,
+	}, nil
 }
 
-func (c *client) createRoleBinding(ctx context.Context, namespace, name, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry, ownerRef *metav1.OwnerReference) (metav1.OwnerReference, error) {
-	thisOwnerRef := metav1.OwnerReference{
-		APIVersion: "rbac.authorization.k8s.io/v1",
-		Name:       name,
+// makeRoleBinding builds the RoleBinding or ClusterRoleBinding to create for
+// a lease, binding the service account to the k8s role
+func makeRoleBinding(namespace, name, serviceAccountName, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry, ownerRef *metav1.OwnerReference) (runtime.Object, error) {
+	additionalSubjects, err := makeSubjects(vaultRole.AdditionalSubjects)
+	if err != nil {
+		return nil, err
 	}
 	// Set standardLabels last so that users can't override them
 	labels := combineMaps(vaultRole.ExtraLabels, standardLabels)
@@ -163,6 +1059,7 @@ func (c *client) createRoleBinding(ctx context.Context, namespace, name, k8sRole
 		Name:        name,
 		Labels:      labels,
 		Annotations: vaultRole.ExtraAnnotations,
+		Finalizers:  vaultRole.RoleBindingFinalizers,
 	}
 	if ownerRef != nil {
 		objectMeta.OwnerReferences = []metav1.OwnerReference{*ownerRef}
@@ -170,74 +1067,161 @@ func (c *client) createRoleBinding(ctx context.Context, namespace, name, k8sRole
 	subjects := []rbacv1.Subject{
 		{
 			Kind:      "ServiceAccount",
-			Name:      name,
+			Name:      serviceAccountName,
 			Namespace: namespace,
 		},
 	}
+	subjects = append(subjects, additionalSubjects...)
+	// The API server defaults the RBAC API group, so it's set here too for
+	// existing bindings to compare equal
 	roleRef := rbacv1.RoleRef{
-		Kind: vaultRole.K8sRoleType,
-		Name: k8sRoleName,
+		APIGroup: rbacv1.GroupName,
+		Kind:     vaultRole.K8sRoleType,
+		Name:     k8sRoleName,
 	}
 
 	if isClusterRoleBinding {
-		roleConfig := &rbacv1.ClusterRoleBinding{
+		return &rbacv1.ClusterRoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "ClusterRoleBinding",
+			},
 			ObjectMeta: objectMeta,
 			Subjects:   subjects,
 			RoleRef:    roleRef,
-		}
-		resp, err := c.k8s.RbacV1().ClusterRoleBindings().Create(ctx, roleConfig, metav1.CreateOptions{})
-		if resp != nil {
-			thisOwnerRef.Kind = "ClusterRoleBinding"
-			thisOwnerRef.UID = resp.UID
-		}
-		return thisOwnerRef, err
+		}, nil
 	}
 
 	objectMeta.Namespace = namespace
-	roleConfig := &rbacv1.RoleBinding{
+	return &rbacv1.RoleBinding{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "RoleBinding",
+		},
 		ObjectMeta: objectMeta,
 		Subjects:   subjects,
 		RoleRef:    roleRef,
-	}
-	resp, err := c.k8s.RbacV1().RoleBindings(namespace).Create(ctx, roleConfig, metav1.CreateOptions{})
-	if resp != nil {
-		thisOwnerRef.Kind = "RoleBinding"
-		thisOwnerRef.UID = resp.UID
-	}
-	return thisOwnerRef, err
+	}, nil
 }
 
-func (c *client) deleteRoleBinding(ctx context.Context, namespace, name string, isClusterRoleBinding bool) error {
-	var err error
-	if isClusterRoleBinding {
-		err = c.k8s.RbacV1().ClusterRoleBindings().Delete(ctx, name, metav1.DeleteOptions{})
-	} else {
-		err = c.k8s.RbacV1().RoleBindings(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+// makeSubjects parses a role's additional_subjects, a JSON or YAML list of
+// subjects. User and Group subjects get the RBAC API group if they don't set
+// it, which Kubernetes would otherwise default, so they compare equal to the
+// created object, while ServiceAccount subjects are in the core API group.
+// Other API groups are rejected, since the subjects wouldn't be granted the
+// role's permissions.
+func makeSubjects(subjects string) ([]rbacv1.Subject, error) {
+	if subjects == "" {
+		return nil, nil
 	}
-	if err != nil && !k8s_errors.IsNotFound(err) {
-		return err
+	var parsed []rbacv1.Subject
+	decoder := k8s_yaml.NewYAMLOrJSONDecoder(strings.NewReader(subjects), len(subjects))
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
 	}
-	return nil
+	for i, subject := range parsed {
+		if subject.Name == "" {
+			return nil, fmt.Errorf("subject %d has no name", i)
+		}
+		switch subject.Kind {
+		case rbacv1.ServiceAccountKind:
+			if subject.Namespace == "" {
+				return nil, fmt.Errorf("ServiceAccount subject '%s' has no namespace", subject.Name)
+			}
+			if subject.APIGroup != "" {
+				return nil, fmt.Errorf("ServiceAccount subject '%s' has apiGroup '%s', which must be empty", subject.Name, subject.APIGroup)
+			}
+		case rbacv1.UserKind, rbacv1.GroupKind:
+			if subject.Namespace != "" {
+				return nil, fmt.Errorf("%s subject '%s' can't have a namespace", subject.Kind, subject.Name)
+			}
+			if subject.APIGroup != "" && subject.APIGroup != rbacv1.GroupName {
+				return nil, fmt.Errorf("%s subject '%s' has apiGroup '%s', which must be '%s'", subject.Kind, subject.Name, subject.APIGroup, rbacv1.GroupName)
+			}
+			parsed[i].APIGroup = rbacv1.GroupName
+		default:
+			return nil, fmt.Errorf("subject '%s' has kind '%s', which must be one of ServiceAccount, User or Group", subject.Name, subject.Kind)
+		}
+	}
+	return parsed, nil
 }
 
-func (c *client) getNamespaceLabelSet(ctx context.Context, namespace string) (map[string]string, error) {
-	ns, err := c.k8s.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
-	if err != nil {
-		return map[string]string{}, err
-	}
-	return ns.Labels, nil
+// ruleSet is a document of generated_role_rules
+type ruleSet struct {
+	Rules []rbacv1.PolicyRule `json:"rules"`
 }
 
+// makeRules parses the rules of generated_role_rules. The rules may be split
+// across several YAML documents separated by '---', or a JSON or YAML list of
+// rule sets, whose rules are concatenated in order.
 func makeRules(rules string) ([]rbacv1.PolicyRule, error) {
-	policyRules := struct {
-		Rules []rbacv1.PolicyRule `json:"rules"`
-	}{}
+	return parseRuleSets(rules, false)
+}
+
+// makeRulesStrict parses the rules like makeRules, but returns an error for
+// fields that aren't part of a PolicyRule, e.g. "resource" in place of
+// "resources", which makeRules would silently drop
+func makeRulesStrict(rules string) ([]rbacv1.PolicyRule, error) {
+	return parseRuleSets(rules, true)
+}
+
+func parseRuleSets(rules string, strict bool) ([]rbacv1.PolicyRule, error) {
+	var policyRules []rbacv1.PolicyRule
 	decoder := k8s_yaml.NewYAMLOrJSONDecoder(strings.NewReader(rules), len(rules))
-	err := decoder.Decode(&policyRules)
-	if err != nil {
-		return nil, err
+	for documents := 0; ; documents++ {
+		var document json.RawMessage
+		err := decoder.Decode(&document)
+		if err == io.EOF && documents > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		document = bytes.TrimSpace(document)
+		if len(document) == 0 || bytes.Equal(document, []byte("null")) {
+			// An empty document, e.g. before a leading '---'
+			continue
+		}
+
+		var sets []ruleSet
+		if document[0] == '[' {
+			err = decodeJSON(document, &sets, strict)
+		} else {
+			sets = make([]ruleSet, 1)
+			err = decodeJSON(document, &sets[0], strict)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range sets {
+			policyRules = append(policyRules, set.Rules...)
+		}
 	}
-	return policyRules.Rules, nil
+	return policyRules, nil
+}
+
+// decodeJSON decodes the JSON data into v. If strict is set, fields that
+// aren't part of v are an error.
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
+
+// duplicateRule returns the index of the first rule that's identical to an
+// earlier one, e.g. because it was pasted into several rule sets, and the
+// index of the earlier rule. -1, -1 is returned if there's none.
+func duplicateRule(rules []rbacv1.PolicyRule) (int, int) {
+	for i := range rules {
+		for j := 0; j < i; j++ {
+			if equality.Semantic.DeepEqual(rules[i], rules[j]) {
+				return i, j
+			}
+		}
+	}
+	return -1, -1
 }
 
 func makeLabelSelector(selector string) (metav1.LabelSelector, error) {
@@ -250,6 +1234,33 @@ func makeLabelSelector(selector string) (metav1.LabelSelector, error) {
 	return labelSelector, nil
 }
 
+// makeNamespaceSelector parses a role's allowed_kubernetes_namespace_selector,
+// which is either a JSON or YAML LabelSelector object, or a label selector
+// string such as "owner=team-a,env in (dev,staging)"
+func makeNamespaceSelector(selector string) (labels.Selector, error) {
+	labelSelector, err := makeLabelSelector(selector)
+	if err != nil {
+		parsed, parseErr := labels.Parse(selector)
+		if parseErr != nil {
+			return nil, fmt.Errorf("not a LabelSelector object (%s) or a label selector string (%s)", err, parseErr)
+		}
+		return parsed, nil
+	}
+	return metav1.LabelSelectorAsSelector(&labelSelector)
+}
+
+func makeAggregationRule(rule string) (*rbacv1.AggregationRule, error) {
+	aggregationRule := &rbacv1.AggregationRule{}
+	decoder := k8s_yaml.NewYAMLOrJSONDecoder(strings.NewReader(rule), len(rule))
+	if err := decoder.Decode(aggregationRule); err != nil {
+		return nil, err
+	}
+	if len(aggregationRule.ClusterRoleSelectors) == 0 {
+		return nil, fmt.Errorf("clusterRoleSelectors must not be empty")
+	}
+	return aggregationRule, nil
+}
+
 func makeRoleType(roleType string) string {
 	switch strings.ToLower(roleType) {
 	case "role":
@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// credsQueueTimeout is how long a creds request waits for one of the mount's
+// max_concurrent_creds slots before it's rejected
+var credsQueueTimeout = 10 * time.Second
+
+// errCredsBusy is returned when a creds request can't get a slot in time
+var errCredsBusy = errors.New("server busy: too many creds requests are creating Kubernetes objects, try again later")
+
+// credsSemaphore limits the number of creds requests that create Kubernetes
+// objects at once. Each request holds one of the slots while it creates its
+// objects.
+type credsSemaphore struct {
+	size  int
+	slots chan struct{}
+}
+
+// acquireCredsSlot waits for a slot to create the objects of a creds request,
+// if the mount's max_concurrent_creds is set, and returns the function that
+// releases it. errCredsBusy is returned if no slot was released within
+// credsQueueTimeout. When max_concurrent_creds changes, requests in progress
+// release their slots of the previous semaphore, so for a while more requests
+// than the new limit may be in progress.
+func (b *backend) acquireCredsSlot(ctx context.Context, limit int) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	b.credsSemaphoreLock.Lock()
+	if b.credsSemaphore == nil || b.credsSemaphore.size != limit {
+		b.credsSemaphore = &credsSemaphore{size: limit, slots: make(chan struct{}, limit)}
+	}
+	sem := b.credsSemaphore
+	b.credsSemaphoreLock.Unlock()
+
+	timer := time.NewTimer(credsQueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem.slots <- struct{}{}:
+		return func() { <-sem.slots }, nil
+	case <-timer.C:
+		return nil, errCredsBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
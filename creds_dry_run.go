@@ -0,0 +1,139 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// dryRunCreds returns the Kubernetes objects that a creds request would
+// create, in the order they would be created, without creating them or a
+// token. Owner references lack the owner's UID, which is only assigned by
+// Kubernetes on creation.
+func (b *backend) dryRunCreds(client *client, role *roleEntry, reqPayload *credsRequest, genName, secretName string, createNamespace bool, ttl time.Duration, audiences []string, warnings []string) (*logical.Response, error) {
+	namespace := reqPayload.Namespace
+	isClusterRoleBinding := reqPayload.ClusterRoleBinding
+	ownerRef := func(kind, name string) metav1.OwnerReference {
+		return client.ownerReference(kind, name, "")
+	}
+	bindingKind := "RoleBinding"
+	if isClusterRoleBinding {
+		bindingKind = "ClusterRoleBinding"
+	}
+	// The bindings only fail to build if the role's additional_subjects
+	// don't parse, which is checked once after the objects are listed
+	var bindingErr error
+	bindingNamespace := namespace
+	if reqPayload.BindingNamespace != "" {
+		bindingNamespace = reqPayload.BindingNamespace
+	}
+	roleBinding := func(name, serviceAccountName, k8sRoleName string, owner *metav1.OwnerReference) runtime.Object {
+		obj, err := makeRoleBinding(bindingNamespace, name, serviceAccountName, k8sRoleName, isClusterRoleBinding, role, owner)
+		if err != nil {
+			bindingErr = err
+		}
+		return obj
+	}
+
+	serviceAccountName := genName
+	var objects []runtime.Object
+	if createNamespace {
+		objects = append(objects, makeNamespace(namespace, role))
+	}
+	switch {
+	case role.bindsExistingServiceAccount():
+		serviceAccountName = role.ServiceAccountName
+		objects = append(objects,
+			roleBinding(genName, serviceAccountName, role.K8sRoleName, nil),
+		)
+	case role.ServiceAccountName != "":
+		// Only a token is created for an existing service account
+		serviceAccountName = role.ServiceAccountName
+	case role.CombineRules:
+		k8sRole, err := makeRole(namespace, genName, role)
+		if err != nil {
+			return nil, err
+		}
+		owner := ownerRef(role.K8sRoleType, genName)
+		objects = append(objects,
+			k8sRole,
+			roleBinding(genName, genName, genName, &owner),
+			roleBinding(genName+baseRoleBindingSuffix, genName, role.K8sRoleName, &owner),
+			makeServiceAccount(namespace, genName, role, owner),
+		)
+	case role.K8sRoleName != "":
+		owner := ownerRef(bindingKind, genName)
+		objects = append(objects,
+			roleBinding(genName, genName, role.K8sRoleName, nil),
+			makeServiceAccount(namespace, genName, role, owner),
+		)
+	case role.SharedClusterRole:
+		// The shared ClusterRole is only created if no other lease uses it
+		sharedName, err := sharedClusterRoleName(b.mountID, client.cluster, role.RoleRules)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := makeSharedClusterRole(sharedName, role)
+		if err != nil {
+			return nil, err
+		}
+		owner := ownerRef(bindingKind, genName)
+		objects = append(objects,
+			shared,
+			roleBinding(genName, genName, sharedName, nil),
+			makeServiceAccount(namespace, genName, role, owner),
+		)
+	case role.generatesRole():
+		k8sRole, err := makeRole(namespace, genName, role)
+		if err != nil {
+			return nil, err
+		}
+		owner := ownerRef(role.K8sRoleType, genName)
+		objects = append(objects,
+			k8sRole,
+			roleBinding(genName, genName, genName, &owner),
+			makeServiceAccount(namespace, genName, role, owner),
+		)
+	default:
+		return nil, fmt.Errorf("one of service_account_name, kubernetes_role_name, or generated_role_rules must be set")
+	}
+	if bindingErr != nil {
+		return nil, bindingErr
+	}
+	if role.TokenType == tokenTypeSecret {
+		objects = append(objects, makeTokenSecret(namespace, secretName, serviceAccountName, role))
+	}
+
+	specs := make([]map[string]interface{}, 0, len(objects))
+	for _, obj := range objects {
+		spec, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %T: %w", obj, err)
+		}
+		specs = append(specs, spec)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":                   true,
+			"service_account_namespace": namespace,
+			"service_account_name":      serviceAccountName,
+			"audiences":                 audiences,
+			"ttl":                       int64(ttl.Seconds()),
+			"objects":                   specs,
+		},
+	}
+	if len(reqPayload.Metadata) > 0 {
+		resp.Data["metadata"] = reqPayload.Metadata
+	}
+	if len(warnings) > 0 {
+		resp.Warnings = warnings
+	}
+	return resp, nil
+}
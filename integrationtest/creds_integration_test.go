@@ -232,14 +232,37 @@ func TestCreds_service_account_name(t *testing.T) {
 		"extra_labels":                          nil,
 		"extra_annotations":                     nil,
 		"generated_role_rules":                  "",
+		"generated_role_rules_file":             "",
+		"generated_aggregation_rule":            "",
 		"kubernetes_role_name":                  "",
 		"kubernetes_role_type":                  "Role",
 		"name":                                  "testrole",
 		"name_template":                         "",
+		"name_include_namespace":                false,
+		"name_prefix":                           "",
+		"shared_cluster_role":                   false,
+		"combine_rules":                         false,
+		"max_active_tokens":                     zero,
+		"token_response_key":                    "service_account_token",
+		"token_type":                            "bound",
+		"token_secret_name_template":            "",
+		"create_namespace":                      false,
+		"allow_cluster_role_binding":            true,
+		"additional_subjects":                   "",
+		"kubernetes_cluster":                    "",
+		"kubernetes_role_binding_name":          "",
 		"service_account_name":                  "sample-app",
 		"token_max_ttl":                         oneDay,
 		"token_default_ttl":                     oneHour,
+		"token_ttl":                             oneHour,
 		"token_default_audiences":               nil,
+		"allowed_audiences":                     nil,
+		"denied_kubernetes_namespaces":          nil,
+		"role_finalizers":                       nil,
+		"role_binding_finalizers":               nil,
+		"force_remove_finalizers":               false,
+		"annotate_lease_id":                     false,
+		"default_namespace":                     "",
 	}, roleResponse.Data)
 
 	result1, err := client.Logical().Write(path+"/creds/testrole", map[string]interface{}{
@@ -310,14 +333,37 @@ func TestCreds_kubernetes_role_name(t *testing.T) {
 			"extra_annotations":                     asMapInterface(extraAnnotations),
 			"extra_labels":                          asMapInterface(extraLabels),
 			"generated_role_rules":                  "",
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "test-role-list-pods",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "testrole",
 			"name_template":                         `{{ printf "v-custom-name-%s" (random 24) | truncate 62 | lowercase }}`,
+			"name_include_namespace":                false,
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     zero,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         oneDay,
 			"token_default_ttl":                     oneHour,
+			"token_ttl":                             oneHour,
 			"token_default_audiences":               nil,
+			"allowed_audiences":                     nil,
+			"denied_kubernetes_namespaces":          nil,
+			"role_finalizers":                       nil,
+			"role_binding_finalizers":               nil,
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}
 		testRoleType(t, client, path, roleConfig, expectedRoleResponse)
 	})
@@ -345,14 +391,37 @@ func TestCreds_kubernetes_role_name(t *testing.T) {
 			"extra_annotations":                     asMapInterface(extraAnnotations),
 			"extra_labels":                          asMapInterface(extraLabels),
 			"generated_role_rules":                  "",
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "test-cluster-role-list-pods",
 			"kubernetes_role_type":                  "ClusterRole",
 			"name":                                  "clusterrole",
 			"name_template":                         "",
+			"name_include_namespace":                false,
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     zero,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         oneDay,
 			"token_default_ttl":                     oneHour,
+			"token_ttl":                             oneHour,
 			"token_default_audiences":               nil,
+			"allowed_audiences":                     nil,
+			"denied_kubernetes_namespaces":          nil,
+			"role_finalizers":                       nil,
+			"role_binding_finalizers":               nil,
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}
 		testClusterRoleType(t, client, path, roleConfig, expectedRoleResponse)
 	})
@@ -415,14 +484,37 @@ func TestCreds_generated_role_rules(t *testing.T) {
 			"extra_annotations":                     asMapInterface(extraAnnotations),
 			"extra_labels":                          asMapInterface(extraLabels),
 			"generated_role_rules":                  roleRulesYAML,
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "testrole",
 			"name_template":                         "",
+			"name_include_namespace":                false,
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     zero,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         oneDay,
 			"token_default_ttl":                     oneHour,
+			"token_ttl":                             oneHour,
 			"token_default_audiences":               nil,
+			"allowed_audiences":                     nil,
+			"denied_kubernetes_namespaces":          nil,
+			"role_finalizers":                       nil,
+			"role_binding_finalizers":               nil,
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}
 		testRoleType(t, client, path, roleConfig, expectedRoleResponse)
 	})
@@ -451,14 +543,37 @@ func TestCreds_generated_role_rules(t *testing.T) {
 			"extra_annotations":                     asMapInterface(extraAnnotations),
 			"extra_labels":                          asMapInterface(extraLabels),
 			"generated_role_rules":                  roleRulesJSON,
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "",
 			"kubernetes_role_type":                  "ClusterRole",
 			"name":                                  "clusterrole",
 			"name_template":                         "",
+			"name_include_namespace":                false,
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     zero,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         oneDay,
 			"token_default_ttl":                     oneHour,
+			"token_ttl":                             oneHour,
 			"token_default_audiences":               nil,
+			"allowed_audiences":                     nil,
+			"denied_kubernetes_namespaces":          nil,
+			"role_finalizers":                       nil,
+			"role_binding_finalizers":               nil,
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}
 		testClusterRoleType(t, client, path, roleConfig, expectedRoleResponse)
 	})
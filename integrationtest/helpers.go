@@ -13,6 +13,7 @@ import (
 	"time"
 
 	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
 	"github.com/hashicorp/vault/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,6 +31,14 @@ var standardLabels = map[string]string{
 	"app.kubernetes.io/created-by": "vault-plugin-secrets-kubernetes",
 }
 
+// managedLabels are set on generated objects to identify the mount and Vault
+// role that created them
+var managedLabels = []string{
+	"vault.hashicorp.com/mount-id",
+	"vault.hashicorp.com/mount-accessor",
+	"vault.hashicorp.com/role",
+}
+
 func randomWithPrefix(name string) string {
 	return fmt.Sprintf("%s-%d", name, rand.New(rand.NewSource(time.Now().UnixNano())).Int())
 }
@@ -53,7 +62,7 @@ func newK8sClient(t *testing.T, token string) kubernetes.Interface {
 func verifyCredsResponseGenerated(t *testing.T, result *api.Secret, namespace string, leaseDuration int, name string) {
 	t.Helper()
 	assert.Equal(t, leaseDuration, result.LeaseDuration)
-	assert.Equal(t, false, result.Renewable)
+	assert.Equal(t, true, result.Renewable)
 	assert.Contains(t, result.Data["service_account_name"], name)
 	assert.Equal(t, namespace, result.Data["service_account_namespace"])
 }
@@ -62,9 +71,10 @@ func verifyCredsResponseGenerated(t *testing.T, result *api.Secret, namespace st
 func verifyCredsResponse(t *testing.T, result *api.Secret, namespace, serviceAccount string, leaseDuration int) {
 	t.Helper()
 	assert.Equal(t, leaseDuration, result.LeaseDuration)
-	assert.Equal(t, false, result.Renewable)
+	assert.Equal(t, true, result.Renewable)
 	assert.Equal(t, serviceAccount, result.Data["service_account_name"])
 	assert.Equal(t, namespace, result.Data["service_account_namespace"])
+	assert.NotContains(t, result.Data, "created_service_account")
 }
 
 // If it's a token that's bound to a Role, test listing pods in the response's
@@ -121,6 +131,8 @@ func verifyRole(t *testing.T, roleConfig map[string]interface{}, credsResponse *
 	// or ClusterRole
 	roleName := credsResponse.Data["service_account_name"].(string)
 	roleType := strings.ToLower(roleConfig["kubernetes_role_type"].(string))
+	assert.Equal(t, roleName, credsResponse.Data["created_role"])
+	assert.Equal(t, roleConfig["kubernetes_role_type"], credsResponse.Data["created_role_type"])
 
 	expectedLabels := makeExpectedLabels(t, roleConfig["extra_labels"].(map[string]interface{}))
 	expectedAnnotations := asMapString(roleConfig["extra_annotations"].(map[string]interface{}))
@@ -145,7 +157,7 @@ func verifyRole(t *testing.T, roleConfig map[string]interface{}, credsResponse *
 		returnedAnnotations = clusterRole.Annotations
 		returnedRules = clusterRole.Rules
 	}
-	assert.Equal(t, expectedLabels, returnedLabels)
+	assert.Equal(t, expectedLabels, withoutManagedLabels(returnedLabels))
 	assert.Equal(t, expectedAnnotations, returnedAnnotations)
 	assert.Equal(t, expectedRules, returnedRules)
 }
@@ -157,6 +169,7 @@ func verifyBinding(t *testing.T, roleConfig map[string]interface{}, credsRespons
 	// service_account_name that is return from creds/ is the same as the Role
 	// or ClusterRole
 	objName := credsResponse.Data["service_account_name"].(string)
+	assert.Equal(t, objName, credsResponse.Data["created_role_binding"])
 
 	expectedLabels := makeExpectedLabels(t, roleConfig["extra_labels"].(map[string]interface{}))
 	expectedAnnotations := asMapString(roleConfig["extra_annotations"].(map[string]interface{}))
@@ -186,7 +199,7 @@ func verifyBinding(t *testing.T, roleConfig map[string]interface{}, credsRespons
 		returnedAnnotations = binding.Annotations
 		returnedSubjects = binding.Subjects
 	}
-	assert.Equal(t, expectedLabels, returnedLabels)
+	assert.Equal(t, expectedLabels, withoutManagedLabels(returnedLabels))
 	assert.Equal(t, expectedAnnotations, returnedAnnotations)
 	assert.Equal(t, expectedSubjects, returnedSubjects)
 }
@@ -198,6 +211,7 @@ func verifyServiceAccount(t *testing.T, roleConfig map[string]interface{}, creds
 	// service_account_name that is return from creds/ is the same as the Role
 	// or ClusterRole
 	objName := credsResponse.Data["service_account_name"].(string)
+	assert.Equal(t, objName, credsResponse.Data["created_service_account"])
 
 	expectedLabels := makeExpectedLabels(t, roleConfig["extra_labels"].(map[string]interface{}))
 	expectedAnnotations := asMapString(roleConfig["extra_annotations"].(map[string]interface{}))
@@ -208,7 +222,7 @@ func verifyServiceAccount(t *testing.T, roleConfig map[string]interface{}, creds
 	returnedLabels := acct.Labels
 	returnedAnnotations := acct.Annotations
 
-	assert.Equal(t, expectedLabels, returnedLabels)
+	assert.Equal(t, expectedLabels, withoutManagedLabels(returnedLabels))
 	assert.Equal(t, expectedAnnotations, returnedAnnotations)
 }
 
@@ -436,6 +450,18 @@ func makeExpectedLabels(t *testing.T, extraLabels map[string]interface{}) map[st
 	return expectedLabels
 }
 
+// withoutManagedLabels returns the labels without the labels identifying the
+// mount and Vault role, whose values differ for each test
+func withoutManagedLabels(labels map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range labels {
+		if !strutil.StrListContains(managedLabels, k) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
 func asMapInterface(m map[string]string) map[string]interface{} {
 	result := map[string]interface{}{}
 	for k, v := range m {
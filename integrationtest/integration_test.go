@@ -105,7 +105,7 @@ func TestConfig(t *testing.T) {
 	_, err = client.Logical().Write(path+"/config", map[string]interface{}{
 		"disable_local_ca_jwt": true,
 		"kubernetes_ca_cert":   "cert",
-		"kubernetes_host":      "host",
+		"kubernetes_host":      "https://host",
 		"service_account_jwt":  "jwt",
 	})
 	assert.NoError(t, err)
@@ -113,23 +113,93 @@ func TestConfig(t *testing.T) {
 	result, err := client.Logical().Read(path + "/config")
 	assert.NoError(t, err)
 	assert.Equal(t, map[string]interface{}{
-		"disable_local_ca_jwt": true,
-		"kubernetes_ca_cert":   "cert",
-		"kubernetes_host":      "host",
+		"disable_local_ca_jwt":               true,
+		"impersonate_groups":                 nil,
+		"impersonate_user":                   "",
+		"jwt_rotation_period":                json.Number("0"),
+		"kubernetes_ca_cert":                 "cert",
+		"kubernetes_ca_cert_file":            "",
+		"kubernetes_host":                    "https://host",
+		"kubernetes_proxy_url":               "",
+		"protected_namespaces":               nil,
+		"next_jwt_rotation":                  "",
+		"kubernetes_tls_server_name":         "",
+		"max_concurrent_creds":               json.Number("0"),
+		"max_token_ttl":                      json.Number("0"),
+		"max_ttl":                            json.Number("0"),
+		"min_token_ttl":                      json.Number("0"),
+		"min_ttl_behavior":                   "raise",
+		"namespace_cache_ttl":                nil,
+		"kubernetes_api_burst":               json.Number("10"),
+		"kubernetes_api_qps":                 json.Number("5"),
+		"kubernetes_api_timeout":             json.Number("30"),
+		"kubernetes_api_retry_base_delay_ms": json.Number("200"),
+		"kubernetes_api_max_retries":         json.Number("3"),
+		"require_resource_names_for_verbs":   nil,
+		"require_token_max_ttl":              false,
+		"allowed_role_types":                 nil,
+		"allowed_verbs":                      nil,
+		"allowed_resources":                  nil,
+		"client_certificate":                 "",
+		"default_ttl":                        json.Number("0"),
+		"strict_role_rules":                  false,
+		"block_owner_deletion":               false,
+		"controller_owner_references":        false,
+		"forbid_wildcard_rules":              false,
+		"absolute_max_ttl":                   json.Number("0"),
+		"reject_metadata_conflicts":          false,
+		"rely_on_owner_gc":                   false,
+		"allowed_role_rules_paths":           nil,
+		"revoke_grace_period_seconds":        nil,
 	}, result.Data)
 
 	// update
 	_, err = client.Logical().Write(path+"/config", map[string]interface{}{
-		"kubernetes_host": "another-host",
+		"kubernetes_host": "https://another-host",
 	})
 	assert.NoError(t, err)
 
 	result, err = client.Logical().Read(path + "/config")
 	assert.NoError(t, err)
 	assert.Equal(t, map[string]interface{}{
-		"disable_local_ca_jwt": true,
-		"kubernetes_ca_cert":   "cert",
-		"kubernetes_host":      "another-host",
+		"disable_local_ca_jwt":               true,
+		"impersonate_groups":                 nil,
+		"impersonate_user":                   "",
+		"jwt_rotation_period":                json.Number("0"),
+		"kubernetes_ca_cert":                 "cert",
+		"kubernetes_ca_cert_file":            "",
+		"kubernetes_host":                    "https://another-host",
+		"kubernetes_proxy_url":               "",
+		"protected_namespaces":               nil,
+		"next_jwt_rotation":                  "",
+		"kubernetes_tls_server_name":         "",
+		"max_concurrent_creds":               json.Number("0"),
+		"max_token_ttl":                      json.Number("0"),
+		"max_ttl":                            json.Number("0"),
+		"min_token_ttl":                      json.Number("0"),
+		"min_ttl_behavior":                   "raise",
+		"namespace_cache_ttl":                nil,
+		"kubernetes_api_burst":               json.Number("10"),
+		"kubernetes_api_qps":                 json.Number("5"),
+		"kubernetes_api_timeout":             json.Number("30"),
+		"kubernetes_api_retry_base_delay_ms": json.Number("200"),
+		"kubernetes_api_max_retries":         json.Number("3"),
+		"require_resource_names_for_verbs":   nil,
+		"require_token_max_ttl":              false,
+		"allowed_role_types":                 nil,
+		"allowed_verbs":                      nil,
+		"allowed_resources":                  nil,
+		"client_certificate":                 "",
+		"default_ttl":                        json.Number("0"),
+		"strict_role_rules":                  false,
+		"block_owner_deletion":               false,
+		"controller_owner_references":        false,
+		"forbid_wildcard_rules":              false,
+		"absolute_max_ttl":                   json.Number("0"),
+		"reject_metadata_conflicts":          false,
+		"rely_on_owner_gc":                   false,
+		"allowed_role_rules_paths":           nil,
+		"revoke_grace_period_seconds":        nil,
 	}, result.Data)
 
 	// delete
@@ -174,14 +244,37 @@ func TestRole(t *testing.T) {
 		"extra_annotations":                     nil,
 		"extra_labels":                          nil,
 		"generated_role_rules":                  sampleRules,
+		"generated_role_rules_file":             "",
+		"generated_aggregation_rule":            "",
 		"kubernetes_role_name":                  "",
 		"kubernetes_role_type":                  "Role",
 		"name":                                  "testrole",
 		"name_template":                         "",
+		"name_prefix":                           "",
+		"shared_cluster_role":                   false,
+		"combine_rules":                         false,
+		"max_active_tokens":                     json.Number("0"),
+		"name_include_namespace":                false,
+		"token_response_key":                    "service_account_token",
+		"token_type":                            "bound",
+		"token_secret_name_template":            "",
+		"create_namespace":                      false,
+		"allow_cluster_role_binding":            true,
+		"additional_subjects":                   "",
+		"kubernetes_cluster":                    "",
+		"kubernetes_role_binding_name":          "",
 		"service_account_name":                  "",
 		"token_max_ttl":                         oneDay,
 		"token_default_ttl":                     oneHour,
+		"token_ttl":                             oneHour,
 		"token_default_audiences":               []interface{}{"foobar"},
+		"allowed_audiences":                     nil,
+		"denied_kubernetes_namespaces":          nil,
+		"role_finalizers":                       nil,
+		"role_binding_finalizers":               nil,
+		"force_remove_finalizers":               false,
+		"annotate_lease_id":                     false,
+		"default_namespace":                     "",
 	}, result.Data)
 
 	// update
@@ -201,14 +294,37 @@ func TestRole(t *testing.T) {
 		"extra_annotations":                     asMapInterface(sampleExtraAnnotations),
 		"extra_labels":                          asMapInterface(sampleExtraLabels),
 		"generated_role_rules":                  sampleRules,
+		"generated_role_rules_file":             "",
+		"generated_aggregation_rule":            "",
 		"kubernetes_role_name":                  "",
 		"kubernetes_role_type":                  "Role",
 		"name":                                  "testrole",
 		"name_template":                         "",
+		"name_prefix":                           "",
+		"shared_cluster_role":                   false,
+		"combine_rules":                         false,
+		"max_active_tokens":                     json.Number("0"),
+		"name_include_namespace":                false,
+		"token_response_key":                    "service_account_token",
+		"token_type":                            "bound",
+		"token_secret_name_template":            "",
+		"create_namespace":                      false,
+		"allow_cluster_role_binding":            true,
+		"additional_subjects":                   "",
+		"kubernetes_cluster":                    "",
+		"kubernetes_role_binding_name":          "",
 		"service_account_name":                  "",
 		"token_max_ttl":                         oneDay,
 		"token_default_ttl":                     thirtyMinutes,
+		"token_ttl":                             thirtyMinutes,
 		"token_default_audiences":               []interface{}{"bar"},
+		"allowed_audiences":                     nil,
+		"denied_kubernetes_namespaces":          nil,
+		"role_finalizers":                       nil,
+		"role_binding_finalizers":               nil,
+		"force_remove_finalizers":               false,
+		"annotate_lease_id":                     false,
+		"default_namespace":                     "",
 	}, result.Data)
 
 	// update again
@@ -225,14 +341,37 @@ func TestRole(t *testing.T) {
 		"extra_annotations":                     asMapInterface(sampleExtraAnnotations),
 		"extra_labels":                          asMapInterface(sampleExtraLabels),
 		"generated_role_rules":                  sampleRules,
+		"generated_role_rules_file":             "",
+		"generated_aggregation_rule":            "",
 		"kubernetes_role_name":                  "",
 		"kubernetes_role_type":                  "Role",
 		"name":                                  "testrole",
 		"name_template":                         "",
+		"name_prefix":                           "",
+		"shared_cluster_role":                   false,
+		"combine_rules":                         false,
+		"max_active_tokens":                     json.Number("0"),
+		"name_include_namespace":                false,
+		"token_response_key":                    "service_account_token",
+		"token_type":                            "bound",
+		"token_secret_name_template":            "",
+		"create_namespace":                      false,
+		"allow_cluster_role_binding":            true,
+		"additional_subjects":                   "",
+		"kubernetes_cluster":                    "",
+		"kubernetes_role_binding_name":          "",
 		"service_account_name":                  "",
 		"token_max_ttl":                         oneDay,
 		"token_default_ttl":                     thirtyMinutes,
+		"token_ttl":                             thirtyMinutes,
 		"token_default_audiences":               []interface{}{"bar"},
+		"allowed_audiences":                     nil,
+		"denied_kubernetes_namespaces":          nil,
+		"role_finalizers":                       nil,
+		"role_binding_finalizers":               nil,
+		"force_remove_finalizers":               false,
+		"annotate_lease_id":                     false,
+		"default_namespace":                     "",
 	}, result.Data)
 
 	result, err = client.Logical().List(path + "/roles")
@@ -361,6 +500,7 @@ var (
 )
 
 const (
+	zero          json.Number = "0"
 	thirtyMinutes json.Number = "1800"
 	oneHour       json.Number = "3600"
 	oneDay        json.Number = "86400"
@@ -74,14 +74,37 @@ func TestCreds_wal_rollback(t *testing.T) {
 			"extra_annotations":                     asMapInterface(extraAnnotations),
 			"extra_labels":                          asMapInterface(extraLabels),
 			"generated_role_rules":                  roleRulesYAML,
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "walrole",
 			"name_template":                         "",
+			"name_include_namespace":                false,
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     zero,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         oneDay,
 			"token_default_ttl":                     oneHour,
+			"token_ttl":                             oneHour,
 			"token_default_audiences":               []interface{}{"foobar"},
+			"allowed_audiences":                     nil,
+			"denied_kubernetes_namespaces":          nil,
+			"role_finalizers":                       nil,
+			"role_binding_finalizers":               nil,
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}
 
 		_, err := client.Logical().Write(mountPath+"/roles/walrole", roleConfig)
@@ -148,14 +171,37 @@ func TestCreds_wal_rollback(t *testing.T) {
 			"extra_annotations":                     asMapInterface(extraAnnotations),
 			"extra_labels":                          asMapInterface(extraLabels),
 			"generated_role_rules":                  "",
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "test-cluster-role-list-pods",
 			"kubernetes_role_type":                  "ClusterRole",
 			"name":                                  "walrolebinding",
 			"name_template":                         "",
+			"name_include_namespace":                false,
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     zero,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         oneDay,
 			"token_default_ttl":                     oneHour,
+			"token_ttl":                             oneHour,
 			"token_default_audiences":               []interface{}{"foobar"},
+			"allowed_audiences":                     nil,
+			"denied_kubernetes_namespaces":          nil,
+			"role_finalizers":                       nil,
+			"role_binding_finalizers":               nil,
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}
 
 		_, err := client.Logical().Write(mountPath+"/roles/walrolebinding", roleConfig)
@@ -6,10 +6,30 @@ package kubesecrets
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// cleanupDeleted and cleanupAlreadyDeleted report how each Kubernetes
+	// object was cleaned up on revocation
+	cleanupDeleted        = "deleted"
+	cleanupAlreadyDeleted = "already_deleted"
+	// cleanupReleased reports that a shared ClusterRole was kept, since other
+	// leases are still bound to it
+	cleanupReleased = "released"
+	// cleanupInUse reports that a namespace created by Vault was kept, since
+	// other leases still have objects in it
+	cleanupInUse = "in_use"
+	// cleanupGarbageCollected reports that an object was left to Kubernetes
+	// garbage collection, since its owner was deleted
+	cleanupGarbageCollected = "garbage_collected"
 )
 
 func (b *backend) kubeServiceAccount() *framework.Secret {
@@ -24,48 +44,281 @@ func (b *backend) kubeServiceAccount() *framework.Secret {
 				Type:        framework.TypeString,
 				Description: "Kubernetes Service Account Name",
 			},
-			"service_account_token": {
+			// The token is returned under the role's token_response_key,
+			// which defaults to service_account_token
+			defaultTokenResponseKey: {
 				Type:        framework.TypeString,
-				Description: "Kubernetes Service Account Token",
+				Description: "Kubernetes Service Account Token, returned under the name set by the role's token_response_key",
 			},
 		},
+		Renew:  b.kubeTokenRenew,
 		Revoke: b.kubeTokenRevoke,
 	}
 }
 
-func (b *backend) kubeTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	client, err := b.getClient(ctx, req.Storage)
+// kubeTokenRenew extends the lease by creating a new token for the lease's
+// service account, since a Kubernetes token's expiration can't be extended.
+// The new token is returned in place of the previous one, which stays valid
+// until it expires. A token stored in a Secret doesn't expire, so its lease is
+// extended without a new token.
+func (b *backend) kubeTokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, _ := req.Secret.InternalData["role"].(string)
+	role, err := getRole(ctx, req.Storage, roleName)
 	if err != nil {
 		return nil, err
 	}
+	if role == nil {
+		return nil, fmt.Errorf("role '%s' no longer exists, unable to renew the lease", roleName)
+	}
+
+	namespace, _ := req.Secret.InternalData["service_account_namespace"].(string)
+	serviceAccountName, ok := req.Secret.InternalData["service_account_name"].(string)
+	if !ok {
+		// Leases created before renewal was supported don't have these
+		serviceAccountName, _ = req.Secret.InternalData["created_service_account"].(string)
+		if serviceAccountName == "" {
+			serviceAccountName = role.ServiceAccountName
+		}
+	}
+	audiences := leaseAudiences(req.Secret.InternalData, role)
 
-	namespace := req.Secret.InternalData["service_account_namespace"].(string)
-	isClusterRoleBinding := req.Secret.InternalData["cluster_role_binding"].(bool)
-	k8sServiceAccount := req.Secret.InternalData["created_service_account"].(string)
-	k8sRoleBinding := req.Secret.InternalData["created_role_binding"].(string)
-	k8sRole := req.Secret.InternalData["created_role"].(string)
-	k8sRoleType := req.Secret.InternalData["created_role_type"].(string)
+	// The renewed TTL has the same bounds as the TTL of issued creds, and
+	// can't go past the lease's max TTL
+	var remaining time.Duration
+	if req.Secret.MaxTTL > 0 {
+		remaining = req.Secret.MaxTTL - time.Since(req.Secret.IssueTime)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("the lease has reached its max TTL of %s", req.Secret.MaxTTL)
+		}
+	}
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	cluster, _ := req.Secret.InternalData["kubernetes_cluster"].(string)
+	// The cluster's bounds only apply to tokens that expire, which depends on
+	// how the lease's token was issued, not on the role's current token_type
+	role.TokenType = tokenTypeBound
+	if tokenSecret, _ := req.Secret.InternalData["created_token_secret"].(string); tokenSecret != "" {
+		role.TokenType = tokenTypeSecret
+	}
+	ttls, err := b.leaseTTL(ctx, req.Storage, role, config, cluster, req.Secret.Increment, remaining)
+	if err != nil {
+		return nil, err
+	}
+	if ttls.rejected != "" {
+		return nil, fmt.Errorf("unable to renew the lease: %s", ttls.rejected)
+	}
+	ttl := ttls.ttl
 
-	var errs *multierror.Error
-	if k8sRole != "" {
-		if err := client.deleteRole(ctx, namespace, k8sRole, k8sRoleType); err != nil {
-			errs = multierror.Append(fmt.Errorf("failed to delete %s '%s/%s': %s", k8sRoleType, namespace, k8sRole, err))
+	// A token stored in a Secret doesn't expire, so only the lease is extended
+	if tokenSecret, _ := req.Secret.InternalData["created_token_secret"].(string); tokenSecret != "" {
+		indexID, _ := req.Secret.InternalData["index_id"].(string)
+		if err := extendCredsIndexEntry(ctx, req.Storage, indexID, ttl); err != nil {
+			return nil, err
 		}
+		resp := &logical.Response{Secret: req.Secret}
+		resp.Secret.TTL = ttl
+		return resp, nil
 	}
-	if k8sRoleBinding != "" {
-		if err := client.deleteRoleBinding(ctx, namespace, k8sRoleBinding, isClusterRoleBinding); err != nil {
-			roleType := "RoleBinding"
-			if isClusterRoleBinding {
-				roleType = "ClusterRoleBinding"
+
+	client, err := b.getClient(ctx, req.Storage, cluster)
+	if err != nil {
+		return nil, err
+	}
+	boundObjectRef := leaseBoundObjectRef(req.Secret.InternalData)
+	requested := time.Now()
+	status, err := client.createToken(ctx, namespace, serviceAccountName, ttl, audiences, boundObjectRef)
+	switch {
+	case k8s_errors.IsNotFound(err) && boundObjectRef != nil:
+		return nil, fmt.Errorf("service account '%s/%s' or bound object %s '%s/%s' no longer exists, unable to renew the lease", namespace, serviceAccountName, boundObjectRef.Kind, namespace, boundObjectRef.Name)
+	case k8s_errors.IsNotFound(err):
+		return nil, fmt.Errorf("service account '%s/%s' no longer exists, unable to renew the lease", namespace, serviceAccountName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a service account token for %s/%s: %s", namespace, serviceAccountName, err)
+	}
+	// Kubernetes may issue a token with a shorter TTL than requested
+	if grantedTTL := grantedTokenTTL(status, requested); grantedTTL < ttl-tokenTTLTolerance {
+		ttl = grantedTTL
+	}
+
+	indexID, _ := req.Secret.InternalData["index_id"].(string)
+	if err := extendCredsIndexEntry(ctx, req.Storage, indexID, ttl); err != nil {
+		return nil, err
+	}
+
+	tokenResponseKey := role.TokenResponseKey
+	if tokenResponseKey == "" {
+		tokenResponseKey = defaultTokenResponseKey
+	}
+	resp := &logical.Response{
+		Secret: req.Secret,
+		Data: map[string]interface{}{
+			"service_account_namespace":        namespace,
+			"service_account_name":             serviceAccountName,
+			"audiences":                        audiences,
+			tokenResponseKey:                   status.Token,
+			"service_account_token_expiration": status.ExpirationTimestamp.Format(time.RFC3339),
+		},
+	}
+	resp.Secret.TTL = ttl
+	return resp, nil
+}
+
+// leaseAudiences returns the audiences of the lease's tokens, which are the
+// role's default audiences if the lease doesn't record them
+func leaseAudiences(internalData map[string]interface{}, role *roleEntry) []string {
+	if audiences, ok := leaseStrings(internalData, "audiences"); ok {
+		return audiences
+	}
+	return role.defaultAudiences()
+}
+
+// leaseStrings returns the list of strings stored in the lease's internal data
+// under the key, and false if it isn't set
+func leaseStrings(internalData map[string]interface{}, key string) ([]string, bool) {
+	switch values := internalData[key].(type) {
+	case []string:
+		return values, true
+	case []interface{}:
+		// Decoded from the stored lease
+		decoded := make([]string, 0, len(values))
+		for _, value := range values {
+			if value, ok := value.(string); ok {
+				decoded = append(decoded, value)
 			}
-			errs = multierror.Append(errs, fmt.Errorf("failed to delete %s '%s/%s: %s", roleType, namespace, k8sRoleBinding, err))
 		}
+		return decoded, true
 	}
-	if k8sServiceAccount != "" {
-		if err := client.deleteServiceAccount(ctx, namespace, k8sServiceAccount); err != nil {
-			errs = multierror.Append(fmt.Errorf("failed to delete ServiceAccount '%s/%s': %s", namespace, k8sServiceAccount, err))
+	return nil, false
+}
+
+// leaseBoundObjectRef returns the object the lease's tokens are bound to, or
+// nil if they aren't bound to one
+func leaseBoundObjectRef(internalData map[string]interface{}) *authenticationv1.BoundObjectReference {
+	boundObjectName, _ := internalData["bound_object_name"].(string)
+	if boundObjectName == "" {
+		return nil
+	}
+	boundObjectKind, _ := internalData["bound_object_kind"].(string)
+	boundObjectUID, _ := internalData["bound_object_uid"].(string)
+	return &authenticationv1.BoundObjectReference{
+		Kind:       boundObjectKind,
+		APIVersion: "v1",
+		Name:       boundObjectName,
+		UID:        types.UID(boundObjectUID),
+	}
+}
+
+func (b *backend) kubeTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	cleanup, err := b.revokeCreds(ctx, req.Storage, req.Secret.InternalData)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: cleanup,
+	}, nil
+}
+
+// revokeCreds deletes the Kubernetes objects created for a lease with the
+// given internal data, and reports whether each one was deleted or was
+// already gone
+func (b *backend) revokeCreds(ctx context.Context, s logical.Storage, internalData map[string]interface{}) (map[string]interface{}, error) {
+	roleName, _ := internalData["role"].(string)
+	cleanup, err := b.deleteLeaseObjects(ctx, s, internalData)
+	if err != nil {
+		emitRevokeMetric("revoke_failed", roleName)
+		return nil, err
+	}
+	emitRevokeMetric("revoked", roleName)
+	return cleanup, nil
+}
+
+// leaseObjects returns the Kubernetes objects created for a lease with the
+// given internal data. Leases created by older versions of the plugin may lack
+// any of these, in which case there is no object of that kind.
+func leaseObjects(internalData map[string]interface{}) *pendingCleanup {
+	objects := &pendingCleanup{}
+	objects.Namespace, _ = internalData["service_account_namespace"].(string)
+	objects.ClusterRoleBinding, _ = internalData["cluster_role_binding"].(bool)
+	objects.ServiceAccount, _ = internalData["created_service_account"].(string)
+	objects.RoleBinding, _ = internalData["created_role_binding"].(string)
+	objects.BaseRoleBinding, _ = internalData["created_base_role_binding"].(string)
+	objects.Role, _ = internalData["created_role"].(string)
+	objects.RoleType, _ = internalData["created_role_type"].(string)
+	objects.SharedClusterRole, _ = internalData["shared_cluster_role"].(string)
+	objects.TokenSecret, _ = internalData["created_token_secret"].(string)
+	objects.IndexID, _ = internalData["index_id"].(string)
+	objects.Cluster, _ = internalData["kubernetes_cluster"].(string)
+	objects.RemoveFinalizers, _ = leaseStrings(internalData, "remove_finalizers")
+	if objects.Role != "" && objects.RoleType == "" {
+		// Roles default to kubernetes_role_type Role
+		objects.RoleType = "Role"
+	}
+	return objects
+}
+
+func (b *backend) deleteLeaseObjects(ctx context.Context, s logical.Storage, internalData map[string]interface{}) (map[string]interface{}, error) {
+	objects := leaseObjects(internalData)
+	// The objects of a lease whose index entry is gone were already cleaned
+	// up, e.g. in the background or when its role was deleted, so its
+	// reference to a shared ClusterRole must not be released again
+	if objects.IndexID != "" && objects.SharedClusterRole != "" {
+		entry, err := getCredsIndexEntry(ctx, s, objects.IndexID)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			objects.SharedClusterRole = ""
 		}
 	}
 
-	return nil, errs.ErrorOrNil()
+	client, err := b.getClient(ctx, s, objects.Cluster)
+	if err != nil {
+		return nil, b.revokeFailed(ctx, s, objects, err)
+	}
+
+	cleanup, err := b.deleteObjects(ctx, s, client, objects, client.relyOnOwnerGC)
+	if err != nil {
+		return nil, b.revokeFailed(ctx, s, objects, err)
+	}
+
+	if err := b.removeCredsIndexEntry(ctx, s, objects.IndexID); err != nil {
+		return nil, err
+	}
+	// A previous revoke attempt may have queued these objects for cleanup
+	if err := s.Delete(ctx, objects.key()); err != nil {
+		return nil, err
+	}
+
+	// The lease's index entry is gone, so the namespace is only kept if other
+	// leases still have objects in it
+	if deleteNamespace, _ := internalData["delete_created_namespace"].(bool); deleteNamespace {
+		result, err := b.deleteCreatedNamespace(ctx, s, client, objects.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if result != "" {
+			cleanup["Namespace"] = result
+		}
+	}
+
+	return cleanup, nil
+}
+
+// revokeFailed queues the lease's objects to be deleted in the background,
+// so they're eventually cleaned up even if Vault gives up on the revocation.
+// The original error is returned so that Vault still retries the revoke.
+func (b *backend) revokeFailed(ctx context.Context, s logical.Storage, objects *pendingCleanup, cause error) error {
+	// The failure may be due to the namespace having been deleted or changed
+	// since it was cached
+	b.forgetNamespace(objects.Cluster, objects.Namespace)
+	if objects.isEmpty() {
+		return cause
+	}
+	if err := b.enqueueCleanup(ctx, s, objects, cause); err != nil {
+		return multierror.Append(cause, fmt.Errorf("failed to queue objects for cleanup: %w", err))
+	}
+	return cause
 }
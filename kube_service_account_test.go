@@ -0,0 +1,447 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testRevoke(t *testing.T, b *backend, s logical.Storage, internalData map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.kubeTokenRevoke(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret: &logical.Secret{
+			InternalData: internalData,
+		},
+	}, nil)
+}
+
+func TestRevoke_cleanupReport(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	// The RoleBinding is missing, as if it had been garbage collected
+	_, err := fakeClient.RbacV1().Roles("app1").Create(ctx, &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "v-token-test", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "v-token-test", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	resp, err := testRevoke(t, b, s, map[string]interface{}{
+		"role":                      "test",
+		"service_account_namespace": "app1",
+		"cluster_role_binding":      false,
+		"created_service_account":   "v-token-test",
+		"created_role_binding":      "v-token-test",
+		"created_role":              "v-token-test",
+		"created_role_type":         "Role",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"Role":           cleanupDeleted,
+		"RoleBinding":    cleanupAlreadyDeleted,
+		"ServiceAccount": cleanupDeleted,
+	}, resp.Data)
+
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, "v-token-test", metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+}
+
+func TestRevoke_legacyLease(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	_, err := fakeClient.RbacV1().Roles("app1").Create(ctx, &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "v-token-test", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = fakeClient.RbacV1().RoleBindings("app1").Create(ctx, &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "v-token-test", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "v-token-test", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// A lease without cluster_role_binding, created_role_type or any of the
+	// fields added since
+	lease := map[string]interface{}{
+		"role":                      "test",
+		"service_account_namespace": "app1",
+		"created_service_account":   "v-token-test",
+		"created_role_binding":      "v-token-test",
+		"created_role":              "v-token-test",
+	}
+	resp, err := testRevoke(t, b, s, lease)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"Role":           cleanupDeleted,
+		"RoleBinding":    cleanupDeleted,
+		"ServiceAccount": cleanupDeleted,
+	}, resp.Data)
+
+	// Revoking it again succeeds, since its objects are already gone
+	resp, err = testRevoke(t, b, s, lease)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"Role":           cleanupAlreadyDeleted,
+		"RoleBinding":    cleanupAlreadyDeleted,
+		"ServiceAccount": cleanupAlreadyDeleted,
+	}, resp.Data)
+
+	// A lease for an existing service account has nothing to delete
+	resp, err = testRevoke(t, b, s, map[string]interface{}{
+		"role":                      "test",
+		"service_account_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Data)
+}
+
+func TestRevoke_concurrentDeletes(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	createObjects := func(name string) {
+		t.Helper()
+		_, err := fakeClient.RbacV1().Roles("app1").Create(ctx, &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app1"},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		_, err = fakeClient.RbacV1().RoleBindings("app1").Create(ctx, &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app1"},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		_, err = fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app1"},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	lease := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"role":                      "test",
+			"service_account_namespace": "app1",
+			"cluster_role_binding":      false,
+			"created_service_account":   name,
+			"created_role_binding":      name,
+			"created_role":              name,
+			"created_role_type":         "Role",
+		}
+	}
+
+	t.Run("all deleted", func(t *testing.T) {
+		createObjects("v-token-all")
+		resp, err := testRevoke(t, b, s, lease("v-token-all"))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"Role":           cleanupDeleted,
+			"RoleBinding":    cleanupDeleted,
+			"ServiceAccount": cleanupDeleted,
+		}, resp.Data)
+
+		_, err = fakeClient.RbacV1().Roles("app1").Get(ctx, "v-token-all", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+		_, err = fakeClient.RbacV1().RoleBindings("app1").Get(ctx, "v-token-all", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+		_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, "v-token-all", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+	})
+
+	t.Run("errors are combined", func(t *testing.T) {
+		createObjects("v-token-failing")
+		client, err := b.getClient(ctx, s, "")
+		require.NoError(t, err)
+		fakeClient.PrependReactor("delete", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetResource().Resource == "rolebindings" {
+				return false, nil, nil
+			}
+			return true, nil, k8s_errors.NewServiceUnavailable("unavailable")
+		})
+		defer func() { fakeClient.ReactionChain = fakeClient.ReactionChain[1:] }()
+
+		cleanup, err := b.deleteObjects(ctx, s, client, &pendingCleanup{
+			Namespace:      "app1",
+			ServiceAccount: "v-token-failing",
+			RoleBinding:    "v-token-failing",
+			Role:           "v-token-failing",
+			RoleType:       "Role",
+		}, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to delete Role 'app1/v-token-failing': unavailable")
+		assert.Contains(t, err.Error(), "failed to delete ServiceAccount 'app1/v-token-failing': unavailable")
+		assert.Equal(t, map[string]interface{}{"RoleBinding": cleanupDeleted}, cleanup)
+	})
+
+	t.Run("owner deleted last", func(t *testing.T) {
+		createObjects("v-token-owned")
+		client, err := b.getClient(ctx, s, "")
+		require.NoError(t, err)
+
+		fakeClient.ClearActions()
+		cleanup, err := b.deleteObjects(ctx, s, client, &pendingCleanup{
+			Namespace:      "app1",
+			ServiceAccount: "v-token-owned",
+			RoleBinding:    "v-token-owned",
+			Role:           "v-token-owned",
+			RoleType:       "Role",
+			TokenSecret:    "v-token-owned",
+		}, true)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"Role":           cleanupDeleted,
+			"RoleBinding":    cleanupGarbageCollected,
+			"Secret":         cleanupAlreadyDeleted,
+			"ServiceAccount": cleanupGarbageCollected,
+		}, cleanup)
+
+		actions := fakeClient.Actions()
+		require.Len(t, actions, 2)
+		assert.Equal(t, "secrets", actions[0].GetResource().Resource)
+		assert.Equal(t, "roles", actions[1].GetResource().Resource)
+	})
+}
+
+func TestRevoke_pendingCleanup(t *testing.T) {
+	defer func(backoff time.Duration) { pendingCleanupBaseBackoff = backoff }(pendingCleanupBaseBackoff)
+	pendingCleanupBaseBackoff = 0
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	_, err := fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "v-token-test", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	failDeletes := true
+	fakeClient.PrependReactor("delete", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failDeletes {
+			return true, nil, k8s_errors.NewServiceUnavailable("unavailable")
+		}
+		return false, nil, nil
+	})
+
+	internalData := map[string]interface{}{
+		"role":                      "test",
+		"service_account_namespace": "app1",
+		"cluster_role_binding":      false,
+		"created_service_account":   "v-token-test",
+		"created_role_binding":      "",
+		"created_role":              "",
+		"created_role_type":         "",
+	}
+
+	// Repeated failures are tracked in a single entry
+	for i := 0; i < 2; i++ {
+		_, err = testRevoke(t, b, s, internalData)
+		require.Error(t, err)
+	}
+	keys, err := s.List(ctx, pendingCleanupPath)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	pending, err := getPendingCleanup(ctx, s, pendingCleanupPath+keys[0])
+	require.NoError(t, err)
+	assert.Equal(t, "v-token-test", pending.ServiceAccount)
+	assert.Equal(t, 2, pending.Attempts)
+	assert.Contains(t, pending.LastError, "unavailable")
+
+	// Still failing, so the entry is kept
+	require.NoError(t, b.drainPendingCleanups(ctx, s))
+	pending, err = getPendingCleanup(ctx, s, pendingCleanupPath+keys[0])
+	require.NoError(t, err)
+	require.NotNil(t, pending)
+	assert.Equal(t, 3, pending.Attempts)
+
+	failDeletes = false
+	require.NoError(t, b.drainPendingCleanups(ctx, s))
+	keys, err = s.List(ctx, pendingCleanupPath)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, "v-token-test", metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+}
+
+func TestRevoke_pendingCleanupRetries(t *testing.T) {
+	defer func(backoff time.Duration) { pendingCleanupBaseBackoff = backoff }(pendingCleanupBaseBackoff)
+	pendingCleanupBaseBackoff = 0
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	fakeClient.PrependReactor("delete", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if strings.HasPrefix(action.(k8stesting.DeleteAction).GetName(), "fail-") {
+			return true, nil, k8s_errors.NewServiceUnavailable("unavailable")
+		}
+		return false, nil, nil
+	})
+	enqueue := func(p *pendingCleanup) {
+		t.Helper()
+		require.NoError(t, b.enqueueCleanup(ctx, s, p, fmt.Errorf("failed")))
+	}
+	pendingKeys := func() []string {
+		t.Helper()
+		keys, err := s.List(ctx, pendingCleanupPath)
+		require.NoError(t, err)
+		return keys
+	}
+
+	t.Run("entries that keep failing don't block the others", func(t *testing.T) {
+		for i := 0; i < maxPendingCleanupsPerRun; i++ {
+			enqueue(&pendingCleanup{Namespace: "app1", ServiceAccount: fmt.Sprintf("fail-%d", i)})
+		}
+		ok := &pendingCleanup{Namespace: "app1", ServiceAccount: "ok"}
+		enqueue(ok)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, b.drainPendingCleanups(ctx, s))
+		}
+		p, err := getPendingCleanup(ctx, s, ok.key())
+		require.NoError(t, err)
+		assert.Nil(t, p)
+		assert.Len(t, pendingKeys(), maxPendingCleanupsPerRun)
+	})
+
+	t.Run("failed entries are given up after max attempts", func(t *testing.T) {
+		for _, key := range pendingKeys() {
+			require.NoError(t, s.Delete(ctx, pendingCleanupPath+key))
+		}
+		p := &pendingCleanup{Namespace: "app1", ServiceAccount: "fail-max"}
+		enqueue(p)
+		p, err := getPendingCleanup(ctx, s, p.key())
+		require.NoError(t, err)
+		p.Attempts = maxPendingCleanupAttempts - 1
+		entry, err := logical.StorageEntryJSON(p.key(), p)
+		require.NoError(t, err)
+		require.NoError(t, s.Put(ctx, entry))
+
+		require.NoError(t, b.drainPendingCleanups(ctx, s))
+		p, err = getPendingCleanup(ctx, s, p.key())
+		require.NoError(t, err)
+		require.NotNil(t, p)
+		assert.Equal(t, maxPendingCleanupAttempts, p.Attempts)
+		require.NoError(t, b.drainPendingCleanups(ctx, s))
+		assert.Empty(t, pendingKeys())
+	})
+
+	t.Run("entries are backed off", func(t *testing.T) {
+		pendingCleanupBaseBackoff = time.Hour
+		p := &pendingCleanup{Namespace: "app1", ServiceAccount: "ok-later"}
+		enqueue(p)
+		require.NoError(t, b.drainPendingCleanups(ctx, s))
+		assert.Len(t, pendingKeys(), 1)
+
+		assert.Equal(t, time.Hour, pendingCleanupBackoff(1))
+		assert.Equal(t, time.Hour, pendingCleanupBackoff(10))
+		pendingCleanupBaseBackoff = time.Minute
+		assert.Equal(t, time.Minute, pendingCleanupBackoff(1))
+		assert.Equal(t, 4*time.Minute, pendingCleanupBackoff(3))
+		assert.Equal(t, pendingCleanupMaxBackoff, pendingCleanupBackoff(maxPendingCleanupAttempts))
+		require.NoError(t, s.Delete(ctx, p.key()))
+		pendingCleanupBaseBackoff = 0
+	})
+
+	t.Run("entries of clusters without a client are skipped", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			enqueue(&pendingCleanup{Namespace: "app1", ServiceAccount: fmt.Sprintf("deleted-%d", i), Cluster: "deleted"})
+		}
+		assert.Error(t, b.drainPendingCleanups(ctx, s))
+		attempts := 0
+		for _, key := range pendingKeys() {
+			p, err := getPendingCleanup(ctx, s, pendingCleanupPath+key)
+			require.NoError(t, err)
+			attempts += p.Attempts
+		}
+		// Only the first entry of the cluster counts a failed attempt
+		assert.Equal(t, 3, attempts)
+	})
+}
+
+func TestRenew(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "renewable", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"token_default_ttl":             "1h",
+		"token_max_ttl":                 "3h",
+		"token_default_audiences":       []string{"foo"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "renewable", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.True(t, resp.Secret.Renewable)
+	token := resp.Data["service_account_token"].(string)
+	name := resp.Data["service_account_name"].(string)
+
+	secret := resp.Secret
+	secret.IssueTime = time.Now()
+	secret.Increment = 2 * time.Hour
+	renew := func(secret *logical.Secret) (*logical.Response, error) {
+		return b.kubeTokenRenew(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    secret,
+		}, nil)
+	}
+
+	resp, err = renew(secret)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, resp.Secret.TTL)
+	assert.Equal(t, name, resp.Data["service_account_name"])
+	assert.NotEqual(t, token, resp.Data["service_account_token"])
+	assert.Equal(t, []string{"foo"}, tokenAudiences(t, resp.Data["service_account_token"].(string)))
+	ttl, err := getTokenTTL(resp.Data["service_account_token"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, ttl)
+	expiration, err := time.Parse(time.RFC3339, resp.Data["service_account_token_expiration"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expiration, 5*time.Second)
+	entry, err := getCredsIndexEntry(ctx, s, secret.InternalData["index_id"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), entry.ExpireTime, time.Minute)
+
+	// Renewals are capped at the lease's max TTL
+	secret.IssueTime = time.Now().Add(-2 * time.Hour)
+	resp, err = renew(secret)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), resp.Secret.TTL.Seconds(), 60)
+
+	secret.IssueTime = time.Now().Add(-4 * time.Hour)
+	_, err = renew(secret)
+	assert.EqualError(t, err, "the lease has reached its max TTL of 3h0m0s")
+
+	// The service account was deleted out-of-band
+	secret.IssueTime = time.Now()
+	require.NoError(t, fakeClient.CoreV1().ServiceAccounts("app1").Delete(ctx, name, metav1.DeleteOptions{}))
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8s_errors.NewNotFound(corev1.Resource("serviceaccounts"), name)
+	})
+	_, err = renew(secret)
+	assert.EqualError(t, err, fmt.Sprintf("service account 'app1/%s' no longer exists, unable to renew the lease", name))
+}
@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// metricName returns the name of a metric of the secrets engine, following
+// the secrets.kubernetes.* convention
+func metricName(parts ...string) []string {
+	return append([]string{"secrets", "kubernetes"}, parts...)
+}
+
+// emitCredsMetric counts the outcome of a creds request, which is "issued" or
+// "failed"
+func emitCredsMetric(outcome, roleName, roleType string) {
+	metrics.IncrCounterWithLabels(metricName("creds", outcome), 1, []metrics.Label{
+		{Name: "role", Value: roleName},
+		{Name: "role_type", Value: roleType},
+	})
+}
+
+// emitRevokeMetric counts the outcome of revoking the objects of a lease,
+// which is "revoked" or "revoke_failed"
+func emitRevokeMetric(outcome, roleName string) {
+	metrics.IncrCounterWithLabels(metricName("creds", outcome), 1, []metrics.Label{
+		{Name: "role", Value: roleName},
+	})
+}
+
+// emitWALRollbackMetric counts the outcome of rolling back a WAL entry of the
+// kind, which is "rollback" or "rollback_failed"
+func emitWALRollbackMetric(outcome, kind string) {
+	metrics.IncrCounterWithLabels(metricName("wal", outcome), 1, []metrics.Label{
+		{Name: "kind", Value: kind},
+	})
+}
+
+// measureAPICall records the latency of a call to the Kubernetes API, and is
+// meant to be deferred at the start of the call
+func measureAPICall(operation string, start time.Time) {
+	metrics.MeasureSinceWithLabels(metricName("api", "latency"), start, []metrics.Label{
+		{Name: "operation", Value: operation},
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(conf, sink)
+	require.NoError(t, err)
+	defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	failToken := false
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !failToken || action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("denied")
+	})
+
+	resp, err := testRoleCreate(t, b, s, "metrics", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "metrics", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	failToken = true
+	_, err = testCredsCreate(t, b, s, "metrics", nil)
+	require.Error(t, err)
+	failToken = false
+
+	resp, err = testCredsCreate(t, b, s, "metrics", nil)
+	require.NoError(t, err)
+	_, err = testRevoke(t, b, s, resp.Secret.InternalData)
+	require.NoError(t, err)
+
+	require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, walServiceAccountKind, map[string]interface{}{
+		"Namespace":  "app1",
+		"Name":       "missing",
+		"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+	}))
+
+	data := sink.Data()
+	require.Len(t, data, 1)
+	counters := make(map[string]int)
+	for key, value := range data[0].Counters {
+		counters[key] = value.Count
+	}
+	assert.Equal(t, map[string]int{
+		"secrets.kubernetes.creds.issued;role=metrics;role_type=Role": 2,
+		"secrets.kubernetes.creds.failed;role=metrics;role_type=Role": 1,
+		"secrets.kubernetes.creds.revoked;role=metrics":               1,
+		"secrets.kubernetes.wal.rollback;kind=serviceAccount":         1,
+	}, counters)
+	assert.Contains(t, data[0].Samples, "secrets.kubernetes.api.latency;operation=create_token")
+	assert.Contains(t, data[0].Samples, "secrets.kubernetes.api.latency;operation=delete_service_account")
+}
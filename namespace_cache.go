@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"time"
+
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// namespaceCacheTTL is how long a namespace looked up by a creds request is
+// cached before it's looked up again, unless the cluster's config sets
+// namespace_cache_ttl
+var namespaceCacheTTL = 10 * time.Second
+
+// namespaceCacheEntry holds the labels of a namespace when it was last looked
+// up, or the error if it was missing or the plugin wasn't allowed to get it
+type namespaceCacheEntry struct {
+	labels  map[string]string
+	err     error
+	expires time.Time
+}
+
+// getNamespace returns the labels of the namespace. The result is cached for
+// the cluster's namespace cache TTL, so most creds requests don't add an API
+// call, unless bypassCache is set. Only a missing namespace or one the plugin
+// isn't allowed to get is cached as an error, other errors are retried by the
+// next request. The lock isn't held during the lookup, so a slow lookup
+// doesn't hold up requests for other namespaces.
+func (b *backend) getNamespace(ctx context.Context, c *client, namespace string, bypassCache bool) (map[string]string, error) {
+	key := c.cluster + "/" + namespace
+	b.namespaceCacheLock.Lock()
+	entry, ok := b.namespaceCache[key]
+	b.namespaceCacheLock.Unlock()
+	if !bypassCache && ok && time.Now().Before(entry.expires) {
+		return entry.labels, entry.err
+	}
+
+	labels, err := c.getNamespaceLabelSet(ctx, namespace)
+	if err != nil && !k8s_errors.IsNotFound(err) && !k8s_errors.IsForbidden(err) {
+		return nil, err
+	}
+	ttl := c.namespaceCacheTTL(namespaceCacheTTL)
+	entry = namespaceCacheEntry{
+		labels:  labels,
+		err:     err,
+		expires: time.Now().Add(ttl),
+	}
+
+	b.namespaceCacheLock.Lock()
+	defer b.namespaceCacheLock.Unlock()
+	if ttl > 0 {
+		b.namespaceCache[key] = entry
+	} else {
+		delete(b.namespaceCache, key)
+	}
+	return entry.labels, entry.err
+}
+
+// namespaceExists returns true if the namespace exists, so creds requests for
+// a missing namespace fail before any object is created. If the plugin isn't
+// allowed to get namespaces, they're assumed to exist.
+func (b *backend) namespaceExists(ctx context.Context, c *client, namespace string, bypassCache bool) (bool, error) {
+	_, err := b.getNamespace(ctx, c, namespace, bypassCache)
+	switch {
+	case k8s_errors.IsNotFound(err):
+		return false, nil
+	case k8s_errors.IsForbidden(err):
+		b.Logger().Debug("not allowed to get namespace, assuming it exists", "namespace", namespace, "error", err)
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// forgetNamespace drops the cached results for a namespace of the cluster
+// that was just created or deleted by the plugin, or whose objects couldn't
+// be revoked, so the next request looks it up again
+func (b *backend) forgetNamespace(cluster, namespace string) {
+	b.namespaceCacheLock.Lock()
+	defer b.namespaceCacheLock.Unlock()
+	delete(b.namespaceCache, cluster+"/"+namespace)
+}
+
+// clearNamespaceCaches drops all cached namespaces, e.g. because the config
+// they were looked up with changed
+func (b *backend) clearNamespaceCaches() {
+	b.namespaceCacheLock.Lock()
+	defer b.namespaceCacheLock.Unlock()
+	b.namespaceCache = make(map[string]namespaceCacheEntry)
+}
@@ -5,19 +5,63 @@ package kubesecrets
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 const (
 	checkPath            = "check"
 	checkHelpSynopsis    = `Checks the Kubernetes configuration is valid.`
-	checkHelpDescription = `Checks the Kubernetes configuration is valid, checking if required environment variables are set.`
+	checkHelpDescription = `Checks the Kubernetes configuration is valid, checking if required environment variables are set
+and that the Kubernetes API has not been rejecting the plugin's credentials. If live is true, a request is made
+to the Kubernetes API instead to check that it's reachable and accepts the plugin's credentials.`
+
+	checkRBACPath            = checkPath + "/rbac"
+	checkRBACHelpSynopsis    = `Checks the plugin's Kubernetes permissions.`
+	checkRBACHelpDescription = `Asks the Kubernetes API whether the plugin's credentials allow the operations needed to
+generate credentials in a namespace, with a SelfSubjectAccessReview for each, and returns whether each
+operation is allowed by resource and verb. ClusterRoles and ClusterRoleBindings are checked cluster-wide.`
+)
+
+// rbacPermission is a Kubernetes API operation the plugin needs to generate
+// credentials
+type rbacPermission struct {
+	group         string
+	resource      string
+	subresource   string
+	verb          string
+	clusterScoped bool
+}
+
+var requiredPermissions = []rbacPermission{
+	{resource: "serviceaccounts", verb: "create"},
+	{resource: "serviceaccounts", verb: "delete"},
+	{resource: "serviceaccounts", subresource: "token", verb: "create"},
+	{group: rbacv1.GroupName, resource: "roles", verb: "create"},
+	{group: rbacv1.GroupName, resource: "roles", verb: "delete"},
+	{group: rbacv1.GroupName, resource: "rolebindings", verb: "create"},
+	{group: rbacv1.GroupName, resource: "rolebindings", verb: "delete"},
+	{group: rbacv1.GroupName, resource: "clusterroles", verb: "create", clusterScoped: true},
+	{group: rbacv1.GroupName, resource: "clusterroles", verb: "delete", clusterScoped: true},
+	{group: rbacv1.GroupName, resource: "clusterrolebindings", verb: "create", clusterScoped: true},
+	{group: rbacv1.GroupName, resource: "clusterrolebindings", verb: "delete", clusterScoped: true},
+}
+
+// Stages of the live check that may fail
+const (
+	checkStageConfig       = "config"
+	checkStageConnectivity = "connectivity"
+	checkStageAuth         = "authentication"
+	checkStageAPI          = "api"
 )
 
 var envVarsToCheck = []string{k8sServiceHostEnv, k8sServicePortEnv}
@@ -30,6 +74,18 @@ func (b *backend) pathCheck() *framework.Path {
 			OperationVerb:   "check",
 			OperationSuffix: "configuration",
 		},
+		Fields: map[string]*framework.FieldSchema{
+			"live": {
+				Type:        framework.TypeBool,
+				Description: "If true, make a request to the Kubernetes API to check connectivity and authentication, rather than checking environment variables.",
+				Query:       true,
+			},
+			"kubernetes_cluster": {
+				Type:        framework.TypeString,
+				Description: "The name of the cluster to check with live, configured at config/<name>. Defaults to the cluster configured at config.",
+				Query:       true,
+			},
+		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
 				Callback: b.pathCheckRead,
@@ -40,7 +96,42 @@ func (b *backend) pathCheck() *framework.Path {
 	}
 }
 
-func (b *backend) pathCheckRead(_ context.Context, _ *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+func (b *backend) pathCheckRBAC() *framework.Path {
+	return &framework.Path{
+		Pattern: checkRBACPath + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "check",
+			OperationSuffix: "rbac",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"kubernetes_namespace": {
+				Type:        framework.TypeString,
+				Description: "The namespace to check the namespaced permissions in.",
+				Required:    true,
+				Query:       true,
+			},
+			"kubernetes_cluster": {
+				Type:        framework.TypeString,
+				Description: "The name of the cluster to check, configured at config/<name>. Defaults to the cluster configured at config.",
+				Query:       true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathCheckRBACRead,
+			},
+		},
+		HelpSynopsis:    checkRBACHelpSynopsis,
+		HelpDescription: checkRBACHelpDescription,
+	}
+}
+
+func (b *backend) pathCheckRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if data != nil && data.Get("live").(bool) {
+		return b.checkLive(ctx, req, data.Get("kubernetes_cluster").(string))
+	}
+
 	var missing []string
 	for _, key := range envVarsToCheck {
 		val := os.Getenv(key)
@@ -49,6 +140,10 @@ func (b *backend) pathCheckRead(_ context.Context, _ *logical.Request, _ *framew
 		}
 	}
 
+	if err := b.credentialsRejected(); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("The Kubernetes API is rejecting the plugin's credentials: %s", err)), nil
+	}
+
 	if len(missing) == 0 {
 		return &logical.Response{
 			Data: map[string]interface{}{
@@ -60,3 +155,105 @@ func (b *backend) pathCheckRead(_ context.Context, _ *logical.Request, _ *framew
 	missingText := strings.Join(missing, ", ")
 	return logical.ErrorResponse(fmt.Sprintf("Missing environment variables: %s", missingText)), nil
 }
+
+// checkLive makes a lightweight request to the Kubernetes API, and reports
+// the stage that failed if it wasn't successful
+func (b *backend) checkLive(ctx context.Context, req *logical.Request, cluster string) (*logical.Response, error) {
+	client, err := b.getClient(ctx, req.Storage, cluster)
+	if err != nil {
+		return checkFailedResponse(checkStageConfig, err), nil
+	}
+
+	if err := client.checkAuth(ctx); err != nil {
+		return checkFailedResponse(checkFailedStage(err), err), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPStatusCode: http.StatusNoContent,
+		},
+	}, nil
+}
+
+func (b *backend) pathCheckRBACRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	namespace := data.Get("kubernetes_namespace").(string)
+	if namespace == "" {
+		return logical.ErrorResponse("kubernetes_namespace must be set"), nil
+	}
+	client, err := b.getClient(ctx, req.Storage, data.Get("kubernetes_cluster").(string))
+	if err != nil {
+		return checkFailedResponse(checkStageConfig, err), nil
+	}
+
+	allowedAll := true
+	permissions := make(map[string]map[string]bool)
+	var warnings []string
+	for _, p := range requiredPermissions {
+		checkNamespace := namespace
+		if p.clusterScoped {
+			checkNamespace = ""
+		}
+		allowed, reason, err := client.checkAccess(ctx, checkNamespace, p.group, p.resource, p.subresource, p.verb)
+		if err != nil {
+			return checkFailedResponse(checkFailedStage(err), err), nil
+		}
+		resource := p.resource
+		if p.subresource != "" {
+			resource += "/" + p.subresource
+		}
+		if permissions[resource] == nil {
+			permissions[resource] = make(map[string]bool)
+		}
+		permissions[resource][p.verb] = allowed
+		if !allowed {
+			allowedAll = false
+			warning := fmt.Sprintf("the plugin is not allowed to %s %s", p.verb, resource)
+			if checkNamespace != "" {
+				warning += fmt.Sprintf(" in namespace '%s'", checkNamespace)
+			}
+			if reason != "" {
+				warning += ": " + reason
+			}
+			warnings = append(warnings, warning)
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"kubernetes_namespace": namespace,
+			"allowed":              allowedAll,
+			"permissions":          permissions,
+		},
+		Warnings: warnings,
+	}, nil
+}
+
+// checkFailedStage returns the stage of a check that failed with the error
+// from the Kubernetes API
+func checkFailedStage(err error) string {
+	var netErr net.Error
+	switch {
+	case k8s_errors.IsUnauthorized(err), k8s_errors.IsForbidden(err):
+		return checkStageAuth
+	case errors.As(err, &netErr):
+		return checkStageConnectivity
+	default:
+		return checkStageAPI
+	}
+}
+
+// checkFailedResponse returns an error response listing the failed stage of
+// the live check
+func checkFailedResponse(stage string, err error) *logical.Response {
+	resp := logical.ErrorResponse(fmt.Sprintf("The Kubernetes API check failed at the %s stage: %s", stage, err))
+	// Error responses may carry additional data under the "data" key
+	resp.Data["data"] = map[string]interface{}{
+		"failures": []map[string]string{
+			{
+				"stage": stage,
+				"error": err.Error(),
+			},
+		},
+	}
+	return resp
+}
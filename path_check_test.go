@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testCheckLive(t *testing.T, b *backend, s logical.Storage) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      checkPath,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"live": true,
+		},
+	})
+	require.NoError(t, err)
+	return resp
+}
+
+func TestCheck_live(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// No config yet
+	resp := testCheckLive(t, b, s)
+	require.Error(t, resp.Error())
+	assert.Equal(t, []map[string]string{{
+		"stage": checkStageConfig,
+		"error": "could not load backend configuration",
+	}}, resp.Data["data"].(map[string]interface{})["failures"])
+
+	testConfigWrite(t, b, s, nil)
+	fakeClient := setupFakeClient(t, b, s)
+
+	var checkErr error
+	fakeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if checkErr != nil {
+			return true, nil, checkErr
+		}
+		return true, &authorizationv1.SelfSubjectAccessReview{}, nil
+	})
+
+	resp = testCheckLive(t, b, s)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, http.StatusNoContent, resp.Data[logical.HTTPStatusCode])
+
+	testCases := map[string]struct {
+		err   error
+		stage string
+	}{
+		"unauthorized": {
+			err:   k8s_errors.NewUnauthorized("token expired"),
+			stage: checkStageAuth,
+		},
+		"unreachable": {
+			err:   &url.Error{Op: "Post", URL: "https://kubernetes.example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+			stage: checkStageConnectivity,
+		},
+		"server error": {
+			err:   k8s_errors.NewInternalError(errors.New("etcd is down")),
+			stage: checkStageAPI,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			checkErr = tc.err
+			resp := testCheckLive(t, b, s)
+			require.Error(t, resp.Error())
+			assert.Equal(t, []map[string]string{{
+				"stage": tc.stage,
+				"error": tc.err.Error(),
+			}}, resp.Data["data"].(map[string]interface{})["failures"])
+		})
+	}
+}
+
+func TestCheck_rbac(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, nil)
+	fakeClient := setupFakeClient(t, b, s)
+
+	var reviews []authorizationv1.ResourceAttributes
+	var reviewErr error
+	fakeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if reviewErr != nil {
+			return true, nil, reviewErr
+		}
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		reviews = append(reviews, *attrs)
+		review.Status.Allowed = attrs.Resource != "clusterroles"
+		if !review.Status.Allowed {
+			review.Status.Reason = "no RBAC policy matched"
+		}
+		return true, review, nil
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      checkRBACPath,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"kubernetes_namespace": "app1",
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, false, resp.Data["allowed"])
+	assert.Equal(t, map[string]map[string]bool{
+		"serviceaccounts":       {"create": true, "delete": true},
+		"serviceaccounts/token": {"create": true},
+		"roles":                 {"create": true, "delete": true},
+		"rolebindings":          {"create": true, "delete": true},
+		"clusterroles":          {"create": false, "delete": false},
+		"clusterrolebindings":   {"create": true, "delete": true},
+	}, resp.Data["permissions"])
+	assert.Equal(t, []string{
+		"the plugin is not allowed to create clusterroles: no RBAC policy matched",
+		"the plugin is not allowed to delete clusterroles: no RBAC policy matched",
+	}, resp.Warnings)
+	require.Len(t, reviews, len(requiredPermissions))
+	for _, attrs := range reviews {
+		if strings.HasPrefix(attrs.Resource, "cluster") {
+			assert.Empty(t, attrs.Namespace, attrs.Resource)
+		} else {
+			assert.Equal(t, "app1", attrs.Namespace, attrs.Resource)
+		}
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      checkRBACPath,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	assert.Error(t, resp.Error())
+
+	reviewErr = k8s_errors.NewUnauthorized("token expired")
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      checkRBACPath,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"kubernetes_namespace": "app1",
+		},
+	})
+	require.NoError(t, err)
+	require.Error(t, resp.Error())
+	assert.Equal(t, []map[string]string{{
+		"stage": checkStageAuth,
+		"error": reviewErr.Error(),
+	}}, resp.Data["data"].(map[string]interface{})["failures"])
+}
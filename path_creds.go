@@ -5,24 +5,41 @@ package kubesecrets
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-jose/go-jose/v4"
-	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
 	"github.com/hashicorp/vault/sdk/framework"
-	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/helper/template"
 	"github.com/hashicorp/vault/sdk/logical"
-	"github.com/mitchellh/mapstructure"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
 	pathCreds     = "creds/"
 	kubeTokenType = "kube_token"
 
+	// Limits on the metadata a caller can attach to a creds request
+	maxCredsMetadataEntries     = 16
+	maxCredsMetadataValueLength = 512
+
+	// baseRoleBindingSuffix is appended to the generated name for the binding
+	// of the existing role of a role with combine_rules
+	baseRoleBindingSuffix = "-base"
+
 	pathCredsHelpSyn  = `Request Kubernetes service account credentials for a given Vault role.`
 	pathCredsHelpDesc = `
 This path creates dynamic Kubernetes service account credentials.
@@ -31,9 +48,22 @@ existing service account, create a new service account bound to an
 existing Role/ClusterRole, or create a new service account and role
 bindings. The service account token and any other objects created in
 Kubernetes will be automatically deleted when the lease has expired.
+
+If bound_object_kind and bound_object_name are set, the token is bound to
+that Pod or Secret in the target namespace, and Kubernetes invalidates it
+as soon as the object is deleted. The lease is not shortened to match the
+object's lifetime: it remains active, and is revoked as usual, after the
+token stopped working. Renewing the lease fails once the object is gone.
 `
 )
 
+// credsResponseFields are the fields of the creds response, which the role's
+// token_response_key can't collide with
+var credsResponseFields = []string{"service_account_name", "service_account_namespace", "audiences", "metadata", "bound_object", "service_account_token_expiration"}
+
+// boundObjectKinds are the kinds of objects a token can be bound to
+var boundObjectKinds = []string{"Pod", "Secret"}
+
 // AllowedSigningAlgs contains all signing algorithms supported by k8s OIDC.
 // ref: https://github.com/kubernetes/kubernetes/blob/b4935d910dcf256288694391ef675acfbdb8e7a3/staging/src/k8s.io/apiserver/plugin/pkg/authenticator/token/oidc/oidc.go#L222-L233
 var AllowedSigningAlgs = []jose.SignatureAlgorithm{
@@ -49,17 +79,40 @@ var AllowedSigningAlgs = []jose.SignatureAlgorithm{
 }
 
 type credsRequest struct {
-	Namespace          string        `json:"kubernetes_namespace"`
-	ClusterRoleBinding bool          `json:"cluster_role_binding"`
-	TTL                time.Duration `json:"ttl"`
-	RoleName           string        `json:"role_name"`
-	Audiences          []string      `json:"audiences"`
+	Namespace            string            `json:"kubernetes_namespace"`
+	ClusterRoleBinding   bool              `json:"cluster_role_binding"`
+	TTL                  time.Duration     `json:"ttl"`
+	RoleName             string            `json:"role_name"`
+	Audiences            []string          `json:"audiences"`
+	Metadata             map[string]string `json:"metadata"`
+	AnnotateMetadata     bool              `json:"annotate_metadata"`
+	DryRun               bool              `json:"dry_run"`
+	BoundObjectKind      string            `json:"bound_object_kind"`
+	BoundObjectName      string            `json:"bound_object_name"`
+	BoundObjectUID       string            `json:"bound_object_uid"`
+	IncludeUIDs          bool              `json:"include_uids"`
+	IncludeTokenStatus   bool              `json:"include_token_status"`
+	BindingNamespace     string            `json:"binding_service_account_namespace"`
+	BypassNamespaceCache bool              `json:"bypass_namespace_cache"`
 }
 
 // The fields in nameMetadata are used for templated name generation
 type nameMetadata struct {
 	DisplayName string
 	RoleName    string
+	NamePrefix  string
+	Namespace   string
+}
+
+// metadataTimestampFormat is the format of the Timestamp of templated label
+// and annotation values, which is valid in a label value
+const metadataTimestampFormat = "20060102T150405Z"
+
+// The fields in metadataTemplateData are used for templated values of
+// extra_labels and extra_annotations
+type metadataTemplateData struct {
+	nameMetadata
+	Timestamp string
 }
 
 func (b *backend) pathCredentials() *framework.Path {
@@ -92,12 +145,52 @@ func (b *backend) pathCredentials() *framework.Path {
 			},
 			"ttl": {
 				Type:        framework.TypeDurationSecond,
-				Description: "The TTL of the generated credentials",
+				Description: "The TTL of the generated credentials. Defaults to the role's token_default_ttl, then the mount's default_ttl, then the system default.",
 			},
 			"audiences": {
 				Type:        framework.TypeCommaStringSlice,
 				Description: "The intended audiences of the generated credentials",
 			},
+			"metadata": {
+				Type:        framework.TypeKVPairs,
+				Description: "Metadata, such as job or request IDs, to record on the lease and return with the generated credentials",
+			},
+			"annotate_metadata": {
+				Type:        framework.TypeBool,
+				Description: "If true, also add the metadata as annotations on the generated Kubernetes objects",
+			},
+			"bound_object_kind": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("The kind of the object to bind the token to, one of %s. The token is invalidated when the object is deleted.", strings.Join(boundObjectKinds, ", ")),
+			},
+			"bound_object_name": {
+				Type:        framework.TypeString,
+				Description: "The name of the object in the target namespace to bind the token to",
+			},
+			"bound_object_uid": {
+				Type:        framework.TypeString,
+				Description: "The UID of the object to bind the token to. If set, the object must have this UID.",
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "If true, return the Kubernetes objects that would be created instead of creating them and a token. No lease is created.",
+			},
+			"include_uids": {
+				Type:        framework.TypeBool,
+				Description: "If true, also return the UIDs of the created service account, role and role binding, e.g. to correlate them with Kubernetes audit logs.",
+			},
+			"include_token_status": {
+				Type:        framework.TypeBool,
+				Description: "If true, also return the status of the TokenRequest that issued a bound token as token_status, without the token itself: its expiration_timestamp, the expiration_seconds the cluster granted, and any warnings about the token, so clients don't need to parse the token. Has no effect for token_type secret.",
+			},
+			"binding_service_account_namespace": {
+				Type:        framework.TypeString,
+				Description: "The namespace of the service account that the ClusterRoleBinding binds, if it's not kubernetes_namespace. The token is still issued in kubernetes_namespace. Requires cluster_role_binding and a role that binds an existing service_account_name, which must exist in this namespace, and must be allowed by the role.",
+			},
+			"bypass_namespace_cache": {
+				Type:        framework.TypeBool,
+				Description: "If true, look up the namespace in the Kubernetes API rather than using the result cached for namespace_cache_ttl, e.g. right after it was created or relabeled.",
+			},
 		},
 
 		HelpSynopsis:    pathCredsHelpSyn,
@@ -141,6 +234,42 @@ func (b *backend) pathCredentialsRead(ctx context.Context, req *logical.Request,
 		request.Audiences = audiences
 	}
 
+	if err := checkAudiencesAllowed(roleEntry, request.Audiences); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if metadata, ok := d.GetOk("metadata"); ok {
+		request.Metadata = metadata.(map[string]string)
+	}
+	if err := validateCredsMetadata(request.Metadata); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	request.AnnotateMetadata = d.Get("annotate_metadata").(bool)
+	request.DryRun = d.Get("dry_run").(bool)
+	request.IncludeUIDs = d.Get("include_uids").(bool)
+	request.IncludeTokenStatus = d.Get("include_token_status").(bool)
+	request.BindingNamespace = d.Get("binding_service_account_namespace").(string)
+	request.BypassNamespaceCache = d.Get("bypass_namespace_cache").(bool)
+
+	request.BoundObjectKind = d.Get("bound_object_kind").(string)
+	request.BoundObjectName = d.Get("bound_object_name").(string)
+	request.BoundObjectUID = d.Get("bound_object_uid").(string)
+	if err := validateBoundObject(request); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenType(roleEntry, request); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	return b.issueCreds(ctx, req, roleEntry, request)
+}
+
+// issueCreds checks that the role allows the namespace and options of the
+// creds request, and creates the credentials. The credentials count towards
+// the role's max_active_tokens until they are revoked.
+func (b *backend) issueCreds(ctx context.Context, req *logical.Request, roleEntry *roleEntry, request *credsRequest) (*logical.Response, error) {
+	roleName := request.RoleName
+
 	// Validate the request
 	isValidNs, err := b.isValidKubernetesNamespace(ctx, req, request, roleEntry)
 	if err != nil {
@@ -149,14 +278,159 @@ func (b *backend) pathCredentialsRead(ctx context.Context, req *logical.Request,
 	if !isValidNs {
 		return logical.ErrorResponse(fmt.Sprintf("kubernetes_namespace '%s' is not present in role's allowed_kubernetes_namespaces or does not match role's label selector allowed_kubernetes_namespace_selector", request.Namespace)), nil
 	}
+	if roleEntry.namespaceDenied(request.Namespace) {
+		return logical.ErrorResponse(fmt.Sprintf("kubernetes_namespace '%s' is denied by role's denied_kubernetes_namespaces", request.Namespace)), nil
+	}
+	config, err := getClusterConfig(ctx, req.Storage, roleEntry.KubernetesCluster)
+	if err != nil {
+		return nil, err
+	}
+	if protected, local := b.protectedNamespace(config, roleEntry.KubernetesCluster, request.Namespace); local {
+		return logical.ErrorResponse("kubernetes_namespace '%s' is protected since Vault runs in it, set protected_namespaces in the config to override", protected), nil
+	} else if protected != "" {
+		return logical.ErrorResponse("kubernetes_namespace '%s' is protected by the config's protected_namespaces entry '%s'", request.Namespace, protected), nil
+	}
+	if request.ClusterRoleBinding && !roleEntry.AllowClusterRoleBinding {
+		return logical.ErrorResponse("cluster_role_binding is not allowed by role's allow_cluster_role_binding"), nil
+	}
 	if request.ClusterRoleBinding && roleEntry.K8sRoleType == "Role" {
 		return logical.ErrorResponse("a ClusterRoleBinding cannot ref a Role"), nil
 	}
+	if request.BindingNamespace != "" {
+		if !request.ClusterRoleBinding {
+			return logical.ErrorResponse("binding_service_account_namespace requires cluster_role_binding"), nil
+		}
+		// A generated service account only exists in kubernetes_namespace,
+		// so the binding would grant its permissions to whoever creates a
+		// service account with the generated name in the other namespace
+		if !roleEntry.bindsExistingServiceAccount() {
+			return logical.ErrorResponse("binding_service_account_namespace can only be used with role '%s' if it binds an existing service_account_name", roleName), nil
+		}
+		isValidNs, err := b.isValidKubernetesNamespace(ctx, req, &credsRequest{Namespace: request.BindingNamespace, BypassNamespaceCache: request.BypassNamespaceCache}, roleEntry)
+		if err != nil {
+			return nil, fmt.Errorf("error verifying namespace: %w", err)
+		}
+		if !isValidNs || roleEntry.namespaceDenied(request.BindingNamespace) {
+			return logical.ErrorResponse("binding_service_account_namespace '%s' is not allowed by the role", request.BindingNamespace), nil
+		}
+		if protected, _ := b.protectedNamespace(config, roleEntry.KubernetesCluster, request.BindingNamespace); protected != "" {
+			return logical.ErrorResponse("binding_service_account_namespace '%s' is protected", request.BindingNamespace), nil
+		}
+	}
+
+	// A dry run creates nothing, so it doesn't count towards the role's
+	// max_active_tokens
+	if request.DryRun {
+		return b.createCreds(ctx, req, roleEntry, request)
+	}
+
+	acquired, err := b.acquireActiveToken(ctx, req.Storage, roleName, roleEntry.MaxActiveTokens)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return logical.ErrorResponse("role '%s' already has its max_active_tokens of %d active credentials", roleName, roleEntry.MaxActiveTokens), nil
+	}
+	resp, err := b.createCreds(ctx, req, roleEntry, request)
+	if err != nil || resp.IsError() {
+		emitCredsMetric("failed", roleName, roleEntry.K8sRoleType)
+		if releaseErr := b.releaseActiveToken(ctx, req.Storage, roleName); releaseErr != nil {
+			b.Logger().Warn("failed to release active token count", "role", roleName, "error", releaseErr)
+		}
+		return resp, err
+	}
+	emitCredsMetric("issued", roleName, roleEntry.K8sRoleType)
+	return resp, nil
+}
 
-	return b.createCreds(ctx, req, roleEntry, request)
+// checkExistingRoleBinding returns the reason that the role's pre-existing
+// kubernetes_role_binding_name can't be used for credentials in the
+// namespace, or an empty string if it binds the role's service account, and
+// its kubernetes_role_name if set
+func checkExistingRoleBinding(ctx context.Context, client *client, role *roleEntry, namespace string, isClusterRoleBinding bool) (string, error) {
+	kind := "RoleBinding"
+	name := namespace + "/" + role.K8sRoleBindingName
+	if isClusterRoleBinding {
+		kind = "ClusterRoleBinding"
+		name = role.K8sRoleBindingName
+	}
+	roleRef, subjects, err := client.getRoleBinding(ctx, namespace, role.K8sRoleBindingName, isClusterRoleBinding)
+	switch {
+	case k8s_errors.IsNotFound(err):
+		return fmt.Sprintf("%s '%s' of the role's kubernetes_role_binding_name does not exist", kind, name), nil
+	case err != nil:
+		return "", fmt.Errorf("failed to get %s '%s': %w", kind, name, err)
+	}
+	if role.K8sRoleName != "" && (roleRef.Kind != role.K8sRoleType || roleRef.Name != role.K8sRoleName) {
+		return fmt.Sprintf("%s '%s' binds %s '%s', not the role's kubernetes_role_name %s '%s'", kind, name, roleRef.Kind, roleRef.Name, role.K8sRoleType, role.K8sRoleName), nil
+	}
+	for _, subject := range subjects {
+		if subject.Kind == rbacv1.ServiceAccountKind && subject.Name == role.ServiceAccountName && subject.Namespace == namespace {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("%s '%s' does not bind service account '%s/%s'", kind, name, namespace, role.ServiceAccountName), nil
+}
+
+// validateCredsMetadata checks that the metadata on a creds request can be
+// used as annotations and doesn't collide with keys managed by the plugin
+func validateCredsMetadata(metadata map[string]string) error {
+	if len(metadata) > maxCredsMetadataEntries {
+		return fmt.Errorf("metadata may contain at most %d entries", maxCredsMetadataEntries)
+	}
+	for k, v := range metadata {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return fmt.Errorf("invalid metadata key '%s': %s", k, strings.Join(errs, ", "))
+		}
+		if isReservedKey(k) {
+			return fmt.Errorf("metadata key '%s' is reserved for use by Vault", k)
+		}
+		if len(v) > maxCredsMetadataValueLength {
+			return fmt.Errorf("metadata value for '%s' must be at most %d characters", k, maxCredsMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// validateBoundObject checks that the bound object fields of a creds request
+// are either unset or name an object of a supported kind
+func validateBoundObject(request *credsRequest) error {
+	switch {
+	case request.BoundObjectKind == "" && request.BoundObjectName == "":
+		if request.BoundObjectUID != "" {
+			return fmt.Errorf("bound_object_uid requires bound_object_kind and bound_object_name")
+		}
+		return nil
+	case request.BoundObjectKind == "" || request.BoundObjectName == "":
+		return fmt.Errorf("bound_object_kind and bound_object_name must be set together")
+	case !strutil.StrListContains(boundObjectKinds, request.BoundObjectKind):
+		return fmt.Errorf("bound_object_kind must be one of %s", strings.Join(boundObjectKinds, ", "))
+	}
+	return nil
+}
+
+// validateTokenType checks that a creds request doesn't ask for token options
+// that the role's token_type can't honor. Tokens stored in a Secret always
+// have the API server's audience, and can't be bound to another object.
+func validateTokenType(role *roleEntry, request *credsRequest) error {
+	if role.TokenType != tokenTypeSecret {
+		return nil
+	}
+	if len(request.Audiences) > 0 {
+		return fmt.Errorf("audiences can't be requested from a role with token_type '%s'", tokenTypeSecret)
+	}
+	if request.BoundObjectName != "" {
+		return fmt.Errorf("the token can't be bound to an object for a role with token_type '%s'", tokenTypeSecret)
+	}
+	return nil
 }
 
 func (b *backend) isValidKubernetesNamespace(ctx context.Context, req *logical.Request, request *credsRequest, role *roleEntry) (bool, error) {
+	if request.Namespace == "" && role.DefaultNamespace != "" {
+		// The default namespace is validated like a requested one, since
+		// it may be allowed by a selector
+		request.Namespace = role.DefaultNamespace
+	}
 	if request.Namespace == "" {
 		if role.HasSingleK8sNamespace() {
 			// Assign the single namespace to the creds request namespace
@@ -167,132 +441,388 @@ func (b *backend) isValidKubernetesNamespace(ctx context.Context, req *logical.R
 		return false, fmt.Errorf("'kubernetes_namespace' is required unless the Vault role has a single namespace specified")
 	}
 
-	if strutil.StrListContains(role.K8sNamespaces, "*") || strutil.StrListContains(role.K8sNamespaces, request.Namespace) {
+	if role.namespaceAllowed(request.Namespace) {
 		return true, nil
 	}
 
 	if role.K8sNamespaceSelector == "" {
 		return false, nil
 	}
-	selector, err := makeLabelSelector(role.K8sNamespaceSelector)
+	selector, err := makeNamespaceSelector(role.K8sNamespaceSelector)
 	if err != nil {
 		return false, err
 	}
 
-	client, err := b.getClient(ctx, req.Storage)
+	client, err := b.getClient(ctx, req.Storage, role.KubernetesCluster)
 	if err != nil {
 		return false, err
 	}
-	nsLabels, err := client.getNamespaceLabelSet(ctx, request.Namespace)
-	if err != nil {
-		return false, err
+	nsLabels, err := b.getNamespace(ctx, client, request.Namespace, request.BypassNamespaceCache)
+	if k8s_errors.IsForbidden(err) {
+		return false, fmt.Errorf("allowed_kubernetes_namespace_selector requires permission to get namespaces: %w", err)
 	}
-	labelSelector, err := metav1.LabelSelectorAsSelector(&selector)
 	if err != nil {
 		return false, err
 	}
-	return labelSelector.Matches(labels.Set(nsLabels)), nil
+	return selector.Matches(labels.Set(nsLabels)), nil
 }
 
 func (b *backend) createCreds(ctx context.Context, req *logical.Request, role *roleEntry, reqPayload *credsRequest) (*logical.Response, error) {
-	client, err := b.getClient(ctx, req.Storage)
+	client, err := b.getClient(ctx, req.Storage, role.KubernetesCluster)
 	if err != nil {
 		return nil, err
 	}
-	nameTemplate := role.NameTemplate
-	if nameTemplate == "" {
-		nameTemplate = defaultNameTemplate
-	}
+	// Bound the whole operation, so a slow Kubernetes API doesn't tie up the
+	// request. If it's cancelled, the WAL entries of the objects created so
+	// far are kept, and the rollback deletes the objects.
+	reqCtx := ctx
+	ctx, cancel := client.withOperationTimeout(ctx)
+	defer cancel()
 
-	up, err := template.NewTemplate(template.Template(nameTemplate))
+	role, err = b.withRoleRulesFromFile(ctx, req.Storage, role)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize name template: %w", err)
+		return nil, err
 	}
-	um := nameMetadata{
+	metadata := nameMetadata{
 		DisplayName: req.DisplayName,
 		RoleName:    role.Name,
+		NamePrefix:  role.NamePrefix,
+		Namespace:   reqPayload.Namespace,
+	}
+	role, err = role.withRenderedMetadata(metadataTemplateData{
+		nameMetadata: metadata,
+		Timestamp:    time.Now().UTC().Format(metadataTimestampFormat),
+	})
+	if err != nil {
+		return nil, err
+	}
+	role = role.withExtraMetadata(b.managedLabels(req, role.Name), nil)
+	genName, err := generateName(role, metadata)
+	if err != nil {
+		return nil, err
+	}
+	secretName := ""
+	if role.TokenType == tokenTypeSecret {
+		secretName, err = tokenSecretName(role, metadata, genName)
+		if err != nil {
+			return nil, err
+		}
 	}
-	genName, err := up.Generate(um)
+
+	config, err := getConfig(ctx, req.Storage)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate name: %w", err)
+		return nil, err
 	}
 
 	// Determine the TTL here, since it might come from the mount if nothing on
 	// the vault role or creds payload is specified, and we need to know it
 	// before creating K8s Token
-	theTTL := time.Duration(0)
+	ttls, err := b.leaseTTL(ctx, req.Storage, role, config, role.KubernetesCluster, reqPayload.TTL, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ttls.rejected != "" {
+		return logical.ErrorResponse(ttls.rejected), nil
+	}
+	theTTL, maxTTL := ttls.ttl, ttls.maxTTL
+	respWarning := ttls.warnings
+
+	theAudiences := role.defaultAudiences()
+	if len(reqPayload.Audiences) != 0 {
+		theAudiences = reqPayload.Audiences
+	}
+
+	if reqPayload.AnnotateMetadata && len(reqPayload.Metadata) > 0 {
+		if role.ServiceAccountName != "" && !role.bindsExistingServiceAccount() {
+			respWarning = append(respWarning, "annotate_metadata has no effect for roles with a service_account_name, since no Kubernetes objects are created")
+		}
+		role = role.withExtraMetadata(nil, reqPayload.Metadata)
+	}
+
+	// Find out whether the namespace has to be created before any other
+	// object, so a dry run can report it too. Without create_namespace, a
+	// missing namespace fails the request before anything is created.
+	createNamespace := false
+	if role.CreateNamespace {
+		_, err := client.getNamespaceLabelSet(ctx, reqPayload.Namespace)
+		switch {
+		case k8s_errors.IsNotFound(err):
+			createNamespace = true
+		case err != nil:
+			return nil, fmt.Errorf("failed to get namespace '%s': %w", reqPayload.Namespace, err)
+		}
+	} else {
+		exists, err := b.namespaceExists(ctx, client, reqPayload.Namespace, reqPayload.BypassNamespaceCache)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get namespace '%s': %w", reqPayload.Namespace, err)
+		}
+		if !exists {
+			return logical.ErrorResponse("namespace '%s' does not exist", reqPayload.Namespace), nil
+		}
+	}
+
+	if role.K8sRoleBindingName != "" {
+		reason, err := checkExistingRoleBinding(ctx, client, role, reqPayload.Namespace, reqPayload.ClusterRoleBinding)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			return logical.ErrorResponse(reason), nil
+		}
+	}
+
+	// A templated Secret name may be deterministic, so make sure it doesn't
+	// take over the Secret of another lease or workload
+	if role.TokenSecretNameTemplate != "" && !createNamespace {
+		exists, err := client.secretExists(ctx, reqPayload.Namespace, secretName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Secret '%s/%s': %w", reqPayload.Namespace, secretName, err)
+		}
+		if exists {
+			return logical.ErrorResponse("Secret '%s/%s' already exists, token_secret_name_template must render a unique name", reqPayload.Namespace, secretName), nil
+		}
+	}
+
+	if reqPayload.DryRun {
+		return b.dryRunCreds(client, role, reqPayload, genName, secretName, createNamespace, theTTL, theAudiences, respWarning)
+	}
+
+	// Limit the requests creating objects at once, to protect Vault and the
+	// Kubernetes API from bursts of requests
+	maxConcurrentCreds := 0
+	if config != nil {
+		maxConcurrentCreds = config.MaxConcurrentCreds
+	}
+	releaseSlot, err := b.acquireCredsSlot(ctx, maxConcurrentCreds)
 	switch {
-	case reqPayload.TTL > 0:
-		theTTL = reqPayload.TTL
-	case role.TokenDefaultTTL > 0:
-		theTTL = role.TokenDefaultTTL
-	default:
-		theTTL = b.System().DefaultLeaseTTL()
+	case errors.Is(err, errCredsBusy):
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
 	}
+	defer releaseSlot()
 
-	var respWarning []string
-	// If the calculated TTL is greater than the role's max ttl, it'll be capped
-	// by the framework when returned. Catch it here so that the k8s token has
-	// the same capped TTL.
-	if role.TokenMaxTTL > 0 && theTTL > role.TokenMaxTTL {
-		respWarning = append(respWarning, fmt.Sprintf("ttl of %s is greater than the role's token_max_ttl of %s; capping accordingly", theTTL.String(), role.TokenMaxTTL.String()))
-		theTTL = role.TokenMaxTTL
+	// The key of the lease in the index is generated before the objects are
+	// created, so they can be annotated with it
+	indexID, err := newCredsIndexID(time.Now())
+	if err != nil {
+		return nil, err
 	}
-	// Similarly, if the calculated TTL is greater than the system's max lease
-	// ttl, cap accordingly here.
-	if theTTL > b.System().MaxLeaseTTL() {
-		respWarning = append(respWarning, fmt.Sprintf("ttl of %s is greater than Vault's max lease ttl %s; capping accordingly", theTTL.String(), b.System().MaxLeaseTTL().String()))
-		theTTL = b.System().MaxLeaseTTL()
+	if role.AnnotateLeaseID {
+		role = role.withExtraMetadata(nil, leaseAnnotations(indexID, req.ID))
 	}
 
-	theAudiences := role.TokenDefaultAudiences
-	if len(reqPayload.Audiences) != 0 {
-		theAudiences = reqPayload.Audiences
+	// The subject of a ClusterRoleBinding may be in another namespace than
+	// the service account and token. A ClusterRoleBinding has no namespace
+	// of its own, so the namespace it's created with is only its subject's.
+	bindingNamespace := reqPayload.Namespace
+	if reqPayload.BindingNamespace != "" {
+		bindingNamespace = reqPayload.BindingNamespace
+		exists, err := client.serviceAccountExists(ctx, bindingNamespace, role.ServiceAccountName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service account '%s/%s': %w", bindingNamespace, role.ServiceAccountName, err)
+		}
+		if !exists {
+			return logical.ErrorResponse("service account '%s/%s' does not exist", bindingNamespace, role.ServiceAccountName), nil
+		}
+	}
+
+	// Check that the object to bind the token to exists before creating
+	// anything, and pin its UID so the token can't outlive it
+	var boundObjectRef *authenticationv1.BoundObjectReference
+	if reqPayload.BoundObjectName != "" {
+		uid, err := client.getBoundObjectUID(ctx, reqPayload.Namespace, reqPayload.BoundObjectKind, reqPayload.BoundObjectName)
+		switch {
+		case k8s_errors.IsNotFound(err):
+			return logical.ErrorResponse("bound object %s '%s/%s' does not exist", reqPayload.BoundObjectKind, reqPayload.Namespace, reqPayload.BoundObjectName), nil
+		case err != nil:
+			return nil, fmt.Errorf("failed to get bound object %s '%s/%s': %w", reqPayload.BoundObjectKind, reqPayload.Namespace, reqPayload.BoundObjectName, err)
+		case reqPayload.BoundObjectUID != "" && string(uid) != reqPayload.BoundObjectUID:
+			return logical.ErrorResponse("bound object %s '%s/%s' has UID '%s', not bound_object_uid '%s'", reqPayload.BoundObjectKind, reqPayload.Namespace, reqPayload.BoundObjectName, uid, reqPayload.BoundObjectUID), nil
+		}
+		boundObjectRef = &authenticationv1.BoundObjectReference{
+			Kind:       reqPayload.BoundObjectKind,
+			APIVersion: "v1",
+			Name:       reqPayload.BoundObjectName,
+			UID:        uid,
+		}
 	}
 
 	// These are created items to save internally and/or return to the caller
 	token := ""
+	var tokenExpiration time.Time
+	var tokenTTL time.Duration
+	// The status of the TokenRequest of a bound token, returned without the
+	// token if include_token_status is set
+	var tokenStatus *authenticationv1.TokenRequestStatus
+	var tokenSecretWALID string
 	serviceAccountName := ""
 	createdServiceAccountName := ""
 	createdK8sRoleBinding := ""
 	createdK8sRole := ""
+	createdBaseRoleBinding := ""
+	sharedClusterRole := ""
+	createdTokenSecret := ""
+	// The UIDs of the created objects, returned if include_uids is set
+	var serviceAccountUID, roleUID, roleBindingUID types.UID
 
-	var walID string
+	// issueToken creates the token for the service account: a bound token
+	// that expires with the lease, or for token_type secret, a long-lived
+	// token stored in a Secret
+	issueToken := func(serviceAccountName string) error {
+		if role.TokenType == tokenTypeSecret {
+			var secretToken string
+			var err error
+			tokenSecretWALID, secretToken, err = createTokenSecretWithWAL(ctx, client, req.Storage, reqPayload.Namespace, secretName, serviceAccountName, role)
+			if err != nil {
+				return fmt.Errorf("failed to create a service account token Secret for %s/%s: %s", reqPayload.Namespace, serviceAccountName, err)
+			}
+			token = secretToken
+			createdTokenSecret = secretName
+			return nil
+		}
+		requested := time.Now()
+		status, err := client.createToken(ctx, reqPayload.Namespace, serviceAccountName, theTTL, theAudiences, boundObjectRef)
+		if err != nil {
+			return fmt.Errorf("failed to create a service account token for %s/%s: %s", reqPayload.Namespace, serviceAccountName, err)
+		}
+		token = status.Token
+		tokenStatus = status
+		tokenExpiration = status.ExpirationTimestamp.Time
+		tokenTTL = grantedTokenTTL(status, requested)
+		return nil
+	}
+
+	var walID, serviceAccountWALID, namespaceWALID string
+
+	if createNamespace {
+		namespaceWALID, err = createNamespaceWithWAL(ctx, client, req.Storage, reqPayload.Namespace, role)
+		if err != nil {
+			return nil, err
+		}
+		b.forgetNamespace(client.cluster, reqPayload.Namespace)
+	}
 
 	switch {
+	case role.bindsExistingServiceAccount():
+		// Create rolebinding for existing role and existing service account,
+		// then token. The RoleBinding/ClusterRoleBinding isn't owned by
+		// anything, since it's the only object created, and is deleted on
+		// revocation.
+		bindingRef := metav1.OwnerReference{}
+		walID, bindingRef, err = createRoleBindingWithWAL(ctx, client, req.Storage, bindingNamespace, genName, role.ServiceAccountName, role.K8sRoleName, reqPayload.ClusterRoleBinding, role)
+		if err != nil {
+			return nil, err
+		}
+		roleBindingUID = bindingRef.UID
+
+		if err := issueToken(role.ServiceAccountName); err != nil {
+			return nil, err
+		}
+		serviceAccountName = role.ServiceAccountName
+		createdK8sRoleBinding = genName
 	case role.ServiceAccountName != "":
 		// Create token for existing service account
-		status, err := client.createToken(ctx, reqPayload.Namespace, role.ServiceAccountName, theTTL, theAudiences)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create a service account token for %s/%s: %s", reqPayload.Namespace, role.ServiceAccountName, err)
+		if err := issueToken(role.ServiceAccountName); err != nil {
+			return nil, err
 		}
 		serviceAccountName = role.ServiceAccountName
-		token = status.Token
+	case role.CombineRules:
+		// Create role, rolebindings for both the generated and the existing
+		// role, service account, token
+		// Role/ClusterRole will be the owning object, so deleting it also
+		// cleans up the binding for the existing role
+		ownerRef := metav1.OwnerReference{}
+		walID, ownerRef, err = createRoleWithWAL(ctx, client, req.Storage, reqPayload.Namespace, genName, role)
+		if err != nil {
+			return nil, err
+		}
+		roleUID = ownerRef.UID
+
+		roleBindingUID, err = createRoleBinding(ctx, client, bindingNamespace, genName, genName, genName, reqPayload.ClusterRoleBinding, role, ownerRef)
+		if err != nil {
+			return nil, err
+		}
+
+		baseRoleBinding := genName + baseRoleBindingSuffix
+		_, err = createRoleBinding(ctx, client, bindingNamespace, baseRoleBinding, genName, role.K8sRoleName, reqPayload.ClusterRoleBinding, role, ownerRef)
+		if err != nil {
+			return nil, err
+		}
+
+		serviceAccountWALID, serviceAccountUID, err = createServiceAccountWithWAL(ctx, client, req.Storage, reqPayload.Namespace, genName, role, ownerRef)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := issueToken(genName); err != nil {
+			return nil, err
+		}
+		createdK8sRole = genName
+		serviceAccountName = genName
+		createdServiceAccountName = genName
+		createdK8sRoleBinding = genName
+		createdBaseRoleBinding = baseRoleBinding
 	case role.K8sRoleName != "":
 		// Create rolebinding for existing role
 		// Create service account for existing role
 		// then token
 		// RoleBinding/ClusterRoleBinding will be the owning object
 		ownerRef := metav1.OwnerReference{}
-		walID, ownerRef, err = createRoleBindingWithWAL(ctx, client, req.Storage, reqPayload.Namespace, genName, role.K8sRoleName, reqPayload.ClusterRoleBinding, role)
+		walID, ownerRef, err = createRoleBindingWithWAL(ctx, client, req.Storage, bindingNamespace, genName, genName, role.K8sRoleName, reqPayload.ClusterRoleBinding, role)
 		if err != nil {
 			return nil, err
 		}
+		roleBindingUID = ownerRef.UID
 
-		err = createServiceAccount(ctx, client, reqPayload.Namespace, genName, role, ownerRef)
+		serviceAccountWALID, serviceAccountUID, err = createServiceAccountWithWAL(ctx, client, req.Storage, reqPayload.Namespace, genName, role, ownerRef)
 		if err != nil {
 			return nil, err
 		}
 
-		status, err := client.createToken(ctx, reqPayload.Namespace, genName, theTTL, theAudiences)
+		if err := issueToken(genName); err != nil {
+			return nil, err
+		}
+		serviceAccountName = genName
+		createdServiceAccountName = genName
+		createdK8sRoleBinding = genName
+	case role.SharedClusterRole:
+		// Take a reference to the shared ClusterRole, then create the
+		// rolebinding, service account and token as for an existing role.
+		// RoleBinding/ClusterRoleBinding will be the owning object
+		sharedClusterRole, err = b.acquireSharedClusterRole(ctx, req.Storage, client, role)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create a service account token for %s/%s: %s", reqPayload.Namespace, genName, err)
+			return nil, err
+		}
+		release := func(err error) (*logical.Response, error) {
+			// The reference is released even if the operation was cancelled
+			ctx, cancel := client.withOperationTimeout(context.WithoutCancel(reqCtx))
+			defer cancel()
+			if _, releaseErr := b.releaseSharedClusterRole(ctx, req.Storage, client, sharedClusterRole); releaseErr != nil {
+				b.Logger().Warn("failed to release shared ClusterRole", "name", sharedClusterRole, "error", releaseErr)
+			}
+			return nil, err
+		}
+
+		ownerRef := metav1.OwnerReference{}
+		walID, ownerRef, err = createRoleBindingWithWAL(ctx, client, req.Storage, bindingNamespace, genName, genName, sharedClusterRole, reqPayload.ClusterRoleBinding, role)
+		if err != nil {
+			return release(err)
+		}
+		roleBindingUID = ownerRef.UID
+
+		serviceAccountWALID, serviceAccountUID, err = createServiceAccountWithWAL(ctx, client, req.Storage, reqPayload.Namespace, genName, role, ownerRef)
+		if err != nil {
+			return release(err)
+		}
+
+		if err := issueToken(genName); err != nil {
+			return release(err)
 		}
-		token = status.Token
 		serviceAccountName = genName
 		createdServiceAccountName = genName
 		createdK8sRoleBinding = genName
-	case role.RoleRules != "":
+	case role.generatesRole():
 		// Create role, rolebinding, service account, token
 		// Role/ClusterRole will be the owning object
 		ownerRef := metav1.OwnerReference{}
@@ -300,22 +830,21 @@ func (b *backend) createCreds(ctx context.Context, req *logical.Request, role *r
 		if err != nil {
 			return nil, err
 		}
+		roleUID = ownerRef.UID
 
-		err = createRoleBinding(ctx, client, reqPayload.Namespace, genName, genName, reqPayload.ClusterRoleBinding, role, ownerRef)
+		roleBindingUID, err = createRoleBinding(ctx, client, bindingNamespace, genName, genName, genName, reqPayload.ClusterRoleBinding, role, ownerRef)
 		if err != nil {
 			return nil, err
 		}
 
-		err = createServiceAccount(ctx, client, reqPayload.Namespace, genName, role, ownerRef)
+		serviceAccountWALID, serviceAccountUID, err = createServiceAccountWithWAL(ctx, client, req.Storage, reqPayload.Namespace, genName, role, ownerRef)
 		if err != nil {
 			return nil, err
 		}
 
-		status, err := client.createToken(ctx, reqPayload.Namespace, genName, theTTL, theAudiences)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create a service account token for %s/%s: %s", reqPayload.Namespace, genName, err)
+		if err := issueToken(genName); err != nil {
+			return nil, err
 		}
-		token = status.Token
 		createdK8sRole = genName
 		serviceAccountName = genName
 		createdServiceAccountName = genName
@@ -325,10 +854,16 @@ func (b *backend) createCreds(ctx context.Context, req *logical.Request, role *r
 		return nil, fmt.Errorf("one of service_account_name, kubernetes_role_name, or generated_role_rules must be set")
 	}
 
+	tokenResponseKey := role.TokenResponseKey
+	if tokenResponseKey == "" {
+		tokenResponseKey = defaultTokenResponseKey
+	}
+
 	resp := b.Secret(kubeTokenType).Response(map[string]interface{}{
 		"service_account_namespace": reqPayload.Namespace,
 		"service_account_name":      serviceAccountName,
-		"service_account_token":     token,
+		"audiences":                 theAudiences,
+		tokenResponseKey:            token,
 	}, map[string]interface{}{
 		// the internal data is whatever we need to cleanup on revoke
 		// (service_account_name, role, role_binding).
@@ -339,32 +874,132 @@ func (b *backend) createCreds(ctx context.Context, req *logical.Request, role *r
 		"created_role_binding":      createdK8sRoleBinding,
 		"created_role":              createdK8sRole,
 		"created_role_type":         role.K8sRoleType,
+		"created_base_role_binding": createdBaseRoleBinding,
+		"service_account_name":      serviceAccountName,
+		"audiences":                 theAudiences,
+		"shared_cluster_role":       sharedClusterRole,
+		"created_token_secret":      createdTokenSecret,
 	})
+	if role.CreateNamespace {
+		// Any lease of the role deletes the namespace if Vault created it and
+		// it's the last lease with objects in it
+		resp.Secret.InternalData["delete_created_namespace"] = true
+	}
+	if role.KubernetesCluster != "" {
+		resp.Secret.InternalData["kubernetes_cluster"] = role.KubernetesCluster
+	}
+	if reqPayload.BindingNamespace != "" {
+		resp.Secret.InternalData["binding_service_account_namespace"] = reqPayload.BindingNamespace
+	}
+	if role.ForceRemoveFinalizers && len(role.RoleFinalizers)+len(role.RoleBindingFinalizers) > 0 {
+		// Recorded with the lease, since the role may change before it's
+		// revoked
+		resp.Secret.InternalData["remove_finalizers"] = strutil.RemoveDuplicatesStable(append(append([]string{}, role.RoleFinalizers...), role.RoleBindingFinalizers...), false)
+	}
+	if role.AnnotateLeaseID && req.ID != "" {
+		// Recorded so rotated objects are annotated with the same request
+		resp.Secret.InternalData["request_id"] = req.ID
+	}
+	// Tokens stored in a Secret don't expire
+	if !tokenExpiration.IsZero() {
+		resp.Data["service_account_token_expiration"] = tokenExpiration.Format(time.RFC3339)
+	}
+
+	if len(reqPayload.Metadata) > 0 {
+		resp.Data["metadata"] = reqPayload.Metadata
+		resp.Secret.InternalData["metadata"] = reqPayload.Metadata
+	}
+	// Report the names of the created objects, which are in the
+	// service_account_namespace unless they're cluster-scoped
+	for key, name := range map[string]string{
+		"created_service_account":   createdServiceAccountName,
+		"created_role_binding":      createdK8sRoleBinding,
+		"created_role":              createdK8sRole,
+		"created_base_role_binding": createdBaseRoleBinding,
+		"created_token_secret":      createdTokenSecret,
+	} {
+		if name != "" {
+			resp.Data[key] = name
+		}
+	}
+	if createdK8sRole != "" {
+		resp.Data["created_role_type"] = role.K8sRoleType
+	}
+	if reqPayload.IncludeUIDs {
+		for key, uid := range map[string]types.UID{
+			"service_account_uid": serviceAccountUID,
+			"role_uid":            roleUID,
+			"role_binding_uid":    roleBindingUID,
+		} {
+			if uid != "" {
+				resp.Data[key] = string(uid)
+			}
+		}
+	}
+	if boundObjectRef != nil {
+		resp.Data["bound_object"] = map[string]interface{}{
+			"kind": boundObjectRef.Kind,
+			"name": boundObjectRef.Name,
+			"uid":  string(boundObjectRef.UID),
+		}
+		// Renewed tokens are bound to the same object
+		resp.Secret.InternalData["bound_object_kind"] = boundObjectRef.Kind
+		resp.Secret.InternalData["bound_object_name"] = boundObjectRef.Name
+		resp.Secret.InternalData["bound_object_uid"] = string(boundObjectRef.UID)
+	}
 
 	resp.Secret.TTL = theTTL
-	if role.TokenMaxTTL > 0 {
-		resp.Secret.MaxTTL = role.TokenMaxTTL
+	if maxTTL > 0 {
+		resp.Secret.MaxTTL = maxTTL
 	}
 
-	createdTokenTTL, err := getTokenTTL(token)
-	switch {
-	case err != nil:
-		return nil, fmt.Errorf("failed to read TTL of created Kubernetes token for %s/%s: %s", reqPayload.Namespace, genName, err)
-	case createdTokenTTL > theTTL:
-		respWarning = append(respWarning, fmt.Sprintf("the created Kubernetes service accout token TTL %v is greater than the Vault lease TTL %v", createdTokenTTL, theTTL))
-	case createdTokenTTL < theTTL:
-		respWarning = append(respWarning, fmt.Sprintf("the created Kubernetes service accout token TTL %v is less than the Vault lease TTL %v; capping the lease TTL accordingly", createdTokenTTL, theTTL))
-		resp.Secret.TTL = createdTokenTTL
+	// Tokens stored in a Secret don't expire, so only a bound token's TTL can
+	// differ from the lease's. The lease is shortened to the token's actual
+	// expiration, so Vault doesn't consider the token valid after it expired.
+	var tokenWarnings []string
+	if createdTokenSecret == "" {
+		switch {
+		case tokenTTL > theTTL+tokenTTLTolerance:
+			tokenWarnings = append(tokenWarnings, fmt.Sprintf("the created Kubernetes service accout token TTL %v is greater than the Vault lease TTL %v", tokenTTL, theTTL))
+		case tokenTTL < theTTL-tokenTTLTolerance:
+			tokenWarnings = append(tokenWarnings, fmt.Sprintf("the created Kubernetes service accout token TTL %v is less than the Vault lease TTL %v; capping the lease TTL accordingly", tokenTTL, theTTL))
+			resp.Secret.TTL = tokenTTL
+		}
+		respWarning = append(respWarning, tokenWarnings...)
+	}
+	if reqPayload.IncludeTokenStatus && tokenStatus != nil {
+		resp.Data["token_status"] = tokenStatusData(tokenStatus, tokenTTL, tokenWarnings)
 	}
 
 	if len(respWarning) > 0 {
 		resp.Warnings = respWarning
 	}
 
-	// Delete the WAL entry that was created, since all the k8s objects were
-	// created successfully (no need to rollback anymore)
-	if walID != "" {
-		if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+	// Record the credentials in the index of active leases
+	issueTime := time.Now()
+	resp.Secret.InternalData["index_id"] = indexID
+	// The objects were all created, so storage is written even if the
+	// operation's time ran out in the meantime
+	err = putCredsIndexEntry(reqCtx, req.Storage, indexID, &credsIndexEntry{
+		Role:                    reqPayload.RoleName,
+		ServiceAccountNamespace: reqPayload.Namespace,
+		ServiceAccountName:      serviceAccountName,
+		IssueTime:               issueTime,
+		ExpireTime:              issueTime.Add(resp.Secret.TTL),
+		InternalData:            resp.Secret.InternalData,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing creds index entry: %w", err)
+	}
+	b.recordCredsIssued(role.KubernetesCluster, issueTime)
+
+	// Delete the WAL entries that were created, since all the k8s objects
+	// were created successfully (no need to rollback anymore)
+	for _, id := range []string{walID, serviceAccountWALID, namespaceWALID, tokenSecretWALID} {
+		if id == "" {
+			continue
+		}
+		if err := framework.DeleteWAL(reqCtx, req.Storage, id); err != nil {
 			return nil, fmt.Errorf("error deleting WAL: %w", err)
 		}
 	}
@@ -372,69 +1007,248 @@ func (b *backend) createCreds(ctx context.Context, req *logical.Request, role *r
 	return resp, nil
 }
 
-func (b *backend) getClient(ctx context.Context, s logical.Storage) (*client, error) {
+// generateName renders the role's name template and verifies that the result
+// is a valid Kubernetes object name
+func generateName(role *roleEntry, metadata nameMetadata) (string, error) {
+	return renderName(role.nameTemplate(), metadata)
+}
+
+// tokenSecretName returns the name of the Secret storing the token of a role
+// with token_type secret, rendered from its token_secret_name_template, or
+// the generated name of the lease's objects if the template is unset
+func tokenSecretName(role *roleEntry, metadata nameMetadata, genName string) (string, error) {
+	if role.TokenSecretNameTemplate == "" {
+		return genName, nil
+	}
+	name, err := renderName(role.TokenSecretNameTemplate, metadata)
+	if err != nil {
+		return "", fmt.Errorf("token_secret_name_template: %w", err)
+	}
+	return name, nil
+}
+
+// renderName renders the name template, and checks that the result is a
+// valid Kubernetes object name
+func renderName(nameTemplate string, metadata nameMetadata) (string, error) {
+	up, err := template.NewTemplate(template.Template(nameTemplate))
+	if err != nil {
+		return "", fmt.Errorf("unable to initialize name template: %w", err)
+	}
+	name, err := up.Generate(metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate name: %w", err)
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("generated name '%s' is not a valid Kubernetes object name: %s", name, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// getClient returns the cached client of the cluster, or builds a new one if
+// there is none or the effective config has changed since the cached client
+// was built, e.g. because the kubernetes_ca_cert_file or local service
+// account token were rotated. The default cluster's name is empty.
+func (b *backend) getClient(ctx context.Context, s logical.Storage, cluster string) (*client, error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	client := b.client
-	if client != nil {
-		return client, nil
+	config, err := b.configWithDynamicValues(ctx, s, cluster)
+	if err != nil {
+		return nil, err
 	}
-
-	config, err := b.configWithDynamicValues(ctx, s)
+	configHash, err := kubeConfigHash(config)
 	if err != nil {
 		return nil, err
 	}
 
-	if b.client == nil && config == nil {
-		config = new(kubeConfig)
+	if cached, ok := b.clients[cluster]; ok {
+		if cached.configHash == configHash {
+			return cached, nil
+		}
+		b.Logger().Debug("Kubernetes configuration changed, rebuilding client", "cluster", cluster)
+		b.clearNamespaceCaches()
 	}
 
-	b.client, err = newClient(config)
+	client, err := newClient(config)
 	if err != nil {
 		return nil, err
 	}
+	client.configHash = configHash
+	client.cluster = cluster
+	b.clients[cluster] = client
 
-	return b.client, nil
+	return client, nil
 }
 
-// create service account
-func createServiceAccount(ctx context.Context, client *client, namespace, name string, vaultRole *roleEntry, ownerRef metav1.OwnerReference) error {
-	_, err := client.createServiceAccount(ctx, namespace, name, vaultRole, ownerRef)
+// kubeConfigHash returns a hash of the effective config, used to detect
+// changes that require rebuilding the client
+func kubeConfigHash(config *kubeConfig) (string, error) {
+	configJSON, err := json.Marshal(config)
 	if err != nil {
-		return fmt.Errorf("failed to create service account '%s/%s': %s", namespace, name, err)
+		return "", err
 	}
+	sum := sha256.Sum256(configJSON)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	return nil
+// managedLabels returns the labels that identify the mount and Vault role
+// that generated an object. The role name is left out if it isn't a valid
+// label value, e.g. because it is longer than 63 characters.
+func (b *backend) managedLabels(req *logical.Request, roleName string) map[string]string {
+	managed := map[string]string{}
+	if b.mountID != "" {
+		managed[mountIDLabel] = b.mountID
+	}
+	if req.MountAccessor != "" {
+		managed[mountAccessorLabel] = req.MountAccessor
+	}
+	if errs := validation.IsValidLabelValue(roleName); len(errs) == 0 {
+		managed[roleNameLabel] = roleName
+	} else {
+		b.Logger().Debug("not labeling generated objects with the role name", "role", roleName, "error", strings.Join(errs, ", "))
+	}
+	return managed
+}
+
+// leaseAnnotations returns the annotations that trace the objects of a lease
+// back to it. Vault only assigns the lease ID once the response of the creds
+// request is returned, so the objects are annotated with the key of the lease
+// in the list of creds, and with the ID of the request, which the audit log
+// records together with the lease ID.
+func leaseAnnotations(indexID, requestID string) map[string]string {
+	annotations := map[string]string{
+		leaseIndexIDAnnotation: indexID,
+	}
+	if requestID != "" {
+		annotations[requestIDAnnotation] = requestID
+	}
+	return annotations
+}
+
+// create service account and return its UID
+func createServiceAccount(ctx context.Context, client *client, namespace, name string, vaultRole *roleEntry, ownerRef metav1.OwnerReference) (types.UID, error) {
+	sa, err := client.createServiceAccount(ctx, namespace, name, vaultRole, ownerRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to create service account '%s/%s': %w", namespace, name, err)
+	}
+
+	return sa.UID, nil
+}
+
+// create service account and put a WAL entry, so it's deleted even if the
+// token can't be created and its owner isn't rolled back
+func createServiceAccountWithWAL(ctx context.Context, client *client, s logical.Storage, namespace, name string, vaultRole *roleEntry, ownerRef metav1.OwnerReference) (string, types.UID, error) {
+	walId, err := framework.PutWAL(ctx, s, walServiceAccountKind, &walServiceAccount{
+		Namespace:  namespace,
+		Name:       name,
+		Cluster:    client.cluster,
+		Expiration: time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error writing service account WAL: %w", err)
+	}
+
+	uid, err := createServiceAccount(ctx, client, namespace, name, vaultRole, ownerRef)
+	if err != nil {
+		return "", "", keepConflictingObject(ctx, s, walId, err)
+	}
+
+	return walId, uid, nil
+}
+
+// create a service account token Secret and put a WAL entry, so it's deleted
+// if the creds request fails after it's created. The Secret isn't owned by
+// any of the lease's objects, so it would otherwise outlive them.
+func createTokenSecretWithWAL(ctx context.Context, client *client, s logical.Storage, namespace, name, serviceAccountName string, vaultRole *roleEntry) (string, string, error) {
+	walId, err := framework.PutWAL(ctx, s, walSecretKind, &walSecret{
+		Namespace:  namespace,
+		Name:       name,
+		Cluster:    client.cluster,
+		Expiration: time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error writing token secret WAL: %w", err)
+	}
+
+	token, err := client.createTokenSecret(ctx, namespace, name, serviceAccountName, vaultRole)
+	if err != nil {
+		return "", "", keepConflictingObject(ctx, s, walId, err)
+	}
+
+	return walId, token, nil
+}
+
+// keepConflictingObject deletes the WAL entry of an object that wasn't
+// created because an object with its name that isn't ours already exists, so
+// rolling back the WAL entry doesn't delete that object. The creation error
+// is returned.
+func keepConflictingObject(ctx context.Context, s logical.Storage, walID string, err error) error {
+	var conflict *objectConflictError
+	if !errors.As(err, &conflict) {
+		return err
+	}
+	if walErr := framework.DeleteWAL(ctx, s, walID); walErr != nil {
+		return multierror.Append(err, fmt.Errorf("error deleting WAL: %w", walErr))
+	}
+	return err
+}
+
+// create a namespace and put a WAL entry, so it's deleted if the creds
+// request fails. No WAL entry is kept if the namespace was created
+// concurrently by someone else.
+func createNamespaceWithWAL(ctx context.Context, client *client, s logical.Storage, name string, vaultRole *roleEntry) (string, error) {
+	walId, err := framework.PutWAL(ctx, s, walNamespaceKind, &walNamespace{
+		Name:       name,
+		Cluster:    client.cluster,
+		Expiration: time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error writing namespace WAL: %w", err)
+	}
+
+	created, err := client.createNamespace(ctx, name, vaultRole)
+	if err != nil {
+		return "", fmt.Errorf("failed to create namespace '%s': %s", name, err)
+	}
+	if !created {
+		if err := framework.DeleteWAL(ctx, s, walId); err != nil {
+			return "", fmt.Errorf("error deleting WAL: %w", err)
+		}
+		return "", nil
+	}
+
+	return walId, nil
 }
 
 // create role binding and put a WAL entry
-func createRoleBindingWithWAL(ctx context.Context, client *client, s logical.Storage, namespace, name, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry) (string, metav1.OwnerReference, error) {
+func createRoleBindingWithWAL(ctx context.Context, client *client, s logical.Storage, namespace, name, serviceAccountName, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry) (string, metav1.OwnerReference, error) {
 	// Write a WAL entry in case the role binding create doesn't complete
 	walId, err := framework.PutWAL(ctx, s, walBindingKind, &walRoleBinding{
 		Namespace:  namespace,
 		Name:       name,
 		IsCluster:  isClusterRoleBinding,
+		Cluster:    client.cluster,
 		Expiration: time.Now().Add(maxWALAge),
 	})
 	if err != nil {
 		return "", metav1.OwnerReference{}, fmt.Errorf("error writing role binding WAL: %w", err)
 	}
 
-	ownerRef, err := client.createRoleBinding(ctx, namespace, name, k8sRoleName, isClusterRoleBinding, vaultRole, nil)
+	ownerRef, err := client.createRoleBinding(ctx, namespace, name, serviceAccountName, k8sRoleName, isClusterRoleBinding, vaultRole, nil)
 	if err != nil {
+		err = keepConflictingObject(ctx, s, walId, err)
 		return "", ownerRef, fmt.Errorf("failed to create RoleBinding/ClusterRoleBinding '%s' for %s: %s", name, k8sRoleName, err)
 	}
 
 	return walId, ownerRef, nil
 }
 
-func createRoleBinding(ctx context.Context, client *client, namespace, name, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry, ownerRef metav1.OwnerReference) error {
-	_, err := client.createRoleBinding(ctx, namespace, name, k8sRoleName, isClusterRoleBinding, vaultRole, &ownerRef)
+func createRoleBinding(ctx context.Context, client *client, namespace, name, serviceAccountName, k8sRoleName string, isClusterRoleBinding bool, vaultRole *roleEntry, ownerRef metav1.OwnerReference) (types.UID, error) {
+	bindingRef, err := client.createRoleBinding(ctx, namespace, name, serviceAccountName, k8sRoleName, isClusterRoleBinding, vaultRole, &ownerRef)
 	if err != nil {
-		return fmt.Errorf("failed to create RoleBinding/ClusterRoleBinding '%s' for %s: %s", name, k8sRoleName, err)
+		return "", fmt.Errorf("failed to create RoleBinding/ClusterRoleBinding '%s' for %s: %s", name, k8sRoleName, err)
 	}
-	return nil
+	return bindingRef.UID, nil
 }
 
 // create a role and put a WAL entry
@@ -444,6 +1258,7 @@ func createRoleWithWAL(ctx context.Context, client *client, s logical.Storage, n
 		Namespace:  namespace,
 		Name:       name,
 		RoleType:   vaultRole.K8sRoleType,
+		Cluster:    client.cluster,
 		Expiration: time.Now().Add(maxWALAge),
 	})
 	if err != nil {
@@ -452,29 +1267,141 @@ func createRoleWithWAL(ctx context.Context, client *client, s logical.Storage, n
 
 	ownerRef, err := client.createRole(ctx, namespace, name, vaultRole)
 	if err != nil {
+		err = keepConflictingObject(ctx, s, walId, err)
 		return "", ownerRef, fmt.Errorf("failed to create Role/ClusterRole '%s/%s: %s", namespace, name, err)
 	}
 
 	return walId, ownerRef, nil
 }
 
-func getTokenTTL(token string) (time.Duration, error) {
-	parsed, err := josejwt.ParseSigned(token, AllowedSigningAlgs)
-	if err != nil {
-		return 0, err
+// leaseTTLs are the TTL and max TTL of a lease and its token
+type leaseTTLs struct {
+	ttl time.Duration
+	// maxTTL is the role's or mount's max TTL of the lease, or 0 if neither
+	// has one
+	maxTTL time.Duration
+	// warnings report each bound that changed the TTL
+	warnings []string
+	// rejected is the reason the TTL was rejected, if it was
+	rejected string
+}
+
+// leaseTTL determines the TTL of a lease and its token from the requested TTL
+// and the bounds of the role, the mount's config, Vault and the cluster. It's
+// used both when issuing creds and renewing their leases, so that renewals
+// stay within the same bounds. The request takes precedence, then the role,
+// then the mount's config, then the system. A limit above 0, e.g. the
+// remaining max TTL of a renewed lease, caps the TTL before the cluster's
+// bounds are applied.
+func (b *backend) leaseTTL(ctx context.Context, s logical.Storage, role *roleEntry, config *kubeConfig, cluster string, requested, limit time.Duration) (*leaseTTLs, error) {
+	theTTL := time.Duration(0)
+	switch {
+	case requested > 0:
+		theTTL = requested
+	case role.TokenDefaultTTL > 0:
+		theTTL = role.TokenDefaultTTL
+	case config != nil && config.DefaultTTL > 0:
+		theTTL = config.DefaultTTL
+	default:
+		theTTL = b.System().DefaultLeaseTTL()
 	}
-	claims := map[string]interface{}{}
-	err = parsed.UnsafeClaimsWithoutVerification(&claims)
-	if err != nil {
-		return 0, err
+
+	var warnings []string
+	// If the calculated TTL is greater than the role's max ttl, it'll be capped
+	// by the framework when returned. Catch it here so that the k8s token has
+	// the same capped TTL. Roles without a max ttl use the mount's.
+	maxTTL := role.TokenMaxTTL
+	switch {
+	case role.TokenMaxTTL > 0 && theTTL > role.TokenMaxTTL:
+		warnings = append(warnings, fmt.Sprintf("ttl of %s is greater than the role's token_max_ttl of %s; capping accordingly", theTTL.String(), role.TokenMaxTTL.String()))
+		theTTL = role.TokenMaxTTL
+	case role.TokenMaxTTL == 0 && config != nil && config.MaxTTL > 0:
+		maxTTL = config.MaxTTL
+		if theTTL > maxTTL {
+			warnings = append(warnings, fmt.Sprintf("ttl of %s is greater than the mount's max_ttl of %s; capping accordingly", theTTL.String(), maxTTL.String()))
+			theTTL = maxTTL
+		}
 	}
-	sa := struct {
-		Expiration int64 `mapstructure:"exp"`
-		IssuedAt   int64 `mapstructure:"iat"`
-	}{}
-	err = mapstructure.Decode(claims, &sa)
-	if err != nil {
-		return 0, err
+	// Similarly, if the calculated TTL is greater than the system's max lease
+	// ttl, cap accordingly here.
+	if theTTL > b.System().MaxLeaseTTL() {
+		warnings = append(warnings, fmt.Sprintf("ttl of %s is greater than Vault's max lease ttl %s; capping accordingly", theTTL.String(), b.System().MaxLeaseTTL().String()))
+		theTTL = b.System().MaxLeaseTTL()
+	}
+
+	// Finally, the mount's absolute_max_ttl caps the TTL regardless of the
+	// role's settings
+	if config != nil && config.AbsoluteMaxTTL > 0 {
+		if theTTL > config.AbsoluteMaxTTL {
+			warnings = append(warnings, fmt.Sprintf("ttl of %s is greater than the mount's absolute_max_ttl of %s; capping accordingly", theTTL.String(), config.AbsoluteMaxTTL.String()))
+			theTTL = config.AbsoluteMaxTTL
+		}
+		if maxTTL == 0 || maxTTL > config.AbsoluteMaxTTL {
+			maxTTL = config.AbsoluteMaxTTL
+		}
+	}
+	if limit > 0 && theTTL > limit {
+		theTTL = limit
+	}
+
+	// Some clusters clamp the expiration of requested tokens to their own
+	// bounds, so the cluster's bounds are applied here to keep the lease in
+	// sync with the token. Tokens stored in a Secret don't expire.
+	if role.TokenType != tokenTypeSecret {
+		clusterConfig := config
+		if cluster != "" {
+			var err error
+			clusterConfig, err = getClusterConfig(ctx, s, cluster)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case clusterConfig == nil:
+		case clusterConfig.MinTokenTTL > 0 && theTTL < clusterConfig.MinTokenTTL:
+			if clusterConfig.minTTLBehavior() == minTTLBehaviorReject {
+				return &leaseTTLs{rejected: fmt.Sprintf("ttl of %s is less than the cluster's min_token_ttl of %s", theTTL, clusterConfig.MinTokenTTL)}, nil
+			}
+			warnings = append(warnings, fmt.Sprintf("ttl of %s is less than the cluster's min_token_ttl of %s; raising accordingly", theTTL.String(), clusterConfig.MinTokenTTL.String()))
+			theTTL = clusterConfig.MinTokenTTL
+			// The lease can't outlive its limit, even if the cluster then
+			// issues a token with a longer TTL
+			if limit > 0 && theTTL > limit {
+				theTTL = limit
+			}
+		case clusterConfig.MaxTokenTTL > 0 && theTTL > clusterConfig.MaxTokenTTL:
+			warnings = append(warnings, fmt.Sprintf("ttl of %s is greater than the cluster's max_token_ttl of %s; capping accordingly", theTTL.String(), clusterConfig.MaxTokenTTL.String()))
+			theTTL = clusterConfig.MaxTokenTTL
+		}
+	}
+
+	return &leaseTTLs{ttl: theTTL, maxTTL: maxTTL, warnings: warnings}, nil
+}
+
+// tokenTTLTolerance is how much the TTL of a created token may differ from the
+// requested TTL before it's reported, to allow for the latency of the
+// request, the second precision of the expiration and clock skew between
+// Vault and the Kubernetes API server
+const tokenTTLTolerance = 5 * time.Second
+
+// grantedTokenTTL returns the TTL that the API server granted a token
+// requested at the given time, from the expiration in the TokenRequest's
+// status. It may be shorter than requested, e.g. if the API server's
+// --service-account-max-token-expiration is lower.
+func grantedTokenTTL(status *authenticationv1.TokenRequestStatus, requested time.Time) time.Duration {
+	return status.ExpirationTimestamp.Sub(requested).Round(time.Second)
+}
+
+// tokenStatusData returns the fields of the TokenRequestStatus that are
+// returned for include_token_status. The token is left out, since it's
+// already returned as service_account_token.
+func tokenStatusData(status *authenticationv1.TokenRequestStatus, granted time.Duration, warnings []string) map[string]interface{} {
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return map[string]interface{}{
+		"expiration_timestamp": status.ExpirationTimestamp.Format(time.RFC3339),
+		"expiration_seconds":   int64(granted.Seconds()),
+		"warnings":             warnings,
 	}
-	return time.Duration(sa.Expiration-sa.IssuedAt) * time.Second, nil
 }
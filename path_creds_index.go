@@ -0,0 +1,394 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	credsIndexPath = "creds-index/"
+
+	defaultCredsListLimit = 100
+	maxCredsListLimit     = 1000
+
+	// expiredLeaseGrace is how long the index entry of an expired lease is
+	// kept, to give Vault time to revoke it. Entries left after that belong
+	// to leases that Vault will never revoke, e.g. because they were force
+	// revoked, which would otherwise count against max_active_tokens and keep
+	// their objects and namespaces in use forever.
+	expiredLeaseGrace = time.Hour
+)
+
+// credsIndexEntry records the credentials issued for a lease, so that the
+// active leases can be listed. Entries are keyed by issue time, so listing
+// them returns the oldest first.
+type credsIndexEntry struct {
+	Role                    string    `json:"role"`
+	ServiceAccountNamespace string    `json:"service_account_namespace"`
+	ServiceAccountName      string    `json:"service_account_name"`
+	IssueTime               time.Time `json:"issue_time"`
+	ExpireTime              time.Time `json:"expire_time"`
+
+	// RotateTime is when the lease's objects were last recreated with
+	// rotate-binding, if they were
+	RotateTime time.Time `json:"rotate_time,omitempty"`
+
+	// InternalData is the internal data of the lease, used to revoke it
+	// without the lease, e.g. when its role is deleted
+	InternalData map[string]interface{} `json:"internal_data,omitempty"`
+}
+
+// newCredsIndexID returns an ID for a creds index entry, that sorts by the
+// time it was issued
+func newCredsIndexID(issueTime time.Time) (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%s", issueTime.UnixNano(), id), nil
+}
+
+func putCredsIndexEntry(ctx context.Context, s logical.Storage, id string, entry *credsIndexEntry) error {
+	storageEntry, err := logical.StorageEntryJSON(credsIndexPath+id, entry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, storageEntry)
+}
+
+func getCredsIndexEntry(ctx context.Context, s logical.Storage, id string) (*credsIndexEntry, error) {
+	storageEntry, err := s.Get(ctx, credsIndexPath+id)
+	if err != nil {
+		return nil, err
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	entry := new(credsIndexEntry)
+	if err := storageEntry.DecodeJSON(entry); err != nil {
+		return nil, fmt.Errorf("error reading creds index entry %q: %w", id, err)
+	}
+	return entry, nil
+}
+
+// extendCredsIndexEntry updates the expiration of the index entry of a
+// renewed lease, if it has one
+func extendCredsIndexEntry(ctx context.Context, s logical.Storage, id string, ttl time.Duration) error {
+	if id == "" {
+		return nil
+	}
+	entry, err := getCredsIndexEntry(ctx, s, id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+	entry.ExpireTime = time.Now().Add(ttl)
+	if err := putCredsIndexEntry(ctx, s, id, entry); err != nil {
+		return fmt.Errorf("error writing creds index entry: %w", err)
+	}
+	return nil
+}
+
+func deleteCredsIndexEntry(ctx context.Context, s logical.Storage, id string) error {
+	if id == "" {
+		return nil
+	}
+	return s.Delete(ctx, credsIndexPath+id)
+}
+
+// revokeRoleLeases deletes the Kubernetes objects of all leases in the creds
+// index that were issued for the role, and returns the number of leases that
+// were revoked, and skipped because their entries predate the lease's
+// internal data being recorded. The Vault leases themselves are left to
+// expire, and revoking them later finds their objects already gone.
+func (b *backend) revokeRoleLeases(ctx context.Context, s logical.Storage, roleName string) (int, int, error) {
+	ids, err := s.List(ctx, credsIndexPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	revoked, skipped := 0, 0
+	var errs *multierror.Error
+	for _, id := range ids {
+		entry, err := getCredsIndexEntry(ctx, s, id)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if entry == nil || entry.Role != roleName {
+			continue
+		}
+		if entry.InternalData == nil {
+			skipped++
+			continue
+		}
+		if _, err := b.revokeCreds(ctx, s, entry.InternalData); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("lease %q: %w", id, err))
+			continue
+		}
+		revoked++
+	}
+	if errs != nil {
+		return revoked, skipped, fmt.Errorf("revoked %d leases of role '%s', failed to revoke the others, which are queued for cleanup: %w", revoked, roleName, errs)
+	}
+
+	return revoked, skipped, nil
+}
+
+// pruneExpiredCreds revokes the leases in the creds index that expired more
+// than expiredLeaseGrace ago, deleting their objects and removing their
+// entries. Leases whose objects fail to delete are queued for cleanup, and
+// left to drainPendingCleanups until their objects are gone.
+func (b *backend) pruneExpiredCreds(ctx context.Context, s logical.Storage) error {
+	ids, err := s.List(ctx, credsIndexPath)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-expiredLeaseGrace)
+	var errs *multierror.Error
+	for _, id := range ids {
+		entry, err := getCredsIndexEntry(ctx, s, id)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if entry == nil || entry.ExpireTime.IsZero() || entry.ExpireTime.After(cutoff) {
+			continue
+		}
+		if entry.InternalData != nil {
+			pending, err := getPendingCleanup(ctx, s, leaseObjects(entry.InternalData).key())
+			if err != nil {
+				errs = multierror.Append(errs, err)
+				continue
+			}
+			if pending != nil {
+				continue
+			}
+			b.Logger().Info("revoking expired lease that wasn't revoked by Vault", "index_id", id, "role", entry.Role, "expire_time", entry.ExpireTime)
+			if _, err := b.revokeCreds(ctx, s, entry.InternalData); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("lease %q: %w", id, err))
+				continue
+			}
+		}
+		// The entry is removed even if its lease's internal data doesn't
+		// record the entry's ID, or predates the internal data being recorded
+		if err := b.removeCredsIndexEntry(ctx, s, id); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+func (b *backend) pathCredsList() *framework.Path {
+	return &framework.Path{
+		Pattern: pathCreds + "?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationSuffix: "credentials",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"limit": {
+				Type:        framework.TypeInt,
+				Description: fmt.Sprintf("The maximum number of leases to return. Defaults to %d, and may be at most %d.", defaultCredsListLimit, maxCredsListLimit),
+				Default:     defaultCredsListLimit,
+			},
+			"after": {
+				Type:        framework.TypeString,
+				Description: "Return leases after this key, e.g. the next_after value of the previous page.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathCredsListRead,
+			},
+		},
+		HelpSynopsis:    pathCredsListHelpSynopsis,
+		HelpDescription: pathCredsListHelpDescription,
+	}
+}
+
+func (b *backend) pathCredsListRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	limit := d.Get("limit").(int)
+	if limit <= 0 || limit > maxCredsListLimit {
+		return logical.ErrorResponse("limit must be between 1 and %d", maxCredsListLimit), nil
+	}
+	after := d.Get("after").(string)
+
+	ids, err := req.Storage.List(ctx, credsIndexPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	start := sort.SearchStrings(ids, after)
+	if start < len(ids) && ids[start] == after {
+		start++
+	}
+	ids = ids[start:]
+
+	nextAfter := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		nextAfter = ids[limit-1]
+	}
+
+	keys := make([]string, 0, len(ids))
+	keyInfo := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		entry, err := getCredsIndexEntry(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			// Revoked since it was listed
+			continue
+		}
+		keys = append(keys, id)
+		info := map[string]interface{}{
+			"role":                      entry.Role,
+			"service_account_namespace": entry.ServiceAccountNamespace,
+			"service_account_name":      entry.ServiceAccountName,
+			"issue_time":                entry.IssueTime.Format(time.RFC3339),
+			"expire_time":               entry.ExpireTime.Format(time.RFC3339),
+		}
+		if !entry.RotateTime.IsZero() {
+			info["rotate_time"] = entry.RotateTime.Format(time.RFC3339)
+		}
+		keyInfo[id] = info
+	}
+
+	resp := logical.ListResponseWithInfo(keys, keyInfo)
+	if nextAfter != "" {
+		resp.Data["next_after"] = nextAfter
+	}
+	return resp, nil
+}
+
+func (b *backend) pathCredsRoleList() *framework.Path {
+	return &framework.Path{
+		Pattern: pathCreds + framework.GenericNameRegex("name") + "/$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationSuffix: "role-credentials",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the Vault role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathCredsRoleListRead,
+			},
+		},
+		HelpSynopsis:    pathCredsRoleListHelpSynopsis,
+		HelpDescription: pathCredsRoleListHelpDescription,
+	}
+}
+
+func (b *backend) pathCredsRoleListRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName := d.Get("name").(string)
+
+	// Every lease has its own index entry, so concurrent creds requests never
+	// update the same entry, and listing them is consistent
+	ids, err := req.Storage.List(ctx, credsIndexPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	keys := []string{}
+	keyInfo := map[string]interface{}{}
+	namespaces := map[string]int{}
+	for _, id := range ids {
+		entry, err := getCredsIndexEntry(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || entry.Role != roleName {
+			// Revoked since it was listed, or issued for another role
+			continue
+		}
+		keys = append(keys, id)
+		namespaces[entry.ServiceAccountNamespace]++
+		info := map[string]interface{}{
+			"service_account_namespace": entry.ServiceAccountNamespace,
+			"service_account_name":      entry.ServiceAccountName,
+			"issue_time":                entry.IssueTime.Format(time.RFC3339),
+			"expire_time":               entry.ExpireTime.Format(time.RFC3339),
+		}
+		if !entry.RotateTime.IsZero() {
+			info["rotate_time"] = entry.RotateTime.Format(time.RFC3339)
+		}
+		if entry.InternalData != nil {
+			objects := leaseObjects(entry.InternalData)
+			if objects.Cluster != "" {
+				info["kubernetes_cluster"] = objects.Cluster
+			}
+			info["objects"] = createdObjects(objects)
+		}
+		keyInfo[id] = info
+	}
+
+	resp := logical.ListResponseWithInfo(keys, keyInfo)
+	resp.Data["namespaces"] = namespaces
+	return resp, nil
+}
+
+// createdObjects returns the kind and name of each of the lease's objects,
+// in the order they are deleted on revocation
+func createdObjects(p *pendingCleanup) []map[string]interface{} {
+	bindingKind := "RoleBinding"
+	if p.ClusterRoleBinding {
+		bindingKind = "ClusterRoleBinding"
+	}
+	var objects []map[string]interface{}
+	for _, obj := range []struct{ kind, name string }{
+		{p.RoleType, p.Role},
+		{bindingKind, p.RoleBinding},
+		{bindingKind, p.BaseRoleBinding},
+		{"Secret", p.TokenSecret},
+		{"ServiceAccount", p.ServiceAccount},
+		{"ClusterRole", p.SharedClusterRole},
+	} {
+		if obj.name == "" {
+			continue
+		}
+		objects = append(objects, map[string]interface{}{
+			"kind": obj.kind,
+			"name": obj.name,
+		})
+	}
+	return objects
+}
+
+const (
+	pathCredsRoleListHelpSynopsis    = `List the active credentials issued for a role.`
+	pathCredsRoleListHelpDescription = `Lists the credentials issued for the role that have not yet been revoked, oldest
+first, with the service account, expiry and Kubernetes objects created for each.
+"namespaces" counts the credentials in each namespace. Credentials issued before
+the objects of a lease were recorded are listed without their objects.`
+
+	pathCredsListHelpSynopsis    = `List the active credentials issued by this secrets engine.`
+	pathCredsListHelpDescription = `Lists the credentials that have been issued and not yet revoked, oldest first,
+with the role, service account and expiry of each. At most "limit" entries are
+returned; if there are more, "next_after" is set to the key to pass as "after"
+to fetch the next page.`
+)
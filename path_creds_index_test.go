@@ -0,0 +1,237 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testCredsList(t *testing.T, b *backend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      pathCreds,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestCredsIndex_list(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "indexed", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-role",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	var leases []map[string]interface{}
+	for i := 0; i < 3; i++ {
+		resp, err := testCredsCreate(t, b, s, "indexed", map[string]interface{}{"ttl": "1h"})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		require.NotEmpty(t, resp.Secret.InternalData["index_id"])
+		leases = append(leases, resp.Secret.InternalData)
+	}
+
+	resp, err = testCredsList(t, b, s, map[string]interface{}{"limit": 2})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{leases[0]["index_id"].(string), leases[1]["index_id"].(string)}, resp.Data["keys"])
+	assert.Equal(t, leases[1]["index_id"], resp.Data["next_after"])
+	info := resp.Data["key_info"].(map[string]interface{})[leases[0]["index_id"].(string)].(map[string]interface{})
+	assert.Equal(t, "indexed", info["role"])
+	assert.Equal(t, "app1", info["service_account_namespace"])
+	assert.Equal(t, leases[0]["created_service_account"], info["service_account_name"])
+
+	resp, err = testCredsList(t, b, s, map[string]interface{}{"limit": 2, "after": resp.Data["next_after"]})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{leases[2]["index_id"].(string)}, resp.Data["keys"])
+	assert.NotContains(t, resp.Data, "next_after")
+
+	// Revoked leases are removed from the index
+	_, err = testRevoke(t, b, s, leases[1])
+	require.NoError(t, err)
+	resp, err = testCredsList(t, b, s, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{leases[0]["index_id"].(string), leases[2]["index_id"].(string)}, resp.Data["keys"])
+
+	for _, limit := range []int{-1, 0, maxCredsListLimit + 1} {
+		resp, err = testCredsList(t, b, s, map[string]interface{}{"limit": limit})
+		require.NoError(t, err)
+		assert.Error(t, resp.Error(), limit)
+	}
+}
+
+func TestCredsIndex_roleList(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	for name, data := range map[string]map[string]interface{}{
+		"generated": {
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"generated_role_rules":          goodYAMLRules,
+		},
+		"other": {
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"kubernetes_role_name":          "existing-role",
+		},
+	} {
+		resp, err := testRoleCreate(t, b, s, name, data)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+	}
+
+	var leases []map[string]interface{}
+	for _, namespace := range []string{"app1", "app2", "app2"} {
+		resp, err := testCredsCreate(t, b, s, "generated", map[string]interface{}{"kubernetes_namespace": namespace})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases = append(leases, resp.Secret.InternalData)
+	}
+	resp, err := testCredsCreate(t, b, s, "other", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	roleList := func(roleName string) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      pathCreds + roleName + "/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		return resp
+	}
+
+	resp = roleList("generated")
+	assert.Equal(t, []string{leases[0]["index_id"].(string), leases[1]["index_id"].(string), leases[2]["index_id"].(string)}, resp.Data["keys"])
+	assert.Equal(t, map[string]int{"app1": 1, "app2": 2}, resp.Data["namespaces"])
+	name := leases[0]["created_service_account"].(string)
+	info := resp.Data["key_info"].(map[string]interface{})[leases[0]["index_id"].(string)].(map[string]interface{})
+	assert.Equal(t, "app1", info["service_account_namespace"])
+	assert.Equal(t, name, info["service_account_name"])
+	assert.Equal(t, []map[string]interface{}{
+		{"kind": "Role", "name": name},
+		{"kind": "RoleBinding", "name": name},
+		{"kind": "ServiceAccount", "name": name},
+	}, info["objects"])
+
+	// Revoked leases are no longer listed
+	_, err = testRevoke(t, b, s, leases[1])
+	require.NoError(t, err)
+	resp = roleList("generated")
+	assert.Equal(t, []string{leases[0]["index_id"].(string), leases[2]["index_id"].(string)}, resp.Data["keys"])
+	assert.Equal(t, map[string]int{"app1": 1, "app2": 1}, resp.Data["namespaces"])
+
+	resp = roleList("unknown")
+	assert.Empty(t, resp.Data["keys"])
+	assert.Empty(t, resp.Data["namespaces"])
+
+	// Creds issued concurrently are all listed
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := testCredsCreate(t, b, s, "other", nil)
+			assert.NoError(t, err)
+			assert.NoError(t, resp.Error())
+		}()
+	}
+	wg.Wait()
+	resp = roleList("other")
+	assert.Len(t, resp.Data["keys"], 11)
+	assert.Equal(t, map[string]int{"app1": 11}, resp.Data["namespaces"])
+}
+
+func TestCredsIndex_pruneExpired(t *testing.T) {
+	defer func(backoff time.Duration) { pendingCleanupBaseBackoff = backoff }(pendingCleanupBaseBackoff)
+	pendingCleanupBaseBackoff = 0
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "capped", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"max_active_tokens":             2,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	var leases []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		resp, err := testCredsCreate(t, b, s, "capped", map[string]interface{}{"ttl": "1h"})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases = append(leases, resp.Secret.InternalData)
+	}
+
+	// The first lease expired without Vault revoking it, e.g. because it
+	// was force revoked, and the second only just expired
+	expire := func(lease map[string]interface{}, ago time.Duration) {
+		id := lease["index_id"].(string)
+		entry, err := getCredsIndexEntry(ctx, s, id)
+		require.NoError(t, err)
+		entry.ExpireTime = time.Now().Add(-ago)
+		require.NoError(t, putCredsIndexEntry(ctx, s, id, entry))
+	}
+	expire(leases[0], expiredLeaseGrace+time.Minute)
+	expire(leases[1], time.Minute)
+	require.NoError(t, b.pruneExpiredCreds(ctx, s))
+
+	resp, err = testCredsList(t, b, s, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{leases[1]["index_id"].(string)}, resp.Data["keys"])
+	active, err := getActiveTokens(ctx, s, "capped")
+	require.NoError(t, err)
+	assert.Equal(t, 1, active.Count)
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, leases[0]["created_service_account"].(string), metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, leases[1]["created_service_account"].(string), metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// Revoking the pruned lease later doesn't release it twice
+	_, err = testRevoke(t, b, s, leases[0])
+	require.NoError(t, err)
+	active, err = getActiveTokens(ctx, s, "capped")
+	require.NoError(t, err)
+	assert.Equal(t, 1, active.Count)
+
+	// Expired leases whose objects fail to delete are left to the pending
+	// cleanups, which remove their entries once they succeed
+	expire(leases[1], expiredLeaseGrace+time.Minute)
+	fakeClient.PrependReactor("delete", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("nope")
+	})
+	assert.Error(t, b.pruneExpiredCreds(ctx, s))
+	require.NoError(t, b.pruneExpiredCreds(ctx, s))
+	resp, err = testCredsList(t, b, s, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{leases[1]["index_id"].(string)}, resp.Data["keys"])
+	fakeClient.ReactionChain = fakeClient.ReactionChain[1:]
+	require.NoError(t, b.drainPendingCleanups(ctx, s))
+	resp, err = testCredsList(t, b, s, nil)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Data["keys"])
+	active, err = getActiveTokens(ctx, s, "capped")
+	require.NoError(t, err)
+	assert.Equal(t, 0, active.Count)
+}
@@ -0,0 +1,343 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	pathCredsMulti     = "creds-multi/"
+	kubeTokenMultiType = "kube_token_multi"
+
+	// maxCredsMultiNamespaces bounds the number of namespaces of a single
+	// creds-multi request
+	maxCredsMultiNamespaces = 20
+	// credsMultiParallelism is the number of namespaces whose credentials
+	// are created concurrently
+	credsMultiParallelism = 4
+
+	pathCredsMultiHelpSyn  = `Request Kubernetes service account credentials in several namespaces at once.`
+	pathCredsMultiHelpDesc = `
+This path creates dynamic Kubernetes service account credentials for a Vault
+role in each of the given namespaces, as if creds/<role> was requested for each
+of them. If any of them fails, the credentials created for the others are
+revoked, so either all or none are returned.
+
+Since Vault returns a single lease per request, the credentials share one
+lease, but each namespace keeps its own lease semantics within it: its own
+TTL, creds index entry and token. Renewing the lease renews each namespace's
+credentials as creds/<role> would, with a new token per namespace, and the
+lease lasts until the first of them expires. Revoking the lease deletes the
+objects created in all of the namespaces.
+`
+)
+
+func (b *backend) pathCredentialsMulti() *framework.Path {
+	forwardOperation := &framework.PathOperation{
+		Callback:                    b.pathCredentialsMultiWrite,
+		ForwardPerformanceSecondary: true,
+		ForwardPerformanceStandby:   true,
+	}
+	return &framework.Path{
+		Pattern: pathCredsMulti + framework.GenericNameRegex("name"),
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "generate",
+			OperationSuffix: "credentials-multi",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the Vault role",
+				Required:    true,
+			},
+			"kubernetes_namespaces": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: fmt.Sprintf("The names of the Kubernetes namespaces in which to generate the credentials, at most %d.", maxCredsMultiNamespaces),
+				Required:    true,
+			},
+			"cluster_role_binding": {
+				Type:        framework.TypeBool,
+				Description: "If true, generate ClusterRoleBindings to grant permissions across the whole cluster instead of within a namespace. Requires the Vault role to have kubernetes_role_type set to ClusterRole.",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The TTL of the generated credentials",
+			},
+			"audiences": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The intended audiences of the generated credentials",
+			},
+			"bypass_namespace_cache": {
+				Type:        framework.TypeBool,
+				Description: "If true, look up the namespaces in the Kubernetes API rather than using the results cached for namespace_cache_ttl.",
+			},
+		},
+
+		HelpSynopsis:    pathCredsMultiHelpSyn,
+		HelpDescription: pathCredsMultiHelpDesc,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: forwardOperation,
+		},
+	}
+}
+
+func (b *backend) kubeServiceAccountMulti() *framework.Secret {
+	return &framework.Secret{
+		Type: kubeTokenMultiType,
+		Fields: map[string]*framework.FieldSchema{
+			"credentials": {
+				Type:        framework.TypeMap,
+				Description: "Kubernetes service account credentials, keyed by namespace",
+			},
+		},
+		Renew:  b.kubeTokenMultiRenew,
+		Revoke: b.kubeTokenMultiRevoke,
+	}
+}
+
+// credsMultiResult is the outcome of creating the credentials for one of the
+// namespaces of a creds-multi request
+type credsMultiResult struct {
+	namespace string
+	resp      *logical.Response
+	err       error
+}
+
+func (r *credsMultiResult) succeeded() bool {
+	return r.err == nil && r.resp != nil && !r.resp.IsError()
+}
+
+func (b *backend) pathCredentialsMultiWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName := d.Get("name").(string)
+
+	roleEntry, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+	if roleEntry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role '%s' does not exist", roleName)), nil
+	}
+
+	namespaces := strutil.RemoveDuplicatesStable(d.Get("kubernetes_namespaces").([]string), false)
+	if len(namespaces) == 0 {
+		return logical.ErrorResponse("kubernetes_namespaces is required"), nil
+	}
+	if len(namespaces) > maxCredsMultiNamespaces {
+		return logical.ErrorResponse("kubernetes_namespaces may contain at most %d namespaces", maxCredsMultiNamespaces), nil
+	}
+
+	request := credsRequest{
+		RoleName:             roleName,
+		ClusterRoleBinding:   d.Get("cluster_role_binding").(bool),
+		TTL:                  time.Duration(d.Get("ttl").(int)) * time.Second,
+		Audiences:            d.Get("audiences").([]string),
+		BypassNamespaceCache: d.Get("bypass_namespace_cache").(bool),
+	}
+	if err := checkAudiencesAllowed(roleEntry, request.Audiences); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTokenType(roleEntry, &request); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	results := make([]credsMultiResult, len(namespaces))
+	sem := make(chan struct{}, credsMultiParallelism)
+	var wg sync.WaitGroup
+	for i, namespace := range namespaces {
+		nsRequest := request
+		nsRequest.Namespace = namespace
+		results[i].namespace = namespace
+		wg.Add(1)
+		go func(result *credsMultiResult, request *credsRequest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			result.resp, result.err = b.issueCreds(ctx, req, roleEntry, request)
+		}(&results[i], &nsRequest)
+	}
+	wg.Wait()
+
+	// Either all of the namespaces get credentials or none do. The objects of
+	// a namespace that failed part way are rolled back by its WAL entries.
+	var errs *multierror.Error
+	internalErr := false
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			internalErr = true
+			errs = multierror.Append(errs, fmt.Errorf("namespace '%s': %w", result.namespace, result.err))
+		case result.resp.IsError():
+			errs = multierror.Append(errs, fmt.Errorf("namespace '%s': %w", result.namespace, result.resp.Error()))
+		}
+	}
+	if errs != nil {
+		for _, result := range results {
+			if !result.succeeded() {
+				continue
+			}
+			if _, err := b.revokeCreds(ctx, req.Storage, result.resp.Secret.InternalData); err != nil {
+				b.Logger().Warn("failed to revoke credentials after a creds-multi failure", "namespace", result.namespace, "error", err)
+			}
+		}
+		if internalErr {
+			return nil, errs
+		}
+		return logical.ErrorResponse(errs.Error()), nil
+	}
+
+	credentials := make(map[string]interface{}, len(results))
+	leases := make([]map[string]interface{}, 0, len(results))
+	var warnings []string
+	var ttl, maxTTL time.Duration
+	for _, result := range results {
+		secret := result.resp.Secret
+		data := result.resp.Data
+		data["ttl"] = int64(secret.TTL.Seconds())
+		credentials[result.namespace] = data
+		leases = append(leases, secret.InternalData)
+		for _, warning := range result.resp.Warnings {
+			warnings = append(warnings, fmt.Sprintf("namespace '%s': %s", result.namespace, warning))
+		}
+		// The shared lease ends when the first of the tokens expires
+		if ttl == 0 || secret.TTL < ttl {
+			ttl = secret.TTL
+		}
+		maxTTL = secret.MaxTTL
+	}
+
+	resp := b.Secret(kubeTokenMultiType).Response(map[string]interface{}{
+		"credentials": credentials,
+	}, map[string]interface{}{
+		"role":   roleName,
+		"leases": leases,
+	})
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = maxTTL
+	if len(warnings) > 0 {
+		resp.Warnings = warnings
+	}
+	return resp, nil
+}
+
+// kubeTokenMultiRenew renews the credentials of each namespace of a
+// creds-multi lease as a single lease of that namespace would be renewed, and
+// returns the namespaces' new tokens. The lease is extended until the first of
+// them expires. If a namespace fails, the creds index entries of the
+// namespaces renewed before it are reset, since the lease isn't extended.
+func (b *backend) kubeTokenMultiRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	leases := multiLeases(req.Secret.InternalData)
+
+	// The index entries as they were before the renewal
+	entries := make(map[string]*credsIndexEntry, len(leases))
+	for _, lease := range leases {
+		indexID, _ := lease["index_id"].(string)
+		if indexID == "" {
+			continue
+		}
+		entry, err := getCredsIndexEntry(ctx, req.Storage, indexID)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries[indexID] = entry
+		}
+	}
+
+	credentials := make(map[string]interface{}, len(leases))
+	var renewed []string
+	var ttl time.Duration
+	for _, lease := range leases {
+		namespace, _ := lease["service_account_namespace"].(string)
+		nsReq := *req
+		nsReq.Secret = &logical.Secret{
+			LeaseOptions: req.Secret.LeaseOptions,
+			InternalData: lease,
+		}
+		resp, err := b.kubeTokenRenew(ctx, &nsReq, d)
+		if err != nil {
+			for _, indexID := range renewed {
+				if err := putCredsIndexEntry(ctx, req.Storage, indexID, entries[indexID]); err != nil {
+					b.Logger().Warn("failed to reset the creds index entry after a creds-multi renewal failure", "index_id", indexID, "error", err)
+				}
+			}
+			return nil, fmt.Errorf("namespace '%s': %w", namespace, err)
+		}
+		if indexID, _ := lease["index_id"].(string); entries[indexID] != nil {
+			renewed = append(renewed, indexID)
+		}
+		data := resp.Data
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		data["ttl"] = int64(resp.Secret.TTL.Seconds())
+		credentials[namespace] = data
+		if ttl == 0 || resp.Secret.TTL < ttl {
+			ttl = resp.Secret.TTL
+		}
+	}
+
+	resp := &logical.Response{
+		Secret: req.Secret,
+		Data: map[string]interface{}{
+			"credentials": credentials,
+		},
+	}
+	resp.Secret.TTL = ttl
+	return resp, nil
+}
+
+// multiLeases returns the internal data of each namespace of a creds-multi
+// lease
+func multiLeases(internalData map[string]interface{}) []map[string]interface{} {
+	var leases []map[string]interface{}
+	switch raw := internalData["leases"].(type) {
+	case []map[string]interface{}:
+		leases = raw
+	case []interface{}:
+		// Decoded from the stored lease
+		for _, lease := range raw {
+			if lease, ok := lease.(map[string]interface{}); ok {
+				leases = append(leases, lease)
+			}
+		}
+	}
+	return leases
+}
+
+// kubeTokenMultiRevoke revokes the credentials of each namespace of a
+// creds-multi lease. Namespaces that fail are queued for cleanup like a
+// single lease, and the revoke is retried by Vault.
+func (b *backend) kubeTokenMultiRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	leases := multiLeases(req.Secret.InternalData)
+
+	cleanup := make(map[string]interface{}, len(leases))
+	var errs *multierror.Error
+	for _, lease := range leases {
+		namespace, _ := lease["service_account_namespace"].(string)
+		result, err := b.revokeCreds(ctx, req.Storage, lease)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("namespace '%s': %w", namespace, err))
+			continue
+		}
+		cleanup[namespace] = result
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	return &logical.Response{
+		Data: cleanup,
+	}, nil
+}
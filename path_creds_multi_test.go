@@ -0,0 +1,193 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testCredsMultiCreate(t *testing.T, b *backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      pathCredsMulti + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestCredsMulti(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "multi", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	t.Run("too many namespaces", func(t *testing.T) {
+		namespaces := make([]string, maxCredsMultiNamespaces+1)
+		for i := range namespaces {
+			namespaces[i] = "app" + string(rune('a'+i))
+		}
+		resp, err := testCredsMultiCreate(t, b, s, "multi", map[string]interface{}{
+			"kubernetes_namespaces": namespaces,
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "kubernetes_namespaces may contain at most 20 namespaces")
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		resp, err := testCredsMultiCreate(t, b, s, "multi", map[string]interface{}{
+			"kubernetes_namespaces": []string{"app1", "app3"},
+		})
+		require.NoError(t, err)
+		require.Error(t, resp.Error())
+		assert.Contains(t, resp.Error().Error(), "namespace 'app3': kubernetes_namespace 'app3' is not present in role's allowed_kubernetes_namespaces")
+
+		// The credentials created in app1 were revoked
+		accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, accounts.Items)
+		bindings, err := fakeClient.RbacV1().RoleBindings("app1").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, bindings.Items)
+		keys, err := s.List(ctx, credsIndexPath)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		resp, err := testCredsMultiCreate(t, b, s, "multi", map[string]interface{}{
+			"kubernetes_namespaces": []string{"app1", "app2", "app1"},
+			"ttl":                   "1h",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		require.NotNil(t, resp.Secret)
+		assert.Equal(t, kubeTokenMultiType, resp.Secret.InternalData["secret_type"])
+
+		credentials := resp.Data["credentials"].(map[string]interface{})
+		require.Len(t, credentials, 2)
+		for _, namespace := range []string{"app1", "app2"} {
+			data := credentials[namespace].(map[string]interface{})
+			assert.Equal(t, namespace, data["service_account_namespace"])
+			assert.NotEmpty(t, data["service_account_token"])
+			assert.Equal(t, int64(3600), data["ttl"])
+
+			name := data["service_account_name"].(string)
+			_, err := fakeClient.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+			require.NoError(t, err)
+		}
+		keys, err := s.List(ctx, credsIndexPath)
+		require.NoError(t, err)
+		assert.Len(t, keys, 2)
+
+		// Renew and revoke with the internal data as it comes back from storage
+		encoded, err := json.Marshal(resp.Secret.InternalData)
+		require.NoError(t, err)
+		var internalData map[string]interface{}
+		require.NoError(t, json.Unmarshal(encoded, &internalData))
+		leaseSecret := resp.Secret
+		leaseSecret.InternalData = internalData
+		leaseSecret.IssueTime = time.Now()
+		leaseSecret.Increment = 30 * time.Minute
+		resp, err = b.kubeTokenMultiRenew(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    leaseSecret,
+		}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 30*time.Minute, resp.Secret.TTL)
+		credentials = resp.Data["credentials"].(map[string]interface{})
+		require.Len(t, credentials, 2)
+		for _, namespace := range []string{"app1", "app2"} {
+			data := credentials[namespace].(map[string]interface{})
+			assert.Equal(t, namespace, data["service_account_namespace"])
+			assert.NotEmpty(t, data["service_account_token"])
+			assert.Equal(t, int64(1800), data["ttl"])
+		}
+
+		resp, err = b.kubeTokenMultiRevoke(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret: &logical.Secret{
+				InternalData: internalData,
+			},
+		}, nil)
+		require.NoError(t, err)
+		assert.Len(t, resp.Data, 2)
+
+		for _, namespace := range []string{"app1", "app2"} {
+			accounts, err := fakeClient.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, accounts.Items)
+			roles, err := fakeClient.RbacV1().Roles(namespace).List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, roles.Items)
+		}
+		keys, err = s.List(ctx, credsIndexPath)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("renewal failure", func(t *testing.T) {
+		resp, err := testCredsMultiCreate(t, b, s, "multi", map[string]interface{}{
+			"kubernetes_namespaces": []string{"app1", "app2"},
+			"ttl":                   "1h",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases := multiLeases(resp.Secret.InternalData)
+		require.Len(t, leases, 2)
+		expireTimes := make(map[string]time.Time, len(leases))
+		for _, lease := range leases {
+			indexID := lease["index_id"].(string)
+			entry, err := getCredsIndexEntry(ctx, s, indexID)
+			require.NoError(t, err)
+			expireTimes[indexID] = entry.ExpireTime
+		}
+
+		// Renewing the second namespace fails
+		fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "token" || action.GetNamespace() != "app2" {
+				return false, nil, nil
+			}
+			return true, nil, k8s_errors.NewForbidden(schema.GroupResource{Resource: "serviceaccounts"}, "", fmt.Errorf("denied"))
+		})
+		defer func() { fakeClient.ReactionChain = fakeClient.ReactionChain[1:] }()
+		leaseSecret := resp.Secret
+		leaseSecret.IssueTime = time.Now()
+		leaseSecret.Increment = 2 * time.Hour
+		_, err = b.kubeTokenMultiRenew(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    leaseSecret,
+		}, nil)
+		require.ErrorContains(t, err, "namespace 'app2'")
+
+		// The first namespace's index entry isn't extended
+		for indexID, expireTime := range expireTimes {
+			entry, err := getCredsIndexEntry(ctx, s, indexID)
+			require.NoError(t, err)
+			assert.True(t, expireTime.Equal(entry.ExpireTime), indexID)
+		}
+	})
+}
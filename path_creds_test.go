@@ -2,3 +2,3137 @@
 // SPDX-License-Identifier: MPL-2.0
 
 package kubesecrets
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// setupFakeClient sets the backend's client to one backed by a fake
+// clientset, writing a default config first if there is none. The client is
+// replaced if the config changes afterwards. TokenRequests against the fake
+// clientset return a signed JWT with the requested expiration and audiences.
+// Namespaces that weren't created exist with no labels, unless their name
+// starts with "missing-".
+func setupFakeClient(t *testing.T, b *backend, s logical.Storage) *fake.Clientset {
+	t.Helper()
+	return setupFakeClusterClient(t, b, s, "")
+}
+
+// setupFakeClusterClient is setupFakeClient for the named cluster, writing
+// its config at config/<cluster> first if there is none.
+func setupFakeClusterClient(t *testing.T, b *backend, s logical.Storage, cluster string) *fake.Clientset {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	require.NoError(t, err)
+
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		createAction := action.(k8stesting.CreateAction)
+		if createAction.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequest := createAction.GetObject().(*authenticationv1.TokenRequest)
+		issuedAt := time.Now()
+		expiration := issuedAt.Add(time.Duration(*tokenRequest.Spec.ExpirationSeconds) * time.Second)
+		token, err := josejwt.Signed(signer).Claims(josejwt.Claims{
+			Subject:  "system:serviceaccount:" + action.GetNamespace() + ":" + createAction.(k8stesting.CreateActionImpl).Name,
+			Audience: josejwt.Audience(tokenRequest.Spec.Audiences),
+			IssuedAt: josejwt.NewNumericDate(issuedAt),
+			Expiry:   josejwt.NewNumericDate(expiration),
+		}).Serialize()
+		if err != nil {
+			return true, nil, err
+		}
+		return true, &authenticationv1.TokenRequest{
+			Spec: tokenRequest.Spec,
+			Status: authenticationv1.TokenRequestStatus{
+				Token:               token,
+				ExpirationTimestamp: metav1.NewTime(expiration),
+			},
+		}, nil
+	})
+	fakeClient.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.GetAction).GetName()
+		if strings.HasPrefix(name, "missing-") {
+			return false, nil, nil
+		}
+		obj, err := fakeClient.Tracker().Get(corev1.SchemeGroupVersion.WithResource("namespaces"), "", name)
+		if k8s_errors.IsNotFound(err) {
+			return true, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+		}
+		return true, obj, err
+	})
+
+	config, err := getClusterConfig(context.Background(), s, cluster)
+	require.NoError(t, err)
+	if config == nil {
+		if cluster == "" {
+			testConfigWrite(t, b, s, nil)
+		} else {
+			testClusterConfigWrite(t, b, s, cluster, nil)
+		}
+	}
+	config, err = b.configWithDynamicValues(context.Background(), s, cluster)
+	require.NoError(t, err)
+	configHash, err := kubeConfigHash(config)
+	require.NoError(t, err)
+
+	b.clients[cluster] = &client{
+		k8s:                 fakeClient,
+		configHash:          configHash,
+		cluster:             cluster,
+		cacheTTL:            config.NamespaceCacheTTL,
+		controllerOwnerRefs: config.ControllerOwnerReferences,
+		blockOwnerDeletion:  config.BlockOwnerDeletion,
+		relyOnOwnerGC:       config.RelyOnOwnerGC,
+	}
+	return fakeClient
+}
+
+func testCredsCreate(t *testing.T, b *backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      pathCreds + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestCreds_tokenResponseKey(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "defaultkey", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "defaultkey", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.NotEmpty(t, resp.Data["service_account_token"])
+
+	resp, err = testRoleCreate(t, b, s, "customkey", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"token_response_key":            "token",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "customkey", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.NotEmpty(t, resp.Data["token"])
+	assert.NotContains(t, resp.Data, "service_account_token")
+	assert.Equal(t, "sa", resp.Data["service_account_name"])
+	assert.Equal(t, "app1", resp.Data["service_account_namespace"])
+}
+
+func TestCreds_namePrefix(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "prefixed", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-role",
+		"name_prefix":                   "myapp",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "prefixed", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Regexp(t, `^myapp-[a-z0-9-]+$`, resp.Data["service_account_name"])
+	assert.LessOrEqual(t, len(resp.Data["service_account_name"].(string)), 62)
+}
+
+func TestCreds_metadata(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "generated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-role",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	t.Run("invalid metadata", func(t *testing.T) {
+		for name, metadata := range map[string]map[string]interface{}{
+			"invalid key":  {"bad key!": "x"},
+			"reserved key": {"vault.hashicorp.com/lease": "x"},
+			"standard key": {"app.kubernetes.io/managed-by": "x"},
+			"long value":   {"job": strings.Repeat("a", maxCredsMetadataValueLength+1)},
+		} {
+			resp, err := testCredsCreate(t, b, s, "generated", map[string]interface{}{
+				"kubernetes_namespace": "app1",
+				"metadata":             metadata,
+			})
+			require.NoError(t, err, name)
+			assert.Error(t, resp.Error(), name)
+		}
+	})
+
+	t.Run("annotated", func(t *testing.T) {
+		resp, err := testCredsCreate(t, b, s, "generated", map[string]interface{}{
+			"kubernetes_namespace": "app1",
+			"metadata":             map[string]interface{}{"example.com/job-id": "1234"},
+			"annotate_metadata":    true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		assert.Equal(t, map[string]string{"example.com/job-id": "1234"}, resp.Data["metadata"])
+		assert.Equal(t, map[string]string{"example.com/job-id": "1234"}, resp.Secret.InternalData["metadata"])
+
+		sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(context.Background(), resp.Data["service_account_name"].(string), metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "1234", sa.Annotations["example.com/job-id"])
+	})
+}
+
+func TestCreds_templatedMetadata(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "templated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"extra_labels": map[string]interface{}{
+			"team":      "a",
+			"namespace": "{{.Namespace}}",
+		},
+		"extra_annotations": map[string]interface{}{
+			"example.com/requested-by": "{{.DisplayName}} via {{.RoleName}}",
+			"example.com/requested-at": "{{.Timestamp}}",
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	start := time.Now().UTC().Truncate(time.Second)
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation:   logical.UpdateOperation,
+		Path:        pathCreds + "templated",
+		Storage:     s,
+		DisplayName: "token-ci",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	name := resp.Data["service_account_name"].(string)
+
+	sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	for _, meta := range []metav1.ObjectMeta{sa.ObjectMeta, role.ObjectMeta} {
+		assert.Equal(t, "a", meta.Labels["team"])
+		assert.Equal(t, "app1", meta.Labels["namespace"])
+		assert.Equal(t, "token-ci via templated", meta.Annotations["example.com/requested-by"])
+		requestedAt, err := time.Parse(metadataTimestampFormat, meta.Annotations["example.com/requested-at"])
+		require.NoError(t, err)
+		assert.WithinRange(t, requestedAt, start, time.Now())
+	}
+
+	// The role keeps the templates
+	resp, err = testRoleRead(t, b, s, "templated")
+	require.NoError(t, err)
+	assert.Equal(t, "{{.Namespace}}", resp.Data["extra_labels"].(map[string]string)["namespace"])
+}
+
+func TestCreds_createdObjects(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "combined", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_role_name":          "existing-role",
+		"combine_rules":                 true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "combined", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	name := resp.Data["service_account_name"].(string)
+	assert.Equal(t, name, resp.Data["created_service_account"])
+	assert.Equal(t, name, resp.Data["created_role"])
+	assert.Equal(t, "Role", resp.Data["created_role_type"])
+	assert.Equal(t, name, resp.Data["created_role_binding"])
+	assert.Equal(t, name+baseRoleBindingSuffix, resp.Data["created_base_role_binding"])
+	assert.NotContains(t, resp.Data, "created_token_secret")
+
+	// Nothing is created for an existing service account
+	resp, err = testRoleCreate(t, b, s, "existing", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "existing-sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "existing", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	for key := range resp.Data {
+		assert.False(t, strings.HasPrefix(key, "created_"), key)
+	}
+}
+
+func TestCreds_includeUIDs(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	// The fake clientset doesn't assign UIDs
+	fakeClient.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "" {
+			obj := action.(k8stesting.CreateAction).GetObject().(metav1.Object)
+			obj.SetUID(types.UID(action.GetResource().Resource + "-uid"))
+		}
+		return false, nil, nil
+	})
+
+	testCases := map[string]struct {
+		roleData map[string]interface{}
+		expected map[string]interface{}
+	}{
+		"generated role": {
+			roleData: map[string]interface{}{"generated_role_rules": goodYAMLRules},
+			expected: map[string]interface{}{
+				"service_account_uid": "serviceaccounts-uid",
+				"role_uid":            "roles-uid",
+				"role_binding_uid":    "rolebindings-uid",
+			},
+		},
+		"existing role": {
+			roleData: map[string]interface{}{"kubernetes_role_name": "existing-role"},
+			expected: map[string]interface{}{
+				"service_account_uid": "serviceaccounts-uid",
+				"role_binding_uid":    "rolebindings-uid",
+			},
+		},
+		"existing service account": {
+			roleData: map[string]interface{}{"service_account_name": "existing-sa"},
+			expected: map[string]interface{}{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			roleName := strings.ReplaceAll(name, " ", "-")
+			tc.roleData["allowed_kubernetes_namespaces"] = []string{"app1"}
+			resp, err := testRoleCreate(t, b, s, roleName, tc.roleData)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+
+			resp, err = testCredsCreate(t, b, s, roleName, nil)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			for key := range tc.expected {
+				assert.NotContains(t, resp.Data, key)
+			}
+
+			resp, err = testCredsCreate(t, b, s, roleName, map[string]interface{}{
+				"include_uids": true,
+			})
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			uids := map[string]interface{}{}
+			for _, key := range []string{"service_account_uid", "role_uid", "role_binding_uid"} {
+				if uid, ok := resp.Data[key]; ok {
+					uids[key] = uid
+				}
+			}
+			assert.Equal(t, tc.expected, uids)
+		})
+	}
+}
+
+func TestCreds_includeTokenStatus(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "status", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "status", map[string]interface{}{"ttl": "1h"})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.NotContains(t, resp.Data, "token_status")
+
+	resp, err = testCredsCreate(t, b, s, "status", map[string]interface{}{
+		"ttl":                  "1h",
+		"include_token_status": true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	require.Contains(t, resp.Data, "token_status")
+	assert.Equal(t, map[string]interface{}{
+		"expiration_timestamp": resp.Data["service_account_token_expiration"],
+		"expiration_seconds":   int64(3600),
+		"warnings":             []string{},
+	}, resp.Data["token_status"])
+	assert.NotContains(t, fmt.Sprint(resp.Data["token_status"]), resp.Data["service_account_token"])
+
+	// A token the API server shortened is reported with the warning
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		createAction := action.(k8stesting.CreateAction)
+		if createAction.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequest := createAction.GetObject().(*authenticationv1.TokenRequest)
+		*tokenRequest.Spec.ExpirationSeconds = 1800
+		return false, nil, nil
+	})
+	resp, err = testCredsCreate(t, b, s, "status", map[string]interface{}{
+		"ttl":                  "1h",
+		"include_token_status": true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	status := resp.Data["token_status"].(map[string]interface{})
+	assert.Equal(t, int64(1800), status["expiration_seconds"])
+	assert.Equal(t, resp.Warnings, status["warnings"])
+	assert.Len(t, resp.Warnings, 1)
+}
+
+func TestCreds_nameIncludeNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "namespaced", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"kubernetes_role_name":          "existing-role",
+		"name_include_namespace":        true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "namespaced", map[string]interface{}{
+		"kubernetes_namespace": "a-very-long-namespace",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Regexp(t, `^v-a-very-l-[a-z0-9-]+$`, resp.Data["service_account_name"])
+	assert.LessOrEqual(t, len(resp.Data["service_account_name"].(string)), 62)
+
+	resp, err = testRoleCreate(t, b, s, "namespaced", map[string]interface{}{
+		"name_prefix": "myapp",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "namespaced", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Regexp(t, `^myapp-app1-[a-z0-9-]+$`, resp.Data["service_account_name"])
+
+	resp, err = testRoleCreate(t, b, s, "namespaced", map[string]interface{}{
+		"name_prefix":   "",
+		"name_template": "{{.RoleName}}-{{random 10}}",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "name_include_namespace can't be used with name_template, use {{.Namespace}} in the template instead")
+}
+
+func TestCreds_nameTemplateNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "nstemplate", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"kubernetes_role_name":          "existing-role",
+		"name_template":                 `{{ printf "v-%s-%s-%s" .Namespace .RoleName (random 8) | truncate 63 | lowercase }}`,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "nstemplate", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Regexp(t, `^v-app1-nstemplate-[a-z0-9]{8}$`, resp.Data["service_account_name"])
+
+	// The template's truncation still applies with a long namespace
+	longNamespace := strings.Repeat("a", 59)
+	resp, err = testCredsCreate(t, b, s, "nstemplate", map[string]interface{}{
+		"kubernetes_namespace": longNamespace,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "v-"+longNamespace+"-n", resp.Data["service_account_name"])
+}
+
+func TestCreds_absoluteMaxTTL(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"absolute_max_ttl": "1h",
+	})
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "capped", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"token_max_ttl":                 "2h",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{"token_max_ttl 2h0m0s is greater than the mount's absolute_max_ttl 1h0m0s, credentials will be capped at 1h0m0s"}, resp.Warnings)
+
+	resp, err = testCredsCreate(t, b, s, "capped", map[string]interface{}{
+		"ttl": "90m",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, time.Hour, resp.Secret.TTL)
+	assert.Equal(t, time.Hour, resp.Secret.MaxTTL)
+	assert.Contains(t, resp.Warnings, "ttl of 1h30m0s is greater than the mount's absolute_max_ttl of 1h0m0s; capping accordingly")
+
+	tokenTTL, err := getTokenTTL(resp.Data["service_account_token"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, tokenTTL)
+}
+
+func TestCreds_mountTTLs(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"default_ttl": "30m",
+		"max_ttl":     "2h",
+	})
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "mount-ttls", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleCreate(t, b, s, "role-ttls", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"token_default_ttl":             "1h",
+		"token_max_ttl":                 "3h",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	testCases := map[string]struct {
+		role        string
+		ttl         string
+		expectedTTL time.Duration
+		expectedMax time.Duration
+	}{
+		"mount default": {
+			role:        "mount-ttls",
+			expectedTTL: 30 * time.Minute,
+			expectedMax: 2 * time.Hour,
+		},
+		"request over mount default": {
+			role:        "mount-ttls",
+			ttl:         "90m",
+			expectedTTL: 90 * time.Minute,
+			expectedMax: 2 * time.Hour,
+		},
+		"capped at mount max": {
+			role:        "mount-ttls",
+			ttl:         "150m",
+			expectedTTL: 2 * time.Hour,
+			expectedMax: 2 * time.Hour,
+		},
+		"role over mount": {
+			role:        "role-ttls",
+			expectedTTL: time.Hour,
+			expectedMax: 3 * time.Hour,
+		},
+		"role max over mount max": {
+			role:        "role-ttls",
+			ttl:         "150m",
+			expectedTTL: 150 * time.Minute,
+			expectedMax: 3 * time.Hour,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			data := map[string]interface{}{}
+			if tc.ttl != "" {
+				data["ttl"] = tc.ttl
+			}
+			resp, err := testCredsCreate(t, b, s, tc.role, data)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			assert.Equal(t, tc.expectedTTL, resp.Secret.TTL)
+			assert.Equal(t, tc.expectedMax, resp.Secret.MaxTTL)
+		})
+	}
+}
+
+func TestCreds_serverShortenedToken(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	// Simulate an API server whose --service-account-max-token-expiration
+	// is an hour
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		createAction := action.(k8stesting.CreateAction)
+		if createAction.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequest := createAction.GetObject().(*authenticationv1.TokenRequest)
+		if *tokenRequest.Spec.ExpirationSeconds > 3600 {
+			*tokenRequest.Spec.ExpirationSeconds = 3600
+		}
+		return false, nil, nil
+	})
+
+	resp, err := testRoleCreate(t, b, s, "shortened", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "shortened", map[string]interface{}{"ttl": "2h"})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, time.Hour, resp.Secret.TTL)
+	assert.Equal(t, []string{"the created Kubernetes service accout token TTL 1h0m0s is less than the Vault lease TTL 2h0m0s; capping the lease TTL accordingly"}, resp.Warnings)
+	entry, err := getCredsIndexEntry(ctx, s, resp.Secret.InternalData["index_id"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entry.ExpireTime, time.Minute)
+
+	// Renewals are shortened too
+	leaseSecret := resp.Secret
+	leaseSecret.IssueTime = time.Now()
+	leaseSecret.Increment = 2 * time.Hour
+	resp, err = b.kubeTokenRenew(ctx, &logical.Request{
+		Operation: logical.RenewOperation,
+		Storage:   s,
+		Secret:    leaseSecret,
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, resp.Secret.TTL)
+
+	// Tokens issued as requested keep the requested TTL
+	resp, err = testCredsCreate(t, b, s, "shortened", map[string]interface{}{"ttl": "30m"})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, 30*time.Minute, resp.Secret.TTL)
+	assert.Empty(t, resp.Warnings)
+}
+
+func TestCreds_maxConcurrentCreds(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"max_concurrent_creds": 1,
+	})
+	fakeClient := setupFakeClient(t, b, s)
+	defer func(timeout time.Duration) { credsQueueTimeout = timeout }(credsQueueTimeout)
+	credsQueueTimeout = 100 * time.Millisecond
+
+	resp := testConfigRead(t, b, s)
+	assert.Equal(t, 1, resp.Data["max_concurrent_creds"])
+
+	resp, err := testRoleCreate(t, b, s, "limited", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-role",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	// Block the first request while it creates its service account
+	creating := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "" {
+			once.Do(func() {
+				close(creating)
+				<-unblock
+			})
+		}
+		return false, nil, nil
+	})
+
+	done := make(chan *logical.Response)
+	go func() {
+		resp, err := testCredsCreate(t, b, s, "limited", nil)
+		assert.NoError(t, err)
+		done <- resp
+	}()
+	<-creating
+
+	resp, err = testCredsCreate(t, b, s, "limited", nil)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), errCredsBusy.Error())
+
+	// Dry runs create nothing, so they aren't limited
+	resp, err = testCredsCreate(t, b, s, "limited", map[string]interface{}{"dry_run": true})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	close(unblock)
+	resp = <-done
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "limited", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestCreds_tokenTTLBounds(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"min_token_ttl": "10m",
+		"max_token_ttl": "1h",
+	})
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "bounded", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	testCases := map[string]struct {
+		ttl             string
+		expectedTTL     time.Duration
+		expectedWarning string
+	}{
+		"raised to min": {
+			ttl:             "5m",
+			expectedTTL:     10 * time.Minute,
+			expectedWarning: "ttl of 5m0s is less than the cluster's min_token_ttl of 10m0s; raising accordingly",
+		},
+		"within bounds": {
+			ttl:         "30m",
+			expectedTTL: 30 * time.Minute,
+		},
+		"capped at max": {
+			ttl:             "2h",
+			expectedTTL:     time.Hour,
+			expectedWarning: "ttl of 2h0m0s is greater than the cluster's max_token_ttl of 1h0m0s; capping accordingly",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := testCredsCreate(t, b, s, "bounded", map[string]interface{}{"ttl": tc.ttl})
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			assert.Equal(t, tc.expectedTTL, resp.Secret.TTL)
+			tokenTTL, err := getTokenTTL(resp.Data["service_account_token"].(string))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedTTL, tokenTTL)
+			if tc.expectedWarning == "" {
+				assert.Empty(t, resp.Warnings)
+			} else {
+				assert.Equal(t, []string{tc.expectedWarning}, resp.Warnings)
+			}
+		})
+	}
+
+	renew := func(t *testing.T, secret *logical.Secret, increment time.Duration) (*logical.Response, error) {
+		t.Helper()
+		secret.IssueTime = time.Now()
+		secret.Increment = increment
+		return b.kubeTokenRenew(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    secret,
+		}, nil)
+	}
+
+	t.Run("renewal", func(t *testing.T) {
+		resp, err := testCredsCreate(t, b, s, "bounded", map[string]interface{}{"ttl": "30m"})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		secret := resp.Secret
+
+		for increment, expectedTTL := range map[time.Duration]time.Duration{
+			5 * time.Minute:  10 * time.Minute,
+			30 * time.Minute: 30 * time.Minute,
+			2 * time.Hour:    time.Hour,
+		} {
+			resp, err = renew(t, secret, increment)
+			require.NoError(t, err)
+			assert.Equal(t, expectedTTL, resp.Secret.TTL, increment)
+			tokenTTL, err := getTokenTTL(resp.Data["service_account_token"].(string))
+			require.NoError(t, err)
+			assert.Equal(t, expectedTTL, tokenTTL, increment)
+		}
+	})
+
+	t.Run("rejected below min", func(t *testing.T) {
+		resp, err := testCredsCreate(t, b, s, "bounded", map[string]interface{}{"ttl": "30m"})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		secret := resp.Secret
+
+		testConfigWrite(t, b, s, map[string]interface{}{
+			"min_ttl_behavior": "reject",
+		})
+		setupFakeClient(t, b, s)
+		resp, err = testCredsCreate(t, b, s, "bounded", map[string]interface{}{"ttl": "5m"})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "ttl of 5m0s is less than the cluster's min_token_ttl of 10m0s")
+
+		_, err = renew(t, secret, 5*time.Minute)
+		assert.EqualError(t, err, "unable to renew the lease: ttl of 5m0s is less than the cluster's min_token_ttl of 10m0s")
+
+		resp, err = testCredsCreate(t, b, s, "bounded", map[string]interface{}{"ttl": "30m"})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		assert.Equal(t, 30*time.Minute, resp.Secret.TTL)
+	})
+}
+
+// getTokenTTL returns the TTL of the token from its iat and exp claims
+func getTokenTTL(token string) (time.Duration, error) {
+	parsed, err := josejwt.ParseSigned(token, AllowedSigningAlgs)
+	if err != nil {
+		return 0, err
+	}
+	claims := map[string]interface{}{}
+	err = parsed.UnsafeClaimsWithoutVerification(&claims)
+	if err != nil {
+		return 0, err
+	}
+	sa := struct {
+		Expiration int64 `mapstructure:"exp"`
+		IssuedAt   int64 `mapstructure:"iat"`
+	}{}
+	err = mapstructure.Decode(claims, &sa)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(sa.Expiration-sa.IssuedAt) * time.Second, nil
+}
+
+// tokenAudiences returns the aud claim of the token
+func tokenAudiences(t *testing.T, token string) []string {
+	t.Helper()
+	parsed, err := josejwt.ParseSigned(token, AllowedSigningAlgs)
+	require.NoError(t, err)
+	claims := josejwt.Claims{}
+	require.NoError(t, parsed.UnsafeClaimsWithoutVerification(&claims))
+	return claims.Audience
+}
+
+func TestCreds_roleAudiences(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	testCases := map[string]struct {
+		audiences []string
+		expected  []string
+	}{
+		"no audiences uses the API server audience": {
+			audiences: nil,
+			expected:  nil,
+		},
+		"single audience": {
+			audiences: []string{"vault"},
+			expected:  []string{"vault"},
+		},
+		"multiple audiences are passed as-is": {
+			audiences: []string{"istio-ca", "https://oidc.example.com"},
+			expected:  []string{"istio-ca", "https://oidc.example.com"},
+		},
+	}
+
+	i := 0
+	for name, tc := range testCases {
+		i++
+		roleName := fmt.Sprintf("audiences%d", i)
+		t.Run(name, func(t *testing.T) {
+			roleData := map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1"},
+				"service_account_name":          "sa",
+			}
+			if tc.audiences != nil {
+				roleData["token_default_audiences"] = tc.audiences
+			}
+			resp, err := testRoleCreate(t, b, s, roleName, roleData)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+
+			resp, err = testCredsCreate(t, b, s, roleName, nil)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			assert.Equal(t, tc.expected, tokenAudiences(t, resp.Data["service_account_token"].(string)))
+		})
+	}
+}
+
+func TestCreds_requestAudiences(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "restricted", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"token_default_audiences":       []string{"other"},
+		"allowed_audiences":             []string{"vault", "istio-ca"},
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "invalid token_default_audiences: audience 'other' is not in the role's allowed_audiences: vault, istio-ca")
+
+	resp, err = testRoleCreate(t, b, s, "restricted", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"token_default_audiences":       []string{"vault"},
+		"allowed_audiences":             []string{"vault", "istio-ca"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	// The role's default audiences are used if none are requested
+	resp, err = testCredsCreate(t, b, s, "restricted", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{"vault"}, resp.Data["audiences"])
+	assert.Equal(t, []string{"vault"}, tokenAudiences(t, resp.Data["service_account_token"].(string)))
+
+	resp, err = testCredsCreate(t, b, s, "restricted", map[string]interface{}{
+		"audiences": []string{"istio-ca"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{"istio-ca"}, resp.Data["audiences"])
+	assert.Equal(t, []string{"istio-ca"}, tokenAudiences(t, resp.Data["service_account_token"].(string)))
+
+	resp, err = testCredsCreate(t, b, s, "restricted", map[string]interface{}{
+		"audiences": []string{"istio-ca", "https://oidc.example.com"},
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "audience 'https://oidc.example.com' is not in the role's allowed_audiences: vault, istio-ca")
+
+	// Without token_default_audiences, the first allowed audience is the
+	// default rather than the cluster's
+	resp, err = testRoleCreate(t, b, s, "allowlist-only", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"allowed_audiences":             []string{"istio-ca", "vault"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleRead(t, b, s, "allowlist-only")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"istio-ca", "vault"}, resp.Data["allowed_audiences"])
+	resp, err = testCredsCreate(t, b, s, "allowlist-only", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{"istio-ca"}, resp.Data["audiences"])
+	assert.Equal(t, []string{"istio-ca"}, tokenAudiences(t, resp.Data["service_account_token"].(string)))
+	resp, err = testCredsCreate(t, b, s, "allowlist-only", map[string]interface{}{
+		"audiences": []string{"https://oidc.example.com"},
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "audience 'https://oidc.example.com' is not in the role's allowed_audiences: istio-ca, vault")
+}
+
+func TestCreds_timeoutRollsBack(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	fakeClient.PrependReactor("create", "rolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, &url.Error{Op: "Post", URL: "https://kubernetes.example.com", Err: context.DeadlineExceeded}
+	})
+
+	resp, err := testRoleCreate(t, b, s, "timeout", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	_, err = testCredsCreate(t, b, s, "timeout", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.ErrorContains(t, err, "context deadline exceeded")
+
+	// The WAL entry for the created Role is left behind, so rolling it back
+	// deletes the Role
+	ctx := context.Background()
+	roles, err := fakeClient.RbacV1().Roles("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, roles.Items, 1)
+	walIDs, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Len(t, walIDs, 1)
+	wal, err := framework.GetWAL(ctx, s, walIDs[0])
+	require.NoError(t, err)
+	require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, wal.Kind, wal.Data))
+	roles, err = fakeClient.RbacV1().Roles("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, roles.Items)
+}
+
+func TestCreds_tokenFailureRollsBack(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		return true, nil, k8s_errors.NewForbidden(schema.GroupResource{Resource: "serviceaccounts/token"}, "", fmt.Errorf("denied"))
+	})
+
+	resp, err := testRoleCreate(t, b, s, "tokenfail", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "base",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	_, err = testCredsCreate(t, b, s, "tokenfail", nil)
+	require.ErrorContains(t, err, "failed to create a service account token")
+
+	// The WAL entries for the RoleBinding and the ServiceAccount are left
+	// behind, and rolling them back deletes both. The fake clientset doesn't
+	// garbage collect, so the ServiceAccount is only deleted by its own WAL.
+	ctx := context.Background()
+	accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, accounts.Items, 1)
+	name := accounts.Items[0].Name
+	walIDs, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Len(t, walIDs, 2)
+	var kinds []string
+	for _, walID := range walIDs {
+		wal, err := framework.GetWAL(ctx, s, walID)
+		require.NoError(t, err)
+		kinds = append(kinds, wal.Kind)
+		require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, wal.Kind, wal.Data))
+	}
+	assert.ElementsMatch(t, []string{walBindingKind, walServiceAccountKind}, kinds)
+	accounts, err = fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, accounts.Items)
+	bindings, err := fakeClient.RbacV1().RoleBindings("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bindings.Items)
+
+	// Rolling back an already deleted ServiceAccount succeeds
+	require.NoError(t, b.rollbackServiceAccountWAL(ctx, &logical.Request{Storage: s}, map[string]interface{}{
+		"Namespace":  "app1",
+		"Name":       name,
+		"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+	}))
+}
+
+func TestCreds_namespacePatterns(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	testCases := map[string]struct {
+		patterns []string
+		allowed  []string
+		denied   []string
+	}{
+		"prefix": {
+			patterns: []string{"team-a-*"},
+			allowed:  []string{"team-a-prod", "team-a-staging", "team-a-"},
+			denied:   []string{"team-b-prod", "team-a", "xteam-a-prod", "Team-a-prod"},
+		},
+		"suffix": {
+			patterns: []string{"*-prod"},
+			allowed:  []string{"team-a-prod", "team-b-prod"},
+			denied:   []string{"team-a-staging", "team-a-prod-2"},
+		},
+		"multi-segment": {
+			patterns: []string{"team-*-prod-?"},
+			allowed:  []string{"team-a-prod-1", "team-payments-prod-2"},
+			denied:   []string{"team-a-prod", "team-a-prod-12", "team-a-staging-1"},
+		},
+		"character class and exact": {
+			patterns: []string{"team-[ab]-prod", "default"},
+			allowed:  []string{"team-a-prod", "team-b-prod", "default"},
+			denied:   []string{"team-c-prod", "default-2"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := testRoleCreate(t, b, s, "patterns", map[string]interface{}{
+				"allowed_kubernetes_namespaces": tc.patterns,
+				"service_account_name":          "sa",
+			})
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+
+			for _, namespace := range tc.allowed {
+				resp, err := testCredsCreate(t, b, s, "patterns", map[string]interface{}{
+					"kubernetes_namespace": namespace,
+				})
+				require.NoError(t, err, namespace)
+				assert.NoError(t, resp.Error(), namespace)
+			}
+			for _, namespace := range tc.denied {
+				resp, err := testCredsCreate(t, b, s, "patterns", map[string]interface{}{
+					"kubernetes_namespace": namespace,
+				})
+				require.NoError(t, err, namespace)
+				assert.Error(t, resp.Error(), namespace)
+			}
+		})
+	}
+
+	t.Run("single pattern requires a namespace", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "single-pattern", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"team-a-*"},
+			"service_account_name":          "sa",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		_, err = testCredsCreate(t, b, s, "single-pattern", nil)
+		assert.EqualError(t, err, "error verifying namespace: 'kubernetes_namespace' is required unless the Vault role has a single namespace specified")
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "bad-pattern", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"team-[a"},
+			"service_account_name":          "sa",
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "invalid allowed_kubernetes_namespaces pattern 'team-[a': syntax error in pattern")
+	})
+}
+
+func TestCreds_defaultNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "defaulted", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+		"default_namespace":             "app2",
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "defaulted", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "app2", resp.Data["service_account_namespace"])
+
+	// An explicit namespace overrides the default
+	resp, err = testCredsCreate(t, b, s, "defaulted", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "app1", resp.Data["service_account_namespace"])
+
+	// A default that a selector has to allow is checked when creds are
+	// requested
+	resp, err = testRoleCreate(t, b, s, "defaulted-selector", map[string]interface{}{
+		"allowed_kubernetes_namespace_selector": `{"matchLabels":{"target":"integration-test"}}`,
+		"default_namespace":                     "app2",
+		"service_account_name":                  "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "defaulted-selector", nil)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "kubernetes_namespace 'app2' is not present in role's allowed_kubernetes_namespaces or does not match role's label selector allowed_kubernetes_namespace_selector")
+}
+
+func TestCreds_deniedNamespaces(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "denied", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"denied_kubernetes_namespaces":  []string{"kube-*", "default"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      rolesPath + "denied",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "kube-*"}, resp.Data["denied_kubernetes_namespaces"])
+
+	for _, namespace := range []string{"kube-system", "kube-public", "default"} {
+		resp, err := testCredsCreate(t, b, s, "denied", map[string]interface{}{
+			"kubernetes_namespace": namespace,
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), fmt.Sprintf("kubernetes_namespace '%s' is denied by role's denied_kubernetes_namespaces", namespace))
+	}
+	resp, err = testCredsCreate(t, b, s, "denied", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.NoError(t, resp.Error())
+
+	// Denies take precedence over an exact allow
+	resp, err = testRoleCreate(t, b, s, "denied-exact", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"kube-system"},
+		"denied_kubernetes_namespaces":  []string{"kube-*"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "denied-exact", nil)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "kubernetes_namespace 'kube-system' is denied by role's denied_kubernetes_namespaces")
+}
+
+func TestCreds_protectedNamespaces(t *testing.T) {
+	t.Setenv(localNamespaceEnv, "vault")
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "anywhere", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	testCreds := func(namespace string) *logical.Response {
+		t.Helper()
+		resp, err := testCredsCreate(t, b, s, "anywhere", map[string]interface{}{
+			"kubernetes_namespace": namespace,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Vault's own namespace is protected by default
+	resp = testCreds("vault")
+	assert.EqualError(t, resp.Error(), "kubernetes_namespace 'vault' is protected since Vault runs in it, set protected_namespaces in the config to override")
+	assert.NoError(t, testCreds("app1").Error())
+
+	// An explicit list replaces the default
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"protected_namespaces": "kube-*,default",
+	})
+	setupFakeClient(t, b, s)
+	resp = testConfigRead(t, b, s)
+	assert.Equal(t, &[]string{"kube-*", "default"}, resp.Data["protected_namespaces"])
+	resp = testCreds("kube-system")
+	assert.EqualError(t, resp.Error(), "kubernetes_namespace 'kube-system' is protected by the config's protected_namespaces entry 'kube-*'")
+	assert.NoError(t, testCreds("vault").Error())
+
+	// An empty list protects no namespace
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"protected_namespaces": "",
+	})
+	setupFakeClient(t, b, s)
+	assert.NoError(t, testCreds("vault").Error())
+	assert.NoError(t, testCreds("kube-system").Error())
+}
+
+func TestCreds_namespaceSelector(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+
+	for name, owner := range map[string]string{"app1": "team-a", "app2": "team-b"} {
+		_, err := fakeClient.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"owner": owner}},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	gets := 0
+	fakeClient.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	resp, err := testRoleCreate(t, b, s, "bad-selector", map[string]interface{}{
+		"allowed_kubernetes_namespace_selector": "owner in (team-a",
+		"service_account_name":                  "sa",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "failed to parse 'allowed_kubernetes_namespace_selector' as k8s.io/api/meta/v1/LabelSelector object")
+
+	// A label selector string is accepted as well as a LabelSelector object
+	resp, err = testRoleCreate(t, b, s, "selector", map[string]interface{}{
+		"allowed_kubernetes_namespace_selector": "owner=team-a",
+		"service_account_name":                  "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "selector", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "selector", map[string]interface{}{
+		"kubernetes_namespace": "app2",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "kubernetes_namespace 'app2' is not present in role's allowed_kubernetes_namespaces or does not match role's label selector allowed_kubernetes_namespace_selector")
+
+	// Each namespace is looked up once and cached, rather than listing the
+	// namespaces matching the selector
+	resp, err = testCredsCreate(t, b, s, "selector", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.NoError(t, resp.Error())
+	assert.Equal(t, 2, gets)
+
+	// A kubernetes_namespace is required, since the selector may match more
+	// than one namespace
+	resp, err = testCredsCreate(t, b, s, "selector", nil)
+	assert.ErrorContains(t, err, "'kubernetes_namespace' is required")
+
+	// Getting namespaces isn't allowed
+	b.clearNamespaceCaches()
+	fakeClient.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8s_errors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "", fmt.Errorf("nope"))
+	})
+	_, err = testCredsCreate(t, b, s, "selector", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	assert.ErrorContains(t, err, "allowed_kubernetes_namespace_selector requires permission to get namespaces")
+}
+
+func TestCreds_combineRules(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "combined", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "base",
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set, unless both service_account_name and kubernetes_role_name are set")
+
+	resp, err = testRoleCreate(t, b, s, "combined", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "base",
+		"combine_rules":                 true,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "combine_rules requires both kubernetes_role_name and generated_role_rules, and can't be used with service_account_name")
+
+	resp, err = testRoleCreate(t, b, s, "combined", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "base",
+		"generated_role_rules":          goodYAMLRules,
+		"combine_rules":                 true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "combined", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	name := resp.Data["service_account_name"].(string)
+	assert.Equal(t, name, resp.Secret.InternalData["created_role"])
+	assert.Equal(t, name, resp.Secret.InternalData["created_role_binding"])
+	assert.Equal(t, name+"-base", resp.Secret.InternalData["created_base_role_binding"])
+
+	role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	for binding, roleName := range map[string]string{name: name, name + "-base": "base"} {
+		rb, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, binding, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, roleName, rb.RoleRef.Name)
+		require.Len(t, rb.Subjects, 1)
+		assert.Equal(t, name, rb.Subjects[0].Name)
+		// Both bindings are owned by the generated Role
+		require.Len(t, rb.OwnerReferences, 1)
+		assert.Equal(t, role.UID, rb.OwnerReferences[0].UID)
+	}
+
+	resp, err = testRevoke(t, b, s, resp.Secret.InternalData)
+	require.NoError(t, err)
+	assert.Equal(t, cleanupDeleted, resp.Data["BaseRoleBinding"])
+	bindings, err := fakeClient.RbacV1().RoleBindings("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bindings.Items)
+}
+
+func TestCreds_finalizers(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"role_finalizers":               "cleanup",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "invalid role_finalizers entry 'cleanup': must be domain-qualified, e.g. 'example.com/cleanup'")
+
+	resp, err = testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"role_binding_finalizers":       "example.com/-cleanup",
+	})
+	require.NoError(t, err)
+	require.Error(t, resp.Error())
+	assert.Contains(t, resp.Error().Error(), "invalid role_binding_finalizers entry 'example.com/-cleanup'")
+
+	resp, err = testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-role",
+		"role_finalizers":               "example.com/cleanup",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "role_finalizers requires generated_role_rules, and can't be used with shared_cluster_role")
+
+	resp, err = testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "existing-sa",
+		"role_binding_finalizers":       "example.com/cleanup",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "role_binding_finalizers can't be used with service_account_name alone, since no role binding is generated")
+
+	resp, err = testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"role_finalizers":               "example.com/cleanup,example.com/audit",
+		"role_binding_finalizers":       "example.com/cleanup",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleRead(t, b, s, "finalized")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com/cleanup", "example.com/audit"}, resp.Data["role_finalizers"])
+	assert.Equal(t, []string{"example.com/cleanup"}, resp.Data["role_binding_finalizers"])
+	assert.Equal(t, false, resp.Data["force_remove_finalizers"])
+
+	// Like the API server, only mark objects with finalizers for deletion
+	for _, resource := range []string{"roles", "rolebindings"} {
+		fakeClient.PrependReactor("delete", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			deleteAction := action.(k8stesting.DeleteAction)
+			obj, err := fakeClient.Tracker().Get(action.GetResource(), action.GetNamespace(), deleteAction.GetName())
+			if err != nil {
+				return false, nil, nil
+			}
+			objectMeta, err := meta.Accessor(obj)
+			if err != nil || len(objectMeta.GetFinalizers()) == 0 {
+				return false, nil, nil
+			}
+			now := metav1.Now()
+			objectMeta.SetDeletionTimestamp(&now)
+			return true, nil, fakeClient.Tracker().Update(action.GetResource(), obj, action.GetNamespace())
+		})
+	}
+	// A finalizer of another controller, which is never removed by Vault
+	addFinalizer := func(t *testing.T, name string) {
+		t.Helper()
+		role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		role.Finalizers = append(role.Finalizers, "other.example.com/keep")
+		_, err = fakeClient.RbacV1().Roles("app1").Update(ctx, role, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	t.Run("kept until removed by their controllers", func(t *testing.T) {
+		resp, err := testCredsCreate(t, b, s, "finalized", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		name := resp.Data["service_account_name"].(string)
+		assert.NotContains(t, resp.Secret.InternalData, "remove_finalizers")
+
+		role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"example.com/cleanup", "example.com/audit"}, role.Finalizers)
+		binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"example.com/cleanup"}, binding.Finalizers)
+
+		_, err = testRevoke(t, b, s, resp.Secret.InternalData)
+		require.NoError(t, err)
+		role, err = fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotNil(t, role.DeletionTimestamp)
+		assert.Equal(t, []string{"example.com/cleanup", "example.com/audit"}, role.Finalizers)
+	})
+
+	t.Run("force removed", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+			"force_remove_finalizers": true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		resp, err = testCredsCreate(t, b, s, "finalized", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		name := resp.Data["service_account_name"].(string)
+		assert.Equal(t, []string{"example.com/cleanup", "example.com/audit"}, resp.Secret.InternalData["remove_finalizers"])
+		addFinalizer(t, name)
+
+		// The finalizers are recorded with the lease, so changing the role
+		// doesn't affect it
+		resp2, err := testRoleCreate(t, b, s, "finalized", map[string]interface{}{
+			"force_remove_finalizers": false,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp2.Error())
+
+		_, err = testRevoke(t, b, s, resp.Secret.InternalData)
+		require.NoError(t, err)
+		role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotNil(t, role.DeletionTimestamp)
+		assert.Equal(t, []string{"other.example.com/keep"}, role.Finalizers)
+		binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, binding.Finalizers)
+	})
+}
+
+func TestCreds_ownerReferenceFlags(t *testing.T) {
+	ctx := context.Background()
+	set := true
+
+	testCases := map[string]struct {
+		config     map[string]interface{}
+		controller *bool
+		block      *bool
+	}{
+		"default": {},
+		"controller and block owner deletion": {
+			config: map[string]interface{}{
+				"controller_owner_references": true,
+				"block_owner_deletion":        true,
+			},
+			controller: &set,
+			block:      &set,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackend(t)
+			testConfigWrite(t, b, s, tc.config)
+			fakeClient := setupFakeClient(t, b, s)
+
+			resp, err := testRoleCreate(t, b, s, "owned", map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1"},
+				"generated_role_rules":          goodYAMLRules,
+			})
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+
+			resp, err = testCredsCreate(t, b, s, "owned", map[string]interface{}{"dry_run": true})
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			objects := resp.Data["objects"].([]map[string]interface{})
+			require.NotEmpty(t, objects)
+			for _, object := range objects[1:] {
+				refs := object["metadata"].(map[string]interface{})["ownerReferences"].([]interface{})
+				ref := refs[0].(map[string]interface{})
+				assert.Equal(t, tc.controller != nil, ref["controller"] == true, object["kind"])
+				assert.Equal(t, tc.block != nil, ref["blockOwnerDeletion"] == true, object["kind"])
+			}
+
+			resp, err = testCredsCreate(t, b, s, "owned", nil)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			name := resp.Data["service_account_name"].(string)
+
+			k8sRole, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+			require.NoError(t, err)
+			wantRef := metav1.OwnerReference{
+				APIVersion:         "rbac.authorization.k8s.io/v1",
+				Kind:               "Role",
+				Name:               name,
+				UID:                k8sRole.UID,
+				Controller:         tc.controller,
+				BlockOwnerDeletion: tc.block,
+			}
+			binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, []metav1.OwnerReference{wantRef}, binding.OwnerReferences)
+			sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, []metav1.OwnerReference{wantRef}, sa.OwnerReferences)
+
+			// Revoking still deletes each object explicitly, regardless of
+			// garbage collection
+			_, err = testRevoke(t, b, s, resp.Secret.InternalData)
+			require.NoError(t, err)
+			_, err = fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+			assert.True(t, k8s_errors.IsNotFound(err))
+			_, err = fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+			assert.True(t, k8s_errors.IsNotFound(err))
+			_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+			assert.True(t, k8s_errors.IsNotFound(err))
+		})
+	}
+}
+
+func TestCreds_relyOnOwnerGC(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"rely_on_owner_gc": true,
+	})
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	deletedResources := func() []string {
+		var resources []string
+		for _, action := range fakeClient.Actions() {
+			if action.GetVerb() == "delete" {
+				resources = append(resources, action.GetResource().Resource)
+			}
+		}
+		return resources
+	}
+
+	testCases := map[string]struct {
+		roleName string
+		role     map[string]interface{}
+		deleted  []string
+		cleanup  map[string]interface{}
+	}{
+		"generated role": {
+			roleName: "generated",
+			role: map[string]interface{}{
+				"generated_role_rules": goodYAMLRules,
+			},
+			deleted: []string{"roles"},
+			cleanup: map[string]interface{}{
+				"Role":           cleanupDeleted,
+				"RoleBinding":    cleanupGarbageCollected,
+				"ServiceAccount": cleanupGarbageCollected,
+			},
+		},
+		"existing role": {
+			roleName: "existing",
+			role: map[string]interface{}{
+				"kubernetes_role_name": "reader",
+			},
+			deleted: []string{"rolebindings"},
+			cleanup: map[string]interface{}{
+				"RoleBinding":    cleanupDeleted,
+				"ServiceAccount": cleanupGarbageCollected,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.role["allowed_kubernetes_namespaces"] = []string{"app1"}
+			resp, err := testRoleCreate(t, b, s, tc.roleName, tc.role)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			resp, err = testCredsCreate(t, b, s, tc.roleName, nil)
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+			name := resp.Data["service_account_name"].(string)
+
+			fakeClient.ClearActions()
+			resp, err = testRevoke(t, b, s, resp.Secret.InternalData)
+			require.NoError(t, err)
+			assert.Equal(t, tc.deleted, deletedResources())
+			assert.Equal(t, tc.cleanup, resp.Data)
+
+			// The fake client doesn't garbage collect, so the owned service
+			// account is still there
+			_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+			assert.NoError(t, err)
+
+			// Nothing is queued for cleanup, since the revocation succeeded
+			keys, err := s.List(ctx, pendingCleanupPath)
+			require.NoError(t, err)
+			assert.Empty(t, keys)
+		})
+	}
+}
+
+func TestCreds_annotateLeaseID(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "annotated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"annotate_lease_id":             true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		ID:        "request-1",
+		Operation: logical.UpdateOperation,
+		Path:      pathCreds + "annotated",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	lease := resp.Secret.InternalData
+	indexID := lease["index_id"].(string)
+	name := resp.Data["service_account_name"].(string)
+	want := map[string]string{
+		leaseIndexIDAnnotation: indexID,
+		requestIDAnnotation:    "request-1",
+	}
+
+	assertAnnotated := func(t *testing.T) {
+		t.Helper()
+		sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, want, sa.Annotations)
+		k8sRole, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, want, k8sRole.Annotations)
+		binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, want, binding.Annotations)
+	}
+	assertAnnotated(t)
+
+	// The annotations match the lease in the list of creds
+	resp, err = testCredsList(t, b, s, nil)
+	require.NoError(t, err)
+	assert.Contains(t, resp.Data["keys"], indexID)
+
+	// Rotated objects keep the annotations of the lease
+	resp, err = testRotateBinding(t, b, s, indexID)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assertAnnotated(t)
+
+	_, err = testRevoke(t, b, s, lease)
+	require.NoError(t, err)
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+
+	// Roles without annotate_lease_id don't annotate their objects
+	resp, err = testRoleCreate(t, b, s, "annotated", map[string]interface{}{
+		"annotate_lease_id": false,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "annotated", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, resp.Data["service_account_name"].(string), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, sa.Annotations, leaseIndexIDAnnotation)
+}
+
+func TestCreds_maxActiveTokens(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "capped", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"max_active_tokens":             -1,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "max_active_tokens must not be negative")
+
+	resp, err = testRoleCreate(t, b, s, "capped", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"max_active_tokens":             2,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	var leases []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		resp, err := testCredsCreate(t, b, s, "capped", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases = append(leases, resp.Secret.InternalData)
+	}
+	resp, err = testCredsCreate(t, b, s, "capped", nil)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "role 'capped' already has its max_active_tokens of 2 active credentials")
+
+	// Revoking a lease makes room for another, and revoking it again doesn't
+	// release it twice
+	for i := 0; i < 2; i++ {
+		_, err = testRevoke(t, b, s, leases[0])
+		require.NoError(t, err)
+	}
+	active, err := getActiveTokens(ctx, s, "capped")
+	require.NoError(t, err)
+	assert.Equal(t, 1, active.Count)
+
+	// Failed requests don't count
+	failRoles := true
+	fakeClient.PrependReactor("create", "roles", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failRoles {
+			return true, nil, fmt.Errorf("nope")
+		}
+		return false, nil, nil
+	})
+	_, err = testCredsCreate(t, b, s, "capped", nil)
+	require.Error(t, err)
+	active, err = getActiveTokens(ctx, s, "capped")
+	require.NoError(t, err)
+	assert.Equal(t, 1, active.Count)
+	failRoles = false
+
+	resp, err = testCredsCreate(t, b, s, "capped", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestCreds_aggregationRule(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+
+	aggregationRule := `clusterRoleSelectors:
+- matchLabels:
+    rbac.example.com/aggregate-to-app: "true"
+`
+	resp, err := testRoleCreate(t, b, s, "aggregated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_aggregation_rule":    aggregationRule,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_aggregation_rule requires a kubernetes_role_type of ClusterRole")
+
+	resp, err = testRoleCreate(t, b, s, "aggregated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_aggregation_rule":    aggregationRule,
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_aggregation_rule can't be combined with generated_role_rules or generated_role_rules_file")
+
+	resp, err = testRoleCreate(t, b, s, "aggregated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_aggregation_rule":    `{"clusterRoleSelectors": []}`,
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "failed to parse 'generated_aggregation_rule' as k8s.io/api/rbac/v1/AggregationRule object: clusterRoleSelectors must not be empty")
+
+	resp, err = testRoleCreate(t, b, s, "aggregated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_aggregation_rule":    aggregationRule,
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "aggregated", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	clusterRole, err := fakeClient.RbacV1().ClusterRoles().Get(context.Background(), resp.Data["service_account_name"].(string), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, clusterRole.Rules)
+	require.NotNil(t, clusterRole.AggregationRule)
+	assert.Equal(t, []metav1.LabelSelector{
+		{MatchLabels: map[string]string{"rbac.example.com/aggregate-to-app": "true"}},
+	}, clusterRole.AggregationRule.ClusterRoleSelectors)
+}
+
+func TestCreds_dryRun(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "generated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"extra_labels":                  map[string]string{"team": "a"},
+		"token_default_ttl":             "1h",
+		"max_active_tokens":             1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleCreate(t, b, s, "existing", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "base",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	kinds := func(objects []map[string]interface{}) []string {
+		var kinds []string
+		for _, obj := range objects {
+			kinds = append(kinds, obj["kind"].(string))
+		}
+		return kinds
+	}
+
+	// Dry runs don't count towards max_active_tokens
+	for i := 0; i < 2; i++ {
+		resp, err = testCredsCreate(t, b, s, "generated", map[string]interface{}{
+			"dry_run": true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+	}
+	assert.Nil(t, resp.Secret)
+	assert.Equal(t, true, resp.Data["dry_run"])
+	assert.Equal(t, int64(3600), resp.Data["ttl"])
+	assert.NotContains(t, resp.Data, "service_account_token")
+	name := resp.Data["service_account_name"].(string)
+	assert.Contains(t, name, "-generate-")
+
+	objects := resp.Data["objects"].([]map[string]interface{})
+	assert.Equal(t, []string{"Role", "RoleBinding", "ServiceAccount"}, kinds(objects))
+	for _, obj := range objects {
+		metadata := obj["metadata"].(map[string]interface{})
+		assert.Equal(t, name, metadata["name"])
+		assert.Equal(t, "app1", metadata["namespace"])
+		assert.Equal(t, "a", metadata["labels"].(map[string]interface{})["team"])
+	}
+	assert.NotEmpty(t, objects[0]["rules"])
+
+	resp, err = testCredsCreate(t, b, s, "existing", map[string]interface{}{
+		"dry_run": true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	objects = resp.Data["objects"].([]map[string]interface{})
+	assert.Equal(t, []string{"RoleBinding", "ServiceAccount"}, kinds(objects))
+	assert.Equal(t, "base", objects[0]["roleRef"].(map[string]interface{})["name"])
+
+	// Nothing was created
+	roles, err := fakeClient.RbacV1().Roles("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, roles.Items)
+	bindings, err := fakeClient.RbacV1().RoleBindings("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bindings.Items)
+	accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, accounts.Items)
+	keys, err := s.List(ctx, credsIndexPath)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	keys, err = s.List(ctx, activeTokensPath)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestCreds_boundObject(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "bound", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	_, err = fakeClient.CoreV1().Pods("app1").Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "app1", UID: "pod-uid"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		data        map[string]interface{}
+		expectedErr string
+	}{
+		"kind without name": {
+			data:        map[string]interface{}{"bound_object_kind": "Pod"},
+			expectedErr: "bound_object_kind and bound_object_name must be set together",
+		},
+		"uid without object": {
+			data:        map[string]interface{}{"bound_object_uid": "pod-uid"},
+			expectedErr: "bound_object_uid requires bound_object_kind and bound_object_name",
+		},
+		"unsupported kind": {
+			data:        map[string]interface{}{"bound_object_kind": "Node", "bound_object_name": "worker"},
+			expectedErr: "bound_object_kind must be one of Pod, Secret",
+		},
+		"missing object": {
+			data:        map[string]interface{}{"bound_object_kind": "Pod", "bound_object_name": "missing"},
+			expectedErr: "bound object Pod 'app1/missing' does not exist",
+		},
+		"uid mismatch": {
+			data:        map[string]interface{}{"bound_object_kind": "Pod", "bound_object_name": "worker", "bound_object_uid": "other"},
+			expectedErr: "bound object Pod 'app1/worker' has UID 'pod-uid', not bound_object_uid 'other'",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := testCredsCreate(t, b, s, "bound", tc.data)
+			require.NoError(t, err)
+			assert.EqualError(t, resp.Error(), tc.expectedErr)
+		})
+	}
+	// Nothing was created for the rejected requests
+	accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, accounts.Items)
+
+	fakeClient.ClearActions()
+	resp, err = testCredsCreate(t, b, s, "bound", map[string]interface{}{
+		"bound_object_kind": "Pod",
+		"bound_object_name": "worker",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, map[string]interface{}{
+		"kind": "Pod",
+		"name": "worker",
+		"uid":  "pod-uid",
+	}, resp.Data["bound_object"])
+	assert.Equal(t, "pod-uid", resp.Secret.InternalData["bound_object_uid"])
+
+	var tokenRequest *authenticationv1.TokenRequest
+	for _, action := range fakeClient.Actions() {
+		if createAction, ok := action.(k8stesting.CreateAction); ok && createAction.GetSubresource() == "token" {
+			tokenRequest = createAction.GetObject().(*authenticationv1.TokenRequest)
+		}
+	}
+	require.NotNil(t, tokenRequest)
+	assert.Equal(t, &authenticationv1.BoundObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Name:       "worker",
+		UID:        "pod-uid",
+	}, tokenRequest.Spec.BoundObjectRef)
+}
+
+func TestCreds_tokenExpiration(t *testing.T) {
+	b, s := getTestBackend(t)
+	setupFakeClient(t, b, s)
+
+	resp, err := testRoleCreate(t, b, s, "expiring", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "expiring", map[string]interface{}{
+		"ttl": "2h",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	expiration, err := time.Parse(time.RFC3339, resp.Data["service_account_token_expiration"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expiration, 5*time.Second)
+}
+
+func TestCreds_managedLabels(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	longName := strings.Repeat("a", 64)
+
+	for _, roleName := range []string{"labeled", longName} {
+		resp, err := testRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules":          goodYAMLRules,
+			"extra_labels":                  map[string]string{"team": "a"},
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+	}
+
+	credsCreate := func(roleName string) string {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:     logical.UpdateOperation,
+			Path:          pathCreds + roleName,
+			Storage:       s,
+			MountAccessor: "kubernetes_1234",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		return resp.Data["service_account_name"].(string)
+	}
+
+	name := credsCreate("labeled")
+	expected := map[string]string{
+		"team":                         "a",
+		"app.kubernetes.io/managed-by": "HashiCorp-Vault",
+		"app.kubernetes.io/created-by": "vault-plugin-secrets-kubernetes",
+		mountAccessorLabel:             "kubernetes_1234",
+		roleNameLabel:                  "labeled",
+	}
+	sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expected, sa.Labels)
+	role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expected, role.Labels)
+	binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expected, binding.Labels)
+
+	// The role name is too long to be a label value
+	name = credsCreate(longName)
+	sa, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, sa.Labels, roleNameLabel)
+	assert.Equal(t, "kubernetes_1234", sa.Labels[mountAccessorLabel])
+}
+
+func TestCreds_tokenSecret(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	// Populate the token as the Kubernetes token controller would
+	fakeClient.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.CreateAction).GetObject().(*corev1.Secret)
+		if secret.Name != "never-issued" {
+			secret.Data = map[string][]byte{corev1.ServiceAccountTokenKey: []byte("token-" + secret.Name)}
+		}
+		return false, nil, nil
+	})
+
+	resp, err := testRoleCreate(t, b, s, "legacy", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"token_type":                    "secret",
+		"token_default_ttl":             "1h",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{"token_type 'secret' issues tokens that don't expire: the TTLs only apply to the Vault lease, and each token stays valid until its lease is revoked and its Secret deleted"}, resp.Warnings)
+
+	t.Run("invalid role options", func(t *testing.T) {
+		for expected, d := range map[string]map[string]interface{}{
+			"token_type must be either 'bound' or 'secret'": {"token_type": "legacy"},
+			"token_default_audiences can't be used with token_type 'secret', since tokens stored in a Secret always have the API server's audience": {
+				"token_type": "secret", "token_default_audiences": []string{"foo"},
+			},
+			"token_secret_name_template requires token_type 'secret'": {"token_secret_name_template": "{{.RoleName}}-token"},
+		} {
+			d["allowed_kubernetes_namespaces"] = []string{"app1"}
+			d["generated_role_rules"] = goodYAMLRules
+			resp, err := testRoleCreate(t, b, s, "invalid", d)
+			require.NoError(t, err)
+			assert.EqualError(t, resp.Error(), expected)
+		}
+	})
+
+	t.Run("invalid creds options", func(t *testing.T) {
+		resp, err := testCredsCreate(t, b, s, "legacy", map[string]interface{}{
+			"audiences": []string{"foo"},
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "audiences can't be requested from a role with token_type 'secret'")
+
+		resp, err = testCredsCreate(t, b, s, "legacy", map[string]interface{}{
+			"bound_object_kind": "Pod",
+			"bound_object_name": "web",
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "the token can't be bound to an object for a role with token_type 'secret'")
+	})
+
+	t.Run("issue, renew and revoke", func(t *testing.T) {
+		resp, err := testCredsCreate(t, b, s, "legacy", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		name := resp.Data["service_account_name"].(string)
+		assert.Equal(t, "token-"+name, resp.Data["service_account_token"])
+		assert.NotContains(t, resp.Data, "service_account_token_expiration")
+		assert.Equal(t, time.Hour, resp.Secret.TTL)
+		assert.Equal(t, name, resp.Secret.InternalData["created_token_secret"])
+
+		secret, err := fakeClient.CoreV1().Secrets("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, corev1.SecretTypeServiceAccountToken, secret.Type)
+		assert.Equal(t, name, secret.Annotations[corev1.ServiceAccountNameKey])
+		assert.Equal(t, "HashiCorp-Vault", secret.Labels["app.kubernetes.io/managed-by"])
+
+		// Renewing only extends the lease
+		leaseSecret := resp.Secret
+		leaseSecret.IssueTime = time.Now()
+		leaseSecret.Increment = 2 * time.Hour
+		resp, err = b.kubeTokenRenew(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    leaseSecret,
+		}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2*time.Hour, resp.Secret.TTL)
+		assert.Empty(t, resp.Data)
+
+		resp, err = testRevoke(t, b, s, resp.Secret.InternalData)
+		require.NoError(t, err)
+		assert.Equal(t, cleanupDeleted, resp.Data["Secret"])
+		_, err = fakeClient.CoreV1().Secrets("app1").Get(ctx, name, metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+	})
+
+	t.Run("templated Secret name", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "named", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules":          goodYAMLRules,
+			"token_type":                    "secret",
+			"token_secret_name_template":    "{{.RoleName}}-token",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testCredsCreate(t, b, s, "named", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		assert.Equal(t, "token-named-token", resp.Data["service_account_token"])
+		assert.Equal(t, "named-token", resp.Secret.InternalData["created_token_secret"])
+		secret, err := fakeClient.CoreV1().Secrets("app1").Get(ctx, "named-token", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, resp.Data["service_account_name"], secret.Annotations[corev1.ServiceAccountNameKey])
+		lease := resp.Secret.InternalData
+
+		// The rendered name must be unique
+		resp, err = testCredsCreate(t, b, s, "named", nil)
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "Secret 'app1/named-token' already exists, token_secret_name_template must render a unique name")
+
+		resp, err = testRevoke(t, b, s, lease)
+		require.NoError(t, err)
+		assert.Equal(t, cleanupDeleted, resp.Data["Secret"])
+		_, err = fakeClient.CoreV1().Secrets("app1").Get(ctx, "named-token", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+
+		// The rendered name must be a valid name
+		resp, err = testRoleCreate(t, b, s, "named", map[string]interface{}{
+			"token_secret_name_template": "{{.RoleName}}_Token",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		_, err = testCredsCreate(t, b, s, "named", nil)
+		require.ErrorContains(t, err, "token_secret_name_template: generated name 'named_Token' is not a valid Kubernetes object name")
+	})
+
+	t.Run("token not issued", func(t *testing.T) {
+		defer func(timeout time.Duration) { tokenSecretTimeout = timeout }(tokenSecretTimeout)
+		tokenSecretTimeout = 100 * time.Millisecond
+		resp, err := testRoleCreate(t, b, s, "never-issued", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"service_account_name":          "existing",
+			"token_type":                    "secret",
+			"name_template":                 "never-issued",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		_, err = testCredsCreate(t, b, s, "never-issued", nil)
+		require.ErrorContains(t, err, "failed to create a service account token Secret for app1/existing")
+		_, err = fakeClient.CoreV1().Secrets("app1").Get(ctx, "never-issued", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+	})
+
+	t.Run("failed request rolls back the Secret", func(t *testing.T) {
+		// Successful requests leave no WAL entries behind
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		for _, walID := range walIDs {
+			require.NoError(t, framework.DeleteWAL(ctx, s, walID))
+		}
+		resp, err := testCredsCreate(t, b, s, "legacy", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		walIDs, err = framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		assert.Empty(t, walIDs)
+		lease := resp.Secret.InternalData
+
+		// A Secret whose creds request failed after it was created is
+		// deleted by its WAL entry, since nothing owns it
+		client, err := b.getClient(ctx, s, "")
+		require.NoError(t, err)
+		walID, _, err := createTokenSecretWithWAL(ctx, client, s, "app1", "orphaned", "existing", &roleEntry{})
+		require.NoError(t, err)
+		wal, err := framework.GetWAL(ctx, s, walID)
+		require.NoError(t, err)
+		assert.Equal(t, walSecretKind, wal.Kind)
+		require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, wal.Kind, wal.Data))
+		_, err = fakeClient.CoreV1().Secrets("app1").Get(ctx, "orphaned", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+
+		// The Secret of an active lease isn't rolled back
+		name := lease["created_token_secret"].(string)
+		require.NoError(t, b.rollbackSecretWAL(ctx, &logical.Request{Storage: s}, map[string]interface{}{
+			"Namespace":  "app1",
+			"Name":       name,
+			"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+		}))
+		_, err = fakeClient.CoreV1().Secrets("app1").Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreds_existingServiceAccountRoleBinding(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	_, err := fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "app1"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	resp, err := testRoleCreate(t, b, s, "workload", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "workload",
+		"kubernetes_role_name":          "base",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "workload", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "workload", resp.Data["service_account_name"])
+	assert.NotEmpty(t, resp.Data["service_account_token"])
+	assert.Empty(t, resp.Secret.InternalData["created_service_account"])
+	bindingName := resp.Secret.InternalData["created_role_binding"].(string)
+	require.NotEmpty(t, bindingName)
+
+	// Only the RoleBinding was created, binding the existing role to the
+	// existing service account
+	accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, accounts.Items, 1)
+	binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, bindingName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, binding.OwnerReferences)
+	assert.Equal(t, "base", binding.RoleRef.Name)
+	require.Len(t, binding.Subjects, 1)
+	assert.Equal(t, "workload", binding.Subjects[0].Name)
+	walIDs, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	assert.Empty(t, walIDs)
+
+	resp, err = testRevoke(t, b, s, resp.Secret.InternalData)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"RoleBinding": cleanupDeleted}, resp.Data)
+	_, err = fakeClient.RbacV1().RoleBindings("app1").Get(ctx, bindingName, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, "workload", metav1.GetOptions{})
+	require.NoError(t, err)
+}
+
+func TestCreds_existingRoleBinding(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	_, err := fakeClient.RbacV1().RoleBindings("app1").Create(ctx, &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload-reader", Namespace: "app1"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "reader"},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: "workload", Namespace: "app1"},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	resp, err := testRoleCreate(t, b, s, "no-service-account", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_binding_name":  "workload-reader",
+		"kubernetes_role_name":          "reader",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "kubernetes_role_binding_name requires service_account_name, and can't be used with generated_role_rules")
+
+	resp, err = testRoleCreate(t, b, s, "prebound", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+		"service_account_name":          "workload",
+		"kubernetes_role_binding_name":  "workload-reader",
+		"kubernetes_role_name":          "reader",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleRead(t, b, s, "prebound")
+	require.NoError(t, err)
+	assert.Equal(t, "workload-reader", resp.Data["kubernetes_role_binding_name"])
+
+	// Only a token is created
+	resp, err = testCredsCreate(t, b, s, "prebound", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "workload", resp.Data["service_account_name"])
+	assert.NotEmpty(t, resp.Data["service_account_token"])
+	assert.NotContains(t, resp.Data, "created_role_binding")
+	bindings, err := fakeClient.RbacV1().RoleBindings("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, bindings.Items, 1)
+
+	// Revoking the lease leaves the binding alone
+	resp, err = testRevoke(t, b, s, resp.Secret.InternalData)
+	require.NoError(t, err)
+	_, err = fakeClient.RbacV1().RoleBindings("app1").Get(ctx, "workload-reader", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	resp, err = testCredsCreate(t, b, s, "prebound", map[string]interface{}{
+		"kubernetes_namespace": "app2",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "RoleBinding 'app2/workload-reader' of the role's kubernetes_role_binding_name does not exist")
+
+	resp, err = testRoleCreate(t, b, s, "prebound", map[string]interface{}{
+		"kubernetes_role_name": "writer",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "prebound", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "RoleBinding 'app1/workload-reader' binds Role 'reader', not the role's kubernetes_role_name Role 'writer'")
+
+	resp, err = testRoleCreate(t, b, s, "prebound", map[string]interface{}{
+		"kubernetes_role_name": "reader",
+		"service_account_name": "other",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "prebound", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "RoleBinding 'app1/workload-reader' does not bind service account 'app1/other'")
+}
+
+func TestCreds_existingObjects(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	failToken := true
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !failToken || action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("denied")
+	})
+
+	resp, err := testRoleCreate(t, b, s, "fixed", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"name_template":                 "fixed-name",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	// The failed request leaves its objects and WAL entries behind
+	_, err = testCredsCreate(t, b, s, "fixed", nil)
+	require.ErrorContains(t, err, "failed to create a service account token")
+	walIDs, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Len(t, walIDs, 2)
+
+	// Retrying uses the objects created by the plugin
+	failToken = false
+	resp, err = testCredsCreate(t, b, s, "fixed", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "fixed-name", resp.Data["service_account_name"])
+
+	// Rolling back the failed request's WAL entries leaves the objects of the
+	// active lease alone
+	for _, id := range walIDs {
+		wal, err := framework.GetWAL(ctx, s, id)
+		require.NoError(t, err)
+		require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, wal.Kind, wal.Data))
+	}
+	_, err = fakeClient.RbacV1().Roles("app1").Get(ctx, "fixed-name", metav1.GetOptions{})
+	require.NoError(t, err)
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, "fixed-name", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	_, err = testRevoke(t, b, s, resp.Secret.InternalData)
+	require.NoError(t, err)
+	for _, id := range walIDs {
+		require.NoError(t, framework.DeleteWAL(ctx, s, id))
+	}
+
+	t.Run("foreign object", func(t *testing.T) {
+		_, err := fakeClient.RbacV1().Roles("app1").Create(ctx, &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "fixed-name", Namespace: "app1"},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		defer fakeClient.RbacV1().Roles("app1").Delete(ctx, "fixed-name", metav1.DeleteOptions{})
+
+		_, err = testCredsCreate(t, b, s, "fixed", nil)
+		require.ErrorContains(t, err, "Role 'app1/fixed-name' already exists and was not created by this mount")
+		// The foreign Role won't be rolled back
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		assert.Empty(t, walIDs)
+	})
+
+	t.Run("mismatched object", func(t *testing.T) {
+		_, err := fakeClient.RbacV1().Roles("app1").Create(ctx, &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "fixed-name", Namespace: "app1", Labels: standardLabels},
+			Rules:      []rbacv1.PolicyRule{{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}}},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		defer fakeClient.RbacV1().Roles("app1").Delete(ctx, "fixed-name", metav1.DeleteOptions{})
+
+		_, err = testCredsCreate(t, b, s, "fixed", nil)
+		require.ErrorContains(t, err, "Role 'app1/fixed-name' already exists and doesn't match the object to create")
+		role, err := fakeClient.RbacV1().Roles("app1").Get(ctx, "fixed-name", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"*"}, role.Rules[0].Verbs)
+	})
+}
+
+func TestCreds_createNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	b.mountID = "test-mount"
+
+	resp, err := testRoleCreate(t, b, s, "createns", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"generated_role_rules":          goodYAMLRules,
+		"create_namespace":              true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "createns", map[string]interface{}{
+		"kubernetes_namespace": "missing-new",
+		"dry_run":              true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	objects := resp.Data["objects"].([]map[string]interface{})
+	assert.Equal(t, "Namespace", objects[0]["kind"])
+	_, err = fakeClient.CoreV1().Namespaces().Get(ctx, "missing-new", metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+
+	var leases []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		resp, err := testCredsCreate(t, b, s, "createns", map[string]interface{}{
+			"kubernetes_namespace": "missing-new",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases = append(leases, resp.Secret.InternalData)
+	}
+	ns, err := fakeClient.CoreV1().Namespaces().Get(ctx, "missing-new", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "true", ns.Labels[createdNamespaceLabel])
+	assert.Equal(t, "test-mount", ns.Labels[mountIDLabel])
+	walIDs, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	assert.Empty(t, walIDs)
+
+	// The namespace is deleted with the last lease that has objects in it
+	resp, err = testRevoke(t, b, s, leases[0])
+	require.NoError(t, err)
+	assert.Equal(t, cleanupInUse, resp.Data["Namespace"])
+	_, err = fakeClient.CoreV1().Namespaces().Get(ctx, "missing-new", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	resp, err = testRevoke(t, b, s, leases[1])
+	require.NoError(t, err)
+	assert.Equal(t, cleanupDeleted, resp.Data["Namespace"])
+	_, err = fakeClient.CoreV1().Namespaces().Get(ctx, "missing-new", metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+
+	t.Run("existing namespace", func(t *testing.T) {
+		_, err := fakeClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "existing-ns"},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		resp, err := testCredsCreate(t, b, s, "createns", map[string]interface{}{
+			"kubernetes_namespace": "existing-ns",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testRevoke(t, b, s, resp.Secret.InternalData)
+		require.NoError(t, err)
+		assert.NotContains(t, resp.Data, "Namespace")
+		_, err = fakeClient.CoreV1().Namespaces().Get(ctx, "existing-ns", metav1.GetOptions{})
+		require.NoError(t, err)
+	})
+
+	t.Run("failed request", func(t *testing.T) {
+		fakeClient.PrependReactor("create", "roles", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("denied")
+		})
+		defer func() { fakeClient.ReactionChain = fakeClient.ReactionChain[1:] }()
+
+		_, err := testCredsCreate(t, b, s, "createns", map[string]interface{}{
+			"kubernetes_namespace": "missing-failed",
+		})
+		require.Error(t, err)
+
+		// The namespace is rolled back with the failed request's objects
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, walIDs, 2)
+		for _, id := range walIDs {
+			wal, err := framework.GetWAL(ctx, s, id)
+			require.NoError(t, err)
+			require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, wal.Kind, wal.Data))
+		}
+		_, err = fakeClient.CoreV1().Namespaces().Get(ctx, "missing-failed", metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+	})
+
+	t.Run("rollback of namespace not created by the mount", func(t *testing.T) {
+		// e.g. the namespace was created by someone else after the WAL entry
+		// was written, or by another mount
+		for name, labels := range map[string]map[string]string{
+			"unlabeled-ns": nil,
+			"other-mount-ns": {
+				createdNamespaceLabel: "true",
+				mountIDLabel:          "other-mount",
+			},
+		} {
+			_, err := fakeClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			}, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			require.NoError(t, b.rollbackNamespaceWAL(ctx, &logical.Request{Storage: s}, map[string]interface{}{
+				"Name":       name,
+				"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+			}))
+			_, err = fakeClient.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+			assert.NoError(t, err, name)
+		}
+
+		// Rolling back an already deleted namespace succeeds
+		require.NoError(t, b.rollbackNamespaceWAL(ctx, &logical.Request{Storage: s}, map[string]interface{}{
+			"Name":       "missing-failed",
+			"Expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+		}))
+	})
+
+	t.Run("service_account_name", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "createns-sa", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"*"},
+			"service_account_name":          "sa",
+			"create_namespace":              true,
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "create_namespace can't be used with service_account_name, since the service account must already exist in the namespace")
+	})
+}
+
+func TestCreds_allowClusterRoleBinding(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "nocluster", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-cluster-role",
+		"kubernetes_role_type":          "ClusterRole",
+		"allow_cluster_role_binding":    false,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "nocluster", map[string]interface{}{
+		"cluster_role_binding": true,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "cluster_role_binding is not allowed by role's allow_cluster_role_binding")
+	bindings, err := fakeClient.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bindings.Items)
+
+	// RoleBindings are still allowed
+	resp, err = testCredsCreate(t, b, s, "nocluster", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	// Roles written before the option existed allow ClusterRoleBindings
+	entry, err := logical.StorageEntryJSON(rolesPath+"legacy", map[string]interface{}{
+		"name":                          "legacy",
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"kubernetes_role_name":          "existing-cluster-role",
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Put(ctx, entry))
+	role, err := getRole(ctx, s, "legacy")
+	require.NoError(t, err)
+	assert.True(t, role.AllowClusterRoleBinding)
+
+	resp, err = testCredsCreate(t, b, s, "legacy", map[string]interface{}{
+		"cluster_role_binding": true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestCreds_bindingServiceAccountNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "cross", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+		"service_account_name":          "sa",
+		"kubernetes_role_name":          "existing-cluster-role",
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleCreate(t, b, s, "generated-sa", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+		"kubernetes_role_name":          "existing-cluster-role",
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleCreate(t, b, s, "token-only", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+		"service_account_name":          "sa",
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	for expected, tc := range map[string]struct {
+		role string
+		data map[string]interface{}
+	}{
+		"binding_service_account_namespace requires cluster_role_binding": {
+			role: "cross",
+			data: map[string]interface{}{"binding_service_account_namespace": "app2"},
+		},
+		"binding_service_account_namespace 'app3' is not allowed by the role": {
+			role: "cross",
+			data: map[string]interface{}{"cluster_role_binding": true, "binding_service_account_namespace": "app3"},
+		},
+		"binding_service_account_namespace can only be used with role 'token-only' if it binds an existing service_account_name": {
+			role: "token-only",
+			data: map[string]interface{}{"cluster_role_binding": true, "binding_service_account_namespace": "app2"},
+		},
+		"binding_service_account_namespace can only be used with role 'generated-sa' if it binds an existing service_account_name": {
+			role: "generated-sa",
+			data: map[string]interface{}{"cluster_role_binding": true, "binding_service_account_namespace": "app2"},
+		},
+		"service account 'app2/sa' does not exist": {
+			role: "cross",
+			data: map[string]interface{}{"cluster_role_binding": true, "binding_service_account_namespace": "app2"},
+		},
+	} {
+		tc.data["kubernetes_namespace"] = "app1"
+		resp, err := testCredsCreate(t, b, s, tc.role, tc.data)
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), expected)
+	}
+	bindings, err := fakeClient.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, bindings.Items)
+
+	_, err = fakeClient.CoreV1().ServiceAccounts("app2").Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "sa", Namespace: "app2"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	resp, err = testCredsCreate(t, b, s, "cross", map[string]interface{}{
+		"kubernetes_namespace":              "app1",
+		"cluster_role_binding":              true,
+		"binding_service_account_namespace": "app2",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, "sa", resp.Data["service_account_name"])
+	assert.Equal(t, "app1", resp.Data["service_account_namespace"])
+	name := resp.Secret.InternalData["created_role_binding"].(string)
+	binding, err := fakeClient.RbacV1().ClusterRoleBindings().Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []rbacv1.Subject{{Kind: "ServiceAccount", Name: "sa", Namespace: "app2"}}, binding.Subjects)
+
+	// Rotating keeps the subject's namespace
+	rotated, err := testRotateBinding(t, b, s, resp.Secret.InternalData["index_id"].(string))
+	require.NoError(t, err)
+	require.NoError(t, rotated.Error())
+	binding, err = fakeClient.RbacV1().ClusterRoleBindings().Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "app2", binding.Subjects[0].Namespace)
+
+	// Rotating fails if the service account was deleted in the meantime
+	require.NoError(t, fakeClient.CoreV1().ServiceAccounts("app2").Delete(ctx, "sa", metav1.DeleteOptions{}))
+	rotated, err = testRotateBinding(t, b, s, resp.Secret.InternalData["index_id"].(string))
+	require.NoError(t, err)
+	assert.EqualError(t, rotated.Error(), "service account 'app2/sa' does not exist")
+	_, err = fakeClient.RbacV1().ClusterRoleBindings().Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	// Revoking deletes the ClusterRoleBinding
+	_, err = testRevoke(t, b, s, resp.Secret.InternalData)
+	require.NoError(t, err)
+	_, err = fakeClient.RbacV1().ClusterRoleBindings().Get(ctx, name, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+}
+
+func TestCreds_additionalSubjects(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "subjects", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"additional_subjects":           `[{"kind": "Group", "name": "oidc:developers"}]`,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "subjects", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, resp.Secret.InternalData["created_role_binding"].(string), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []rbacv1.Subject{
+		{Kind: "ServiceAccount", Name: resp.Data["service_account_name"].(string), Namespace: "app1"},
+		{Kind: "Group", APIGroup: rbacv1.GroupName, Name: "oidc:developers"},
+	}, binding.Subjects)
+	assert.Equal(t, rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: binding.Name}, binding.RoleRef)
+
+	resp, err = testRoleCreate(t, b, s, "subjects-bad", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"additional_subjects":           `[{"kind": "Pod", "name": "web"}]`,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "failed to parse 'additional_subjects': subject 'web' has kind 'Pod', which must be one of ServiceAccount, User or Group")
+
+	resp, err = testRoleCreate(t, b, s, "subjects-sa", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"additional_subjects":           `[{"kind": "Group", "name": "oidc:developers"}]`,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "additional_subjects can't be used with service_account_name alone, since no role binding is generated")
+}
+
+func TestCreds_missingNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "anyns", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	namespaceGets := func() int {
+		count := 0
+		for _, action := range fakeClient.Actions() {
+			if action.Matches("get", "namespaces") {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err = testCredsCreate(t, b, s, "anyns", map[string]interface{}{
+			"kubernetes_namespace": "missing-app",
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "namespace 'missing-app' does not exist")
+	}
+	// The second request used the cached result, and nothing was created
+	assert.Equal(t, 1, namespaceGets())
+	for _, action := range fakeClient.Actions() {
+		assert.NotEqual(t, "create", action.GetVerb())
+	}
+	walIDs, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	assert.Empty(t, walIDs)
+
+	// The cached result expires
+	entry := b.namespaceCache["/missing-app"]
+	entry.expires = time.Now().Add(-time.Second)
+	b.namespaceCache["/missing-app"] = entry
+	resp, err = testCredsCreate(t, b, s, "anyns", map[string]interface{}{
+		"kubernetes_namespace": "missing-app",
+	})
+	require.NoError(t, err)
+	assert.Error(t, resp.Error())
+	assert.Equal(t, 2, namespaceGets())
+
+	t.Run("forbidden", func(t *testing.T) {
+		fakeClient.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, k8s_errors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "app1", fmt.Errorf("denied"))
+		})
+		defer func() { fakeClient.ReactionChain = fakeClient.ReactionChain[1:] }()
+
+		// Without permission to get namespaces, they're assumed to exist
+		resp, err := testCredsCreate(t, b, s, "anyns", map[string]interface{}{
+			"kubernetes_namespace": "app1",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+	})
+}
+
+func TestCreds_namespaceCache(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "dev", map[string]interface{}{
+		"allowed_kubernetes_namespace_selector": `{"matchLabels": {"env": "dev"}}`,
+		"generated_role_rules":                  goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	ns, err := fakeClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Labels: map[string]string{"env": "dev"}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	resp, err = testCredsCreate(t, b, s, "dev", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	// The relabeled namespace is still allowed until it's looked up again
+	ns.Labels["env"] = "prod"
+	_, err = fakeClient.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	resp, err = testCredsCreate(t, b, s, "dev", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+		"dry_run":              true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "dev", map[string]interface{}{
+		"kubernetes_namespace":   "app1",
+		"bypass_namespace_cache": true,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, resp.Error().Error(), "kubernetes_namespace 'app1' is not present in role's allowed_kubernetes_namespaces")
+	// which also refreshed the cached namespace
+	resp, err = testCredsCreate(t, b, s, "dev", map[string]interface{}{
+		"kubernetes_namespace": "app1",
+	})
+	require.NoError(t, err)
+	assert.Contains(t, resp.Error().Error(), "kubernetes_namespace 'app1' is not present in role's allowed_kubernetes_namespaces")
+
+	t.Run("revoke failure", func(t *testing.T) {
+		_, err := b.getNamespace(ctx, b.clients[""], "app2", false)
+		require.NoError(t, err)
+		require.Contains(t, b.namespaceCache, "/app2")
+
+		fakeClient.PrependReactor("delete", "rolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("connection refused")
+		})
+		defer func() { fakeClient.ReactionChain = fakeClient.ReactionChain[1:] }()
+		_, err = testRevoke(t, b, s, map[string]interface{}{
+			"service_account_namespace": "app2",
+			"created_role_binding":      "binding",
+		})
+		require.Error(t, err)
+		assert.NotContains(t, b.namespaceCache, "/app2")
+	})
+
+	t.Run("lookup without the lock", func(t *testing.T) {
+		// A slow lookup mustn't hold up requests for other namespaces
+		locked := true
+		fakeClient.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if b.namespaceCacheLock.TryLock() {
+				locked = false
+				b.namespaceCacheLock.Unlock()
+			}
+			return false, nil, nil
+		})
+		defer func() { fakeClient.ReactionChain = fakeClient.ReactionChain[1:] }()
+
+		_, err := b.getNamespace(ctx, b.clients[""], "app1", true)
+		require.NoError(t, err)
+		assert.False(t, locked)
+		assert.Contains(t, b.namespaceCache, "/app1")
+	})
+
+	t.Run("config", func(t *testing.T) {
+		_, err := b.getNamespace(ctx, b.clients[""], "app1", false)
+		require.NoError(t, err)
+		require.NotEmpty(t, b.namespaceCache)
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"kubernetes_host":     "https://kubernetes.example.com",
+				"namespace_cache_ttl": -1,
+			},
+		})
+		require.NoError(t, err)
+		assert.Error(t, resp.Error())
+
+		testConfigWrite(t, b, s, map[string]interface{}{
+			"namespace_cache_ttl": 0,
+		})
+		resp = testConfigRead(t, b, s)
+		assert.Equal(t, int64(0), resp.Data["namespace_cache_ttl"])
+		// Changing the config dropped the cached namespaces
+		_, err = b.getClient(ctx, s, "")
+		require.NoError(t, err)
+		assert.Empty(t, b.namespaceCache)
+
+		fakeClient := setupFakeClient(t, b, s)
+		for i := 0; i < 2; i++ {
+			_, err := b.namespaceExists(ctx, b.clients[""], "app1", false)
+			require.NoError(t, err)
+		}
+		// Nothing is cached with a TTL of 0
+		gets := 0
+		for _, action := range fakeClient.Actions() {
+			if action.Matches("get", "namespaces") {
+				gets++
+			}
+		}
+		assert.Equal(t, 2, gets)
+		assert.Empty(t, b.namespaceCache)
+	})
+}
+
+func TestCreds_kubernetesCluster(t *testing.T) {
+	b, s := getTestBackend(t)
+	defaultClient := setupFakeClient(t, b, s)
+	eastClient := setupFakeClusterClient(t, b, s, "east")
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "east", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_cluster":            "east",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testCredsCreate(t, b, s, "east", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	internalData := resp.Secret.InternalData
+	assert.Equal(t, "east", internalData["kubernetes_cluster"])
+	name := resp.Data["service_account_name"].(string)
+
+	_, err = eastClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	_, err = defaultClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+
+	// The objects are deleted from the role's cluster on revocation
+	_, err = testRevoke(t, b, s, internalData)
+	require.NoError(t, err)
+	_, err = eastClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+	_, err = eastClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+}
+
+func TestCreds_cancelled(t *testing.T) {
+	testCases := map[string]struct {
+		// interrupt is called when the RoleBinding is created, which is
+		// after the Role and before the ServiceAccount
+		interrupt func(cancel context.CancelFunc)
+		expected  error
+	}{
+		"cancelled": {
+			interrupt: func(cancel context.CancelFunc) { cancel() },
+			expected:  context.Canceled,
+		},
+		"deadline exceeded": {
+			interrupt: func(cancel context.CancelFunc) {
+				time.Sleep(10 * time.Millisecond)
+			},
+			expected: context.DeadlineExceeded,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackend(t)
+			fakeClient := setupFakeClient(t, b, s)
+			b.clients[""].timeout = time.Millisecond
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fakeClient.PrependReactor("create", "rolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				tc.interrupt(cancel)
+				return false, nil, nil
+			})
+
+			resp, err := testRoleCreate(t, b, s, "cancelled", map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1"},
+				"generated_role_rules":          goodYAMLRules,
+			})
+			require.NoError(t, err)
+			require.NoError(t, resp.Error())
+
+			_, err = b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      pathCreds + "cancelled",
+				Storage:   s,
+			})
+			require.ErrorIs(t, err, tc.expected)
+
+			// No ServiceAccount is created once the request is cancelled,
+			// and the WAL entry of the Role is kept so that the rollback
+			// deletes it. The RoleBinding is owned by the Role, so Kubernetes
+			// garbage collects it.
+			ctx = context.Background()
+			accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, accounts.Items)
+			walIDs, err := framework.ListWAL(ctx, s)
+			require.NoError(t, err)
+			require.NotEmpty(t, walIDs)
+			for _, walID := range walIDs {
+				wal, err := framework.GetWAL(ctx, s, walID)
+				require.NoError(t, err)
+				require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, wal.Kind, wal.Data))
+			}
+			roles, err := fakeClient.RbacV1().Roles("app1").List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, roles.Items)
+		})
+	}
+}
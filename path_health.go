@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	healthPath            = "health"
+	healthHelpSynopsis    = `Reports the status of the plugin's config and Kubernetes API client.`
+	healthHelpDescription = `Reports whether the cluster is configured, whether the Kubernetes API is reachable and
+accepts the plugin's credentials, and when credentials were last issued for the cluster, with an overall
+status of "ok", "unhealthy" or "unconfigured". The result of the API request is cached for a short while,
+unless refresh is true, so the endpoint can be polled by dashboards. Unlike check, it doesn't depend on the
+environment variables of the pod Vault runs in, and works with an explicit config.`
+)
+
+// Overall statuses reported by the health endpoint
+const (
+	healthStatusOK           = "ok"
+	healthStatusUnhealthy    = "unhealthy"
+	healthStatusUnconfigured = "unconfigured"
+)
+
+// healthCheckTTL is how long the result of the request the health endpoint
+// makes to the Kubernetes API is reused
+var healthCheckTTL = 30 * time.Second
+
+// apiCheckResult is the cached result of the health endpoint's request to a
+// cluster's Kubernetes API
+type apiCheckResult struct {
+	checkedAt time.Time
+	err       error
+}
+
+func (b *backend) pathHealth() *framework.Path {
+	return &framework.Path{
+		Pattern: healthPath + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "read",
+			OperationSuffix: "health",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"kubernetes_cluster": {
+				Type:        framework.TypeString,
+				Description: "The name of the cluster to report on, configured at config/<name>. Defaults to the cluster configured at config.",
+				Query:       true,
+			},
+			"refresh": {
+				Type:        framework.TypeBool,
+				Description: "If true, make a new request to the Kubernetes API rather than reporting the cached result.",
+				Query:       true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathHealthRead,
+			},
+		},
+		HelpSynopsis:    healthHelpSynopsis,
+		HelpDescription: healthHelpDescription,
+	}
+}
+
+func (b *backend) pathHealthRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cluster := data.Get("kubernetes_cluster").(string)
+	config, err := getClusterConfig(ctx, req.Storage, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"status":               healthStatusUnconfigured,
+			"configured":           config != nil,
+			"api_reachable":        false,
+			"credentials_rejected": false,
+			"last_creds_issued":    "",
+		},
+	}
+	if cluster != "" {
+		resp.Data["kubernetes_cluster"] = cluster
+	}
+	if issued := b.lastCredsIssued(cluster); !issued.IsZero() {
+		resp.Data["last_creds_issued"] = issued.Format(time.RFC3339)
+	}
+	if config == nil {
+		return resp, nil
+	}
+
+	result := b.checkAPIHealth(ctx, req.Storage, cluster, data.Get("refresh").(bool))
+	resp.Data["api_checked"] = result.checkedAt.Format(time.RFC3339)
+	resp.Data["status"] = healthStatusOK
+	if result.err != nil {
+		resp.Data["status"] = healthStatusUnhealthy
+		resp.Data["api_error"] = result.err.Error()
+		resp.Data["api_error_stage"] = checkFailedStage(result.err)
+	} else {
+		resp.Data["api_reachable"] = true
+	}
+	// The periodic credential check only covers the default cluster
+	if cluster == "" {
+		if err := b.credentialsRejected(); err != nil {
+			resp.Data["status"] = healthStatusUnhealthy
+			resp.Data["credentials_rejected"] = true
+		}
+	}
+	return resp, nil
+}
+
+// checkAPIHealth returns the result of a request to the cluster's Kubernetes
+// API, which is reused for healthCheckTTL unless refresh is set. Failing to
+// build the client is reported like a failed request.
+func (b *backend) checkAPIHealth(ctx context.Context, s logical.Storage, cluster string, refresh bool) apiCheckResult {
+	b.healthLock.RLock()
+	cached, ok := b.apiChecks[cluster]
+	b.healthLock.RUnlock()
+	if ok && !refresh && time.Since(cached.checkedAt) < healthCheckTTL {
+		return cached
+	}
+
+	result := apiCheckResult{checkedAt: time.Now()}
+	client, err := b.getClient(ctx, s, cluster)
+	if err == nil {
+		err = client.checkAuth(ctx)
+	}
+	result.err = err
+
+	b.healthLock.Lock()
+	b.apiChecks[cluster] = result
+	b.healthLock.Unlock()
+	return result
+}
+
+// clearAPIChecks drops the cached results of the health endpoint's requests,
+// e.g. because the config changed
+func (b *backend) clearAPIChecks() {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+	b.apiChecks = make(map[string]apiCheckResult)
+}
+
+// recordCredsIssued records when credentials were last issued for the
+// cluster, for the health endpoint
+func (b *backend) recordCredsIssued(cluster string, issued time.Time) {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+	b.credsIssued[cluster] = issued
+}
+
+// lastCredsIssued returns when credentials were last issued for the cluster
+// by this Vault node since the plugin started, or the zero time if none were
+func (b *backend) lastCredsIssued(cluster string) time.Time {
+	b.healthLock.RLock()
+	defer b.healthLock.RUnlock()
+	return b.credsIssued[cluster]
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testHealthRead(t *testing.T, b *backend, s logical.Storage, d map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      healthPath,
+		Data:      d,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	return resp.Data
+}
+
+func TestHealth(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// No config yet
+	assert.Equal(t, map[string]interface{}{
+		"status":               healthStatusUnconfigured,
+		"configured":           false,
+		"api_reachable":        false,
+		"credentials_rejected": false,
+		"last_creds_issued":    "",
+	}, testHealthRead(t, b, s, nil))
+
+	fakeClient := setupFakeClient(t, b, s)
+	reviews := 0
+	var checkErr error
+	fakeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		if checkErr != nil {
+			return true, nil, checkErr
+		}
+		return true, &authorizationv1.SelfSubjectAccessReview{}, nil
+	})
+
+	data := testHealthRead(t, b, s, nil)
+	assert.Equal(t, healthStatusOK, data["status"])
+	assert.Equal(t, true, data["configured"])
+	assert.Equal(t, true, data["api_reachable"])
+	assert.NotEmpty(t, data["api_checked"])
+	assert.Equal(t, "", data["last_creds_issued"])
+	assert.Equal(t, 1, reviews)
+
+	// The result of the request is cached
+	checkErr = k8s_errors.NewUnauthorized("token expired")
+	data = testHealthRead(t, b, s, nil)
+	assert.Equal(t, healthStatusOK, data["status"])
+	assert.Equal(t, 1, reviews)
+
+	data = testHealthRead(t, b, s, map[string]interface{}{"refresh": true})
+	assert.Equal(t, healthStatusUnhealthy, data["status"])
+	assert.Equal(t, false, data["api_reachable"])
+	assert.Equal(t, "token expired", data["api_error"])
+	assert.Equal(t, checkStageAuth, data["api_error_stage"])
+	assert.Equal(t, 2, reviews)
+
+	// Credentials consistently rejected by the periodic check are reported
+	// even if the API request succeeds
+	for i := 0; i < maxCredentialCheckFailures; i++ {
+		require.NoError(t, b.checkCredentials(context.Background(), s))
+	}
+	checkErr = nil
+	data = testHealthRead(t, b, s, map[string]interface{}{"refresh": true})
+	assert.Equal(t, healthStatusUnhealthy, data["status"])
+	assert.Equal(t, true, data["api_reachable"])
+	assert.Equal(t, true, data["credentials_rejected"])
+	require.NoError(t, b.checkCredentials(context.Background(), s))
+
+	resp, err := testRoleCreate(t, b, s, "healthy", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testCredsCreate(t, b, s, "healthy", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	data = testHealthRead(t, b, s, nil)
+	assert.Equal(t, healthStatusOK, data["status"])
+	assert.NotEmpty(t, data["last_creds_issued"])
+
+	// Another cluster is reported on separately
+	data = testHealthRead(t, b, s, map[string]interface{}{"kubernetes_cluster": "other"})
+	assert.Equal(t, healthStatusUnconfigured, data["status"])
+	assert.Equal(t, "other", data["kubernetes_cluster"])
+	assert.Equal(t, "", data["last_creds_issued"])
+}
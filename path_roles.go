@@ -6,6 +6,10 @@ package kubesecrets
 import (
 	"context"
 	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-secure-stdlib/strutil"
@@ -13,35 +17,363 @@ import (
 	"github.com/hashicorp/vault/sdk/helper/template"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/mitchellh/mapstructure"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
-	defaultRoleType     = "Role"
-	rolesPath           = "roles/"
-	defaultNameTemplate = `{{ printf "v-%s-%s-%s-%s" (.DisplayName | truncate 8) (.RoleName | truncate 8) (unix_time) (random 24) | truncate 62 | lowercase }}`
+	defaultRoleType      = "Role"
+	rolesPath            = "roles/"
+	defaultNameTemplate  = `{{ printf "v-%s-%s-%s-%s" (.DisplayName | truncate 8) (.RoleName | truncate 8) (unix_time) (random 24) | truncate 62 | lowercase }}`
+	prefixedNameTemplate = `{{ printf "%s-%s-%s-%s-%s" .NamePrefix (.DisplayName | truncate 8) (.RoleName | truncate 8) (unix_time) (random 24) | truncate 62 | lowercase }}`
+
+	// validateNameTemplatePath is outside of rolesPath, so it can't shadow a
+	// role of the same name
+	validateNameTemplatePath = "validate-name-template"
+
+	// The namespaced templates are used in place of the default templates
+	// above when the role sets name_include_namespace
+	namespacedNameTemplate         = `{{ printf "v-%s-%s-%s-%s-%s" (.Namespace | truncate 8) (.DisplayName | truncate 8) (.RoleName | truncate 8) (unix_time) (random 24) | truncate 62 | lowercase }}`
+	prefixedNamespacedNameTemplate = `{{ printf "%s-%s-%s-%s-%s-%s" .NamePrefix (.Namespace | truncate 8) (.DisplayName | truncate 8) (.RoleName | truncate 8) (unix_time) (random 24) | truncate 62 | lowercase }}`
+
+	maxNamePrefixLength     = 20
+	defaultTokenResponseKey = "service_account_token"
+
+	// tokenTypeBound issues tokens with the TokenRequest API, which expire
+	// with the lease. tokenTypeSecret stores a long-lived token in a Secret of
+	// type kubernetes.io/service-account-token, which is valid until the
+	// Secret is deleted.
+	tokenTypeBound  = "bound"
+	tokenTypeSecret = "secret"
 )
 
+// tokenResponseKeyRegex matches the allowed names of the creds response field
+// holding the service account token
+var tokenResponseKeyRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,63}$`)
+
+// namePrefixRegex matches a DNS-1123 label, so the prefix can start a
+// generated Kubernetes object name
+var namePrefixRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
 type roleEntry struct {
-	Name                  string            `json:"name" mapstructure:"name"`
-	K8sNamespaces         []string          `json:"allowed_kubernetes_namespaces" mapstructure:"allowed_kubernetes_namespaces"`
-	K8sNamespaceSelector  string            `json:"allowed_kubernetes_namespace_selector" mapstructure:"allowed_kubernetes_namespace_selector"`
-	TokenMaxTTL           time.Duration     `json:"token_max_ttl" mapstructure:"token_max_ttl"`
-	TokenDefaultTTL       time.Duration     `json:"token_default_ttl" mapstructure:"token_default_ttl"`
-	TokenDefaultAudiences []string          `json:"token_default_audiences" mapstructure:"token_default_audiences"`
-	ServiceAccountName    string            `json:"service_account_name" mapstructure:"service_account_name"`
-	K8sRoleName           string            `json:"kubernetes_role_name" mapstructure:"kubernetes_role_name"`
-	K8sRoleType           string            `json:"kubernetes_role_type" mapstructure:"kubernetes_role_type"`
-	RoleRules             string            `json:"generated_role_rules" mapstructure:"generated_role_rules"`
-	NameTemplate          string            `json:"name_template" mapstructure:"name_template"`
-	ExtraLabels           map[string]string `json:"extra_labels" mapstructure:"extra_labels"`
-	ExtraAnnotations      map[string]string `json:"extra_annotations" mapstructure:"extra_annotations"`
+	Name                    string            `json:"name" mapstructure:"name"`
+	K8sNamespaces           []string          `json:"allowed_kubernetes_namespaces" mapstructure:"allowed_kubernetes_namespaces"`
+	K8sNamespaceSelector    string            `json:"allowed_kubernetes_namespace_selector" mapstructure:"allowed_kubernetes_namespace_selector"`
+	DeniedK8sNamespaces     []string          `json:"denied_kubernetes_namespaces" mapstructure:"denied_kubernetes_namespaces"`
+	DefaultNamespace        string            `json:"default_namespace" mapstructure:"default_namespace"`
+	TokenMaxTTL             time.Duration     `json:"token_max_ttl" mapstructure:"token_max_ttl"`
+	TokenDefaultTTL         time.Duration     `json:"token_default_ttl" mapstructure:"token_default_ttl"`
+	TokenDefaultAudiences   []string          `json:"token_default_audiences" mapstructure:"token_default_audiences"`
+	AllowedAudiences        []string          `json:"allowed_audiences" mapstructure:"allowed_audiences"`
+	ServiceAccountName      string            `json:"service_account_name" mapstructure:"service_account_name"`
+	K8sRoleName             string            `json:"kubernetes_role_name" mapstructure:"kubernetes_role_name"`
+	K8sRoleType             string            `json:"kubernetes_role_type" mapstructure:"kubernetes_role_type"`
+	K8sRoleBindingName      string            `json:"kubernetes_role_binding_name" mapstructure:"kubernetes_role_binding_name"`
+	RoleRules               string            `json:"generated_role_rules" mapstructure:"generated_role_rules"`
+	RoleRulesFile           string            `json:"generated_role_rules_file" mapstructure:"generated_role_rules_file"`
+	AggregationRule         string            `json:"generated_aggregation_rule" mapstructure:"generated_aggregation_rule"`
+	NameTemplate            string            `json:"name_template" mapstructure:"name_template"`
+	ExtraLabels             map[string]string `json:"extra_labels" mapstructure:"extra_labels"`
+	ExtraAnnotations        map[string]string `json:"extra_annotations" mapstructure:"extra_annotations"`
+	RoleFinalizers          []string          `json:"role_finalizers" mapstructure:"role_finalizers"`
+	RoleBindingFinalizers   []string          `json:"role_binding_finalizers" mapstructure:"role_binding_finalizers"`
+	ForceRemoveFinalizers   bool              `json:"force_remove_finalizers" mapstructure:"force_remove_finalizers"`
+	AnnotateLeaseID         bool              `json:"annotate_lease_id" mapstructure:"annotate_lease_id"`
+	TokenResponseKey        string            `json:"token_response_key" mapstructure:"token_response_key"`
+	NamePrefix              string            `json:"name_prefix" mapstructure:"name_prefix"`
+	NameIncludeNamespace    bool              `json:"name_include_namespace" mapstructure:"name_include_namespace"`
+	SharedClusterRole       bool              `json:"shared_cluster_role" mapstructure:"shared_cluster_role"`
+	CombineRules            bool              `json:"combine_rules" mapstructure:"combine_rules"`
+	MaxActiveTokens         int               `json:"max_active_tokens" mapstructure:"max_active_tokens"`
+	TokenType               string            `json:"token_type" mapstructure:"token_type"`
+	TokenSecretNameTemplate string            `json:"token_secret_name_template" mapstructure:"token_secret_name_template"`
+	CreateNamespace         bool              `json:"create_namespace" mapstructure:"create_namespace"`
+	AllowClusterRoleBinding bool              `json:"allow_cluster_role_binding" mapstructure:"allow_cluster_role_binding"`
+	AdditionalSubjects      string            `json:"additional_subjects" mapstructure:"additional_subjects"`
+	KubernetesCluster       string            `json:"kubernetes_cluster" mapstructure:"kubernetes_cluster"`
+
+	// ParsedRoleRules caches RoleRules as parsed when the role was written,
+	// so creds requests don't parse them again. Roles written before it was
+	// introduced don't have it.
+	ParsedRoleRules []rbacv1.PolicyRule `json:"parsed_role_rules,omitempty" mapstructure:"-"`
 }
 
 // HasSingleK8sNamespace returns true if the role has a single namespace specified
 // and the label selector for Kubernetes namespaces is empty
 func (r *roleEntry) HasSingleK8sNamespace() bool {
 	return r.K8sNamespaceSelector == "" &&
-		len(r.K8sNamespaces) == 1 && r.K8sNamespaces[0] != "" && r.K8sNamespaces[0] != "*"
+		len(r.K8sNamespaces) == 1 && r.K8sNamespaces[0] != "" && !isNamespacePattern(r.K8sNamespaces[0])
+}
+
+// isNamespacePattern returns true if an entry of allowed_kubernetes_namespaces
+// is a glob pattern rather than a namespace name
+func isNamespacePattern(namespace string) bool {
+	return strings.ContainsAny(namespace, `*?[\`)
+}
+
+// namespaceAllowed returns true if the namespace matches any of the role's
+// allowed_kubernetes_namespaces, which may be glob patterns as accepted by
+// path.Match, such as "*" or "team-a-*"
+func (r *roleEntry) namespaceAllowed(namespace string) bool {
+	return matchesNamespacePattern(r.K8sNamespaces, namespace)
+}
+
+// validateDefaultNamespace returns an error if the role's default_namespace
+// isn't a valid namespace name, or can't be allowed by the role. Namespaces
+// matching a selector are only known when creds are requested, so the
+// default_namespace of a role with a selector is checked then.
+func (r *roleEntry) validateDefaultNamespace() error {
+	if r.DefaultNamespace == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(r.DefaultNamespace); len(errs) > 0 {
+		return fmt.Errorf("default_namespace '%s' is not a valid namespace name: %s", r.DefaultNamespace, strings.Join(errs, ", "))
+	}
+	if r.namespaceDenied(r.DefaultNamespace) {
+		return fmt.Errorf("default_namespace '%s' is denied by denied_kubernetes_namespaces", r.DefaultNamespace)
+	}
+	if r.K8sNamespaceSelector == "" && !r.namespaceAllowed(r.DefaultNamespace) {
+		return fmt.Errorf("default_namespace '%s' is not present in allowed_kubernetes_namespaces", r.DefaultNamespace)
+	}
+	return nil
+}
+
+// namespaceDenied returns true if the namespace matches any of the role's
+// denied_kubernetes_namespaces, which take precedence over the allowed ones
+func (r *roleEntry) namespaceDenied(namespace string) bool {
+	return matchesNamespacePattern(r.DeniedK8sNamespaces, namespace)
+}
+
+func matchesNamespacePattern(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, namespace); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNamespacePatterns returns an error if any of the patterns of the
+// field aren't valid glob patterns
+func validateNamespacePatterns(field string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid %s pattern '%s': %w", field, pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkAudiencesAllowed returns an error if any of the audiences aren't in the
+// role's allowed_audiences
+func checkAudiencesAllowed(r *roleEntry, audiences []string) error {
+	if len(r.AllowedAudiences) == 0 {
+		return nil
+	}
+	for _, audience := range audiences {
+		if !strutil.StrListContains(r.AllowedAudiences, audience) {
+			return fmt.Errorf("audience '%s' is not in the role's allowed_audiences: %s", audience, strings.Join(r.AllowedAudiences, ", "))
+		}
+	}
+	return nil
+}
+
+// policyRules returns the role's generated_role_rules, parsed when the role
+// was written if possible
+func (r *roleEntry) policyRules() ([]rbacv1.PolicyRule, error) {
+	if r.ParsedRoleRules != nil {
+		return r.ParsedRoleRules, nil
+	}
+	return makeRules(r.RoleRules)
+}
+
+// defaultAudiences returns the audiences of tokens for requests that don't
+// set any: the role's token_default_audiences, or else the first of its
+// allowed_audiences, so that tokens never get the cluster's default audience
+// if the role restricts them
+func (r *roleEntry) defaultAudiences() []string {
+	if len(r.TokenDefaultAudiences) > 0 || len(r.AllowedAudiences) == 0 || r.TokenType == tokenTypeSecret {
+		return r.TokenDefaultAudiences
+	}
+	return r.AllowedAudiences[:1]
+}
+
+// checkRulesPolicy returns an error naming the first rule that the mount's
+// forbid_wildcard_rules, allowed_verbs, allowed_resources or
+// require_resource_names_for_verbs don't allow
+func (c *kubeConfig) checkRulesPolicy(rules []rbacv1.PolicyRule) error {
+	if c.ForbidWildcardRules {
+		if err := checkRulesNoWildcards(rules); err != nil {
+			return err
+		}
+	}
+	if err := checkRulesAllowed(rules, c.AllowedVerbs, c.AllowedResources); err != nil {
+		return err
+	}
+	return checkRulesResourceNames(rules, c.RequireResourceNamesForVerbs)
+}
+
+// checkRulesAllowed returns an error naming the first rule with a verb or
+// resource that isn't in the allowed verbs or resources. An empty list allows
+// anything.
+func checkRulesAllowed(rules []rbacv1.PolicyRule, allowedVerbs, allowedResources []string) error {
+	for i, rule := range rules {
+		if len(allowedVerbs) > 0 {
+			for _, verb := range rule.Verbs {
+				if !strutil.StrListContains(allowedVerbs, verb) {
+					return fmt.Errorf("rule %d: verb '%s' is not in the mount's allowed_verbs: %s", i, verb, strings.Join(allowedVerbs, ", "))
+				}
+			}
+		}
+		if len(allowedResources) > 0 {
+			for _, resource := range rule.Resources {
+				if !strutil.StrListContains(allowedResources, resource) {
+					return fmt.Errorf("rule %d: resource '%s' is not in the mount's allowed_resources: %s", i, resource, strings.Join(allowedResources, ", "))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkRulesNoWildcards returns an error naming the first rule with a
+// wildcard in its verbs, apiGroups or resources
+func checkRulesNoWildcards(rules []rbacv1.PolicyRule) error {
+	for i, rule := range rules {
+		switch {
+		case strutil.StrListContains(rule.Verbs, rbacv1.VerbAll):
+			return fmt.Errorf("rule %d: '*' in verbs is forbidden by the mount's forbid_wildcard_rules", i)
+		case strutil.StrListContains(rule.APIGroups, rbacv1.APIGroupAll):
+			return fmt.Errorf("rule %d: '*' in apiGroups is forbidden by the mount's forbid_wildcard_rules", i)
+		case strutil.StrListContains(rule.Resources, rbacv1.ResourceAll):
+			return fmt.Errorf("rule %d: '*' in resources is forbidden by the mount's forbid_wildcard_rules", i)
+		}
+	}
+	return nil
+}
+
+// checkRulesResourceNames returns an error naming the first rule that grants
+// one of the verbs without listing resourceNames
+func checkRulesResourceNames(rules []rbacv1.PolicyRule, verbs []string) error {
+	for i, rule := range rules {
+		if len(rule.ResourceNames) > 0 {
+			continue
+		}
+		for _, verb := range rule.Verbs {
+			if strutil.StrListContains(verbs, verb) {
+				return fmt.Errorf("rule %d: verb '%s' requires resourceNames by the mount's require_resource_names_for_verbs", i, verb)
+			}
+		}
+	}
+	return nil
+}
+
+// sampleNameMetadata returns the metadata of a typical creds request for the
+// role, to check that its name template renders a valid name
+func (r *roleEntry) sampleNameMetadata() nameMetadata {
+	namespace := "default"
+	if r.DefaultNamespace != "" {
+		namespace = r.DefaultNamespace
+	} else if r.HasSingleK8sNamespace() {
+		namespace = r.K8sNamespaces[0]
+	}
+	return nameMetadata{
+		DisplayName: "token",
+		RoleName:    r.Name,
+		NamePrefix:  r.NamePrefix,
+		Namespace:   namespace,
+	}
+}
+
+// generatesRole returns true if a Role or ClusterRole is generated for each
+// set of credentials
+func (r *roleEntry) generatesRole() bool {
+	return r.RoleRules != "" || r.RoleRulesFile != "" || r.AggregationRule != ""
+}
+
+// bindsExistingServiceAccount returns true if an existing Role or ClusterRole
+// is bound to an existing service account for each set of credentials, so
+// only a RoleBinding and a token are created
+func (r *roleEntry) bindsExistingServiceAccount() bool {
+	return r.ServiceAccountName != "" && r.K8sRoleName != "" && !r.generatesRole() && r.K8sRoleBindingName == ""
+}
+
+// nameTemplate returns the template used to generate the names of the
+// Kubernetes objects created for this role
+func (r *roleEntry) nameTemplate() string {
+	switch {
+	case r.NameTemplate != "":
+		return r.NameTemplate
+	case r.NamePrefix != "" && r.NameIncludeNamespace:
+		return prefixedNamespacedNameTemplate
+	case r.NamePrefix != "":
+		return prefixedNameTemplate
+	case r.NameIncludeNamespace:
+		return namespacedNameTemplate
+	default:
+		return defaultNameTemplate
+	}
+}
+
+// withExtraMetadata returns a copy of the role with the given labels and
+// annotations added to the extra labels and annotations applied to generated
+// Kubernetes objects
+func (r *roleEntry) withExtraMetadata(labels, annotations map[string]string) *roleEntry {
+	role := *r
+	role.ExtraLabels = combineMaps(r.ExtraLabels, labels)
+	role.ExtraAnnotations = combineMaps(r.ExtraAnnotations, annotations)
+	return &role
+}
+
+// withRenderedMetadata returns a copy of the role with the templated values
+// of its extra labels and annotations rendered for a creds request. Values
+// without a template expression are kept as they are.
+func (r *roleEntry) withRenderedMetadata(data metadataTemplateData) (*roleEntry, error) {
+	labels, err := renderMetadata("extra_labels", r.ExtraLabels, data, true)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := renderMetadata("extra_annotations", r.ExtraAnnotations, data, false)
+	if err != nil {
+		return nil, err
+	}
+	role := *r
+	role.ExtraLabels = labels
+	role.ExtraAnnotations = annotations
+	return &role, nil
+}
+
+// renderMetadata renders the templated values of the labels or annotations
+// set in the field. Rendered label values must be valid label values.
+func renderMetadata(field string, metadata map[string]string, data metadataTemplateData, isLabel bool) (map[string]string, error) {
+	var rendered map[string]string
+	for _, k := range sortedKeys(metadata) {
+		v := metadata[k]
+		if !strings.Contains(v, "{{") {
+			continue
+		}
+		up, err := template.NewTemplate(template.Template(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %s key '%s': %w", field, k, err)
+		}
+		value, err := up.Generate(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s key '%s': %w", field, k, err)
+		}
+		if isLabel {
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				return nil, fmt.Errorf("%s key '%s' renders to '%s', which is not a valid label value: %s", field, k, value, strings.Join(errs, ", "))
+			}
+		}
+		if rendered == nil {
+			rendered = combineMaps(metadata)
+		}
+		rendered[k] = value
+	}
+	if rendered == nil {
+		return metadata, nil
+	}
+	return rendered, nil
 }
 
 func (r *roleEntry) toResponseData() (map[string]interface{}, error) {
@@ -51,6 +383,7 @@ func (r *roleEntry) toResponseData() (map[string]interface{}, error) {
 	}
 	// Format the TTLs as seconds
 	respData["token_default_ttl"] = r.TokenDefaultTTL.Seconds()
+	respData["token_ttl"] = r.TokenDefaultTTL.Seconds()
 	respData["token_max_ttl"] = r.TokenMaxTTL.Seconds()
 
 	return respData, nil
@@ -58,6 +391,47 @@ func (r *roleEntry) toResponseData() (map[string]interface{}, error) {
 
 func (b *backend) pathRoles() []*framework.Path {
 	return []*framework.Path{
+		{
+			Pattern: validateNameTemplatePath + "/?$",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefixKubernetes,
+				OperationVerb:   "validate",
+				OperationSuffix: "name-template",
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name_template": {
+					Type:        framework.TypeString,
+					Description: "The name template to validate. If not set, the default template is used.",
+				},
+				"name_prefix": {
+					Type:        framework.TypeString,
+					Description: "The name prefix to validate, as an alternative to name_template.",
+				},
+				"role_name": {
+					Type:        framework.TypeString,
+					Description: "Sample Vault role name to render the template with.",
+				},
+				"display_name": {
+					Type:        framework.TypeString,
+					Description: "Sample token display name to render the template with.",
+				},
+				"namespace": {
+					Type:        framework.TypeString,
+					Description: "Sample Kubernetes namespace to render the template with.",
+				},
+				"name_include_namespace": {
+					Type:        framework.TypeBool,
+					Description: "If true, validate the default template that includes the namespace.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRolesValidateNameTemplate,
+				},
+			},
+			HelpSynopsis:    pathRolesValidateNameTemplateHelpSynopsis,
+			HelpDescription: pathRolesValidateNameTemplateHelpDescription,
+		},
 		{
 			Pattern: rolesPath + framework.GenericNameRegex("name"),
 			DisplayAttrs: &framework.DisplayAttributes{
@@ -72,22 +446,37 @@ func (b *backend) pathRoles() []*framework.Path {
 				},
 				"allowed_kubernetes_namespaces": {
 					Type:        framework.TypeCommaStringSlice,
-					Description: `A list of the Kubernetes namespaces in which credentials can be generated. If set to "*" all namespaces are allowed.`,
+					Description: `A list of the Kubernetes namespaces in which credentials can be generated. Entries may be glob patterns such as "team-a-*". If set to "*" all namespaces are allowed.`,
+					Required:    false,
+				},
+				"denied_kubernetes_namespaces": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: `A list of the Kubernetes namespaces in which credentials can't be generated, even if they are allowed by allowed_kubernetes_namespaces or allowed_kubernetes_namespace_selector. Entries may be glob patterns such as "kube-*".`,
 					Required:    false,
 				},
 				"allowed_kubernetes_namespace_selector": {
 					Type:        framework.TypeString,
-					Description: `A label selector for Kubernetes namespaces in which credentials can be generated. Accepts either a JSON or YAML object. If set with allowed_kubernetes_namespaces, the conditions are conjuncted.`,
+					Description: `A label selector for Kubernetes namespaces in which credentials can be generated. Accepts either a JSON or YAML object, or a label selector string such as "owner=team-a,env in (dev,staging)". If set with allowed_kubernetes_namespaces, the conditions are conjuncted.`,
+					Required:    false,
+				},
+				"default_namespace": {
+					Type:        framework.TypeLowerCaseString,
+					Description: `The Kubernetes namespace in which credentials are generated if the creds request doesn't set kubernetes_namespace. It must be allowed by the role like a requested namespace. If not set, kubernetes_namespace is required unless allowed_kubernetes_namespaces is a single namespace.`,
 					Required:    false,
 				},
 				"token_max_ttl": {
 					Type:        framework.TypeDurationSecond,
-					Description: "The maximum ttl for generated Kubernetes service account tokens. If not set or set to 0, will use system default.",
+					Description: "The maximum ttl for generated Kubernetes service account tokens. If not set or set to 0, will use the mount's max_ttl, or the system default.",
 					Required:    false,
 				},
 				"token_default_ttl": {
 					Type:        framework.TypeDurationSecond,
-					Description: "The default ttl for generated Kubernetes service account tokens. If not set or set to 0, will use system default.",
+					Description: "The default ttl for generated Kubernetes service account tokens. If not set or set to 0, will use the mount's default_ttl, or the system default.",
+					Required:    false,
+				},
+				"token_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Alias of token_default_ttl, which is the canonical name. Both are returned when reading the role.",
 					Required:    false,
 				},
 				"token_default_audiences": {
@@ -95,14 +484,24 @@ func (b *backend) pathRoles() []*framework.Path {
 					Description: "The default audiences for generated Kubernetes service account tokens. If not set or set to \"\", will use k8s cluster default.",
 					Required:    false,
 				},
+				"allowed_audiences": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The audiences that may be requested when generating credentials. If set without token_default_audiences, requests that don't set audiences get the first allowed audience. If not set, any audiences may be requested.",
+					Required:    false,
+				},
 				"service_account_name": {
 					Type:        framework.TypeString,
-					Description: "The pre-existing service account to generate tokens for. Mutually exclusive with all role parameters. If set, only a Kubernetes service account token will be created.",
+					Description: "The pre-existing service account to generate tokens for. If set, only a Kubernetes service account token will be created, unless kubernetes_role_name is also set. Mutually exclusive with generated_role_rules.",
 					Required:    false,
 				},
 				"kubernetes_role_name": {
 					Type:        framework.TypeString,
-					Description: "The pre-existing Role or ClusterRole to bind a generated service account to. If set, Kubernetes token, service account, and role binding objects will be created.",
+					Description: "The pre-existing Role or ClusterRole to bind a generated service account to. If set, Kubernetes token, service account, and role binding objects will be created. If service_account_name is also set, the role is bound to that service account instead, and only the role binding and token are created.",
+					Required:    false,
+				},
+				"kubernetes_role_binding_name": {
+					Type:        framework.TypeString,
+					Description: "The pre-existing RoleBinding, or ClusterRoleBinding if cluster_role_binding is requested, that binds service_account_name in the requested namespace. If set, only a token is created, once the binding is found to bind the service account, and kubernetes_role_name if that is set. The binding is never deleted. Requires service_account_name.",
 					Required:    false,
 				},
 				"kubernetes_role_type": {
@@ -113,7 +512,63 @@ func (b *backend) pathRoles() []*framework.Path {
 				},
 				"generated_role_rules": {
 					Type:        framework.TypeString,
-					Description: "The Role or ClusterRole rules to use when generating a role. Accepts either a JSON or YAML object. If set, the entire chain of Kubernetes objects will be generated.",
+					Description: "The Role or ClusterRole rules to use when generating a role. Accepts either a JSON or YAML object, several YAML documents separated by '---', or a list of such objects, whose rules are combined. If set, the entire chain of Kubernetes objects will be generated.",
+					Required:    false,
+				},
+				"generated_role_rules_file": {
+					Type:        framework.TypeString,
+					Description: "The path of a file containing the Role or ClusterRole rules to use when generating a role, as an alternative to generated_role_rules. The path must be in the mount's allowed_role_rules_paths. The file is re-read when it changes.",
+					Required:    false,
+				},
+				"generated_aggregation_rule": {
+					Type:        framework.TypeString,
+					Description: `The aggregation rule to use when generating a ClusterRole, in JSON or YAML, e.g. {"clusterRoleSelectors": [{"matchLabels": {"rbac.example.com/aggregate-to-app": "true"}}]}. The generated ClusterRole has no rules of its own, Kubernetes fills them in from the ClusterRoles matching the selectors. Requires a kubernetes_role_type of ClusterRole, and can't be used with generated_role_rules.`,
+					Required:    false,
+				},
+				"shared_cluster_role": {
+					Type:        framework.TypeBool,
+					Description: "If true, a single ClusterRole is generated for the generated_role_rules and shared by all leases with the same rules, rather than one per lease. It is deleted when the last of those leases is revoked. Requires a kubernetes_role_type of ClusterRole.",
+					Required:    false,
+				},
+				"max_active_tokens": {
+					Type:        framework.TypeInt,
+					Description: "The maximum number of active (unrevoked) credentials for this role. Requests beyond the limit are rejected until some are revoked. If not set or set to 0, there is no limit.",
+					Required:    false,
+				},
+				"combine_rules": {
+					Type:        framework.TypeBool,
+					Description: "If true, both kubernetes_role_name and generated_role_rules may be set. The existing role is bound in addition to a role generated from the rules, and both bindings are cleaned up on revocation. The kubernetes_role_type applies to both roles.",
+					Required:    false,
+				},
+				"create_namespace": {
+					Type:        framework.TypeBool,
+					Description: "If true, the requested kubernetes_namespace is created if it doesn't exist. A namespace created by Vault is deleted when the last lease in it is revoked, while existing namespaces are never deleted. Requires permission to create, get and delete namespaces.",
+					Required:    false,
+				},
+				"kubernetes_cluster": {
+					Type:        framework.TypeString,
+					Description: "The name of the Kubernetes cluster to generate credentials in, configured at config/<name>. If not set, the cluster configured at config is used.",
+					Required:    false,
+				},
+				"additional_subjects": {
+					Type:        framework.TypeString,
+					Description: "JSON or YAML list of subjects to add to the generated RoleBinding or ClusterRoleBinding besides the service account, each with a kind of ServiceAccount, User or Group, a name, and a namespace for ServiceAccounts.",
+					Required:    false,
+				},
+				"allow_cluster_role_binding": {
+					Type:        framework.TypeBool,
+					Description: "If false, creds requests with cluster_role_binding set are rejected. Defaults to true.",
+					Default:     true,
+					Required:    false,
+				},
+				"token_type": {
+					Type:        framework.TypeString,
+					Description: "The type of service account token to issue. 'bound' tokens are created with the TokenRequest API and expire with the lease. 'secret' tokens are stored in a Secret of type kubernetes.io/service-account-token for clients that can't refresh tokens; they don't expire, and are only invalidated when the lease is revoked and the Secret deleted. Defaults to 'bound'.",
+					Required:    false,
+				},
+				"token_secret_name_template": {
+					Type:        framework.TypeString,
+					Description: "The name template of the Secret storing the token of a role with token_type 'secret', with the same fields as name_template. The rendered name must not be used by an existing Secret. Defaults to the generated name of the service account.",
 					Required:    false,
 				},
 				"name_template": {
@@ -121,14 +576,55 @@ func (b *backend) pathRoles() []*framework.Path {
 					Description: "The name template to use when generating service accounts, roles and role bindings. If unset, a default template is used.",
 					Required:    false,
 				},
+				"name_prefix": {
+					Type:        framework.TypeString,
+					Description: "The prefix to use in place of 'v' in the default name template when generating service accounts, roles and role bindings. Mutually exclusive with name_template.",
+					Required:    false,
+				},
+				"name_include_namespace": {
+					Type:        framework.TypeBool,
+					Description: "If true, include the target Kubernetes namespace in the default name template when generating service accounts, roles and role bindings. Can't be used with name_template.",
+					Required:    false,
+				},
 				"extra_labels": {
 					Type:        framework.TypeKVPairs,
-					Description: "Additional labels to apply to all generated Kubernetes objects.",
+					Description: "Additional labels to apply to all generated Kubernetes objects. Values may be templates, rendered for each request with .DisplayName, .RoleName, .NamePrefix, .Namespace and .Timestamp.",
 					Required:    false,
 				},
 				"extra_annotations": {
 					Type:        framework.TypeKVPairs,
-					Description: "Additional annotations to apply to all generated Kubernetes objects.",
+					Description: "Additional annotations to apply to all generated Kubernetes objects. Values may be templates, rendered for each request with .DisplayName, .RoleName, .NamePrefix, .Namespace and .Timestamp.",
+					Required:    false,
+				},
+				"role_finalizers": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Finalizers to set on the generated Role or ClusterRole, such as 'example.com/cleanup'. A deleted object isn't removed until its finalizers are, so the object outlives its lease unless force_remove_finalizers is set.",
+					Required:    false,
+				},
+				"role_binding_finalizers": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Finalizers to set on the generated RoleBinding or ClusterRoleBinding, such as 'example.com/cleanup'. A deleted binding keeps granting its permissions until its finalizers are removed, so it outlives its lease unless force_remove_finalizers is set.",
+					Required:    false,
+				},
+				"force_remove_finalizers": {
+					Type:        framework.TypeBool,
+					Description: "If true, revoking a lease removes the role_finalizers and role_binding_finalizers from its objects after deleting them, so they're removed without waiting for the controllers that own the finalizers.",
+					Required:    false,
+				},
+				"annotate_lease_id": {
+					Type:        framework.TypeBool,
+					Description: "If true, generated Kubernetes objects are annotated with the key of their lease in the list of creds (vault.hashicorp.com/lease-index-id) and the ID of the creds request (vault.hashicorp.com/request-id), which the audit log records with the lease ID.",
+					Required:    false,
+				},
+				"token_response_key": {
+					Type:        framework.TypeString,
+					Description: "The name of the field in the credentials response that holds the service account token.",
+					Required:    false,
+					Default:     defaultTokenResponseKey,
+				},
+				"revoke_leases": {
+					Type:        framework.TypeBool,
+					Description: "On delete, also delete the Kubernetes objects of all leases issued for the role. Their Vault leases remain until they expire or are revoked.",
 					Required:    false,
 				},
 			},
@@ -197,6 +693,40 @@ func (b *backend) pathRolesRead(ctx context.Context, req *logical.Request, d *fr
 	}, nil
 }
 
+func (b *backend) pathRolesValidateNameTemplate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role := &roleEntry{
+		NameTemplate:         d.Get("name_template").(string),
+		NamePrefix:           d.Get("name_prefix").(string),
+		NameIncludeNamespace: d.Get("name_include_namespace").(bool),
+	}
+	if role.NameTemplate != "" && role.NamePrefix != "" {
+		return logical.ErrorResponse("only one of name_template or name_prefix may be set"), nil
+	}
+	if role.NameTemplate != "" && role.NameIncludeNamespace {
+		return logical.ErrorResponse("name_include_namespace can't be used with name_template, use {{.Namespace}} in the template instead"), nil
+	}
+	if role.NamePrefix != "" && (len(role.NamePrefix) > maxNamePrefixLength || !namePrefixRegex.MatchString(role.NamePrefix)) {
+		return logical.ErrorResponse("name_prefix must be at most %d lowercase alphanumeric characters or '-', and must start and end with an alphanumeric character", maxNamePrefixLength), nil
+	}
+
+	name, err := generateName(role, nameMetadata{
+		DisplayName: d.Get("display_name").(string),
+		RoleName:    d.Get("role_name").(string),
+		NamePrefix:  role.NamePrefix,
+		Namespace:   d.Get("namespace").(string),
+	})
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":   name,
+			"length": len(name),
+		},
+	}, nil
+}
+
 func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	name := d.Get("name").(string)
 	if name == "" {
@@ -210,25 +740,49 @@ func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *f
 
 	if entry == nil {
 		entry = &roleEntry{
-			Name: name,
+			Name:                    name,
+			AllowClusterRoleBinding: true,
 		}
 	}
 
 	if k8sNamespaces, ok := d.GetOk("allowed_kubernetes_namespaces"); ok {
 		// K8s namespaces need to be lowercase
 		entry.K8sNamespaces = strutil.RemoveDuplicates(k8sNamespaces.([]string), true)
+		if err := validateNamespacePatterns("allowed_kubernetes_namespaces", entry.K8sNamespaces); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	if deniedK8sNamespaces, ok := d.GetOk("denied_kubernetes_namespaces"); ok {
+		entry.DeniedK8sNamespaces = strutil.RemoveDuplicates(deniedK8sNamespaces.([]string), true)
+		if err := validateNamespacePatterns("denied_kubernetes_namespaces", entry.DeniedK8sNamespaces); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 	}
 	if k8sNamespaceSelector, ok := d.GetOk("allowed_kubernetes_namespace_selector"); ok {
 		entry.K8sNamespaceSelector = k8sNamespaceSelector.(string)
 	}
+	if defaultNamespace, ok := d.GetOk("default_namespace"); ok {
+		entry.DefaultNamespace = defaultNamespace.(string)
+	}
 	if tokenMaxTTLRaw, ok := d.GetOk("token_max_ttl"); ok {
 		entry.TokenMaxTTL = time.Duration(tokenMaxTTLRaw.(int)) * time.Second
 	}
-	if tokenTTLRaw, ok := d.GetOk("token_default_ttl"); ok {
+	// token_ttl is an alias of token_default_ttl, so they can't disagree
+	tokenTTLRaw, tokenTTLOk := d.GetOk("token_default_ttl")
+	if aliasRaw, ok := d.GetOk("token_ttl"); ok {
+		if tokenTTLOk && aliasRaw.(int) != tokenTTLRaw.(int) {
+			return logical.ErrorResponse("token_ttl is an alias of token_default_ttl, and can't be set to a different value"), nil
+		}
+		tokenTTLRaw, tokenTTLOk = aliasRaw, true
+	}
+	if tokenTTLOk {
 		entry.TokenDefaultTTL = time.Duration(tokenTTLRaw.(int)) * time.Second
 	}
 	if tokenAudiencesRaw, ok := d.GetOk("token_default_audiences"); ok {
-		entry.TokenDefaultAudiences = strutil.RemoveDuplicates(tokenAudiencesRaw.([]string), false)
+		entry.TokenDefaultAudiences = strutil.RemoveDuplicatesStable(tokenAudiencesRaw.([]string), false)
+	}
+	if allowedAudiencesRaw, ok := d.GetOk("allowed_audiences"); ok {
+		entry.AllowedAudiences = strutil.RemoveDuplicatesStable(allowedAudiencesRaw.([]string), false)
 	}
 	if svcAccount, ok := d.GetOk("service_account_name"); ok {
 		entry.ServiceAccountName = svcAccount.(string)
@@ -236,6 +790,9 @@ func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *f
 	if k8sRoleName, ok := d.GetOk("kubernetes_role_name"); ok {
 		entry.K8sRoleName = k8sRoleName.(string)
 	}
+	if k8sRoleBindingName, ok := d.GetOk("kubernetes_role_binding_name"); ok {
+		entry.K8sRoleBindingName = k8sRoleBindingName.(string)
+	}
 
 	if k8sRoleType, ok := d.GetOk("kubernetes_role_type"); ok {
 		entry.K8sRoleType = k8sRoleType.(string)
@@ -247,26 +804,154 @@ func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *f
 	if roleRules, ok := d.GetOk("generated_role_rules"); ok {
 		entry.RoleRules = roleRules.(string)
 	}
+	if roleRulesFile, ok := d.GetOk("generated_role_rules_file"); ok {
+		entry.RoleRulesFile = roleRulesFile.(string)
+	}
+	if aggregationRule, ok := d.GetOk("generated_aggregation_rule"); ok {
+		entry.AggregationRule = aggregationRule.(string)
+	}
+	if sharedClusterRole, ok := d.GetOk("shared_cluster_role"); ok {
+		entry.SharedClusterRole = sharedClusterRole.(bool)
+	}
+	if maxActiveTokens, ok := d.GetOk("max_active_tokens"); ok {
+		entry.MaxActiveTokens = maxActiveTokens.(int)
+	}
+	if combineRules, ok := d.GetOk("combine_rules"); ok {
+		entry.CombineRules = combineRules.(bool)
+	}
+	if createNamespace, ok := d.GetOk("create_namespace"); ok {
+		entry.CreateNamespace = createNamespace.(bool)
+	}
+	if allowClusterRoleBinding, ok := d.GetOk("allow_cluster_role_binding"); ok {
+		entry.AllowClusterRoleBinding = allowClusterRoleBinding.(bool)
+	}
+	if kubernetesCluster, ok := d.GetOk("kubernetes_cluster"); ok {
+		entry.KubernetesCluster = kubernetesCluster.(string)
+	}
+	if additionalSubjects, ok := d.GetOk("additional_subjects"); ok {
+		entry.AdditionalSubjects = additionalSubjects.(string)
+	}
+	if tokenType, ok := d.GetOk("token_type"); ok {
+		entry.TokenType = tokenType.(string)
+	}
+	if entry.TokenType == "" {
+		entry.TokenType = tokenTypeBound
+	}
+	if tokenSecretNameTemplate, ok := d.GetOk("token_secret_name_template"); ok {
+		entry.TokenSecretNameTemplate = tokenSecretNameTemplate.(string)
+	}
 	if nameTemplate, ok := d.GetOk("name_template"); ok {
 		entry.NameTemplate = nameTemplate.(string)
 	}
+	if namePrefix, ok := d.GetOk("name_prefix"); ok {
+		entry.NamePrefix = namePrefix.(string)
+	}
+	if nameIncludeNamespace, ok := d.GetOk("name_include_namespace"); ok {
+		entry.NameIncludeNamespace = nameIncludeNamespace.(bool)
+	}
 	if extraLabels, ok := d.GetOk("extra_labels"); ok {
 		entry.ExtraLabels = extraLabels.(map[string]string)
 	}
 	if extraAnnotations, ok := d.GetOk("extra_annotations"); ok {
 		entry.ExtraAnnotations = extraAnnotations.(map[string]string)
 	}
+	if roleFinalizers, ok := d.GetOk("role_finalizers"); ok {
+		entry.RoleFinalizers = strutil.RemoveDuplicatesStable(roleFinalizers.([]string), false)
+	}
+	if roleBindingFinalizers, ok := d.GetOk("role_binding_finalizers"); ok {
+		entry.RoleBindingFinalizers = strutil.RemoveDuplicatesStable(roleBindingFinalizers.([]string), false)
+	}
+	if forceRemoveFinalizers, ok := d.GetOk("force_remove_finalizers"); ok {
+		entry.ForceRemoveFinalizers = forceRemoveFinalizers.(bool)
+	}
+	if annotateLeaseID, ok := d.GetOk("annotate_lease_id"); ok {
+		entry.AnnotateLeaseID = annotateLeaseID.(bool)
+	}
+	if tokenResponseKey, ok := d.GetOk("token_response_key"); ok {
+		entry.TokenResponseKey = tokenResponseKey.(string)
+	}
+	if entry.TokenResponseKey == "" {
+		entry.TokenResponseKey = defaultTokenResponseKey
+	}
 
 	// Validate the entry
 	if len(entry.K8sNamespaces) == 0 && entry.K8sNamespaceSelector == "" {
 		return logical.ErrorResponse("one (at least) of allowed_kubernetes_namespaces or allowed_kubernetes_namespace_selector must be set"), nil
 	}
-	if !onlyOneSet(entry.ServiceAccountName, entry.K8sRoleName, entry.RoleRules) {
-		return logical.ErrorResponse("one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set"), nil
+	if err := entry.validateDefaultNamespace(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if entry.RoleRules != "" && entry.RoleRulesFile != "" {
+		return logical.ErrorResponse("only one of generated_role_rules or generated_role_rules_file may be set"), nil
+	}
+	if entry.AggregationRule != "" && (entry.RoleRules != "" || entry.RoleRulesFile != "") {
+		return logical.ErrorResponse("generated_aggregation_rule can't be combined with generated_role_rules or generated_role_rules_file"), nil
+	}
+	if entry.CombineRules {
+		if entry.K8sRoleName == "" || !entry.generatesRole() || entry.ServiceAccountName != "" {
+			return logical.ErrorResponse("combine_rules requires both kubernetes_role_name and generated_role_rules, and can't be used with service_account_name"), nil
+		}
+		if entry.SharedClusterRole {
+			return logical.ErrorResponse("combine_rules can't be used with shared_cluster_role"), nil
+		}
+	}
+	if entry.K8sRoleBindingName != "" {
+		if entry.ServiceAccountName == "" || entry.generatesRole() {
+			return logical.ErrorResponse("kubernetes_role_binding_name requires service_account_name, and can't be used with generated_role_rules"), nil
+		}
+		if entry.SharedClusterRole || entry.AdditionalSubjects != "" {
+			return logical.ErrorResponse("kubernetes_role_binding_name can't be used with shared_cluster_role or additional_subjects, since no role binding is generated"), nil
+		}
+	} else if !entry.CombineRules && !onlyOneSet(entry.ServiceAccountName, entry.K8sRoleName, entry.RoleRules+entry.RoleRulesFile+entry.AggregationRule) && !entry.bindsExistingServiceAccount() {
+		return logical.ErrorResponse("one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set, unless both service_account_name and kubernetes_role_name are set"), nil
+	}
+	if entry.MaxActiveTokens < 0 {
+		return logical.ErrorResponse("max_active_tokens must not be negative"), nil
 	}
 	if entry.TokenMaxTTL > 0 && entry.TokenDefaultTTL > entry.TokenMaxTTL {
 		return logical.ErrorResponse("token_default_ttl %s cannot be greater than token_max_ttl %s", entry.TokenDefaultTTL, entry.TokenMaxTTL), nil
 	}
+	if entry.CreateNamespace && entry.ServiceAccountName != "" {
+		return logical.ErrorResponse("create_namespace can't be used with service_account_name, since the service account must already exist in the namespace"), nil
+	}
+	if entry.TokenType != tokenTypeBound && entry.TokenType != tokenTypeSecret {
+		return logical.ErrorResponse("token_type must be either '%s' or '%s'", tokenTypeBound, tokenTypeSecret), nil
+	}
+	if entry.TokenType == tokenTypeSecret && len(entry.TokenDefaultAudiences) > 0 {
+		return logical.ErrorResponse("token_default_audiences can't be used with token_type '%s', since tokens stored in a Secret always have the API server's audience", tokenTypeSecret), nil
+	}
+	if entry.TokenSecretNameTemplate != "" {
+		if entry.TokenType != tokenTypeSecret {
+			return logical.ErrorResponse("token_secret_name_template requires token_type '%s'", tokenTypeSecret), nil
+		}
+		if _, err := template.NewTemplate(template.Template(entry.TokenSecretNameTemplate)); err != nil {
+			return logical.ErrorResponse("invalid token_secret_name_template: %s", err), nil
+		}
+	}
+
+	if err := validateFinalizers("role_finalizers", entry.RoleFinalizers); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateFinalizers("role_binding_finalizers", entry.RoleBindingFinalizers); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if len(entry.RoleFinalizers) > 0 && (!entry.generatesRole() || entry.SharedClusterRole) {
+		return logical.ErrorResponse("role_finalizers requires generated_role_rules, and can't be used with shared_cluster_role"), nil
+	}
+	if len(entry.RoleBindingFinalizers) > 0 && entry.ServiceAccountName != "" && !entry.bindsExistingServiceAccount() {
+		return logical.ErrorResponse("role_binding_finalizers can't be used with service_account_name alone, since no role binding is generated"), nil
+	}
+
+	if !tokenResponseKeyRegex.MatchString(entry.TokenResponseKey) {
+		return logical.ErrorResponse("token_response_key must start with a letter or underscore, contain only letters, digits and underscores, and be at most 64 characters"), nil
+	}
+	if err := checkAudiencesAllowed(entry, entry.TokenDefaultAudiences); err != nil {
+		return logical.ErrorResponse("invalid token_default_audiences: %s", err), nil
+	}
+
+	if strutil.StrListContains(credsResponseFields, entry.TokenResponseKey) {
+		return logical.ErrorResponse("token_response_key '%s' conflicts with another field in the credentials response", entry.TokenResponseKey), nil
+	}
 
 	casedRoleType := makeRoleType(entry.K8sRoleType)
 	if casedRoleType != "Role" && casedRoleType != "ClusterRole" {
@@ -274,43 +959,209 @@ func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *f
 	}
 	entry.K8sRoleType = casedRoleType
 
+	if entry.AggregationRule != "" {
+		if entry.K8sRoleType != "ClusterRole" {
+			return logical.ErrorResponse("generated_aggregation_rule requires a kubernetes_role_type of ClusterRole"), nil
+		}
+		if entry.SharedClusterRole {
+			return logical.ErrorResponse("generated_aggregation_rule can't be used with shared_cluster_role"), nil
+		}
+		if _, err := makeAggregationRule(entry.AggregationRule); err != nil {
+			return logical.ErrorResponse("failed to parse 'generated_aggregation_rule' as k8s.io/api/rbac/v1/AggregationRule object: %s", err), nil
+		}
+	}
+	if entry.SharedClusterRole && (!entry.generatesRole() || entry.K8sRoleType != "ClusterRole") {
+		return logical.ErrorResponse("shared_cluster_role requires generated_role_rules and a kubernetes_role_type of ClusterRole"), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	// The role type only applies when a role is bound or generated
+	if config != nil && len(config.AllowedRoleTypes) > 0 && (entry.K8sRoleName != "" || entry.generatesRole()) {
+		if !strutil.StrListContains(config.AllowedRoleTypes, entry.K8sRoleType) {
+			return logical.ErrorResponse("kubernetes_role_type '%s' is not allowed on this mount, allowed types are: %s", entry.K8sRoleType, strings.Join(config.AllowedRoleTypes, ", ")), nil
+		}
+	}
+	if config != nil && config.RequireTokenMaxTTL && entry.TokenMaxTTL <= 0 {
+		return logical.ErrorResponse("token_max_ttl must be set to a non-zero value on this mount"), nil
+	}
+	if entry.KubernetesCluster != "" {
+		clusterConfig, err := getClusterConfig(ctx, req.Storage, entry.KubernetesCluster)
+		if err != nil {
+			return nil, err
+		}
+		if clusterConfig == nil {
+			return logical.ErrorResponse("kubernetes_cluster '%s' is not configured, write its config to %s first", entry.KubernetesCluster, configStoragePath(entry.KubernetesCluster)), nil
+		}
+	}
+
 	// Try parsing the label selector as json or yaml
 	if entry.K8sNamespaceSelector != "" {
-		if _, err := makeLabelSelector(entry.K8sNamespaceSelector); err != nil {
+		if _, err := makeNamespaceSelector(entry.K8sNamespaceSelector); err != nil {
 			return logical.ErrorResponse("failed to parse 'allowed_kubernetes_namespace_selector' as k8s.io/api/meta/v1/LabelSelector object"), nil
 		}
 	}
 
-	// Try parsing the role rules as json or yaml
+	if entry.AdditionalSubjects != "" {
+		if _, err := makeSubjects(entry.AdditionalSubjects); err != nil {
+			return logical.ErrorResponse("failed to parse 'additional_subjects': %s", err), nil
+		}
+		if entry.ServiceAccountName != "" && !entry.bindsExistingServiceAccount() {
+			return logical.ErrorResponse("additional_subjects can't be used with service_account_name alone, since no role binding is generated"), nil
+		}
+	}
+
+	// Try parsing the role rules as json or yaml, and keep the result for
+	// creds requests
+	entry.ParsedRoleRules = nil
 	if entry.RoleRules != "" {
-		if _, err := makeRules(entry.RoleRules); err != nil {
+		var rules []rbacv1.PolicyRule
+		if config != nil && config.StrictRoleRules {
+			if rules, err = makeRulesStrict(entry.RoleRules); err != nil {
+				return logical.ErrorResponse("failed to parse 'generated_role_rules' as k8s.io/api/rbac/v1/Policy object: %s", err), nil
+			}
+		} else if rules, err = makeRules(entry.RoleRules); err != nil {
 			return logical.ErrorResponse("failed to parse 'generated_role_rules' as k8s.io/api/rbac/v1/Policy object"), nil
 		}
+		if i, j := duplicateRule(rules); i >= 0 {
+			return logical.ErrorResponse("generated_role_rules rule %d is a duplicate of rule %d", i, j), nil
+		}
+		entry.ParsedRoleRules = rules
+	}
+	if entry.RoleRulesFile != "" {
+		if _, err := b.withRoleRulesFromFile(ctx, req.Storage, entry); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	// The rules of a generated_role_rules_file are checked against the
+	// mount's policy by withRoleRulesFromFile, whenever they're read
+	if entry.RoleRules != "" && config != nil {
+		if err := config.checkRulesPolicy(entry.ParsedRoleRules); err != nil {
+			return logical.ErrorResponse("generated_role_rules are not allowed on this mount: %s", err), nil
+		}
 	}
 
-	// verify the template is valid
-	nameTemplate := entry.NameTemplate
-	if nameTemplate == "" {
-		nameTemplate = defaultNameTemplate
+	if entry.NamePrefix != "" {
+		if entry.NameTemplate != "" {
+			return logical.ErrorResponse("only one of name_template or name_prefix may be set"), nil
+		}
+		if len(entry.NamePrefix) > maxNamePrefixLength || !namePrefixRegex.MatchString(entry.NamePrefix) {
+			return logical.ErrorResponse("name_prefix must be at most %d lowercase alphanumeric characters or '-', and must start and end with an alphanumeric character", maxNamePrefixLength), nil
+		}
 	}
-	_, err = template.NewTemplate(template.Template(nameTemplate))
-	if err != nil {
-		return logical.ErrorResponse("unable to initialize name template: %s", err), nil
+
+	if entry.NameIncludeNamespace && entry.NameTemplate != "" {
+		return logical.ErrorResponse("name_include_namespace can't be used with name_template, use {{.Namespace}} in the template instead"), nil
+	}
+
+	// verify the template is valid, and renders a valid name for a sample
+	// request
+	if _, err := generateName(entry, entry.sampleNameMetadata()); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	// likewise for templated label and annotation values
+	if _, err := entry.withRenderedMetadata(metadataTemplateData{
+		nameMetadata: entry.sampleNameMetadata(),
+		Timestamp:    time.Now().UTC().Format(metadataTimestampFormat),
+	}); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var warnings []string
+	if entry.TokenType == tokenTypeSecret {
+		warnings = append(warnings, fmt.Sprintf("token_type '%s' issues tokens that don't expire: the TTLs only apply to the Vault lease, and each token stays valid until its lease is revoked and its Secret deleted", tokenTypeSecret))
+	}
+	if config != nil && config.AbsoluteMaxTTL > 0 && entry.TokenMaxTTL > config.AbsoluteMaxTTL {
+		warnings = append(warnings, fmt.Sprintf("token_max_ttl %s is greater than the mount's absolute_max_ttl %s, credentials will be capped at %s", entry.TokenMaxTTL, config.AbsoluteMaxTTL, config.AbsoluteMaxTTL))
+	}
+	if conflicts := metadataConflicts(entry.ExtraLabels, entry.ExtraAnnotations); len(conflicts) > 0 {
+		if config != nil && config.RejectMetadataConflicts {
+			return logical.ErrorResponse(strings.Join(conflicts, "; ")), nil
+		}
+		warnings = append(warnings, conflicts...)
 	}
 
 	if err := setRole(ctx, req.Storage, name, entry); err != nil {
 		return nil, err
 	}
 
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
 	return nil, nil
 }
 
+// validateFinalizers returns an error if any of the finalizers of the field
+// aren't valid. They must be domain-qualified, e.g. "example.com/cleanup",
+// since the unqualified ones are reserved for Kubernetes.
+func validateFinalizers(field string, finalizers []string) error {
+	for _, finalizer := range finalizers {
+		if errs := validation.IsQualifiedName(finalizer); len(errs) > 0 {
+			return fmt.Errorf("invalid %s entry '%s': %s", field, finalizer, strings.Join(errs, "; "))
+		}
+		if !strings.Contains(finalizer, "/") {
+			return fmt.Errorf("invalid %s entry '%s': must be domain-qualified, e.g. 'example.com/%s'", field, finalizer, finalizer)
+		}
+	}
+	return nil
+}
+
+// metadataConflicts describes the extra label and annotation keys that are set
+// as both a label and an annotation, which is usually a mistake, or that are
+// reserved for the labels and annotations managed by Vault
+func metadataConflicts(labels, annotations map[string]string) []string {
+	var conflicts []string
+	for _, k := range sortedKeys(labels) {
+		if _, ok := annotations[k]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("key '%s' is set in both extra_labels and extra_annotations", k))
+		}
+		if isReservedKey(k) {
+			conflicts = append(conflicts, fmt.Sprintf("extra_labels key '%s' is reserved for use by Vault and will be overridden", k))
+		}
+	}
+	for _, k := range sortedKeys(annotations) {
+		if isReservedKey(k) {
+			conflicts = append(conflicts, fmt.Sprintf("extra_annotations key '%s' is reserved for use by Vault and will be overridden", k))
+		}
+	}
+	return conflicts
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (b *backend) pathRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (resp *logical.Response, err error) {
 	rName := d.Get("name").(string)
 	if err := req.Storage.Delete(ctx, rolesPath+rName); err != nil {
 		return nil, err
 	}
-	return nil, nil
+	if !d.Get("revoke_leases").(bool) {
+		return nil, nil
+	}
+
+	// The role is deleted first so no new leases are issued for it while its
+	// existing leases are revoked
+	revoked, skipped, err := b.revokeRoleLeases(ctx, req.Storage, rName)
+	if err != nil {
+		return nil, err
+	}
+	resp = &logical.Response{
+		Data: map[string]interface{}{
+			"revoked_leases": revoked,
+		},
+	}
+	if skipped > 0 {
+		resp.AddWarning(fmt.Sprintf("%d leases were issued before their objects were recorded in the creds index, and were not revoked", skipped))
+	}
+	return resp, nil
 }
 
 func (b *backend) pathRolesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (resp *logical.Response, err error) {
@@ -345,7 +1196,11 @@ func getRole(ctx context.Context, s logical.Storage, name string) (*roleEntry, e
 		return nil, nil
 	}
 
-	var role roleEntry
+	// Roles written before allow_cluster_role_binding was added lack it, and
+	// keep allowing ClusterRoleBindings
+	role := roleEntry{
+		AllowClusterRoleBinding: true,
+	}
 
 	if err := entry.DecodeJSON(&role); err != nil {
 		return nil, err
@@ -371,4 +1226,9 @@ const (
 	rolesHelpDescription         = `This path lets you manage the roles that can be created with this secrets engine.`
 	pathRolesListHelpSynopsis    = `List the existing roles in this secrets engine.`
 	pathRolesListHelpDescription = `A list of existing role names will be returned.`
+
+	pathRolesValidateNameTemplateHelpSynopsis    = `Validate a name template without creating a role.`
+	pathRolesValidateNameTemplateHelpDescription = `Renders the given name_template (or name_prefix) with the sample role_name,
+display_name and namespace, and returns the generated name and its length. An error is
+returned if the template is invalid or produces an invalid Kubernetes object name.`
 )
@@ -5,12 +5,15 @@ package kubesecrets
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestRoles(t *testing.T) {
@@ -21,15 +24,15 @@ func TestRoles(t *testing.T) {
 			"allowed_kubernetes_namespaces": []string{"*"},
 		})
 		assert.NoError(t, err)
-		assert.EqualError(t, resp.Error(), "one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set")
+		assert.EqualError(t, resp.Error(), "one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set, unless both service_account_name and kubernetes_role_name are set")
 
 		resp, err = testRoleCreate(t, b, s, "badrole", map[string]interface{}{
 			"allowed_kubernetes_namespaces": []string{"*"},
 			"service_account_name":          "test_svc_account",
-			"kubernetes_role_name":          "existing_role",
+			"generated_role_rules":          goodYAMLRules,
 		})
 		assert.NoError(t, err)
-		assert.EqualError(t, resp.Error(), "one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set")
+		assert.EqualError(t, resp.Error(), "one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set, unless both service_account_name and kubernetes_role_name are set")
 
 		resp, err = testRoleCreate(t, b, s, "badrole", map[string]interface{}{
 			"service_account_name": "test_svc_account",
@@ -65,6 +68,13 @@ func TestRoles(t *testing.T) {
 		assert.NoError(t, err)
 		assert.EqualError(t, resp.Error(), "failed to parse 'generated_role_rules' as k8s.io/api/rbac/v1/Policy object")
 
+		resp, err = testRoleCreate(t, b, s, "badrole", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"generated_role_rules":          goodYAMLRules + "---\n" + goodYAMLRules,
+		})
+		assert.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "generated_role_rules rule 1 is a duplicate of rule 0")
+
 		badmeta := map[string]interface{}{
 			"foo": []string{"one", "two"},
 		}
@@ -94,6 +104,24 @@ func TestRoles(t *testing.T) {
 		assert.NoError(t, err)
 		assert.EqualError(t, resp.Error(), "token_default_ttl 11h0m0s cannot be greater than token_max_ttl 5h0m0s")
 
+		resp, err = testRoleCreate(t, b, s, "badttl_alias", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"service_account_name":          "test_svc_account",
+			"token_default_ttl":             "1h",
+			"token_ttl":                     "2h",
+		})
+		assert.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "token_ttl is an alias of token_default_ttl, and can't be set to a different value")
+
+		resp, err = testRoleCreate(t, b, s, "badttl_alias_tokenmax", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"service_account_name":          "test_svc_account",
+			"token_ttl":                     "11h",
+			"token_max_ttl":                 "5h",
+		})
+		assert.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "token_default_ttl 11h0m0s cannot be greater than token_max_ttl 5h0m0s")
+
 		resp, err = testRoleCreate(t, b, s, "badtemplate", map[string]interface{}{
 			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
 			"service_account_name":          "test_svc_account",
@@ -101,6 +129,39 @@ func TestRoles(t *testing.T) {
 		})
 		assert.NoError(t, err)
 		assert.EqualError(t, resp.Error(), "unable to initialize name template: unable to parse template: template: template:1: unclosed action")
+
+		resp, err = testRoleCreate(t, b, s, "badtemplatename", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"service_account_name":          "test_svc_account",
+			"name_template":                 "Vault_{{.RoleName}}",
+		})
+		assert.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "generated name 'Vault_badtemplatename' is not a valid Kubernetes object name: a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')")
+
+		resp, err = testRoleCreate(t, b, s, "badtemplatelength", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"service_account_name":          "test_svc_account",
+			"name_template":                 `{{ printf "%s-%s" (random 250) .Namespace | lowercase }}`,
+		})
+		assert.NoError(t, err)
+		assert.ErrorContains(t, resp.Error(), "is not a valid Kubernetes object name: must be no more than 253 characters")
+
+		resp, err = testRoleCreate(t, b, s, "badprefix", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"service_account_name":          "test_svc_account",
+			"name_prefix":                   "Not_A_Label-",
+		})
+		assert.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "name_prefix must be at most 20 lowercase alphanumeric characters or '-', and must start and end with an alphanumeric character")
+
+		resp, err = testRoleCreate(t, b, s, "prefixandtemplate", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+			"service_account_name":          "test_svc_account",
+			"name_prefix":                   "myapp",
+			"name_template":                 "{{.RoleName}}",
+		})
+		assert.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "only one of name_template or name_prefix may be set")
 	})
 
 	t.Run("delete role - non-existant and blank", func(t *testing.T) {
@@ -139,14 +200,37 @@ func TestRoles(t *testing.T) {
 			"extra_labels":                          nilMeta,
 			"extra_annotations":                     nilMeta,
 			"generated_role_rules":                  "",
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "existing_role",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "jsonselector",
 			"name_template":                         "",
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     0,
+			"name_include_namespace":                false,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         time.Duration(0).Seconds(),
 			"token_default_ttl":                     time.Duration(time.Hour * 5).Seconds(),
+			"token_ttl":                             time.Duration(time.Hour * 5).Seconds(),
 			"token_default_audiences":               []string{"foobar"},
+			"allowed_audiences":                     []string(nil),
+			"denied_kubernetes_namespaces":          []string(nil),
+			"role_finalizers":                       []string(nil),
+			"role_binding_finalizers":               []string(nil),
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}, resp.Data)
 
 		// Create one with yaml namespace selector and metadata
@@ -169,14 +253,37 @@ func TestRoles(t *testing.T) {
 			"extra_annotations":                     testExtraAnnotations,
 			"extra_labels":                          testExtraLabels,
 			"generated_role_rules":                  "",
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "existing_role",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "yamlselector",
 			"name_template":                         "",
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     0,
+			"name_include_namespace":                false,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         time.Duration(0).Seconds(),
 			"token_default_ttl":                     time.Duration(0).Seconds(),
+			"token_ttl":                             time.Duration(0).Seconds(),
 			"token_default_audiences":               []string{"foobar"},
+			"allowed_audiences":                     []string(nil),
+			"denied_kubernetes_namespaces":          []string(nil),
+			"role_finalizers":                       []string(nil),
+			"role_binding_finalizers":               []string(nil),
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}, resp.Data)
 
 		// Create one with json role rules
@@ -197,14 +304,37 @@ func TestRoles(t *testing.T) {
 			"extra_labels":                          nilMeta,
 			"extra_annotations":                     nilMeta,
 			"generated_role_rules":                  goodJSONRules,
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "jsonrules",
 			"name_template":                         "",
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     0,
+			"name_include_namespace":                false,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         time.Duration(0).Seconds(),
 			"token_default_ttl":                     time.Duration(time.Hour * 5).Seconds(),
+			"token_ttl":                             time.Duration(time.Hour * 5).Seconds(),
 			"token_default_audiences":               []string{"foobar"},
+			"allowed_audiences":                     []string(nil),
+			"denied_kubernetes_namespaces":          []string(nil),
+			"role_finalizers":                       []string(nil),
+			"role_binding_finalizers":               []string(nil),
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}, resp.Data)
 
 		// Create one with yaml role rules and metadata
@@ -227,14 +357,37 @@ func TestRoles(t *testing.T) {
 			"extra_annotations":                     testExtraAnnotations,
 			"extra_labels":                          testExtraLabels,
 			"generated_role_rules":                  goodYAMLRules,
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "yamlrules",
 			"name_template":                         "",
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     0,
+			"name_include_namespace":                false,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         time.Duration(0).Seconds(),
 			"token_default_ttl":                     time.Duration(0).Seconds(),
+			"token_ttl":                             time.Duration(0).Seconds(),
 			"token_default_audiences":               []string{"foobar"},
+			"allowed_audiences":                     []string(nil),
+			"denied_kubernetes_namespaces":          []string(nil),
+			"role_finalizers":                       []string(nil),
+			"role_binding_finalizers":               []string(nil),
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}, resp.Data)
 
 		// update yamlrules (with a duplicate namespace)
@@ -251,14 +404,37 @@ func TestRoles(t *testing.T) {
 			"extra_annotations":                     testExtraAnnotations,
 			"extra_labels":                          testExtraLabels,
 			"generated_role_rules":                  goodYAMLRules,
+			"generated_role_rules_file":             "",
+			"generated_aggregation_rule":            "",
 			"kubernetes_role_name":                  "",
 			"kubernetes_role_type":                  "Role",
 			"name":                                  "yamlrules",
 			"name_template":                         "",
+			"name_prefix":                           "",
+			"shared_cluster_role":                   false,
+			"combine_rules":                         false,
+			"max_active_tokens":                     0,
+			"name_include_namespace":                false,
+			"token_response_key":                    "service_account_token",
+			"token_type":                            "bound",
+			"token_secret_name_template":            "",
+			"create_namespace":                      false,
+			"allow_cluster_role_binding":            true,
+			"additional_subjects":                   "",
+			"kubernetes_cluster":                    "",
+			"kubernetes_role_binding_name":          "",
 			"service_account_name":                  "",
 			"token_max_ttl":                         time.Duration(0).Seconds(),
 			"token_default_ttl":                     time.Duration(0).Seconds(),
+			"token_ttl":                             time.Duration(0).Seconds(),
 			"token_default_audiences":               []string{"foobar"},
+			"allowed_audiences":                     []string(nil),
+			"denied_kubernetes_namespaces":          []string(nil),
+			"role_finalizers":                       []string(nil),
+			"role_binding_finalizers":               []string(nil),
+			"force_remove_finalizers":               false,
+			"annotate_lease_id":                     false,
+			"default_namespace":                     "",
 		}, resp.Data)
 
 		// Now there should be four roles returned from list
@@ -421,3 +597,585 @@ const (
 	- patch
 `
 )
+
+func TestRoles_allowedRoleTypes(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"allowed_role_types": []string{"role"},
+	})
+
+	resp, err := testRoleCreate(t, b, s, "clusterrole", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "kubernetes_role_type 'ClusterRole' is not allowed on this mount, allowed types are: Role")
+
+	resp, err = testRoleCreate(t, b, s, "role", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_role_type":          "Role",
+	})
+	require.NoError(t, err)
+	assert.NoError(t, resp.Error())
+
+	// The role type doesn't matter for pre-existing service accounts
+	resp, err = testRoleCreate(t, b, s, "svcaccount", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"service_account_name":          "test_svc_account",
+		"kubernetes_role_type":          "ClusterRole",
+	})
+	require.NoError(t, err)
+	assert.NoError(t, resp.Error())
+}
+
+func TestRoles_tokenResponseKey(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	for _, key := range []string{"1token", "token-key", "service_account_name"} {
+		resp, err := testRoleCreate(t, b, s, "badkey", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"*"},
+			"service_account_name":          "test_svc_account",
+			"token_response_key":            key,
+		})
+		require.NoError(t, err)
+		assert.True(t, resp.IsError(), "expected error for token_response_key %q", key)
+	}
+}
+
+func TestRoles_tokenTTLAlias(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	resp, err := testRoleCreate(t, b, s, "alias", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"service_account_name":          "test_svc_account",
+		"token_ttl":                     "2h",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	resp, err = testRoleRead(t, b, s, "alias")
+	require.NoError(t, err)
+	assert.Equal(t, (2 * time.Hour).Seconds(), resp.Data["token_default_ttl"])
+	assert.Equal(t, (2 * time.Hour).Seconds(), resp.Data["token_ttl"])
+
+	// Setting both to the same value is allowed
+	resp, err = testRoleCreate(t, b, s, "alias", map[string]interface{}{
+		"token_default_ttl": "3h",
+		"token_ttl":         "3h",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleRead(t, b, s, "alias")
+	require.NoError(t, err)
+	assert.Equal(t, (3 * time.Hour).Seconds(), resp.Data["token_ttl"])
+}
+
+func TestRoles_requireTokenMaxTTL(t *testing.T) {
+	b, s := getTestBackend(t)
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"require_token_max_ttl": true,
+	})
+
+	resp, err := testRoleCreate(t, b, s, "nomax", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"service_account_name":          "test_svc_account",
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "token_max_ttl must be set to a non-zero value on this mount")
+
+	resp, err = testRoleCreate(t, b, s, "withmax", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"service_account_name":          "test_svc_account",
+		"token_max_ttl":                 "2h",
+	})
+	require.NoError(t, err)
+	assert.NoError(t, resp.Error())
+}
+
+func TestRoles_defaultNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	testCases := map[string]struct {
+		roleData    map[string]interface{}
+		expectedErr string
+	}{
+		"allowed": {
+			roleData: map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1", "app2"},
+				"default_namespace":             "app2",
+			},
+		},
+		"matches pattern": {
+			roleData: map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"team-*"},
+				"default_namespace":             "team-a",
+			},
+		},
+		"checked at creds time with a selector": {
+			roleData: map[string]interface{}{
+				"allowed_kubernetes_namespace_selector": "team=a",
+				"default_namespace":                     "team-a",
+			},
+		},
+		"not allowed": {
+			roleData: map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1"},
+				"default_namespace":             "app2",
+			},
+			expectedErr: "default_namespace 'app2' is not present in allowed_kubernetes_namespaces",
+		},
+		"denied": {
+			roleData: map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"*"},
+				"denied_kubernetes_namespaces":  []string{"kube-*"},
+				"default_namespace":             "kube-system",
+			},
+			expectedErr: "default_namespace 'kube-system' is denied by denied_kubernetes_namespaces",
+		},
+		"invalid name": {
+			roleData: map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"*"},
+				"default_namespace":             "app_1",
+			},
+			expectedErr: "default_namespace 'app_1' is not a valid namespace name: a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.roleData["service_account_name"] = "sa"
+			resp, err := testRoleCreate(t, b, s, strings.ReplaceAll(name, " ", "-"), tc.roleData)
+			require.NoError(t, err)
+			if tc.expectedErr == "" {
+				require.NoError(t, resp.Error())
+				resp, err = testRoleRead(t, b, s, strings.ReplaceAll(name, " ", "-"))
+				require.NoError(t, err)
+				assert.Equal(t, tc.roleData["default_namespace"], resp.Data["default_namespace"])
+			} else {
+				assert.EqualError(t, resp.Error(), tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestRoles_validateNameTemplate(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	validate := func(d map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      validateNameTemplatePath,
+			Data:      d,
+			Storage:   s,
+		})
+	}
+
+	resp, err := validate(map[string]interface{}{
+		"name_template": "{{.RoleName}}-{{.DisplayName}}",
+		"role_name":     "myrole",
+		"display_name":  "token",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, map[string]interface{}{"name": "myrole-token", "length": 12}, resp.Data)
+
+	resp, err = validate(map[string]interface{}{"name_prefix": "app"})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Regexp(t, `^app-`, resp.Data["name"])
+
+	for name, d := range map[string]map[string]interface{}{
+		"invalid template": {"name_template": "{{.RoleName"},
+		"invalid name":     {"name_template": "{{.RoleName}}", "role_name": "Not_Valid"},
+		"too long":         {"name_template": strings.Repeat("a", 254)},
+		"bad prefix":       {"name_prefix": "-app"},
+		"template and prefix": {
+			"name_template": "{{.RoleName}}",
+			"name_prefix":   "app",
+		},
+	} {
+		resp, err := validate(d)
+		require.NoError(t, err, name)
+		assert.Error(t, resp.Error(), name)
+	}
+
+	// A role may have the same name as the path
+	resp, err = testRoleCreate(t, b, s, "validate-name-template", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"*"},
+		"service_account_name":          "sample-app",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	resp, err = testRoleRead(t, b, s, "validate-name-template")
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, "sample-app", resp.Data["service_account_name"])
+}
+
+func TestRoles_templatedMetadata(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	testCases := map[string]struct {
+		labels      map[string]interface{}
+		annotations map[string]interface{}
+		expected    string
+	}{
+		"invalid template": {
+			annotations: map[string]interface{}{"owner": "{{.DisplayName"},
+			expected:    "invalid template for extra_annotations key 'owner'",
+		},
+		"unknown field": {
+			labels:   map[string]interface{}{"owner": "{{.Owner}}"},
+			expected: "failed to render extra_labels key 'owner'",
+		},
+		"invalid label value": {
+			labels:   map[string]interface{}{"owner": "{{.DisplayName}} {{.RoleName}}"},
+			expected: "extra_labels key 'owner' renders to 'token templated', which is not a valid label value",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := testRoleCreate(t, b, s, "templated", map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1"},
+				"service_account_name":          "sa",
+				"extra_labels":                  tc.labels,
+				"extra_annotations":             tc.annotations,
+			})
+			require.NoError(t, err)
+			require.Error(t, resp.Error())
+			assert.Contains(t, resp.Error().Error(), tc.expected)
+		})
+	}
+
+	// Annotation values don't have to be valid label values
+	resp, err := testRoleCreate(t, b, s, "templated", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"extra_labels":                  map[string]interface{}{"namespace": "{{.Namespace}}"},
+		"extra_annotations":             map[string]interface{}{"owner": "{{.DisplayName}} {{.RoleName}}"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestRoles_metadataConflicts(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	roleData := map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"extra_labels": map[string]interface{}{
+			"team":                         "a",
+			"app.kubernetes.io/managed-by": "me",
+		},
+		"extra_annotations": map[string]interface{}{
+			"team":                      "a",
+			"vault.hashicorp.com/lease": "x",
+		},
+	}
+	expectedConflicts := []string{
+		"extra_labels key 'app.kubernetes.io/managed-by' is reserved for use by Vault and will be overridden",
+		"key 'team' is set in both extra_labels and extra_annotations",
+		"extra_annotations key 'vault.hashicorp.com/lease' is reserved for use by Vault and will be overridden",
+	}
+
+	resp, err := testRoleCreate(t, b, s, "conflicts", roleData)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, expectedConflicts, resp.Warnings)
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"reject_metadata_conflicts": true,
+	})
+	resp, err = testRoleCreate(t, b, s, "conflicts", roleData)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), strings.Join(expectedConflicts, "; "))
+
+	resp, err = testRoleCreate(t, b, s, "noconflicts", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+		"extra_labels":                  map[string]interface{}{"team": "a"},
+		"extra_annotations":             map[string]interface{}{"owner": "b"},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestRoles_strictRoleRules(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	typoRules := `rules:
+- apiGroups: [""]
+  resource: ["pods"]
+  verbs: ["get"]
+`
+	roleData := map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          typoRules,
+	}
+
+	// Lenient by default
+	resp, err := testRoleCreate(t, b, s, "typo", roleData)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"strict_role_rules": true,
+	})
+	resp, err = testRoleCreate(t, b, s, "typo", roleData)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), `failed to parse 'generated_role_rules' as k8s.io/api/rbac/v1/Policy object: json: unknown field "resource"`)
+
+	resp, err = testRoleCreate(t, b, s, "good", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestRoles_allowedVerbsAndResources(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	rules := `rules:
+- apiGroups: [""]
+  resources: ["pods", "pods/log"]
+  verbs: ["get", "list"]
+- apiGroups: ["rbac.authorization.k8s.io"]
+  resources: ["clusterroles"]
+  verbs: ["escalate"]
+`
+	roleData := map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          rules,
+	}
+
+	// Anything is allowed by default
+	resp, err := testRoleCreate(t, b, s, "rules", roleData)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"allowed_verbs": "get,list,watch",
+	})
+	resp, err = testRoleCreate(t, b, s, "rules", roleData)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_role_rules are not allowed on this mount: rule 1: verb 'escalate' is not in the mount's allowed_verbs: get, list, watch")
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"allowed_verbs":     "get,list,watch,escalate",
+		"allowed_resources": "pods",
+	})
+	resp, err = testRoleCreate(t, b, s, "rules", roleData)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_role_rules are not allowed on this mount: rule 0: resource 'pods/log' is not in the mount's allowed_resources: pods")
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"allowed_resources": "pods,pods/log,clusterroles",
+	})
+	resp, err = testRoleCreate(t, b, s, "rules", roleData)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	// Roles that don't generate rules aren't affected
+	resp, err = testRoleCreate(t, b, s, "sa", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"service_account_name":          "sa",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestRoles_parsedRoleRules(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	resp, err := testRoleCreate(t, b, s, "parsed", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	role, err := getRole(ctx, s, "parsed")
+	require.NoError(t, err)
+	assert.Equal(t, []rbacv1.PolicyRule{{
+		APIGroups: []string{"admissionregistration.k8s.io"},
+		Resources: []string{"mutatingwebhookconfigurations"},
+		Verbs:     []string{"get", "list", "watch", "patch"},
+	}}, role.ParsedRoleRules)
+
+	// The original text is returned on read, without the parsed rules
+	resp, err = testRoleRead(t, b, s, "parsed")
+	require.NoError(t, err)
+	assert.Equal(t, goodYAMLRules, resp.Data["generated_role_rules"])
+	assert.NotContains(t, resp.Data, "parsed_role_rules")
+	assert.NotContains(t, resp.Data, "ParsedRoleRules")
+
+	// Replacing the rules with an existing role drops the parsed rules
+	resp, err = testRoleCreate(t, b, s, "parsed", map[string]interface{}{
+		"generated_role_rules": "",
+		"kubernetes_role_name": "existing",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	role, err = getRole(ctx, s, "parsed")
+	require.NoError(t, err)
+	assert.Nil(t, role.ParsedRoleRules)
+}
+
+func TestRoles_forbidWildcardRules(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	wildcardRules := `rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get"]
+- apiGroups: ["*"]
+  resources: ["deployments"]
+  verbs: ["get"]
+`
+	roleData := map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          wildcardRules,
+	}
+
+	// Wildcards are allowed by default
+	resp, err := testRoleCreate(t, b, s, "wildcard", roleData)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"forbid_wildcard_rules": true,
+	})
+	resp, err = testRoleCreate(t, b, s, "wildcard", roleData)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_role_rules are not allowed on this mount: rule 1: '*' in apiGroups is forbidden by the mount's forbid_wildcard_rules")
+
+	resp, err = testRoleCreate(t, b, s, "wildcard", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          `{"rules": [{"apiGroups": [""], "resources": ["pods"], "verbs": ["*"]}]}`,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_role_rules are not allowed on this mount: rule 0: '*' in verbs is forbidden by the mount's forbid_wildcard_rules")
+
+	resp, err = testRoleCreate(t, b, s, "good", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestRoles_requireResourceNamesForVerbs(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	unnamedRules := `rules:
+- apiGroups: [""]
+  resources: ["configmaps"]
+  resourceNames: ["app-config"]
+  verbs: ["get", "update"]
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: ["list", "get"]
+`
+	roleData := map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          unnamedRules,
+	}
+
+	// Not enforced by default
+	resp, err := testRoleCreate(t, b, s, "unnamed", roleData)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"require_resource_names_for_verbs": "get,update",
+	})
+	resp, err = testRoleCreate(t, b, s, "unnamed", roleData)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "generated_role_rules are not allowed on this mount: rule 1: verb 'get' requires resourceNames by the mount's require_resource_names_for_verbs")
+
+	resp, err = testRoleCreate(t, b, s, "named", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules": `rules:
+- apiGroups: [""]
+  resources: ["configmaps"]
+  resourceNames: ["app-config"]
+  verbs: ["get", "update"]
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: ["list"]
+`,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+}
+
+func TestRoles_deleteRevokeLeases(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	for _, name := range []string{"doomed", "other"} {
+		resp, err := testRoleCreate(t, b, s, name, map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules":          goodYAMLRules,
+			"kubernetes_role_type":          "ClusterRole",
+			"shared_cluster_role":           true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+	}
+	var leases []map[string]interface{}
+	for _, name := range []string{"doomed", "doomed", "other"} {
+		resp, err := testCredsCreate(t, b, s, name, nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases = append(leases, resp.Secret.InternalData)
+	}
+	sharedName := leases[0]["shared_cluster_role"].(string)
+
+	accountCount := func() int {
+		accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		return len(accounts.Items)
+	}
+
+	// By default the leases are left alone
+	resp, err := testRolesDelete(t, b, s, "doomed")
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+	assert.Equal(t, 3, accountCount())
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      rolesPath + "doomed",
+		Data:      map[string]interface{}{"revoke_leases": true},
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, 2, resp.Data["revoked_leases"])
+	assert.Equal(t, 1, accountCount())
+	keys, err := s.List(ctx, credsIndexPath)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	shared, err := getSharedClusterRole(ctx, s, "", sharedName)
+	require.NoError(t, err)
+	assert.Equal(t, 1, shared.RefCount)
+
+	// Revoking the Vault leases afterwards finds their objects gone, and
+	// doesn't release the shared ClusterRole again
+	for _, lease := range leases[:2] {
+		resp, err = testRevoke(t, b, s, lease)
+		require.NoError(t, err)
+		assert.Equal(t, cleanupAlreadyDeleted, resp.Data["ServiceAccount"])
+		assert.NotContains(t, resp.Data, "ClusterRole")
+	}
+	shared, err = getSharedClusterRole(ctx, s, "", sharedName)
+	require.NoError(t, err)
+	assert.Equal(t, 1, shared.RefCount)
+	_, err = fakeClient.RbacV1().ClusterRoles().Get(ctx, sharedName, metav1.GetOptions{})
+	require.NoError(t, err)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	rotateBindingPath            = "rotate-binding/"
+	rotateBindingHelpSynopsis    = `Recreate the Kubernetes objects of an active lease.`
+	rotateBindingHelpDescription = `Deletes and recreates the RoleBinding of an active lease, and its ServiceAccount
+and Role if they were generated, from the current definition of the lease's role,
+and returns a new token. The lease is kept, and the objects keep their names, so
+revoking the lease still deletes them. Deleting the ServiceAccount invalidates the
+tokens issued before.
+
+The lease is identified by its key in the list of creds. Leases whose role now
+generates different objects, e.g. because generated_role_rules was replaced by
+kubernetes_role_name, can't be rotated, and must be revoked instead.`
+)
+
+func (b *backend) pathRotateBinding() *framework.Path {
+	return &framework.Path{
+		Pattern: rotateBindingPath + framework.GenericNameRegex("index_id"),
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "rotate",
+			OperationSuffix: "binding",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"index_id": {
+				Type:        framework.TypeString,
+				Description: "The key of the lease in the list of creds.",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathRotateBindingWrite,
+				ForwardPerformanceSecondary: true,
+				ForwardPerformanceStandby:   true,
+			},
+		},
+		HelpSynopsis:    rotateBindingHelpSynopsis,
+		HelpDescription: rotateBindingHelpDescription,
+	}
+}
+
+func (b *backend) pathRotateBindingWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	id := d.Get("index_id").(string)
+	entry, err := getCredsIndexEntry(ctx, req.Storage, id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse("lease '%s' not found", id), nil
+	}
+	if entry.InternalData == nil {
+		return logical.ErrorResponse("lease '%s' was issued by an older version of the plugin that didn't record its objects, and can't be rotated", id), nil
+	}
+	ttl := time.Until(entry.ExpireTime)
+	if ttl <= 0 {
+		return logical.ErrorResponse("lease '%s' has expired", id), nil
+	}
+	objects := leaseObjects(entry.InternalData)
+	if objects.RoleBinding == "" {
+		return logical.ErrorResponse("lease '%s' has no generated RoleBinding to rotate", id), nil
+	}
+
+	role, err := getRole(ctx, req.Storage, entry.Role)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("role '%s' no longer exists, unable to rotate lease '%s'", entry.Role, id), nil
+	}
+	role, err = b.withRoleRulesFromFile(ctx, req.Storage, role)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := changedRoleSetting(b.mountID, role, objects)
+	if err != nil {
+		return nil, err
+	}
+	if changed != "" {
+		return logical.ErrorResponse("the %s of role '%s' changed since lease '%s' was issued, so its objects can't be recreated; revoke the lease and generate new credentials instead", changed, entry.Role, id), nil
+	}
+	role, err = role.withRenderedMetadata(metadataTemplateData{
+		nameMetadata: nameMetadata{
+			DisplayName: req.DisplayName,
+			RoleName:    role.Name,
+			NamePrefix:  role.NamePrefix,
+			Namespace:   objects.Namespace,
+		},
+		Timestamp: time.Now().UTC().Format(metadataTimestampFormat),
+	})
+	if err != nil {
+		return nil, err
+	}
+	role = role.withExtraMetadata(b.managedLabels(req, role.Name), nil)
+	if role.AnnotateLeaseID {
+		// The recreated objects are traced back to the original request
+		requestID, _ := entry.InternalData["request_id"].(string)
+		role = role.withExtraMetadata(nil, leaseAnnotations(id, requestID))
+	}
+
+	client, err := b.getClient(ctx, req.Storage, objects.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := client.withOperationTimeout(ctx)
+	defer cancel()
+
+	namespace := objects.Namespace
+	bindingNamespace := namespace
+	if ns, _ := entry.InternalData["binding_service_account_namespace"].(string); ns != "" {
+		bindingNamespace = ns
+	}
+	if bindingNamespace != namespace {
+		// Only existing service accounts may be bound in another namespace
+		serviceAccountName, _ := entry.InternalData["service_account_name"].(string)
+		if objects.ServiceAccount != "" {
+			return logical.ErrorResponse("lease '%s' binds its generated service account in namespace '%s', where it doesn't exist, so its objects can't be recreated; revoke the lease instead", id, bindingNamespace), nil
+		}
+		exists, err := client.serviceAccountExists(ctx, bindingNamespace, serviceAccountName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service account '%s/%s': %w", bindingNamespace, serviceAccountName, err)
+		}
+		if !exists {
+			return logical.ErrorResponse("service account '%s/%s' does not exist", bindingNamespace, serviceAccountName), nil
+		}
+	}
+
+	// The lease keeps its reference to a shared ClusterRole. The objects are
+	// deleted explicitly even with rely_on_owner_gc, since they're recreated
+	// with the same names right away.
+	deleted := *objects
+	deleted.SharedClusterRole = ""
+	if _, err := b.deleteObjects(ctx, req.Storage, client, &deleted, false); err != nil {
+		return nil, fmt.Errorf("failed to delete the objects of lease '%s': %w", id, err)
+	}
+
+	serviceAccountName, _ := entry.InternalData["service_account_name"].(string)
+	var ownerRef metav1.OwnerReference
+	switch {
+	case objects.Role != "":
+		ownerRef, err = client.createRole(ctx, namespace, objects.Role, role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s '%s/%s': %s", objects.RoleType, namespace, objects.Role, err)
+		}
+		if _, err := createRoleBinding(ctx, client, bindingNamespace, objects.RoleBinding, serviceAccountName, objects.Role, objects.ClusterRoleBinding, role, ownerRef); err != nil {
+			return nil, err
+		}
+		if objects.BaseRoleBinding != "" {
+			if _, err := createRoleBinding(ctx, client, bindingNamespace, objects.BaseRoleBinding, serviceAccountName, role.K8sRoleName, objects.ClusterRoleBinding, role, ownerRef); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		k8sRoleName := role.K8sRoleName
+		if objects.SharedClusterRole != "" {
+			k8sRoleName = objects.SharedClusterRole
+		}
+		ownerRef, err = client.createRoleBinding(ctx, bindingNamespace, objects.RoleBinding, serviceAccountName, k8sRoleName, objects.ClusterRoleBinding, role, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create RoleBinding/ClusterRoleBinding '%s' for %s: %s", objects.RoleBinding, k8sRoleName, err)
+		}
+	}
+	if objects.ServiceAccount != "" {
+		if _, err := createServiceAccount(ctx, client, namespace, objects.ServiceAccount, role, ownerRef); err != nil {
+			return nil, err
+		}
+	}
+
+	tokenResponseKey := role.TokenResponseKey
+	if tokenResponseKey == "" {
+		tokenResponseKey = defaultTokenResponseKey
+	}
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"service_account_namespace": namespace,
+			"service_account_name":      serviceAccountName,
+		},
+	}
+	if objects.TokenSecret != "" {
+		token, err := client.createTokenSecret(ctx, namespace, objects.TokenSecret, serviceAccountName, role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a service account token Secret for %s/%s: %s", namespace, serviceAccountName, err)
+		}
+		resp.Data[tokenResponseKey] = token
+	} else {
+		status, err := client.createToken(ctx, namespace, serviceAccountName, ttl, leaseAudiences(entry.InternalData, role), leaseBoundObjectRef(entry.InternalData))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a service account token for %s/%s: %s", namespace, serviceAccountName, err)
+		}
+		resp.Data[tokenResponseKey] = status.Token
+		resp.Data["service_account_token_expiration"] = status.ExpirationTimestamp.Format(time.RFC3339)
+	}
+
+	entry.RotateTime = time.Now()
+	if err := putCredsIndexEntry(ctx, req.Storage, id, entry); err != nil {
+		return nil, fmt.Errorf("error writing creds index entry: %w", err)
+	}
+	b.Logger().Info("rotated the objects of lease", "index_id", id, "role", entry.Role)
+
+	return resp, nil
+}
+
+// changedRoleSetting returns the setting of the role that changed since the
+// lease with the objects was issued, such that the objects it would generate
+// now differ in kind or name from the lease's. An empty string is returned if
+// the objects can be recreated from the role.
+func changedRoleSetting(mountID string, role *roleEntry, objects *pendingCleanup) (string, error) {
+	switch {
+	case role.KubernetesCluster != objects.Cluster:
+		return "kubernetes_cluster", nil
+	case role.SharedClusterRole != (objects.SharedClusterRole != ""):
+		return "shared_cluster_role", nil
+	case (objects.Role != "") != (role.generatesRole() && !role.SharedClusterRole):
+		return "generated_role_rules", nil
+	case objects.Role != "" && objects.RoleType != role.K8sRoleType:
+		return "kubernetes_role_type", nil
+	case (objects.BaseRoleBinding != "") != role.CombineRules:
+		return "combine_rules", nil
+	case (objects.ServiceAccount != "") != (role.ServiceAccountName == ""):
+		return "service_account_name", nil
+	case (objects.TokenSecret != "") != (role.TokenType == tokenTypeSecret):
+		return "token_type", nil
+	}
+	if objects.SharedClusterRole != "" {
+		// The shared ClusterRole is named after its rules
+		name, err := sharedClusterRoleName(mountID, objects.Cluster, role.RoleRules)
+		if err != nil {
+			return "", err
+		}
+		if name != objects.SharedClusterRole {
+			return "generated_role_rules", nil
+		}
+	}
+	return "", nil
+}
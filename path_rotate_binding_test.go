@@ -0,0 +1,162 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testRotateBinding(t *testing.T, b *backend, s logical.Storage, id string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      rotateBindingPath + id,
+		Storage:   s,
+	})
+}
+
+func TestRotateBinding(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+
+	t.Run("generated role", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "generated", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules":          goodYAMLRules,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		resp, err = testCredsCreate(t, b, s, "generated", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		lease := resp.Secret.InternalData
+		name := resp.Data["service_account_name"].(string)
+
+		resp, err = testRoleCreate(t, b, s, "generated", map[string]interface{}{
+			"generated_role_rules": `rules:
+- apiGroups: [""]
+  resources: ["configmaps"]
+  verbs: ["get"]`,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testRotateBinding(t, b, s, lease["index_id"].(string))
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		assert.Equal(t, "app1", resp.Data["service_account_namespace"])
+		assert.Equal(t, name, resp.Data["service_account_name"])
+		assert.NotEmpty(t, resp.Data["service_account_token"])
+		assert.NotEmpty(t, resp.Data["service_account_token_expiration"])
+
+		k8sRole, err := fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Len(t, k8sRole.Rules, 1)
+		assert.Equal(t, []string{"configmaps"}, k8sRole.Rules[0].Resources)
+		binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, name, binding.RoleRef.Name)
+		_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+
+		resp, err = testCredsList(t, b, s, nil)
+		require.NoError(t, err)
+		info := resp.Data["key_info"].(map[string]interface{})[lease["index_id"].(string)].(map[string]interface{})
+		assert.NotEmpty(t, info["rotate_time"])
+
+		// Revoking the lease still deletes the recreated objects
+		_, err = testRevoke(t, b, s, lease)
+		require.NoError(t, err)
+		_, err = fakeClient.RbacV1().Roles("app1").Get(ctx, name, metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+		_, err = fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+		_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, name, metav1.GetOptions{})
+		assert.True(t, k8s_errors.IsNotFound(err))
+	})
+
+	t.Run("existing role", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "existing", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"kubernetes_role_name":          "reader",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		resp, err = testCredsCreate(t, b, s, "existing", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		lease := resp.Secret.InternalData
+		name := resp.Data["service_account_name"].(string)
+
+		resp, err = testRoleCreate(t, b, s, "existing", map[string]interface{}{
+			"kubernetes_role_name": "writer",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testRotateBinding(t, b, s, lease["index_id"].(string))
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "writer", binding.RoleRef.Name)
+	})
+
+	t.Run("changed role", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "changed", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules":          goodYAMLRules,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		resp, err = testCredsCreate(t, b, s, "changed", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		lease := resp.Secret.InternalData
+
+		resp, err = testRoleCreate(t, b, s, "changed", map[string]interface{}{
+			"generated_role_rules": "",
+			"kubernetes_role_name": "reader",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testRotateBinding(t, b, s, lease["index_id"].(string))
+		require.NoError(t, err)
+		require.Error(t, resp.Error())
+		assert.Contains(t, resp.Error().Error(), "generated_role_rules")
+	})
+
+	t.Run("no binding", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "token-only", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"service_account_name":          "existing-sa",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		resp, err = testCredsCreate(t, b, s, "token-only", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testRotateBinding(t, b, s, resp.Secret.InternalData["index_id"].(string))
+		require.NoError(t, err)
+		require.Error(t, resp.Error())
+		assert.Contains(t, resp.Error().Error(), "no generated RoleBinding")
+	})
+
+	t.Run("unknown lease", func(t *testing.T) {
+		resp, err := testRotateBinding(t, b, s, "unknown")
+		require.NoError(t, err)
+		require.Error(t, resp.Error())
+		assert.Contains(t, resp.Error().Error(), "not found")
+	})
+}
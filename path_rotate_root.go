@@ -0,0 +1,185 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	rotateRootPath            = "rotate-root"
+	rotateRootHelpSynopsis    = `Rotate the service account JWT the plugin uses to authenticate to Kubernetes.`
+	rotateRootHelpDescription = `Uses the configured service_account_jwt to request a new token for the same
+service account, and stores it as the new service_account_jwt. The service account
+must be allowed to create tokens for itself (the "create" verb on the
+"serviceaccounts/token" subresource). The local service account token of a plugin
+running in a pod is rotated by Kubernetes, so it can't be rotated here.`
+
+	// defaultRotateRootTTL is the TTL of the rotated token if none is requested
+	defaultRotateRootTTL = 24 * time.Hour
+
+	// minJWTRotationPeriod is the shortest jwt_rotation_period. Tokens are
+	// issued for twice the period, and Kubernetes requires at least 10m.
+	minJWTRotationPeriod = 5 * time.Minute
+
+	serviceAccountSubjectPrefix = "system:serviceaccount:"
+)
+
+// errNoServiceAccountJWT is returned when rotating the root credentials of a
+// mount that doesn't use a configured service_account_jwt
+var errNoServiceAccountJWT = errors.New("service_account_jwt is not set, only a configured service_account_jwt can be rotated")
+
+func (b *backend) pathRotateRoot() *framework.Path {
+	return &framework.Path{
+		Pattern: rotateRootPath + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "rotate",
+			OperationSuffix: "root-credentials",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("The TTL of the new service account token. Defaults to %s.", defaultRotateRootTTL),
+				Default:     int(defaultRotateRootTTL.Seconds()),
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRotateRootUpdate,
+			},
+		},
+		HelpSynopsis:    rotateRootHelpSynopsis,
+		HelpDescription: rotateRootHelpDescription,
+	}
+}
+
+func (b *backend) pathRotateRootUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
+	if ttl <= 0 {
+		return logical.ErrorResponse("ttl must be positive"), nil
+	}
+
+	rotated, err := b.rotateRoot(ctx, req.Storage, ttl)
+	if errors.Is(err, errNoServiceAccountJWT) {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"service_account_namespace": rotated.Namespace,
+			"service_account_name":      rotated.Name,
+			"expiration_time":           rotated.Expiration,
+		},
+	}, nil
+}
+
+// rotatedRoot describes the token that replaced the service_account_jwt
+type rotatedRoot struct {
+	Namespace  string
+	Name       string
+	Expiration time.Time
+}
+
+// rotateRoot requests a new token for the service account of the configured
+// service_account_jwt, stores it in the config and resets the client
+func (b *backend) rotateRoot(ctx context.Context, s logical.Storage, ttl time.Duration) (*rotatedRoot, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, errors.New("could not load backend configuration")
+	}
+	if config.ServiceAccountJwt == "" {
+		return nil, errNoServiceAccountJWT
+	}
+	namespace, name, err := serviceAccountFromJWT(config.ServiceAccountJwt)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, s, "")
+	if err != nil {
+		return nil, err
+	}
+	status, err := client.createToken(ctx, namespace, name, ttl, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a service account token for %s/%s: %w", namespace, name, err)
+	}
+
+	config.ServiceAccountJwt = status.Token
+	config.LastJWTRotation = time.Now()
+	entry, err := logical.StorageEntryJSON(configPath, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	b.reset()
+
+	return &rotatedRoot{
+		Namespace:  namespace,
+		Name:       name,
+		Expiration: status.ExpirationTimestamp.Time,
+	}, nil
+}
+
+// rotateRootIfDue rotates the service_account_jwt if its jwt_rotation_period
+// has passed. Failures are logged and the current token is kept, so they are
+// retried on the next call.
+func (b *backend) rotateRootIfDue(ctx context.Context, s logical.Storage) {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		b.Logger().Warn("failed to load config to check for JWT rotation", "error", err)
+		return
+	}
+	if config == nil {
+		return
+	}
+	next := config.nextJWTRotation()
+	if next.IsZero() || time.Now().Before(next) {
+		return
+	}
+
+	rotated, err := b.rotateRoot(ctx, s, 2*config.JWTRotationPeriod)
+	if err != nil {
+		b.Logger().Warn("failed to rotate service_account_jwt, continuing to use the current token", "error", err)
+		return
+	}
+	b.Logger().Info("rotated service_account_jwt", "namespace", rotated.Namespace, "name", rotated.Name, "expiration", rotated.Expiration)
+}
+
+// serviceAccountFromJWT returns the namespace and name of the service account
+// a token was issued for. The token's signature isn't verified.
+func serviceAccountFromJWT(token string) (string, string, error) {
+	parsed, err := josejwt.ParseSigned(token, AllowedSigningAlgs)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse service_account_jwt: %w", err)
+	}
+	claims := josejwt.Claims{}
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", "", fmt.Errorf("failed to parse service_account_jwt: %w", err)
+	}
+	parts := strings.Split(strings.TrimPrefix(claims.Subject, serviceAccountSubjectPrefix), ":")
+	if !strings.HasPrefix(claims.Subject, serviceAccountSubjectPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("service_account_jwt is not a service account token, subject is %q", claims.Subject)
+	}
+	return parts[0], parts[1], nil
+}
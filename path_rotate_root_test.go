@@ -0,0 +1,199 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testRotateRoot(t *testing.T, b *backend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      rotateRootPath,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestRotateRoot(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	t.Run("local token", func(t *testing.T) {
+		testConfigWrite(t, b, s, nil)
+		resp, err := testRotateRoot(t, b, s, nil)
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), errNoServiceAccountJWT.Error())
+	})
+
+	t.Run("configured token", func(t *testing.T) {
+		// Issue the initial service_account_jwt from a fake cluster
+		fakeClient := setupFakeClient(t, b, s)
+		c := &client{k8s: fakeClient}
+		status, err := c.createToken(ctx, "vault", "vault-plugin", time.Hour, nil, nil)
+		require.NoError(t, err)
+		testConfigWrite(t, b, s, map[string]interface{}{
+			"service_account_jwt": status.Token,
+		})
+		setupFakeClient(t, b, s)
+
+		resp, err := testRotateRoot(t, b, s, map[string]interface{}{
+			"ttl": "2h",
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		assert.Equal(t, "vault", resp.Data["service_account_namespace"])
+		assert.Equal(t, "vault-plugin", resp.Data["service_account_name"])
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), resp.Data["expiration_time"].(time.Time), time.Minute)
+
+		config, err := getConfig(ctx, s)
+		require.NoError(t, err)
+		assert.NotEqual(t, status.Token, config.ServiceAccountJwt)
+		namespace, name, err := serviceAccountFromJWT(config.ServiceAccountJwt)
+		require.NoError(t, err)
+		assert.Equal(t, "vault", namespace)
+		assert.Equal(t, "vault-plugin", name)
+		tokenTTL, err := getTokenTTL(config.ServiceAccountJwt)
+		require.NoError(t, err)
+		assert.Equal(t, 2*time.Hour, tokenTTL)
+
+		// The client is rebuilt with the new token
+		assert.Empty(t, b.clients)
+	})
+
+	t.Run("concurrent config write", func(t *testing.T) {
+		previous, err := getConfig(ctx, s)
+		require.NoError(t, err)
+		fakeClient := setupFakeClient(t, b, s)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() == "token" {
+				close(started)
+				<-release
+			}
+			return false, nil, nil
+		})
+
+		rotated := make(chan error, 1)
+		go func() {
+			_, err := b.rotateRoot(ctx, s, time.Hour)
+			rotated <- err
+		}()
+		<-started
+		written := make(chan error, 1)
+		go func() {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      configPath,
+				Storage:   s,
+				Data:      map[string]interface{}{"kubernetes_host": "https://kubernetes.example.com", "max_ttl": "2h"},
+			})
+			if err == nil && resp != nil && resp.IsError() {
+				err = resp.Error()
+			}
+			written <- err
+		}()
+
+		// The config write waits for the rotation, rather than being
+		// overwritten by it
+		select {
+		case <-written:
+			t.Fatal("config was written during the rotation")
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(release)
+		require.NoError(t, <-rotated)
+		require.NoError(t, <-written)
+		config, err := getConfig(ctx, s)
+		require.NoError(t, err)
+		assert.Equal(t, 2*time.Hour, config.MaxTTL)
+		assert.NotEqual(t, previous.ServiceAccountJwt, config.ServiceAccountJwt)
+	})
+}
+
+func TestRotateRoot_periodic(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	fakeClient := setupFakeClient(t, b, s)
+	c := &client{k8s: fakeClient}
+	status, err := c.createToken(ctx, "vault", "vault-plugin", time.Hour, nil, nil)
+	require.NoError(t, err)
+
+	for _, data := range []map[string]interface{}{
+		{"jwt_rotation_period": "1m", "service_account_jwt": status.Token},
+		{"jwt_rotation_period": "1h"},
+	} {
+		data["kubernetes_host"] = "https://kubernetes.example.com"
+		data["disable_local_ca_jwt"] = true
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      configPath,
+			Storage:   s,
+			Data:      data,
+		})
+		assert.NoError(t, err, data)
+		assert.Error(t, resp.Error(), data)
+	}
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"service_account_jwt": status.Token,
+		"jwt_rotation_period": "10m",
+	})
+	resp := testConfigRead(t, b, s)
+	assert.Equal(t, int64(600), resp.Data["jwt_rotation_period"])
+	nextRotation, err := time.Parse(time.RFC3339, resp.Data["next_jwt_rotation"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), nextRotation, time.Minute)
+
+	// Not due yet
+	fakeClient = setupFakeClient(t, b, s)
+	b.rotateRootIfDue(ctx, s)
+	config, err := getConfig(ctx, s)
+	require.NoError(t, err)
+	assert.Equal(t, status.Token, config.ServiceAccountJwt)
+
+	// A failed rotation keeps the current token
+	setLastJWTRotation := func(lastRotation time.Time) {
+		t.Helper()
+		config, err := getConfig(ctx, s)
+		require.NoError(t, err)
+		config.LastJWTRotation = lastRotation
+		entry, err := logical.StorageEntryJSON(configPath, config)
+		require.NoError(t, err)
+		require.NoError(t, s.Put(ctx, entry))
+	}
+	setLastJWTRotation(time.Now().Add(-11 * time.Minute))
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8s_errors.NewForbidden(schema.GroupResource{Resource: "serviceaccounts"}, "vault-plugin", errors.New("nope"))
+	})
+	b.rotateRootIfDue(ctx, s)
+	config, err = getConfig(ctx, s)
+	require.NoError(t, err)
+	assert.Equal(t, status.Token, config.ServiceAccountJwt)
+
+	// Once due, the token is replaced with one valid for twice the period
+	setupFakeClient(t, b, s)
+	b.rotateRootIfDue(ctx, s)
+	config, err = getConfig(ctx, s)
+	require.NoError(t, err)
+	assert.NotEqual(t, status.Token, config.ServiceAccountJwt)
+	tokenTTL, err := getTokenTTL(config.ServiceAccountJwt)
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, tokenTTL)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), config.nextJWTRotation(), time.Minute)
+}
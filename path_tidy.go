@@ -0,0 +1,270 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	tidyPath            = "tidy"
+	tidyHelpSynopsis    = `Delete orphaned Kubernetes objects created by this secrets engine.`
+	tidyHelpDescription = `Lists the ServiceAccounts, Roles and RoleBindings that this mount created, and
+deletes those that don't belong to an active lease, e.g. because revoking the lease
+failed or the lease was lost. Only objects labeled with the mount's ID, or its
+accessor if the ID isn't available, are considered, so objects created before the
+label was introduced, or by other mounts, are never deleted. Objects younger than min_age are skipped, since they
+may belong to a creds request in progress.
+
+The namespaces listed in roles' allowed_kubernetes_namespaces and the namespaces
+of active leases are searched, unless kubernetes_namespaces is set. Set dry_run to
+report the orphaned objects without deleting them.`
+
+	defaultTidyMinAge     = time.Hour
+	defaultTidyMaxDeletes = 100
+)
+
+// tidyDeletesPerSecond limits the rate at which tidy deletes objects, to
+// avoid overloading the Kubernetes API
+var tidyDeletesPerSecond float32 = 5
+
+func (b *backend) pathTidy() *framework.Path {
+	return &framework.Path{
+		Pattern: tidyPath + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "tidy",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"kubernetes_namespaces": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The namespaces to search for orphaned objects. Defaults to the namespaces allowed by name in roles, and those of active leases.",
+			},
+			"min_age": {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("Only delete objects older than this. Defaults to %s.", defaultTidyMinAge),
+				Default:     int(defaultTidyMinAge.Seconds()),
+			},
+			"max_deletes": {
+				Type:        framework.TypeInt,
+				Description: fmt.Sprintf("The maximum number of objects to delete. Defaults to %d.", defaultTidyMaxDeletes),
+				Default:     defaultTidyMaxDeletes,
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "If true, report the orphaned objects without deleting them.",
+			},
+			"kubernetes_cluster": {
+				Type:        framework.TypeString,
+				Description: "The name of the cluster to search, configured at config/<name>. Defaults to the cluster configured at config.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathTidyUpdate,
+				ForwardPerformanceSecondary: true,
+				ForwardPerformanceStandby:   true,
+			},
+		},
+		HelpSynopsis:    tidyHelpSynopsis,
+		HelpDescription: tidyHelpDescription,
+	}
+}
+
+func (b *backend) pathTidyUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	selector := labels.Set{mountIDLabel: b.mountID}.String()
+	if b.mountID == "" {
+		if req.MountAccessor == "" {
+			return logical.ErrorResponse("tidy requires the mount's unique ID or accessor, which are not available"), nil
+		}
+		selector = labels.Set{mountAccessorLabel: req.MountAccessor}.String()
+	}
+	minAge := time.Duration(d.Get("min_age").(int)) * time.Second
+	if minAge < 0 {
+		return logical.ErrorResponse("min_age must not be negative"), nil
+	}
+	maxDeletes := d.Get("max_deletes").(int)
+	if maxDeletes <= 0 {
+		return logical.ErrorResponse("max_deletes must be positive"), nil
+	}
+	dryRun := d.Get("dry_run").(bool)
+	cluster := d.Get("kubernetes_cluster").(string)
+
+	active, leaseNamespaces, err := activeLeaseObjects(ctx, req.Storage, cluster)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	namespaces := d.Get("kubernetes_namespaces").([]string)
+	if len(namespaces) == 0 {
+		namespaces, warnings, err = roleNamespaces(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = strutil.RemoveDuplicates(append(namespaces, leaseNamespaces...), false)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphaned []managedObject
+	for _, namespace := range namespaces {
+		objects, err := client.listManagedObjects(ctx, namespace, selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in namespace '%s': %w", namespace, err)
+		}
+		for _, obj := range objects {
+			if _, ok := active[obj.Namespace+"/"+obj.Name]; ok {
+				continue
+			}
+			if time.Since(obj.Created) < minAge {
+				continue
+			}
+			orphaned = append(orphaned, obj)
+		}
+	}
+	sort.Slice(orphaned, func(i, j int) bool {
+		if orphaned[i].Namespace != orphaned[j].Namespace {
+			return orphaned[i].Namespace < orphaned[j].Namespace
+		}
+		if orphaned[i].Name != orphaned[j].Name {
+			return orphaned[i].Name < orphaned[j].Name
+		}
+		return orphaned[i].Kind < orphaned[j].Kind
+	})
+
+	report := make([]map[string]interface{}, 0, len(orphaned))
+	for _, obj := range orphaned {
+		report = append(report, map[string]interface{}{
+			"kind":      obj.Kind,
+			"namespace": obj.Namespace,
+			"name":      obj.Name,
+		})
+	}
+
+	deleted := 0
+	if !dryRun {
+		if len(orphaned) > maxDeletes {
+			warnings = append(warnings, fmt.Sprintf("%d orphaned objects were not deleted since max_deletes was reached, run tidy again to delete them", len(orphaned)-maxDeletes))
+			orphaned = orphaned[:maxDeletes]
+		}
+		limiter := flowcontrol.NewTokenBucketRateLimiter(tidyDeletesPerSecond, 1)
+		defer limiter.Stop()
+		for _, obj := range orphaned {
+			if err := limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+			var err error
+			switch obj.Kind {
+			case "ServiceAccount":
+				_, err = client.deleteServiceAccount(ctx, obj.Namespace, obj.Name)
+			case "Role":
+				_, err = client.deleteRole(ctx, obj.Namespace, obj.Name, obj.Kind)
+			case "RoleBinding":
+				_, err = client.deleteRoleBinding(ctx, obj.Namespace, obj.Name, false)
+			}
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("failed to delete %s '%s/%s': %s", obj.Kind, obj.Namespace, obj.Name, err))
+				continue
+			}
+			b.Logger().Info("deleted orphaned object", "kind", obj.Kind, "namespace", obj.Namespace, "name", obj.Name)
+			deleted++
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":  dryRun,
+			"orphaned": report,
+			"deleted":  deleted,
+		},
+	}
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
+}
+
+// activeLeaseObjects returns the names of the objects of the leases in the
+// creds index that belong to the cluster, keyed by namespace/name, and the
+// namespaces of the leases. The objects generated for a lease are named after
+// its service account, so that name covers leases from before the index
+// recorded their internal data.
+func activeLeaseObjects(ctx context.Context, s logical.Storage, cluster string) (map[string]struct{}, []string, error) {
+	ids, err := s.List(ctx, credsIndexPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	active := make(map[string]struct{})
+	var namespaces []string
+	for _, id := range ids {
+		entry, err := getCredsIndexEntry(ctx, s, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		if entryCluster, _ := entry.InternalData["kubernetes_cluster"].(string); entryCluster != cluster {
+			continue
+		}
+		namespace := entry.ServiceAccountNamespace
+		namespaces = append(namespaces, namespace)
+		names := []string{entry.ServiceAccountName, entry.ServiceAccountName + baseRoleBindingSuffix}
+		for _, key := range []string{"created_service_account", "created_role_binding", "created_role", "created_base_role_binding", "created_token_secret"} {
+			if name, ok := entry.InternalData[key].(string); ok && name != "" {
+				names = append(names, name)
+			}
+		}
+		for _, name := range names {
+			active[namespace+"/"+name] = struct{}{}
+		}
+	}
+	return active, strutil.RemoveDuplicates(namespaces, false), nil
+}
+
+// roleNamespaces returns the namespaces that roles of the cluster allow by
+// name. Warnings are returned for roles that allow namespaces by pattern or
+// selector, whose namespaces are only searched if they have active leases.
+func roleNamespaces(ctx context.Context, s logical.Storage, cluster string) ([]string, []string, error) {
+	roleNames, err := s.List(ctx, rolesPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var namespaces, warnings []string
+	for _, roleName := range roleNames {
+		role, err := getRole(ctx, s, roleName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if role == nil || role.KubernetesCluster != cluster {
+			continue
+		}
+		patterns := role.K8sNamespaceSelector != ""
+		for _, namespace := range role.K8sNamespaces {
+			if isNamespacePattern(namespace) {
+				patterns = true
+				continue
+			}
+			namespaces = append(namespaces, namespace)
+		}
+		if patterns {
+			warnings = append(warnings, fmt.Sprintf("role '%s' allows namespaces by pattern or label selector, set kubernetes_namespaces to search namespaces without active leases", roleName))
+		}
+	}
+	return namespaces, warnings, nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testTidy(t *testing.T, b *backend, s logical.Storage, d map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      tidyPath,
+		Data:      d,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	return resp
+}
+
+func TestTidy(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	b.mountID = "test-mount"
+	defer func(rate float32) { tidyDeletesPerSecond = rate }(tidyDeletesPerSecond)
+	tidyDeletesPerSecond = 1000
+
+	resp, err := testRoleCreate(t, b, s, "tidy", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	var leases []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		resp, err := testCredsCreate(t, b, s, "tidy", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		leases = append(leases, resp.Secret.InternalData)
+	}
+	sa, err := fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, leases[0]["created_service_account"].(string), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "test-mount", sa.Labels[mountIDLabel])
+
+	// The first lease was lost, so its objects are orphaned
+	require.NoError(t, deleteCredsIndexEntry(ctx, s, leases[0]["index_id"].(string)))
+	orphanName := leases[0]["created_service_account"].(string)
+
+	// Objects of other mounts, without the label, or too recent are kept
+	for name, labels := range map[string]map[string]string{
+		"other-mount": {mountIDLabel: "other-mount"},
+		"unlabeled":   nil,
+	} {
+		_, err := fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app1", Labels: labels},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "fresh",
+			Namespace:         "app1",
+			Labels:            map[string]string{mountIDLabel: "test-mount"},
+			CreationTimestamp: metav1.Now(),
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	expected := []map[string]interface{}{
+		{"kind": "Role", "namespace": "app1", "name": orphanName},
+		{"kind": "RoleBinding", "namespace": "app1", "name": orphanName},
+		{"kind": "ServiceAccount", "namespace": "app1", "name": orphanName},
+	}
+
+	resp = testTidy(t, b, s, map[string]interface{}{"dry_run": true})
+	assert.Equal(t, expected, resp.Data["orphaned"])
+	assert.Equal(t, 0, resp.Data["deleted"])
+	_, err = fakeClient.CoreV1().ServiceAccounts("app1").Get(ctx, orphanName, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	resp = testTidy(t, b, s, map[string]interface{}{"max_deletes": 1})
+	assert.Equal(t, expected, resp.Data["orphaned"])
+	assert.Equal(t, 1, resp.Data["deleted"])
+	assert.Equal(t, []string{"2 orphaned objects were not deleted since max_deletes was reached, run tidy again to delete them"}, resp.Warnings)
+
+	resp = testTidy(t, b, s, nil)
+	assert.Equal(t, expected[1:], resp.Data["orphaned"])
+	assert.Equal(t, 2, resp.Data["deleted"])
+
+	resp = testTidy(t, b, s, nil)
+	assert.Empty(t, resp.Data["orphaned"])
+
+	accounts, err := fakeClient.CoreV1().ServiceAccounts("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, account := range accounts.Items {
+		names = append(names, account.Name)
+	}
+	assert.ElementsMatch(t, []string{leases[1]["created_service_account"].(string), "other-mount", "unlabeled", "fresh"}, names)
+	roles, err := fakeClient.RbacV1().Roles("app1").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, roles.Items, 1)
+	assert.Equal(t, leases[1]["created_role"], roles.Items[0].Name)
+}
+
+func TestTidy_mountAccessor(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	defer func(rate float32) { tidyDeletesPerSecond = rate }(tidyDeletesPerSecond)
+	tidyDeletesPerSecond = 1000
+
+	tidy := func(accessor string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:     logical.UpdateOperation,
+			Path:          tidyPath,
+			Data:          map[string]interface{}{"kubernetes_namespaces": "app1", "dry_run": true},
+			Storage:       s,
+			MountAccessor: accessor,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Without the mount's ID, objects are selected by the mount's accessor
+	for name, accessor := range map[string]string{
+		"orphan": "kubernetes_1234",
+		"other":  "kubernetes_5678",
+	} {
+		_, err := fakeClient.CoreV1().ServiceAccounts("app1").Create(ctx, &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "app1", Labels: map[string]string{mountAccessorLabel: accessor}},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	resp := tidy("kubernetes_1234")
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []map[string]interface{}{
+		{"kind": "ServiceAccount", "namespace": "app1", "name": "orphan"},
+	}, resp.Data["orphaned"])
+
+	resp = tidy("")
+	assert.EqualError(t, resp.Error(), "tidy requires the mount's unique ID or accessor, which are not available")
+}
@@ -0,0 +1,91 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	tokenValidatePath            = "token/validate"
+	tokenValidateHelpSynopsis    = `Check whether a Kubernetes token is valid.`
+	tokenValidateHelpDescription = `Asks the Kubernetes API with a TokenReview whether the token is currently valid,
+and returns the user it authenticates as: the username, UID and groups, and the
+audiences it's valid for. If audiences is set, the token must be valid for one of
+them, otherwise for the API server's audience. The token is never logged or
+returned.`
+)
+
+func (b *backend) pathTokenValidate() *framework.Path {
+	return &framework.Path{
+		Pattern: tokenValidatePath + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixKubernetes,
+			OperationVerb:   "validate",
+			OperationSuffix: "token",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "The Kubernetes token to validate.",
+				Required:    true,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Token",
+					Sensitive: true,
+				},
+			},
+			"audiences": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The audiences the token must be valid for one of. Defaults to the API server's audience.",
+			},
+			"kubernetes_cluster": {
+				Type:        framework.TypeString,
+				Description: "The name of the cluster to validate the token with, configured at config/<name>. Defaults to the cluster configured at config.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathTokenValidateWrite,
+			},
+		},
+		HelpSynopsis:    tokenValidateHelpSynopsis,
+		HelpDescription: tokenValidateHelpDescription,
+	}
+}
+
+func (b *backend) pathTokenValidateWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	token := d.Get("token").(string)
+	if token == "" {
+		return logical.ErrorResponse("token must be set"), nil
+	}
+	client, err := b.getClient(ctx, req.Storage, d.Get("kubernetes_cluster").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors of the Kubernetes client don't include the request body, so
+	// they're safe to return and log without leaking the token
+	status, err := client.reviewToken(ctx, token, d.Get("audiences").([]string))
+	if err != nil {
+		return nil, fmt.Errorf("failed to review the token: %w", err)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"authenticated": status.Authenticated,
+			"username":      status.User.Username,
+			"uid":           status.User.UID,
+			"groups":        status.User.Groups,
+			"audiences":     status.Audiences,
+		},
+	}
+	if status.Error != "" {
+		resp.Data["error"] = status.Error
+	}
+	return resp, nil
+}
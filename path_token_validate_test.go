@@ -0,0 +1,91 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testTokenValidate(t *testing.T, b *backend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      tokenValidatePath,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestTokenValidate(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+
+	var reviewed *authenticationv1.TokenReview
+	var reviewErr error
+	fakeClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if reviewErr != nil {
+			return true, nil, reviewErr
+		}
+		reviewed = action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		review := reviewed.DeepCopy()
+		if review.Spec.Token != "valid-token" {
+			review.Status.Error = "invalid bearer token"
+			return true, review, nil
+		}
+		review.Status = authenticationv1.TokenReviewStatus{
+			Authenticated: true,
+			User: authenticationv1.UserInfo{
+				Username: "system:serviceaccount:app1:sa",
+				UID:      "1234",
+				Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:app1"},
+			},
+			Audiences: review.Spec.Audiences,
+		}
+		return true, review, nil
+	})
+
+	resp, err := testTokenValidate(t, b, s, map[string]interface{}{
+		"token":     "valid-token",
+		"audiences": "vault",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, []string{"vault"}, reviewed.Spec.Audiences)
+	assert.Equal(t, map[string]interface{}{
+		"authenticated": true,
+		"username":      "system:serviceaccount:app1:sa",
+		"uid":           "1234",
+		"groups":        []string{"system:serviceaccounts", "system:serviceaccounts:app1"},
+		"audiences":     []string{"vault"},
+	}, resp.Data)
+
+	resp, err = testTokenValidate(t, b, s, map[string]interface{}{
+		"token": "expired-token",
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, false, resp.Data["authenticated"])
+	assert.Equal(t, "invalid bearer token", resp.Data["error"])
+
+	resp, err = testTokenValidate(t, b, s, nil)
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "token must be set")
+
+	// The token isn't part of the error
+	reviewErr = k8s_errors.NewForbidden(authenticationv1.Resource("tokenreviews"), "", nil)
+	_, err = testTokenValidate(t, b, s, map[string]interface{}{
+		"token": "valid-token",
+	})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "valid-token")
+}
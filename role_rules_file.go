@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-secure-stdlib/fileutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// isAllowedRoleRulesPath returns true if the path is one of the allowed paths
+// or is inside one of the allowed directories. Symlinks are resolved first, so
+// that a link can't be used to escape an allowed directory. Mounted
+// ConfigMaps are made up of symlinks within the mount directory, so they still
+// resolve to a path inside it.
+func isAllowedRoleRulesPath(allowedPaths []string, path string) (bool, error) {
+	if !filepath.IsAbs(path) {
+		return false, nil
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, allowed := range allowedPaths {
+		resolvedAllowed, err := filepath.EvalSymlinks(allowed)
+		if err != nil {
+			// The allowed path may not be mounted on this node
+			continue
+		}
+		if resolved == resolvedAllowed || strings.HasPrefix(resolved, strings.TrimSuffix(resolvedAllowed, string(filepath.Separator))+string(filepath.Separator)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readRoleRulesFile reads the role rules from a file on an allowed path. The
+// contents are cached for roleRulesReloadPeriod, so changes to the file are
+// picked up without rewriting the role.
+func (b *backend) readRoleRulesFile(config *kubeConfig, path string) (string, error) {
+	allowed, err := isAllowedRoleRulesPath(config.AllowedRoleRulesPaths, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read generated_role_rules_file %q: %w", path, err)
+	}
+	if !allowed {
+		return "", fmt.Errorf("generated_role_rules_file %q is not in allowed_role_rules_paths", path)
+	}
+
+	b.roleRulesLock.Lock()
+	reader, ok := b.roleRulesReaders[path]
+	if !ok {
+		reader = fileutil.NewCachingFileReader(path, roleRulesReloadPeriod)
+		b.roleRulesReaders[path] = reader
+	}
+	b.roleRulesLock.Unlock()
+
+	rules, err := reader.ReadFile()
+	if err != nil {
+		return "", fmt.Errorf("failed to read generated_role_rules_file %q: %w", path, err)
+	}
+	return string(rules), nil
+}
+
+// withRoleRulesFromFile returns a copy of the role with the rules read from
+// its generated_role_rules_file, or the role itself if it doesn't use one. The
+// file may change after the role was written, so its rules are checked
+// against the mount's policy every time they're read.
+func (b *backend) withRoleRulesFromFile(ctx context.Context, s logical.Storage, role *roleEntry) (*roleEntry, error) {
+	if role.RoleRulesFile == "" {
+		return role, nil
+	}
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, errors.New("could not load backend configuration")
+	}
+
+	rules, err := b.readRoleRulesFile(config, role.RoleRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	parseRules := makeRules
+	if config.StrictRoleRules {
+		parseRules = makeRulesStrict
+	}
+	parsed, err := parseRules(rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse generated_role_rules_file %q as k8s.io/api/rbac/v1/Policy object: %w", role.RoleRulesFile, err)
+	}
+	if err := config.checkRulesPolicy(parsed); err != nil {
+		return nil, fmt.Errorf("generated_role_rules_file %q is not allowed on this mount: %w", role.RoleRulesFile, err)
+	}
+
+	withRules := *role
+	withRules.RoleRules = rules
+	withRules.ParsedRoleRules = parsed
+	return &withRules, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRoleRulesFile(t *testing.T) {
+	origPeriod := roleRulesReloadPeriod
+	roleRulesReloadPeriod = 0
+	defer func() { roleRulesReloadPeriod = origPeriod }()
+
+	b, s := getTestBackend(t)
+
+	allowedDir := t.TempDir()
+	rulesFile := filepath.Join(allowedDir, "rules.yaml")
+	require.NoError(t, os.WriteFile(rulesFile, []byte(goodYAMLRules), 0o600))
+
+	otherDir := t.TempDir()
+	otherFile := filepath.Join(otherDir, "rules.yaml")
+	require.NoError(t, os.WriteFile(otherFile, []byte(goodYAMLRules), 0o600))
+	// A link inside the allowed directory that points outside of it
+	escapeLink := filepath.Join(allowedDir, "escape.yaml")
+	require.NoError(t, os.Symlink(otherFile, escapeLink))
+
+	testConfigWrite(t, b, s, map[string]interface{}{
+		"allowed_role_rules_paths": []string{allowedDir},
+	})
+	// Writing the config resets the client, so set up the fake one afterwards
+	fakeClient := setupFakeClient(t, b, s)
+
+	t.Run("rejected paths", func(t *testing.T) {
+		for name, path := range map[string]string{
+			"outside allowed paths": otherFile,
+			"symlink escape":        escapeLink,
+			"relative":              "rules.yaml",
+			"missing":               filepath.Join(allowedDir, "missing.yaml"),
+		} {
+			resp, err := testRoleCreate(t, b, s, "fromfile", map[string]interface{}{
+				"allowed_kubernetes_namespaces": []string{"app1"},
+				"generated_role_rules_file":     path,
+			})
+			require.NoError(t, err, name)
+			assert.Error(t, resp.Error(), name)
+		}
+
+		resp, err := testRoleCreate(t, b, s, "fromfile", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules":          goodYAMLRules,
+			"generated_role_rules_file":     rulesFile,
+		})
+		require.NoError(t, err)
+		assert.EqualError(t, resp.Error(), "only one of generated_role_rules or generated_role_rules_file may be set")
+	})
+
+	t.Run("rules read from file", func(t *testing.T) {
+		resp, err := testRoleCreate(t, b, s, "fromfile", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules_file":     rulesFile,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		resp, err = testCredsCreate(t, b, s, "fromfile", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		role, err := fakeClient.RbacV1().Roles("app1").Get(context.Background(), resp.Data["service_account_name"].(string), metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Len(t, role.Rules, 1)
+		assert.Equal(t, []string{"mutatingwebhookconfigurations"}, role.Rules[0].Resources)
+
+		// Changes to the file are picked up
+		require.NoError(t, os.WriteFile(rulesFile, []byte(goodJSONRules), 0o600))
+		resp, err = testCredsCreate(t, b, s, "fromfile", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		role, err = fakeClient.RbacV1().Roles("app1").Get(context.Background(), resp.Data["service_account_name"].(string), metav1.GetOptions{})
+		require.NoError(t, err)
+		expected, err := makeRules(goodJSONRules)
+		require.NoError(t, err)
+		assert.Equal(t, expected, role.Rules)
+	})
+
+	t.Run("mount policy checked when read", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(rulesFile, []byte(goodYAMLRules), 0o600))
+		testConfigWrite(t, b, s, map[string]interface{}{
+			"forbid_wildcard_rules": true,
+			"allowed_verbs":         []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+		})
+		setupFakeClient(t, b, s)
+		resp, err := testRoleCreate(t, b, s, "fromfile", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules_file":     rulesFile,
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		resp, err = testCredsCreate(t, b, s, "fromfile", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+
+		// Rules edited into the file after the role was written are checked
+		// too, when creds are requested
+		wildcardRules := "rules:\n- apiGroups: [\"*\"]\n  resources: [\"*\"]\n  verbs: [\"get\"]\n"
+		require.NoError(t, os.WriteFile(rulesFile, []byte(wildcardRules), 0o600))
+		_, err = testCredsCreate(t, b, s, "fromfile", nil)
+		assert.EqualError(t, err, fmt.Sprintf("generated_role_rules_file %q is not allowed on this mount: rule 0: '*' in apiGroups is forbidden by the mount's forbid_wildcard_rules", rulesFile))
+
+		escalateRules := "rules:\n- apiGroups: [\"\"]\n  resources: [\"pods\"]\n  verbs: [\"escalate\"]\n"
+		require.NoError(t, os.WriteFile(rulesFile, []byte(escalateRules), 0o600))
+		_, err = testCredsCreate(t, b, s, "fromfile", nil)
+		assert.ErrorContains(t, err, "verb 'escalate' is not in the mount's allowed_verbs")
+		resp, err = testRoleCreate(t, b, s, "fromfile", map[string]interface{}{
+			"allowed_kubernetes_namespaces": []string{"app1"},
+			"generated_role_rules_file":     rulesFile,
+		})
+		require.NoError(t, err)
+		assert.ErrorContains(t, resp.Error(), "verb 'escalate' is not in the mount's allowed_verbs")
+	})
+}
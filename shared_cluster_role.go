@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	sharedClusterRolesPath = "shared-cluster-roles/"
+
+	// sharedClusterRolePrefix is the name prefix of ClusterRoles that are
+	// shared by all leases of roles with the same rules
+	sharedClusterRolePrefix = "v-shared-"
+)
+
+// sharedClusterRole tracks the number of leases bound to a shared ClusterRole,
+// so it can be deleted when the last of them is revoked
+type sharedClusterRole struct {
+	RefCount int `json:"ref_count"`
+}
+
+// sharedClusterRoleName returns the name of the shared ClusterRole for the
+// rules. The name is derived from the rules, so roles with identical rules
+// share a ClusterRole, and changing a role's rules moves new leases to a new
+// one. The mount and cluster are part of the name too, so mounts never share
+// a ClusterRole, since each tracks its own references to it.
+func sharedClusterRoleName(mountID, cluster, roleRules string) (string, error) {
+	rules, err := makeRules(roleRules)
+	if err != nil {
+		return "", err
+	}
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(mountID + "\x00" + cluster + "\x00" + string(rulesJSON)))
+	return sharedClusterRolePrefix + hex.EncodeToString(sum[:])[:32], nil
+}
+
+// sharedClusterRoleKey returns the storage key of the reference count of a
+// shared ClusterRole in the cluster. The keys of the default cluster predate
+// support for multiple clusters, so they don't include its name.
+func sharedClusterRoleKey(cluster, name string) string {
+	if cluster == "" {
+		return sharedClusterRolesPath + name
+	}
+	return sharedClusterRolesPath + cluster + "/" + name
+}
+
+func getSharedClusterRole(ctx context.Context, s logical.Storage, cluster, name string) (*sharedClusterRole, error) {
+	entry, err := s.Get(ctx, sharedClusterRoleKey(cluster, name))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	shared := new(sharedClusterRole)
+	if err := entry.DecodeJSON(shared); err != nil {
+		return nil, fmt.Errorf("error reading shared ClusterRole %q: %w", name, err)
+	}
+	return shared, nil
+}
+
+func setSharedClusterRole(ctx context.Context, s logical.Storage, cluster, name string, shared *sharedClusterRole) error {
+	entry, err := logical.StorageEntryJSON(sharedClusterRoleKey(cluster, name), shared)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// acquireSharedClusterRole takes a reference to the shared ClusterRole for
+// the role's rules, creating it if this is the first reference, and returns
+// its name
+func (b *backend) acquireSharedClusterRole(ctx context.Context, s logical.Storage, client *client, role *roleEntry) (string, error) {
+	name, err := sharedClusterRoleName(b.mountID, client.cluster, role.RoleRules)
+	if err != nil {
+		return "", err
+	}
+
+	b.sharedClusterRolesLock.Lock()
+	defer b.sharedClusterRolesLock.Unlock()
+
+	shared, err := getSharedClusterRole(ctx, s, client.cluster, name)
+	if err != nil {
+		return "", err
+	}
+	if shared == nil {
+		shared = &sharedClusterRole{}
+	}
+	if shared.RefCount == 0 {
+		if err := client.createSharedClusterRole(ctx, name, role); err != nil {
+			return "", fmt.Errorf("failed to create shared ClusterRole '%s': %s", name, err)
+		}
+	}
+
+	shared.RefCount++
+	if err := setSharedClusterRole(ctx, s, client.cluster, name, shared); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// releaseSharedClusterRole drops a reference to the shared ClusterRole, and
+// deletes it when no leases are bound to it anymore. The reference count is
+// only updated once the ClusterRole is deleted, so a failed release can be
+// retried. It returns true if the ClusterRole was deleted.
+func (b *backend) releaseSharedClusterRole(ctx context.Context, s logical.Storage, client *client, name string) (bool, error) {
+	b.sharedClusterRolesLock.Lock()
+	defer b.sharedClusterRolesLock.Unlock()
+
+	shared, err := getSharedClusterRole(ctx, s, client.cluster, name)
+	if err != nil {
+		return false, err
+	}
+	if shared == nil {
+		// Already released, e.g. by an earlier revoke attempt
+		return false, nil
+	}
+
+	shared.RefCount--
+	if shared.RefCount > 0 {
+		return false, setSharedClusterRole(ctx, s, client.cluster, name, shared)
+	}
+
+	if _, err := client.deleteRole(ctx, "", name, "ClusterRole"); err != nil {
+		return false, fmt.Errorf("failed to delete shared ClusterRole '%s': %s", name, err)
+	}
+	return true, s.Delete(ctx, sharedClusterRoleKey(client.cluster, name))
+}
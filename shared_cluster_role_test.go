@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package kubesecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSharedClusterRole(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	b.mountID = "test-mount"
+
+	resp, err := testRoleCreate(t, b, s, "shared", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"shared_cluster_role":           true,
+	})
+	require.NoError(t, err)
+	assert.EqualError(t, resp.Error(), "shared_cluster_role requires generated_role_rules and a kubernetes_role_type of ClusterRole")
+
+	resp, err = testRoleCreate(t, b, s, "shared", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_role_type":          "ClusterRole",
+		"shared_cluster_role":           true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+
+	sharedName, err := sharedClusterRoleName("test-mount", "", goodYAMLRules)
+	require.NoError(t, err)
+	// Equivalent rules in another format share the ClusterRole
+	jsonName, err := sharedClusterRoleName("test-mount", "", goodJSONRules)
+	require.NoError(t, err)
+	assert.Equal(t, sharedName, jsonName)
+	// Other mounts and clusters don't
+	otherMountName, err := sharedClusterRoleName("other-mount", "", goodYAMLRules)
+	require.NoError(t, err)
+	assert.NotEqual(t, sharedName, otherMountName)
+	otherClusterName, err := sharedClusterRoleName("test-mount", "other", goodYAMLRules)
+	require.NoError(t, err)
+	assert.NotEqual(t, sharedName, otherClusterName)
+
+	var leases []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		resp, err := testCredsCreate(t, b, s, "shared", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Error())
+		assert.Equal(t, sharedName, resp.Secret.InternalData["shared_cluster_role"])
+		assert.Empty(t, resp.Secret.InternalData["created_role"])
+		leases = append(leases, resp.Secret.InternalData)
+
+		binding, err := fakeClient.RbacV1().RoleBindings("app1").Get(ctx, resp.Data["service_account_name"].(string), metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "ClusterRole", binding.RoleRef.Kind)
+		assert.Equal(t, sharedName, binding.RoleRef.Name)
+	}
+
+	clusterRoles, err := fakeClient.RbacV1().ClusterRoles().List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, clusterRoles.Items, 1)
+	assert.Equal(t, sharedName, clusterRoles.Items[0].Name)
+	// The ClusterRole is labeled with the mount, but not the role
+	assert.Equal(t, "test-mount", clusterRoles.Items[0].Labels[mountIDLabel])
+	assert.NotContains(t, clusterRoles.Items[0].Labels, roleNameLabel)
+	shared, err := getSharedClusterRole(ctx, s, "", sharedName)
+	require.NoError(t, err)
+	assert.Equal(t, 2, shared.RefCount)
+
+	// The ClusterRole is kept until the last lease is revoked
+	resp, err = testRevoke(t, b, s, leases[0])
+	require.NoError(t, err)
+	assert.Equal(t, cleanupReleased, resp.Data["ClusterRole"])
+	_, err = fakeClient.RbacV1().ClusterRoles().Get(ctx, sharedName, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	resp, err = testRevoke(t, b, s, leases[1])
+	require.NoError(t, err)
+	assert.Equal(t, cleanupDeleted, resp.Data["ClusterRole"])
+	_, err = fakeClient.RbacV1().ClusterRoles().Get(ctx, sharedName, metav1.GetOptions{})
+	assert.True(t, k8s_errors.IsNotFound(err))
+	shared, err = getSharedClusterRole(ctx, s, "", sharedName)
+	require.NoError(t, err)
+	assert.Nil(t, shared)
+
+	// Revoking again, e.g. on a retry, succeeds once the references are gone
+	_, err = testRevoke(t, b, s, leases[1])
+	require.NoError(t, err)
+}
+
+func TestSharedClusterRole_existing(t *testing.T) {
+	b, s := getTestBackend(t)
+	fakeClient := setupFakeClient(t, b, s)
+	ctx := context.Background()
+	b.mountID = "test-mount"
+
+	resp, err := testRoleCreate(t, b, s, "shared", map[string]interface{}{
+		"allowed_kubernetes_namespaces": []string{"app1"},
+		"generated_role_rules":          goodYAMLRules,
+		"kubernetes_role_type":          "ClusterRole",
+		"shared_cluster_role":           true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	sharedName, err := sharedClusterRoleName("test-mount", "", goodYAMLRules)
+	require.NoError(t, err)
+
+	// A ClusterRole with the name that wasn't created by the mount, e.g. with
+	// broader rules, is never bound
+	_, err = fakeClient.RbacV1().ClusterRoles().Create(ctx, &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: sharedName},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{"*"},
+			Resources: []string{"*"},
+			Verbs:     []string{"*"},
+		}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = testCredsCreate(t, b, s, "shared", nil)
+	assert.ErrorContains(t, err, "was not created by this mount")
+	shared, err := getSharedClusterRole(ctx, s, "", sharedName)
+	require.NoError(t, err)
+	assert.Nil(t, shared)
+
+	// One the mount created with the same rules is reused
+	require.NoError(t, fakeClient.RbacV1().ClusterRoles().Delete(ctx, sharedName, metav1.DeleteOptions{}))
+	role, err := getRole(ctx, s, "shared")
+	require.NoError(t, err)
+	client, err := b.getClient(ctx, s, "")
+	require.NoError(t, err)
+	role = role.withExtraMetadata(b.managedLabels(&logical.Request{}, "shared"), nil)
+	require.NoError(t, client.createSharedClusterRole(ctx, sharedName, role))
+	resp, err = testCredsCreate(t, b, s, "shared", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error())
+	assert.Equal(t, sharedName, resp.Secret.InternalData["shared_cluster_role"])
+}
@@ -13,28 +13,58 @@ import (
 )
 
 const (
-	walRoleKind    = "role"
-	walBindingKind = "roleBinding"
+	walRoleKind           = "role"
+	walBindingKind        = "roleBinding"
+	walServiceAccountKind = "serviceAccount"
+	walNamespaceKind      = "namespace"
+	walSecretKind         = "secret"
 )
 
 // Eventually expire the WAL if for some reason the rollback operation consistently fails
 var maxWALAge = 24 * time.Hour
 
 func (b *backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	var err error
 	switch kind {
 	case walRoleKind:
-		return b.rollbackRoleWAL(ctx, req, data)
+		err = b.rollbackRoleWAL(ctx, req, data)
 	case walBindingKind:
-		return b.rollbackRoleBindingWAL(ctx, req, data)
+		err = b.rollbackRoleBindingWAL(ctx, req, data)
+	case walServiceAccountKind:
+		err = b.rollbackServiceAccountWAL(ctx, req, data)
+	case walNamespaceKind:
+		err = b.rollbackNamespaceWAL(ctx, req, data)
+	case walSecretKind:
+		err = b.rollbackSecretWAL(ctx, req, data)
 	default:
 		return fmt.Errorf("unknown rollback type %q", kind)
 	}
+	if err != nil {
+		emitWALRollbackMetric("rollback_failed", kind)
+		return err
+	}
+	emitWALRollbackMetric("rollback", kind)
+	return nil
+}
+
+// usedByLease returns true if the object belongs to an active lease in the
+// cluster. The object a WAL entry refers to may have been used by a later
+// creds request that generated the same name after the request that wrote the
+// entry failed, in which case it must not be rolled back.
+func usedByLease(ctx context.Context, s logical.Storage, cluster, namespace, name string) (bool, error) {
+	active, _, err := activeLeaseObjects(ctx, s, cluster)
+	if err != nil {
+		return false, err
+	}
+	_, ok := active[namespace+"/"+name]
+	return ok, nil
 }
 
 type walRole struct {
 	Namespace  string
 	Name       string
 	RoleType   string
+	Cluster    string
 	Expiration time.Time
 }
 
@@ -56,8 +86,16 @@ func (b *backend) rollbackRoleWAL(ctx context.Context, req *logical.Request, dat
 	if err != nil {
 		return err
 	}
+	inUse, err := usedByLease(ctx, req.Storage, entry.Cluster, entry.Namespace, entry.Name)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		b.Logger().Debug("not rolling back object used by a lease", "namespace", entry.Namespace, "name", entry.Name)
+		return nil
+	}
 
-	client, err := b.getClient(ctx, req.Storage)
+	client, err := b.getClient(ctx, req.Storage, entry.Cluster)
 	if err != nil {
 		return err
 	}
@@ -67,7 +105,7 @@ func (b *backend) rollbackRoleWAL(ctx context.Context, req *logical.Request, dat
 	// Attempt to delete the Role. If we don't succeed within maxWALAge (e.g.
 	// client creds are somehow incorrect and the delete will never succeed),
 	// unconditionally remove the WAL.
-	if err := client.deleteRole(ctx, entry.Namespace, entry.Name, entry.RoleType); err != nil {
+	if _, err := client.deleteRole(ctx, entry.Namespace, entry.Name, entry.RoleType); err != nil {
 		b.Logger().Warn("rollback error deleting", "roleType", entry.RoleType, "namespace", entry.Namespace, "name", entry.Name, "err", err)
 
 		if time.Now().After(entry.Expiration) {
@@ -84,6 +122,7 @@ type walRoleBinding struct {
 	Namespace  string
 	Name       string
 	IsCluster  bool
+	Cluster    string
 	Expiration time.Time
 }
 
@@ -105,8 +144,16 @@ func (b *backend) rollbackRoleBindingWAL(ctx context.Context, req *logical.Reque
 	if err != nil {
 		return err
 	}
+	inUse, err := usedByLease(ctx, req.Storage, entry.Cluster, entry.Namespace, entry.Name)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		b.Logger().Debug("not rolling back object used by a lease", "namespace", entry.Namespace, "name", entry.Name)
+		return nil
+	}
 
-	client, err := b.getClient(ctx, req.Storage)
+	client, err := b.getClient(ctx, req.Storage, entry.Cluster)
 	if err != nil {
 		return err
 	}
@@ -116,7 +163,7 @@ func (b *backend) rollbackRoleBindingWAL(ctx context.Context, req *logical.Reque
 	// Attempt to delete the RoleBinding. If we don't succeed within maxWALAge
 	// (e.g. client creds are somehow incorrect and the delete will never
 	// succeed), unconditionally remove the WAL.
-	if err := client.deleteRoleBinding(ctx, entry.Namespace, entry.Name, entry.IsCluster); err != nil {
+	if _, err := client.deleteRoleBinding(ctx, entry.Namespace, entry.Name, entry.IsCluster); err != nil {
 		b.Logger().Warn("rollback error deleting role binding", "isClusterRoleBinding", entry.IsCluster, "namespace", entry.Namespace, "name", entry.Name, "err", err)
 
 		if time.Now().After(entry.Expiration) {
@@ -128,3 +175,164 @@ func (b *backend) rollbackRoleBindingWAL(ctx context.Context, req *logical.Reque
 
 	return nil
 }
+
+type walServiceAccount struct {
+	Namespace  string
+	Name       string
+	Cluster    string
+	Expiration time.Time
+}
+
+// rollbackServiceAccountWAL uses the info in a walServiceAccount entry to
+// delete a ServiceAccount from Kubernetes, in case it outlived the failed
+// creds request that created it
+func (b *backend) rollbackServiceAccountWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	// Decode the WAL data
+	var entry walServiceAccount
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+	inUse, err := usedByLease(ctx, req.Storage, entry.Cluster, entry.Namespace, entry.Name)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		b.Logger().Debug("not rolling back object used by a lease", "namespace", entry.Namespace, "name", entry.Name)
+		return nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage, entry.Cluster)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("rolling back service account", "namespace", entry.Namespace, "name", entry.Name)
+
+	// Attempt to delete the ServiceAccount. If we don't succeed within
+	// maxWALAge (e.g. client creds are somehow incorrect and the delete will
+	// never succeed), unconditionally remove the WAL.
+	if _, err := client.deleteServiceAccount(ctx, entry.Namespace, entry.Name); err != nil {
+		b.Logger().Warn("rollback error deleting service account", "namespace", entry.Namespace, "name", entry.Name, "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("giving up deleting service account", "namespace", entry.Namespace, "name", entry.Name)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+type walSecret struct {
+	Namespace  string
+	Name       string
+	Cluster    string
+	Expiration time.Time
+}
+
+// rollbackSecretWAL uses the info in a walSecret entry to delete a service
+// account token Secret. The Secret has no owner reference, since the service
+// account it's for may not be Vault's, so it's never garbage collected and
+// its token never expires unless it's deleted.
+func (b *backend) rollbackSecretWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	// Decode the WAL data
+	var entry walSecret
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+	inUse, err := usedByLease(ctx, req.Storage, entry.Cluster, entry.Namespace, entry.Name)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		b.Logger().Debug("not rolling back object used by a lease", "namespace", entry.Namespace, "name", entry.Name)
+		return nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage, entry.Cluster)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("rolling back token secret", "namespace", entry.Namespace, "name", entry.Name)
+
+	// Attempt to delete the Secret. If we don't succeed within maxWALAge
+	// (e.g. client creds are somehow incorrect and the delete will never
+	// succeed), unconditionally remove the WAL.
+	if _, err := client.deleteSecret(ctx, entry.Namespace, entry.Name); err != nil {
+		b.Logger().Warn("rollback error deleting token secret", "namespace", entry.Namespace, "name", entry.Name, "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("giving up deleting token secret", "namespace", entry.Namespace, "name", entry.Name)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+type walNamespace struct {
+	Name       string
+	Cluster    string
+	Expiration time.Time
+}
+
+// rollbackNamespaceWAL uses the info in a walNamespace entry to delete a
+// namespace created for a failed creds request of a role with
+// create_namespace. The namespace is only deleted if Vault created it and no
+// lease has objects in it.
+func (b *backend) rollbackNamespaceWAL(ctx context.Context, req *logical.Request, data interface{}) error {
+	// Decode the WAL data
+	var entry walNamespace
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     &entry,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, entry.Cluster)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Debug("rolling back namespace", "name", entry.Name)
+
+	// Attempt to delete the namespace. If we don't succeed within maxWALAge
+	// (e.g. client creds are somehow incorrect and the delete will never
+	// succeed), unconditionally remove the WAL.
+	if _, err := b.deleteCreatedNamespace(ctx, req.Storage, client, entry.Name); err != nil {
+		b.Logger().Warn("rollback error deleting namespace", "name", entry.Name, "err", err)
+
+		if time.Now().After(entry.Expiration) {
+			b.Logger().Warn("giving up deleting namespace", "name", entry.Name)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}